@@ -2,23 +2,82 @@ package buffer
 
 import (
 	"errors"
-	"unsafe"
+	"sort"
+	"sync"
+	"sync/atomic"
 
 	"yadb-go/pkg/io"
 	. "yadb-go/pkg/types"
 )
 
 const BufferPoolCapacityInBytes = 512000000
-const PageSizeInBytes = int(unsafe.Sizeof(Page{}))
+const PageSizeInBytes = io.PageSizeInBytes
 const MaxPoolSize = BufferPoolCapacityInBytes / PageSizeInBytes
 const FrameNotFound = -1
 
+// Pool is the API shared by BufferPool and ParallelBufferPool
+type Pool interface {
+	FetchPage(pageId PageId) (*Page, error)
+	NewPage(pageId PageId) (*Page, error)
+	ReleasePage(pageId PageId) error
+	WritePage(pageId PageId, data []byte, lsn LSN) error
+	FlushPage(pageId PageId) error
+	CleanPage(pageId PageId) (bool, error)
+	DirtyPages() []DirtyPage
+	Stats() Stats
+}
+
+// DirtyPage describes a page which has been modified since it was last written
+type DirtyPage struct {
+	PageId    PageId
+	RecLSN    LSN    // LSN of the first change since the page was last clean
+	DirtiedAt uint64 // orders pages by when they became dirty, oldest first
+	Pinned    bool
+}
+
+// dirtyClock hands out DirtiedAt values. It is shared by every pool so that
+// pages from different ParallelBufferPool instances can be ordered by age.
+var dirtyClock atomic.Uint64
+
+// Stats is a point-in-time summary of buffer pool activity
+type Stats struct {
+	PoolSize   int    // total number of frames
+	PagesInUse int    // frames currently holding a page
+	Hits       uint64 // fetches served from a frame
+	Misses     uint64 // fetches that had to read from disk
+	Flushes    uint64 // pages written back to disk
+	Evictions  uint64 // pages dropped to make room for another
+	DirtyPages int    // frames holding changes not yet on disk
+}
+
+// add accumulates the stats of another pool into s
+func (s *Stats) add(other Stats) {
+	s.PoolSize += other.PoolSize
+	s.PagesInUse += other.PagesInUse
+	s.Hits += other.Hits
+	s.Misses += other.Misses
+	s.Flushes += other.Flushes
+	s.Evictions += other.Evictions
+	s.DirtyPages += other.DirtyPages
+}
+
+// BufferPool caches disk pages in a fixed number of frames. It is safe for
+// concurrent use; all bookkeeping is guarded by a single mutex.
+//
+// Only one write of a page may be in progress at a time, or an older version
+// could land on disk after a newer one. CleanPage writes without holding the
+// mutex, so it marks the page as flushing, and keeps it from being evicted;
+// anything else about to write the page waits on flushed until it is done.
 type BufferPool struct {
-	pageTable map[PageId]FrameId
-	pages     [MaxPoolSize]Page
-	freeList  []FrameId // frames that are not currently in use
-	// replacer  *Replacer // some kind of replacement policy
+	mu          sync.Mutex
+	flushed     *sync.Cond // signalled when a page stops flushing
+	flushing    int        // pages being written by CleanPage
+	pageTable   map[PageId]FrameId
+	pages       []*Page
+	freeList    []FrameId    // frames that are not currently in use
+	replacer    *lruReplacer // unpinned frames which may be evicted
 	diskManager io.DiskManager
+	stats       Stats
 }
 
 func NewBufferPool() *BufferPool {
@@ -27,45 +86,115 @@ func NewBufferPool() *BufferPool {
 }
 
 func NewBufferPoolWithManager(diskManager io.DiskManager) *BufferPool {
-	freeList := make([]FrameId, 0)
-	pages := [MaxPoolSize]*Page{}
-	for i := 0; i < MaxPoolSize; i++ {
-		pages[i] = nil
+	return NewBufferPoolWithSize(MaxPoolSize, diskManager)
+}
+
+// NewBufferPoolWithSize creates a buffer pool holding at most poolSize pages
+func NewBufferPoolWithSize(poolSize int, diskManager io.DiskManager) *BufferPool {
+	if poolSize < 1 {
+		panic("Pool size must be >= 1")
+	}
+
+	freeList := make([]FrameId, 0, poolSize)
+	for i := 0; i < poolSize; i++ {
 		freeList = append(freeList, FrameId(i))
 	}
 
-	return &BufferPool{
+	pool := &BufferPool{
 		pageTable:   make(map[PageId]FrameId),
-		pages:       [MaxPoolSize]Page{},
+		pages:       make([]*Page, poolSize),
 		freeList:    freeList,
+		replacer:    newLruReplacer(),
 		diskManager: diskManager,
+		stats:       Stats{PoolSize: poolSize},
 	}
+	pool.flushed = sync.NewCond(&pool.mu)
+	return pool
 }
 
+// errAllFramesFlushing is returned by getEmptyFrame when the only pages which
+// could be evicted are being written by CleanPage
+var errAllFramesFlushing = errors.New("every unpinned page is being flushed")
+
 // FetchPage returns a pointer to a Page containing the page ID.
 // It also pins the page by incrementing the page's refCount
 func (pool *BufferPool) FetchPage(pageId PageId) (*Page, error) {
-	// If page is already in buffer pool, return it
-	frameId, found := pool.pageTable[pageId]
-	if found {
-		page := pool.pages[frameId]
-		page.incrementRefCount()
-		return &page, nil
-	}
+	pool.mu.Lock()
+	defer pool.mu.Unlock()
 
-	// Otherwise, try to load it from disk into an empty frame
-	frameId = pool.getEmptyFrame()
-	if frameId == FrameNotFound {
-		return nil, errors.New("no empty frame to load page into")
+	var frameId FrameId
+	for {
+		// If page is already in buffer pool, return it
+		var found bool
+		frameId, found = pool.pageTable[pageId]
+		if found {
+			page := pool.pages[frameId]
+			page.incrementRefCount()
+			pool.replacer.pin(frameId)
+			pool.stats.Hits++
+			return page, nil
+		}
+
+		// Otherwise, try to load it from disk into an empty frame. Waiting
+		// for one unlocks the pool, so the page may be loaded meanwhile.
+		var err error
+		frameId, err = pool.getEmptyFrame()
+		if err == errAllFramesFlushing {
+			pool.flushed.Wait()
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		break
 	}
 
 	data, err := pool.diskManager.ReadPage(pageId)
 	if err != nil {
+		pool.freeList = append(pool.freeList, frameId)
 		return nil, err
 	}
 	page := NewPage(pageId, string(data))
 	page.incrementRefCount()
-	pool.pages[frameId] = *page
+	pool.pages[frameId] = page
+	pool.pageTable[pageId] = frameId
+	pool.stats.Misses++
+
+	return page, nil
+}
+
+// NewPage returns a pinned page which is about to be overwritten, such as one
+// just allocated. Its old contents don't matter, so unless it is already in
+// the pool it is not read from disk, but starts out zeroed.
+func (pool *BufferPool) NewPage(pageId PageId) (*Page, error) {
+	pool.mu.Lock()
+	defer pool.mu.Unlock()
+
+	var frameId FrameId
+	for {
+		var found bool
+		frameId, found = pool.pageTable[pageId]
+		if found {
+			page := pool.pages[frameId]
+			page.incrementRefCount()
+			pool.replacer.pin(frameId)
+			return page, nil
+		}
+
+		var err error
+		frameId, err = pool.getEmptyFrame()
+		if err == errAllFramesFlushing {
+			pool.flushed.Wait()
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		break
+	}
+	page := NewPage(pageId, string(make([]byte, PageSizeInBytes)))
+	page.incrementRefCount()
+	pool.pages[frameId] = page
 	pool.pageTable[pageId] = frameId
 
 	return page, nil
@@ -75,42 +204,200 @@ func (pool *BufferPool) FetchPage(pageId PageId) (*Page, error) {
 // It will decrement the refCount, making the frame available for replacement
 // Returns an error if the operation was unsuccessful
 func (pool *BufferPool) ReleasePage(pageId PageId) error {
+	pool.mu.Lock()
+	defer pool.mu.Unlock()
+
 	frameId, err := pool.validatePageInBuffer(pageId)
 	if err != nil {
 		return err
 	}
 
 	page := pool.pages[frameId]
+	if page.refCount == 0 {
+		return errors.New("released page which is not pinned")
+	}
 	page.decrementRefCount()
+	if page.refCount == 0 && !page.flushing {
+		pool.replacer.unpin(frameId)
+	}
+
+	return nil
+}
+
+// WritePage replaces the contents of a page held in the buffer pool and marks
+// it dirty. lsn is the log record describing the change; if the page was
+// clean it becomes the page's RecLSN.
+func (pool *BufferPool) WritePage(pageId PageId, data []byte, lsn LSN) error {
+	pool.mu.Lock()
+	defer pool.mu.Unlock()
+
+	frameId, err := pool.validatePageInBuffer(pageId)
+	if err != nil {
+		return err
+	}
+
+	page := pool.pages[frameId]
+	page.setData(string(data))
+	page.version++
+	if !page.dirty {
+		page.dirty = true
+		page.recLSN = lsn
+		page.dirtiedAt = dirtyClock.Add(1)
+	}
 
 	return nil
 }
 
-// FlushPage flushes a page to disk
+// FlushPage flushes a page to disk, after any write of it in progress
 func (pool *BufferPool) FlushPage(pageId PageId) error {
-	frameId, found := pool.pageTable[pageId]
-	if !found {
-		return errors.New("requested to flush page which is not in buffer pool")
+	pool.mu.Lock()
+	defer pool.mu.Unlock()
+
+	for {
+		frameId, found := pool.pageTable[pageId]
+		if !found {
+			return errors.New("requested to flush page which is not in buffer pool")
+		}
+		if page := pool.pages[frameId]; page == nil || !page.flushing {
+			return pool.flushFrame(pageId, frameId)
+		}
+		pool.flushed.Wait()
 	}
+}
+
+// CleanPage writes a page to disk if it is dirty, and reports whether it did.
+// Unlike FlushPage the pool is not locked during the write, so other pages
+// can be fetched meanwhile. If the page changes while being written it stays
+// dirty. If it is already being written, that write is waited for first.
+func (pool *BufferPool) CleanPage(pageId PageId) (bool, error) {
+	pool.mu.Lock()
+	defer pool.mu.Unlock()
 
+	var frameId FrameId
+	for {
+		var found bool
+		frameId, found = pool.pageTable[pageId]
+		if !found || !pool.pages[frameId].dirty {
+			return false, nil
+		}
+		if !pool.pages[frameId].flushing {
+			break
+		}
+		pool.flushed.Wait()
+	}
 	page := pool.pages[frameId]
-	err := pool.diskManager.FlushPage(pageId, []byte(page.data))
+	data, version := page.data, page.version
+	page.flushing = true
+	pool.flushing++
+	pool.replacer.pin(frameId)
+	pool.mu.Unlock()
+
+	err := pool.diskManager.FlushPage(pageId, []byte(data))
+
+	pool.mu.Lock()
+	page.flushing = false
+	pool.flushing--
+	if page.refCount == 0 {
+		pool.replacer.unpin(frameId)
+	}
+	pool.flushed.Broadcast()
 	if err != nil {
-		return err
+		return false, err
+	}
+	if page.version == version {
+		page.dirty = false
 	}
+	pool.stats.Flushes++
 
-	return nil
+	return true, nil
+}
+
+// DirtyPages lists the pages which are dirty, oldest first
+func (pool *BufferPool) DirtyPages() []DirtyPage {
+	pool.mu.Lock()
+	defer pool.mu.Unlock()
+
+	dirty := make([]DirtyPage, 0)
+	for _, frameId := range pool.pageTable {
+		page := pool.pages[frameId]
+		if page != nil && page.dirty {
+			dirty = append(dirty, page.describeDirty())
+		}
+	}
+	sortDirtyPages(dirty)
+
+	return dirty
+}
+
+// Stats returns a snapshot of this pool's counters
+func (pool *BufferPool) Stats() Stats {
+	pool.mu.Lock()
+	defer pool.mu.Unlock()
+
+	stats := pool.stats
+	stats.PagesInUse = len(pool.pageTable)
+	for _, frameId := range pool.pageTable {
+		if page := pool.pages[frameId]; page != nil && page.dirty {
+			stats.DirtyPages++
+		}
+	}
+	return stats
 }
 
-func (pool *BufferPool) getEmptyFrame() FrameId {
+// getEmptyFrame returns a frame from the free list, or evicts the least
+// recently used unpinned page. Evicting a dirty page means writing it back
+// first, which stalls the caller; the PageCleaner exists to make that rare.
+// Pages being written by CleanPage aren't evicted, so if they are all that
+// could be it returns errAllFramesFlushing, and the caller should wait.
+func (pool *BufferPool) getEmptyFrame() (FrameId, error) {
 	if len(pool.freeList) > 0 {
 		frameId, newFreeList := pool.freeList[0], pool.freeList[1:]
 		pool.freeList = newFreeList
 
-		return frameId
-	} else {
-		return FrameNotFound
+		return frameId, nil
+	}
+
+	frameId := pool.replacer.victim()
+	if frameId == FrameNotFound {
+		if pool.flushing > 0 {
+			return FrameNotFound, errAllFramesFlushing
+		}
+		return FrameNotFound, errors.New("no empty frame to load page into")
+	}
+
+	page := pool.pages[frameId]
+	if page.dirty {
+		if err := pool.flushFrame(page.pageId, frameId); err != nil {
+			pool.replacer.unpin(frameId)
+			return FrameNotFound, err
+		}
+	}
+	delete(pool.pageTable, page.pageId)
+	pool.pages[frameId] = nil
+	pool.stats.Evictions++
+
+	return frameId, nil
+}
+
+// flushFrame writes the page in a frame to disk while holding the pool lock.
+// The page mustn't be flushing.
+func (pool *BufferPool) flushFrame(pageId PageId, frameId FrameId) error {
+	page := pool.pages[frameId]
+	var data []byte
+	if page != nil {
+		data = []byte(page.data)
+	}
+
+	err := pool.diskManager.FlushPage(pageId, data)
+	if err != nil {
+		return err
 	}
+	if page != nil {
+		page.dirty = false
+	}
+	pool.stats.Flushes++
+
+	return nil
 }
 
 // check that the given pageId is currently loaded in the buffer pool, if so
@@ -124,12 +411,20 @@ func (pool *BufferPool) validatePageInBuffer(pageId PageId) (FrameId, error) {
 	return frameId, nil
 }
 
-// A Page stores some disk page in memory.
+// A Page stores some disk page in memory. Its fields are guarded by the
+// pool's lock, except that data is written holding dataMu too, so that Data
+// can read it without the pool.
 type Page struct {
 	pageId   PageId
 	refCount uint32 // to determine if the page should be pinned
 	dirty    bool   // whether the page needs flushing to disk
+	flushing bool   // whether CleanPage is writing the page to disk
+	dataMu   sync.RWMutex
 	data     string
+
+	recLSN    LSN    // first change since the page was last clean
+	dirtiedAt uint64 // dirtyClock value when the page became dirty
+	version   uint64 // incremented on every write, to detect concurrent changes
 	// node     *Node  // null if the page is not yet loaded into memory
 }
 
@@ -144,6 +439,37 @@ func NewPage(pageId PageId, data string) *Page {
 	}
 }
 
+// PageId returns the ID of the disk page held by this Page
+func (p *Page) PageId() PageId {
+	return p.pageId
+}
+
+// Data returns the page contents as of the time the page was fetched or last
+// written. It should only be called while the page is pinned, so that the
+// frame still holds this page, but may race with writes of it: the contents
+// returned are those before or after a write, never a mix.
+func (p *Page) Data() string {
+	p.dataMu.RLock()
+	defer p.dataMu.RUnlock()
+	return p.data
+}
+
+// setData replaces the page contents. The pool must be locked.
+func (p *Page) setData(data string) {
+	p.dataMu.Lock()
+	defer p.dataMu.Unlock()
+	p.data = data
+}
+
+func (p *Page) describeDirty() DirtyPage {
+	return DirtyPage{
+		PageId:    p.pageId,
+		RecLSN:    p.recLSN,
+		DirtiedAt: p.dirtiedAt,
+		Pinned:    p.refCount > 0,
+	}
+}
+
 func (p *Page) incrementRefCount() {
 	p.refCount++
 }
@@ -153,3 +479,9 @@ func (p *Page) decrementRefCount() {
 }
 
 type FrameId int
+
+func sortDirtyPages(pages []DirtyPage) {
+	sort.Slice(pages, func(i, j int) bool {
+		return pages[i].DirtiedAt < pages[j].DirtiedAt
+	})
+}
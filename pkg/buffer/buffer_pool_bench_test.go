@@ -0,0 +1,58 @@
+package buffer
+
+import (
+	"fmt"
+	"testing"
+
+	. "yadb-go/pkg/types"
+)
+
+const benchWorkingSet = 4096
+
+// benchmarkPool fetches and releases pages from the working set using the
+// given number of goroutines per GOMAXPROCS. With a single BufferPool every
+// goroutine contends on one mutex; a ParallelBufferPool spreads that load.
+func benchmarkPool(b *testing.B, pool Pool, parallelism int) {
+	for i := 0; i < benchWorkingSet; i++ {
+		if _, err := pool.FetchPage(PageId(i)); err != nil {
+			b.Fatal(err)
+		}
+	}
+
+	b.ReportAllocs()
+	b.SetParallelism(parallelism)
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		i := 0
+		for pb.Next() {
+			pageId := PageId((i * 7919) % benchWorkingSet)
+			if _, err := pool.FetchPage(pageId); err != nil {
+				b.Error(err)
+				return
+			}
+			if err := pool.ReleasePage(pageId); err != nil {
+				b.Error(err)
+				return
+			}
+			i++
+		}
+	})
+}
+
+func BenchmarkBufferPool(b *testing.B) {
+	for _, parallelism := range []int{1, 2, 4, 8, 16} {
+		b.Run(fmt.Sprintf("goroutines=%dxGOMAXPROCS", parallelism), func(b *testing.B) {
+			pool := NewBufferPoolWithSize(2*benchWorkingSet, newMemoryDiskManager())
+			benchmarkPool(b, pool, parallelism)
+		})
+	}
+}
+
+func BenchmarkParallelBufferPool(b *testing.B) {
+	for _, parallelism := range []int{1, 2, 4, 8, 16} {
+		b.Run(fmt.Sprintf("goroutines=%dxGOMAXPROCS", parallelism), func(b *testing.B) {
+			pool := NewParallelBufferPoolWithSize(16, 2*benchWorkingSet, newMemoryDiskManager())
+			benchmarkPool(b, pool, parallelism)
+		})
+	}
+}
@@ -2,7 +2,9 @@ package buffer
 
 import (
 	"errors"
+	"sync"
 	"testing"
+	"time"
 
 	. "yadb-go/pkg/types"
 
@@ -72,6 +74,219 @@ func TestFlushPage(t *testing.T) {
 	diskManager.AssertCalled(t, "FlushPage", PageId(1))
 }
 
+func TestStats(t *testing.T) {
+	// Given
+	pool := NewBufferPoolWithSize(4, newMemoryDiskManager())
+
+	// When
+	_, _ = pool.FetchPage(1)
+	_, _ = pool.FetchPage(1)
+	_, _ = pool.FetchPage(2)
+	_ = pool.FlushPage(2)
+
+	// Then
+	stats := pool.Stats()
+	assert.Equal(t, 4, stats.PoolSize)
+	assert.Equal(t, 2, stats.PagesInUse)
+	assert.Equal(t, uint64(1), stats.Hits)
+	assert.Equal(t, uint64(2), stats.Misses)
+	assert.Equal(t, uint64(1), stats.Flushes)
+}
+
+func TestFetchPage_FailsIfPoolFull(t *testing.T) {
+	// Given
+	pool := NewBufferPoolWithSize(1, newMemoryDiskManager())
+	_, err := pool.FetchPage(1)
+	assert.NoError(t, err)
+
+	// When
+	page, err := pool.FetchPage(2)
+
+	// Then
+	assert.Nil(t, page)
+	assert.Error(t, err)
+}
+
+func TestNewPage_DoesNotReadFromDisk(t *testing.T) {
+	// Given
+	diskManager := new(MockDiskManager)
+	pool := NewBufferPoolWithSize(4, diskManager)
+
+	// When
+	page, err := pool.NewPage(1)
+
+	// Then
+	assert.NoError(t, err)
+	assert.Equal(t, PageId(1), page.PageId())
+	assert.Len(t, page.Data(), PageSizeInBytes)
+	diskManager.AssertNotCalled(t, "ReadPage", PageId(1))
+}
+
+func TestNewPage_PinsPageAlreadyInPool(t *testing.T) {
+	// Given
+	pool := NewBufferPoolWithSize(4, newMemoryDiskManager())
+	page, _ := pool.FetchPage(1)
+	_ = pool.WritePage(1, []byte("data"), 1)
+	_ = pool.ReleasePage(1)
+
+	// When
+	newPage, err := pool.NewPage(1)
+
+	// Then
+	assert.NoError(t, err)
+	assert.Same(t, page, newPage)
+	assert.True(t, pool.DirtyPages()[0].Pinned)
+}
+
+func TestWritePage_MarksPageDirty(t *testing.T) {
+	// Given
+	pool := NewBufferPoolWithSize(4, newMemoryDiskManager())
+	page, _ := pool.FetchPage(1)
+
+	// When
+	err := pool.WritePage(1, []byte("new data"), 10)
+	assert.NoError(t, err)
+	err = pool.WritePage(1, []byte("newer data"), 20)
+	assert.NoError(t, err)
+
+	// Then
+	assert.Equal(t, "newer data", page.Data())
+	dirty := pool.DirtyPages()
+	assert.Len(t, dirty, 1)
+	assert.Equal(t, PageId(1), dirty[0].PageId)
+	assert.Equal(t, LSN(10), dirty[0].RecLSN) // the first change since clean
+	assert.True(t, dirty[0].Pinned)
+}
+
+func TestData_ConcurrentWithWritePage(t *testing.T) {
+	// Given a pinned page, and a writer changing it
+	pool := NewBufferPoolWithSize(4, newMemoryDiskManager())
+	page, _ := pool.FetchPage(1)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 1000; i++ {
+			_ = pool.WritePage(1, []byte{byte('a' + i%2), byte('a' + i%2)}, LSN(i))
+		}
+	}()
+
+	// When it is read meanwhile
+	// Then each read sees a whole version of the page (and -race sees no race)
+	for i := 0; i < 1000; i++ {
+		if data := page.Data(); len(data) == 2 {
+			assert.Equal(t, data[0], data[1])
+		}
+	}
+	<-done
+	assert.Equal(t, "bb", page.Data())
+}
+
+func TestWritePage_FailsIfPageNotInBuffer(t *testing.T) {
+	pool := NewBufferPoolWithSize(4, newMemoryDiskManager())
+
+	err := pool.WritePage(1, []byte("data"), 1)
+
+	assert.Error(t, err)
+}
+
+func TestCleanPage(t *testing.T) {
+	// Given
+	diskManager := newMemoryDiskManager()
+	pool := NewBufferPoolWithSize(4, diskManager)
+	_, _ = pool.FetchPage(1)
+	_ = pool.WritePage(1, []byte("data"), 1)
+
+	// When
+	cleaned, err := pool.CleanPage(1)
+
+	// Then
+	assert.NoError(t, err)
+	assert.True(t, cleaned)
+	assert.Empty(t, pool.DirtyPages())
+	assert.Equal(t, []byte("data"), diskManager.pages[1])
+
+	// And cleaning a clean page should not write it again
+	cleaned, err = pool.CleanPage(1)
+	assert.NoError(t, err)
+	assert.False(t, cleaned)
+	assert.Equal(t, []PageId{1}, diskManager.written())
+}
+
+func TestFetchPage_EvictsLeastRecentlyUsedPage(t *testing.T) {
+	// Given
+	diskManager := newMemoryDiskManager()
+	pool := NewBufferPoolWithSize(2, diskManager)
+	_, _ = pool.FetchPage(1)
+	_, _ = pool.FetchPage(2)
+	_ = pool.WritePage(1, []byte("dirty"), 1)
+	_ = pool.ReleasePage(1)
+	_ = pool.ReleasePage(2)
+
+	// When
+	page, err := pool.FetchPage(3)
+
+	// Then
+	assert.NoError(t, err)
+	assert.Equal(t, PageId(3), page.PageId())
+	_, found := pool.pageTable[1]
+	assert.False(t, found)
+	assert.Equal(t, uint64(1), pool.Stats().Evictions)
+
+	// And the dirty victim should have been written back first
+	assert.Equal(t, []PageId{1}, diskManager.written())
+	assert.Equal(t, []byte("dirty"), diskManager.pages[1])
+}
+
+func TestCleanPage_WritesOnePageAtATime(t *testing.T) {
+	for name, write := range map[string]func(pool *BufferPool) error{
+		"flush": func(pool *BufferPool) error {
+			return pool.FlushPage(1)
+		},
+		"evict": func(pool *BufferPool) error {
+			_, err := pool.FetchPage(2)
+			return err
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			// Given a page whose first version is being written by the cleaner
+			diskManager := &blockingDiskManager{
+				memoryDiskManager: newMemoryDiskManager(),
+				started:           make(chan struct{}),
+				release:           make(chan struct{}),
+			}
+			pool := NewBufferPoolWithSize(1, diskManager)
+			_, _ = pool.FetchPage(1)
+			_ = pool.WritePage(1, []byte("v1"), 1)
+			_ = pool.ReleasePage(1)
+			cleaned := make(chan error)
+			go func() {
+				_, err := pool.CleanPage(1)
+				cleaned <- err
+			}()
+			<-diskManager.started
+
+			// When it is changed, then written again
+			_ = pool.WritePage(1, []byte("v2"), 2)
+			written := make(chan error)
+			go func() { written <- write(pool) }()
+
+			// Then that waits for the cleaner
+			select {
+			case <-written:
+				t.Fatal("Page was written while being cleaned")
+			case <-time.After(10 * time.Millisecond):
+			}
+			close(diskManager.release)
+			assert.NoError(t, <-cleaned)
+			assert.NoError(t, <-written)
+
+			// And the second version is what ends up on disk
+			assert.Equal(t, []byte("v2"), diskManager.pages[1])
+			assert.Equal(t, []PageId{1, 1}, diskManager.written())
+		})
+	}
+}
+
 // Test helper objects
 
 type MockDiskManager struct {
@@ -92,3 +307,61 @@ func (m *MockDiskManager) ReadPage(pageId PageId) ([]byte, error) {
 func (m *MockDiskManager) FlushPage(pageId PageId, _ []byte) error {
 	return m.Called(pageId).Error(0)
 }
+
+// memoryDiskManager is a thread safe DiskManager which keeps pages in a map.
+// Unlike MockDiskManager it is cheap enough to use in benchmarks.
+type memoryDiskManager struct {
+	mu     sync.Mutex
+	pages  map[PageId][]byte
+	writes []PageId // every page written, in order
+}
+
+func newMemoryDiskManager() *memoryDiskManager {
+	return &memoryDiskManager{pages: make(map[PageId][]byte)}
+}
+
+func (m *memoryDiskManager) ReadPage(pageId PageId) ([]byte, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	data, found := m.pages[pageId]
+	if !found {
+		return make([]byte, PageSizeInBytes), nil
+	}
+	return data, nil
+}
+
+func (m *memoryDiskManager) FlushPage(pageId PageId, data []byte) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.pages[pageId] = append([]byte(nil), data...)
+	m.writes = append(m.writes, pageId)
+	return nil
+}
+
+func (m *memoryDiskManager) written() []PageId {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return append([]PageId(nil), m.writes...)
+}
+
+// blockingDiskManager blocks its first write until release is closed,
+// closing started once it has begun
+type blockingDiskManager struct {
+	*memoryDiskManager
+	started chan struct{}
+	release chan struct{}
+	once    sync.Once
+}
+
+func (m *blockingDiskManager) FlushPage(pageId PageId, data []byte) error {
+	first := false
+	m.once.Do(func() { first = true })
+	if first {
+		close(m.started)
+		<-m.release
+	}
+	return m.memoryDiskManager.FlushPage(pageId, data)
+}
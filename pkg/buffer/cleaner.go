@@ -0,0 +1,211 @@
+package buffer
+
+import (
+	"log"
+	"sync"
+	"time"
+
+	. "yadb-go/pkg/types"
+)
+
+// Without help, dirty pages only reach disk when they are evicted or flushed
+// explicitly. That makes eviction slow (the evicting fetch has to write the
+// victim first) and leaves recovery with an unbounded amount of log to redo.
+//
+// The PageCleaner trickles dirty, unpinned pages out in the background so that
+// eviction victims are usually clean. The Checkpointer periodically makes
+// sure everything dirtied before some log position is on disk, and records
+// that position so recovery can start from it.
+
+// CleanerOptions configures a PageCleaner
+type CleanerOptions struct {
+	Interval      time.Duration // how often the cleaner wakes up
+	PagesPerRound int           // I/O budget: the most pages written per wake up
+}
+
+var DefaultCleanerOptions = CleanerOptions{
+	Interval:      100 * time.Millisecond,
+	PagesPerRound: 64,
+}
+
+// PageCleaner is a background writer for dirty pages
+type PageCleaner struct {
+	pool    Pool
+	options CleanerOptions
+	worker  backgroundWorker
+}
+
+func NewPageCleaner(pool Pool, options CleanerOptions) *PageCleaner {
+	if options.Interval <= 0 || options.PagesPerRound < 1 {
+		panic("Cleaner interval and pages per round must be positive")
+	}
+
+	return &PageCleaner{
+		pool:    pool,
+		options: options,
+	}
+}
+
+// Start runs the cleaner in a new goroutine until Stop is called
+func (c *PageCleaner) Start() {
+	c.worker.start(c.options.Interval, func() {
+		if _, err := c.RunOnce(); err != nil {
+			log.Println("Page cleaner failed to write page.", err)
+		}
+	})
+}
+
+// Stop waits for the cleaner goroutine to exit
+func (c *PageCleaner) Stop() {
+	c.worker.stop()
+}
+
+// RunOnce writes up to PagesPerRound dirty, unpinned pages, oldest first, and
+// returns how many pages were written
+func (c *PageCleaner) RunOnce() (int, error) {
+	written := 0
+	for _, dirty := range c.pool.DirtyPages() {
+		if written >= c.options.PagesPerRound {
+			break
+		}
+		if dirty.Pinned {
+			continue
+		}
+
+		cleaned, err := c.pool.CleanPage(dirty.PageId)
+		if err != nil {
+			return written, err
+		}
+		if cleaned {
+			written++
+		}
+	}
+
+	return written, nil
+}
+
+// CheckpointLog is the part of the write-ahead log a Checkpointer needs
+type CheckpointLog interface {
+	// Position returns the LSN just past the last record in the log
+	Position() (LSN, error)
+	// RecordCheckpoint durably records that every change before lsn is on disk
+	RecordCheckpoint(lsn LSN) error
+}
+
+// Checkpointer periodically flushes every page dirtied before the current end
+// of the log, then records that position in the log
+type Checkpointer struct {
+	pool     Pool
+	log      CheckpointLog
+	interval time.Duration
+	worker   backgroundWorker
+
+	mu      sync.Mutex // serialises checkpoints
+	lastLSN LSN
+}
+
+func NewCheckpointer(pool Pool, log CheckpointLog, interval time.Duration) *Checkpointer {
+	if interval <= 0 {
+		panic("Checkpoint interval must be positive")
+	}
+
+	return &Checkpointer{
+		pool:     pool,
+		log:      log,
+		interval: interval,
+	}
+}
+
+// Start takes a checkpoint every interval in a new goroutine until Stop is called
+func (c *Checkpointer) Start() {
+	c.worker.start(c.interval, func() {
+		if _, err := c.Checkpoint(); err != nil {
+			log.Println("Failed to take checkpoint.", err)
+		}
+	})
+}
+
+// Stop waits for the checkpoint goroutine to exit
+func (c *Checkpointer) Stop() {
+	c.worker.stop()
+}
+
+// Checkpoint flushes every page whose RecLSN is no later than the current log
+// position, records that position, and returns it. An LSN is the end of its
+// record, so a page dirtied by the last record logged has the position as
+// its RecLSN. Pages dirtied after the position was read are left for the
+// next checkpoint.
+func (c *Checkpointer) Checkpoint() (LSN, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	lsn, err := c.log.Position()
+	if err != nil {
+		return 0, err
+	}
+
+	for _, dirty := range c.pool.DirtyPages() {
+		if dirty.RecLSN > lsn {
+			continue
+		}
+		if _, err := c.pool.CleanPage(dirty.PageId); err != nil {
+			return 0, err
+		}
+	}
+
+	// Nothing has been logged since the last checkpoint, so there is no need
+	// to record it again
+	if lsn == c.lastLSN {
+		return lsn, nil
+	}
+	if err := c.log.RecordCheckpoint(lsn); err != nil {
+		return 0, err
+	}
+	c.lastLSN = lsn
+
+	return lsn, nil
+}
+
+// backgroundWorker runs a function on a fixed interval in its own goroutine
+type backgroundWorker struct {
+	mu   sync.Mutex
+	quit chan struct{}
+	done chan struct{}
+}
+
+func (w *backgroundWorker) start(interval time.Duration, fn func()) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.quit != nil {
+		panic("Background worker already started")
+	}
+
+	w.quit = make(chan struct{})
+	w.done = make(chan struct{})
+	go func(quit <-chan struct{}, done chan<- struct{}) {
+		defer close(done)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-quit:
+				return
+			case <-ticker.C:
+				fn()
+			}
+		}
+	}(w.quit, w.done)
+}
+
+func (w *backgroundWorker) stop() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.quit == nil {
+		return
+	}
+
+	close(w.quit)
+	<-w.done
+	w.quit, w.done = nil, nil
+}
@@ -0,0 +1,130 @@
+package buffer
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	. "yadb-go/pkg/types"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPageCleaner_WritesOldestUnpinnedPagesWithinBudget(t *testing.T) {
+	// Given
+	diskManager := newMemoryDiskManager()
+	pool := NewBufferPoolWithSize(8, diskManager)
+	for _, pageId := range []PageId{3, 1, 2, 4} {
+		_, _ = pool.FetchPage(pageId)
+		_ = pool.WritePage(pageId, []byte("data"), 1)
+	}
+	for _, pageId := range []PageId{3, 1, 4} {
+		_ = pool.ReleasePage(pageId)
+	}
+	cleaner := NewPageCleaner(pool, CleanerOptions{Interval: time.Second, PagesPerRound: 2})
+
+	// When
+	written, err := cleaner.RunOnce()
+
+	// Then
+	assert.NoError(t, err)
+	assert.Equal(t, 2, written)
+	assert.Equal(t, []PageId{3, 1}, diskManager.written())
+
+	// And the pinned page should be skipped on the next round
+	written, err = cleaner.RunOnce()
+	assert.NoError(t, err)
+	assert.Equal(t, 1, written)
+	assert.Equal(t, []PageId{3, 1, 4}, diskManager.written())
+	assert.Len(t, pool.DirtyPages(), 1)
+}
+
+func TestPageCleaner_RunsInBackground(t *testing.T) {
+	// Given
+	pool := NewParallelBufferPoolWithSize(4, 64, newMemoryDiskManager())
+	for i := 0; i < 16; i++ {
+		_, _ = pool.FetchPage(PageId(i))
+		_ = pool.WritePage(PageId(i), []byte("data"), 1)
+		_ = pool.ReleasePage(PageId(i))
+	}
+	cleaner := NewPageCleaner(pool, CleanerOptions{Interval: time.Millisecond, PagesPerRound: 4})
+
+	// When
+	cleaner.Start()
+	defer cleaner.Stop()
+
+	// Then
+	assert.Eventually(t, func() bool {
+		return pool.Stats().DirtyPages == 0
+	}, time.Second, time.Millisecond)
+}
+
+func TestCheckpointer_FlushesPagesDirtiedBeforeLogPosition(t *testing.T) {
+	// Given
+	diskManager := newMemoryDiskManager()
+	pool := NewBufferPoolWithSize(8, diskManager)
+	_, _ = pool.FetchPage(1)
+	_ = pool.WritePage(1, []byte("old"), 10)
+	_, _ = pool.FetchPage(2)
+	_ = pool.WritePage(2, []byte("new"), 50)
+	_, _ = pool.FetchPage(3)
+	_ = pool.WritePage(3, []byte("last"), 40) // by the record ending at 40
+	log := &fakeCheckpointLog{position: 40}
+	checkpointer := NewCheckpointer(pool, log, time.Second)
+
+	// When
+	lsn, err := checkpointer.Checkpoint()
+
+	// Then
+	assert.NoError(t, err)
+	assert.Equal(t, LSN(40), lsn)
+	assert.Equal(t, []LSN{40}, log.recorded())
+
+	// Pinned pages are flushed too; only the page dirtied after 40 remains
+	assert.ElementsMatch(t, []PageId{1, 3}, diskManager.written())
+	dirty := pool.DirtyPages()
+	assert.Len(t, dirty, 1)
+	assert.Equal(t, PageId(2), dirty[0].PageId)
+}
+
+func TestCheckpointer_SkipsRecordingUnchangedPosition(t *testing.T) {
+	// Given
+	pool := NewBufferPoolWithSize(8, newMemoryDiskManager())
+	log := &fakeCheckpointLog{position: 40}
+	checkpointer := NewCheckpointer(pool, log, time.Second)
+
+	// When
+	_, _ = checkpointer.Checkpoint()
+	_, _ = checkpointer.Checkpoint()
+
+	// Then
+	assert.Equal(t, []LSN{40}, log.recorded())
+}
+
+type fakeCheckpointLog struct {
+	mu          sync.Mutex
+	position    LSN
+	checkpoints []LSN
+}
+
+func (l *fakeCheckpointLog) Position() (LSN, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return l.position, nil
+}
+
+func (l *fakeCheckpointLog) RecordCheckpoint(lsn LSN) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.checkpoints = append(l.checkpoints, lsn)
+	return nil
+}
+
+func (l *fakeCheckpointLog) recorded() []LSN {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return append([]LSN(nil), l.checkpoints...)
+}
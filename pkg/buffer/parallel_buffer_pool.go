@@ -0,0 +1,106 @@
+package buffer
+
+import (
+	"yadb-go/pkg/io"
+	. "yadb-go/pkg/types"
+)
+
+// ParallelBufferPool shards frames across several independent BufferPools so
+// that goroutines working on different pages rarely contend on the same lock.
+// A page always maps to the same instance, chosen by hashing its PageId.
+type ParallelBufferPool struct {
+	instances []*BufferPool
+}
+
+// NewParallelBufferPool creates numInstances pools which share MaxPoolSize
+// frames between them
+func NewParallelBufferPool(numInstances int, diskManager io.DiskManager) *ParallelBufferPool {
+	return NewParallelBufferPoolWithSize(numInstances, MaxPoolSize, diskManager)
+}
+
+// NewParallelBufferPoolWithSize creates numInstances pools holding poolSize
+// frames in total. Frames are divided as evenly as possible between instances.
+func NewParallelBufferPoolWithSize(numInstances int, poolSize int, diskManager io.DiskManager) *ParallelBufferPool {
+	if numInstances < 1 {
+		panic("Number of instances must be >= 1")
+	}
+	if poolSize < numInstances {
+		panic("Pool size must be >= number of instances")
+	}
+
+	instances := make([]*BufferPool, numInstances)
+	for i := range instances {
+		size := poolSize / numInstances
+		if i < poolSize%numInstances {
+			size++
+		}
+		instances[i] = NewBufferPoolWithSize(size, diskManager)
+	}
+
+	return &ParallelBufferPool{instances: instances}
+}
+
+// FetchPage returns a pinned page from the instance responsible for pageId
+func (p *ParallelBufferPool) FetchPage(pageId PageId) (*Page, error) {
+	return p.instanceFor(pageId).FetchPage(pageId)
+}
+
+// NewPage returns a pinned page from the instance responsible for pageId,
+// without reading it from disk
+func (p *ParallelBufferPool) NewPage(pageId PageId) (*Page, error) {
+	return p.instanceFor(pageId).NewPage(pageId)
+}
+
+// ReleasePage unpins a page in the instance responsible for pageId
+func (p *ParallelBufferPool) ReleasePage(pageId PageId) error {
+	return p.instanceFor(pageId).ReleasePage(pageId)
+}
+
+// WritePage updates a page held by the instance responsible for pageId
+func (p *ParallelBufferPool) WritePage(pageId PageId, data []byte, lsn LSN) error {
+	return p.instanceFor(pageId).WritePage(pageId, data, lsn)
+}
+
+// FlushPage flushes a page held by the instance responsible for pageId
+func (p *ParallelBufferPool) FlushPage(pageId PageId) error {
+	return p.instanceFor(pageId).FlushPage(pageId)
+}
+
+// CleanPage writes a page to disk if it is dirty
+func (p *ParallelBufferPool) CleanPage(pageId PageId) (bool, error) {
+	return p.instanceFor(pageId).CleanPage(pageId)
+}
+
+// DirtyPages lists the dirty pages of every instance, oldest first
+func (p *ParallelBufferPool) DirtyPages() []DirtyPage {
+	dirty := make([]DirtyPage, 0)
+	for _, instance := range p.instances {
+		dirty = append(dirty, instance.DirtyPages()...)
+	}
+	sortDirtyPages(dirty)
+
+	return dirty
+}
+
+// Stats returns the sum of the stats of every instance
+func (p *ParallelBufferPool) Stats() Stats {
+	var stats Stats
+	for _, instance := range p.instances {
+		stats.add(instance.Stats())
+	}
+	return stats
+}
+
+// NumInstances returns the number of shards in this pool
+func (p *ParallelBufferPool) NumInstances() int {
+	return len(p.instances)
+}
+
+// instanceFor picks the shard for a page. Page IDs are usually allocated
+// sequentially, so they are mixed (Fibonacci hashing) before taking the modulo
+// to avoid hot runs of neighbouring pages landing on related shards.
+func (p *ParallelBufferPool) instanceFor(pageId PageId) *BufferPool {
+	h := uint64(pageId) * 0x9E3779B97F4A7C15
+	h ^= h >> 32
+	return p.instances[h%uint64(len(p.instances))]
+}
@@ -0,0 +1,96 @@
+package buffer
+
+import (
+	"sync"
+	"testing"
+
+	. "yadb-go/pkg/types"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParallelBufferPool_DividesFrames(t *testing.T) {
+	// When
+	pool := NewParallelBufferPoolWithSize(3, 10, newMemoryDiskManager())
+
+	// Then
+	assert.Equal(t, 3, pool.NumInstances())
+	assert.Equal(t, 4, pool.instances[0].Stats().PoolSize)
+	assert.Equal(t, 3, pool.instances[1].Stats().PoolSize)
+	assert.Equal(t, 3, pool.instances[2].Stats().PoolSize)
+	assert.Equal(t, 10, pool.Stats().PoolSize)
+}
+
+func TestParallelBufferPool_RoutesPageToSameInstance(t *testing.T) {
+	// Given
+	pool := NewParallelBufferPoolWithSize(4, 64, newMemoryDiskManager())
+
+	// When
+	first, err := pool.FetchPage(7)
+	assert.NoError(t, err)
+	second, err := pool.FetchPage(7)
+	assert.NoError(t, err)
+
+	// Then
+	assert.Same(t, first, second)
+	assert.Equal(t, uint32(2), first.refCount)
+
+	// And the page should live in exactly one instance
+	holders := 0
+	for _, instance := range pool.instances {
+		if _, found := instance.pageTable[7]; found {
+			holders++
+		}
+	}
+	assert.Equal(t, 1, holders)
+
+	assert.NoError(t, pool.ReleasePage(7))
+	assert.NoError(t, pool.ReleasePage(7))
+	assert.Equal(t, uint32(0), first.refCount)
+}
+
+func TestParallelBufferPool_AggregatesStats(t *testing.T) {
+	// Given
+	pool := NewParallelBufferPoolWithSize(4, 64, newMemoryDiskManager())
+
+	// When
+	for i := 0; i < 16; i++ {
+		_, err := pool.FetchPage(PageId(i))
+		assert.NoError(t, err)
+	}
+	_, _ = pool.FetchPage(0)
+	assert.NoError(t, pool.FlushPage(3))
+
+	// Then
+	stats := pool.Stats()
+	assert.Equal(t, 16, stats.PagesInUse)
+	assert.Equal(t, uint64(16), stats.Misses)
+	assert.Equal(t, uint64(1), stats.Hits)
+	assert.Equal(t, uint64(1), stats.Flushes)
+}
+
+func TestParallelBufferPool_ConcurrentFetchAndRelease(t *testing.T) {
+	// Given
+	pool := NewParallelBufferPoolWithSize(8, 256, newMemoryDiskManager())
+
+	// When
+	var wg sync.WaitGroup
+	for g := 0; g < 16; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := 0; i < 1000; i++ {
+				pageId := PageId((g*31 + i) % 128)
+				_, err := pool.FetchPage(pageId)
+				assert.NoError(t, err)
+				assert.NoError(t, pool.ReleasePage(pageId))
+			}
+		}(g)
+	}
+	wg.Wait()
+
+	// Then
+	stats := pool.Stats()
+	assert.Equal(t, 128, stats.PagesInUse)
+	assert.Equal(t, uint64(16*1000), stats.Hits+stats.Misses)
+}
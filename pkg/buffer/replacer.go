@@ -0,0 +1,46 @@
+package buffer
+
+import "container/list"
+
+// lruReplacer tracks frames whose pages are unpinned, and picks the least
+// recently unpinned frame as the victim when the pool needs space.
+// It is not thread safe; the BufferPool serialises access to it.
+type lruReplacer struct {
+	order  *list.List // front is least recently used
+	frames map[FrameId]*list.Element
+}
+
+func newLruReplacer() *lruReplacer {
+	return &lruReplacer{
+		order:  list.New(),
+		frames: make(map[FrameId]*list.Element),
+	}
+}
+
+// unpin makes a frame a candidate for eviction
+func (r *lruReplacer) unpin(frameId FrameId) {
+	if _, found := r.frames[frameId]; found {
+		return
+	}
+	r.frames[frameId] = r.order.PushBack(frameId)
+}
+
+// pin removes a frame from the eviction candidates
+func (r *lruReplacer) pin(frameId FrameId) {
+	if elem, found := r.frames[frameId]; found {
+		r.order.Remove(elem)
+		delete(r.frames, frameId)
+	}
+}
+
+// victim removes and returns the least recently used frame, or FrameNotFound
+// if every frame is pinned
+func (r *lruReplacer) victim() FrameId {
+	elem := r.order.Front()
+	if elem == nil {
+		return FrameNotFound
+	}
+	frameId := r.order.Remove(elem).(FrameId)
+	delete(r.frames, frameId)
+	return frameId
+}
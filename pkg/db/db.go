@@ -1,41 +1,180 @@
 package db
 
 import (
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"log"
+	"sync"
+	"time"
 	"yadb-go/pkg/buffer"
 	"yadb-go/pkg/store"
 	"yadb-go/pkg/store/inmemory-btree"
+	"yadb-go/pkg/types"
 	"yadb-go/pkg/wal"
 	"yadb-go/protoc"
 )
 
+const checkpointInterval = 30 * time.Second
+const treeDegree = 10
+const keyLockStripes = 64
+
+// Database is safe for concurrent use. The store synchronises itself; the
+// database only has to keep the WAL in the same order as the changes made to
+// the store, so that replaying it gives the same result.
 type Database struct {
-	store      store.Store
-	wal        *wal.LogFile
-	bufferPool *buffer.BufferPool
+	// Writes to a single key take mu shared and the lock for their key, so
+	// writes to the same key are logged and applied in the same order.
+	// Operations on many keys at once take mu exclusively.
+	mu       sync.RWMutex
+	keyLocks [keyLockStripes]sync.Mutex
+
+	store        store.Store
+	cmp          store.Comparator
+	wal          *wal.LogFile
+	logWrites    bool // false if the store logs writes itself
+	bufferPool   *buffer.BufferPool
+	cleaner      *buffer.PageCleaner
+	checkpointer *buffer.Checkpointer
 }
 
 // TODO will also need a data file path
 func NewDatabase(walFileName string) *Database {
-	wal := wal.NewWalFile(walFileName)
+	d, err := NewDatabaseWithComparator(walFileName, store.Bytewise)
+	if err != nil {
+		log.Fatalln("Failed to open database.", err)
+	}
+	return d
+}
+
+// NewDatabaseWithComparator creates a database whose keys are ordered by cmp.
+// The comparator's name is recorded next to the WAL, and reopening the
+// database with a different comparator is an error. A database with nothing
+// recorded was created with Bytewise.
+func NewDatabaseWithComparator(walFileName string, cmp store.Comparator) (*Database, error) {
+	return NewDatabaseWithEngine(walFileName, cmp, BTreeEngine{})
+}
+
+// NewDatabaseWithEngine creates a database held in the store engine opens.
+// Stores which log their own writes keep the WAL for the comparator and
+// checkpoints alone, so a database can't switch to one once it has logged
+// writes. There is no data file, so stores held in pages keep them in memory;
+// use Open to give the database one.
+func NewDatabaseWithEngine(walFileName string, cmp store.Comparator, engine Engine) (*Database, error) {
+	return newDatabase(wal.NewWalFile(walFileName), cmp, engine, newBufferPool("", 0))
+}
+
+func newDatabase(wal *wal.LogFile, cmp store.Comparator, engine Engine, bufferPool *buffer.BufferPool) (*Database, error) {
+	if err := checkComparator(wal, cmp); err != nil {
+		return nil, err
+	}
+	if engine.LogsWrites() {
+		position, err := wal.Position()
+		if err != nil {
+			return nil, err
+		}
+		if position > 0 {
+			return nil, errors.New("database has writes in its WAL, so can only be opened with an engine which replays them")
+		}
+	}
+	s, err := engine.Open(cmp, bufferPool)
+	if err != nil {
+		return nil, err
+	}
 
 	d := &Database{
-		store:      inmemory_btree.NewTree(10),
-		wal:        wal,
-		bufferPool: buffer.NewBufferPool(),
+		store:        s,
+		cmp:          cmp,
+		wal:          wal,
+		logWrites:    !engine.LogsWrites(),
+		bufferPool:   bufferPool,
+		cleaner:      buffer.NewPageCleaner(bufferPool, buffer.DefaultCleanerOptions),
+		checkpointer: buffer.NewCheckpointer(bufferPool, wal, checkpointInterval),
 	}
+	d.cleaner.Start()
+	d.checkpointer.Start()
 
-	return d
+	return d, nil
+}
+
+// checkComparator returns an error if the database in wal was created with a
+// comparator other than cmp, and otherwise records cmp for a new database
+func checkComparator(wal *wal.LogFile, cmp store.Comparator) error {
+	recorded, err := wal.Comparator()
+	if err != nil {
+		return err
+	}
+	if recorded == "" {
+		position, err := wal.Position()
+		if err != nil {
+			return err
+		}
+		// Bytewise isn't recorded, so databases created before comparators
+		// existed open as they always have
+		if position == 0 && cmp != store.Bytewise {
+			return wal.RecordComparator(cmp.Name())
+		}
+		recorded = store.Bytewise.Name()
+	}
+
+	if recorded != cmp.Name() {
+		return fmt.Errorf("database was created with comparator %s, not %s", recorded, cmp.Name())
+	}
+	return nil
 }
 
 func LoadDatabaseFromWal(walFileName string) *Database {
 	d := NewDatabase(walFileName)
-	d.wal.ReplayIntoStore(d.store)
+	if err := d.wal.ReplayIntoStore(d.store); err != nil {
+		log.Fatalln("Failed to replay WAL.", err)
+	}
 
 	return d
 }
 
+// LoadDatabaseFromWalWithComparator reopens a database created with cmp
+func LoadDatabaseFromWalWithComparator(walFileName string, cmp store.Comparator) (*Database, error) {
+	d, err := NewDatabaseWithComparator(walFileName, cmp)
+	if err != nil {
+		return nil, err
+	}
+	if err := d.replay(); err != nil {
+		return nil, err
+	}
+
+	return d, nil
+}
+
+// LoadDatabaseFromWalWithEngine reopens a database held in the store engine
+// opens, replaying the WAL into it unless the store logs its own writes
+func LoadDatabaseFromWalWithEngine(walFileName string, cmp store.Comparator, engine Engine) (*Database, error) {
+	d, err := NewDatabaseWithEngine(walFileName, cmp, engine)
+	if err != nil {
+		return nil, err
+	}
+	if err := d.replay(); err != nil {
+		return nil, err
+	}
+
+	return d, nil
+}
+
+// replay applies the WAL to the store, unless the store logs its own writes.
+// The database is closed if that fails.
+func (d *Database) replay() error {
+	if !d.logWrites {
+		return nil
+	}
+	if err := d.wal.ReplayIntoStore(d.store); err != nil {
+		d.Close()
+		return err
+	}
+	return nil
+}
+
 func (d *Database) Get(key string) (string, bool) {
-	ret := d.store.Get(key)
+	ret := d.currentStore().Get(key)
 	if ret == nil {
 		return "", false
 	}
@@ -43,17 +182,260 @@ func (d *Database) Get(key string) (string, bool) {
 }
 
 func (d *Database) Set(key string, value string) {
-	d.store.Set(key, value)
-	d.wal.Write(&protoc.WalEntry{
-		Key:   key,
-		Value: value,
-	})
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	l := d.keyLock(key)
+	l.Lock()
+	defer l.Unlock()
+
+	var lsn types.LSN
+	if d.logWrites {
+		lsn = d.wal.Write(&protoc.WalEntry{
+			Key:   []byte(key),
+			Value: []byte(value),
+		})
+	}
+	store.SetLogged(d.store, key, value, lsn)
 }
 
 func (d *Database) Delete(key string) {
-	d.store.Delete(key)
-	d.wal.Write(&protoc.WalEntry{
-		Key:       key,
-		Tombstone: true,
-	})
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	l := d.keyLock(key)
+	l.Lock()
+	defer l.Unlock()
+
+	var lsn types.LSN
+	if d.logWrites {
+		lsn = d.wal.Write(&protoc.WalEntry{
+			Key:       []byte(key),
+			Tombstone: true,
+		})
+	}
+	store.DeleteLogged(d.store, key, lsn)
+}
+
+// GetBytes looks up a binary key. The value returned is a view of the stored
+// value rather than a copy, so must not be modified.
+func (d *Database) GetBytes(key []byte) ([]byte, bool) {
+	return store.GetBytes(d.currentStore(), key)
+}
+
+// SetBytes writes a binary key and value, which are copied
+func (d *Database) SetBytes(key []byte, value []byte) {
+	d.Set(string(key), string(value))
+}
+
+// DeleteBytes removes a binary key
+func (d *Database) DeleteBytes(key []byte) {
+	d.Delete(string(key))
+}
+
+// keyLock returns the lock serialising writes to key. Keys are hashed onto a
+// fixed set of locks, so unrelated keys occasionally share one.
+func (d *Database) keyLock(key string) *sync.Mutex {
+	// Under most comparators, keys with different bytes can be the same key,
+	// so it is their normalized spelling which is hashed. Without one, every
+	// key has to share a lock.
+	n, ok := d.cmp.(store.Normalizer)
+	if !ok {
+		return &d.keyLocks[0]
+	}
+	h := fnv.New32a()
+	h.Write([]byte(n.Normalize(key)))
+	return &d.keyLocks[h.Sum32()%keyLockStripes]
+}
+
+// currentStore returns the store, which ImportSorted may replace
+func (d *Database) currentStore() store.Store {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	return d.store
+}
+
+// Close stops the database's background workers, takes a final checkpoint,
+// and closes the store if it has anything to close
+func (d *Database) Close() error {
+	d.cleaner.Stop()
+	d.checkpointer.Stop()
+	_, err := d.checkpointer.Checkpoint()
+	if closer, ok := d.currentStore().(io.Closer); ok {
+		if closeErr := closer.Close(); err == nil {
+			err = closeErr
+		}
+	}
+	if closeErr := d.wal.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// DeletePrefix removes every key starting with prefix. However many keys are
+// removed, only a single record is written to the WAL.
+func (d *Database) DeletePrefix(prefix string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	var lsn types.LSN
+	if d.logWrites {
+		lsn = d.wal.Write(&protoc.WalEntry{
+			Key:       []byte(prefix),
+			Tombstone: true,
+			Prefix:    true,
+		})
+	}
+	store.DeletePrefixLogged(d.store, prefix, lsn)
+}
+
+// ScanPrefix returns an iterator over the keys starting with prefix, in key order
+func (d *Database) ScanPrefix(prefix string) store.Iterator {
+	return d.currentStore().ScanPrefix(prefix)
+}
+
+// ImportSorted loads pairs, which must be sorted by key, into an empty
+// database. The tree is bulk loaded bottom-up rather than built by repeated
+// inserts, and the WAL is written with a single fsync. Other stores are
+// written pair by pair.
+func (d *Database) ImportSorted(pairs store.Iterator) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.store.First() != nil {
+		return errors.New("can only import sorted data into an empty database")
+	}
+	empty, ok := d.store.(*inmemory_btree.Tree)
+	if !ok {
+		defer pairs.Close()
+		for ; pairs.Valid(); pairs.Next() {
+			var lsn types.LSN
+			if d.logWrites {
+				lsn = d.wal.Write(&protoc.WalEntry{Key: pairs.KeyBytes(), Value: pairs.ValueBytes()})
+			}
+			store.SetLogged(d.store, pairs.Key(), pairs.Value(), lsn)
+		}
+		return nil
+	}
+
+	tree, err := empty.BulkLoad(pairs, inmemory_btree.DefaultFillFactor)
+	if err != nil {
+		return err
+	}
+	if err = d.wal.WritePairs(tree.Scan("", "")); err != nil {
+		return err
+	}
+	d.store = tree
+
+	return nil
+}
+
+// Scan returns an iterator over the keys in [start, end), in key order. An
+// empty end leaves the range unbounded.
+func (d *Database) Scan(start, end string) store.Iterator {
+	return d.NewIterator(store.ScanOptions{Start: start, End: end})
+}
+
+// NewIterator returns an iterator over the range of keys described by opts
+func (d *Database) NewIterator(opts store.ScanOptions) store.Iterator {
+	return d.currentStore().NewIterator(opts)
+}
+
+// First returns the smallest key in the database and its value
+func (d *Database) First() (string, string, bool) {
+	return unpack(d.currentStore().First())
+}
+
+// Last returns the largest key in the database and its value
+func (d *Database) Last() (string, string, bool) {
+	return unpack(d.currentStore().Last())
+}
+
+// Floor returns the largest key <= key, and its value
+func (d *Database) Floor(key string) (string, string, bool) {
+	return unpack(d.currentStore().Floor(key))
+}
+
+// Ceiling returns the smallest key >= key, and its value
+func (d *Database) Ceiling(key string) (string, string, bool) {
+	return unpack(d.currentStore().Ceiling(key))
+}
+
+// Stats reports the shape of the tree holding the database, for tuning its
+// degree. It returns false unless the database is held in a B+ tree.
+func (d *Database) Stats() (inmemory_btree.Stats, bool) {
+	tree, ok := d.currentStore().(*inmemory_btree.Tree)
+	if !ok {
+		return inmemory_btree.Stats{}, false
+	}
+	return tree.Stats(), true
+}
+
+// orderStatistics is implemented by stores which can count and select keys
+// by their position without scanning them, as B+ trees can
+type orderStatistics interface {
+	Count(start, end string) int
+	Rank(key string) int
+	Select(i int) *store.KeyValuePair
+}
+
+// Count returns the number of keys in [start, end). An empty end leaves the
+// range unbounded. Unless the store keeps order statistics, the range is
+// scanned.
+func (d *Database) Count(start, end string) int {
+	s := d.currentStore()
+	if stats, ok := s.(orderStatistics); ok {
+		return stats.Count(start, end)
+	}
+	return count(s.NewIterator(store.ScanOptions{Start: start, End: end}))
+}
+
+// Rank returns the number of keys less than key. Unless the store keeps order
+// statistics, those keys are scanned.
+func (d *Database) Rank(key string) int {
+	s := d.currentStore()
+	if stats, ok := s.(orderStatistics); ok {
+		return stats.Rank(key)
+	}
+	if key == "" {
+		return 0
+	}
+	return count(s.NewIterator(store.ScanOptions{End: key}))
+}
+
+// Select returns the key at position i in key order, counting from 0, and its
+// value. Unless the store keeps order statistics, the keys before it are
+// scanned.
+func (d *Database) Select(i int) (string, string, bool) {
+	s := d.currentStore()
+	if stats, ok := s.(orderStatistics); ok {
+		return unpack(stats.Select(i))
+	}
+	if i < 0 {
+		return "", "", false
+	}
+	it := s.NewIterator(store.ScanOptions{})
+	defer it.Close()
+	for ; it.Valid() && i > 0; it.Next() {
+		i--
+	}
+	if !it.Valid() {
+		return "", "", false
+	}
+	return it.Key(), it.Value(), true
+}
+
+func count(it store.Iterator) int {
+	defer it.Close()
+
+	n := 0
+	for ; it.Valid(); it.Next() {
+		n++
+	}
+	return n
+}
+
+func unpack(pair *store.KeyValuePair) (string, string, bool) {
+	if pair == nil {
+		return "", "", false
+	}
+	return pair.Key, pair.Value, true
 }
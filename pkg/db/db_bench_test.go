@@ -1,16 +1,25 @@
 package db
 
 import (
+	"fmt"
 	"math/rand"
 	"os"
+	"runtime"
 	"strconv"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
+
+	"yadb-go/pkg/store"
+	"yadb-go/pkg/store/inmemory-btree"
+	"yadb-go/pkg/store/skiplist"
 )
 
 func BenchmarkGet(b *testing.B) {
 	rand.Seed(time.Now().UnixNano())
 	db := NewDatabase("wal")
+	defer db.Close()
 
 	// Create database with 100 items
 	for i := 0; i < 100; i++ {
@@ -28,6 +37,7 @@ func BenchmarkGet(b *testing.B) {
 func BenchmarkInsert(b *testing.B) {
 	file, _ := os.CreateTemp("", "yadb_wal")
 	db := NewDatabase(file.Name())
+	defer db.Close()
 
 	b.ReportAllocs()
 	b.ResetTimer()
@@ -35,3 +45,140 @@ func BenchmarkInsert(b *testing.B) {
 		db.Set("key"+strconv.Itoa(i), "some random value")
 	}
 }
+
+// Many goroutines inserting at once share each fsync of the WAL, or of the
+// LSM tree's log, so throughput should grow with their number
+func BenchmarkInsertParallel(b *testing.B) {
+	for _, engine := range []string{"btree", "lsm"} {
+		for _, goroutines := range []int{1, 8, 64, 256} {
+			b.Run(fmt.Sprintf("%s/goroutines=%d", engine, goroutines), func(b *testing.B) {
+				db, err := Open(Options{Engine: engine, DataDir: b.TempDir()})
+				if err != nil {
+					b.Fatal(err)
+				}
+				defer db.Close()
+
+				var next atomic.Int64
+				b.ReportAllocs()
+				b.SetParallelism((goroutines + runtime.GOMAXPROCS(0) - 1) / runtime.GOMAXPROCS(0))
+				b.ResetTimer()
+				start := time.Now()
+				b.RunParallel(func(pb *testing.PB) {
+					for pb.Next() {
+						db.Set("key"+strconv.FormatInt(next.Add(1), 10), "some random value")
+					}
+				})
+				b.ReportMetric(float64(b.N)/time.Since(start).Seconds(), "ops/s")
+			})
+		}
+	}
+}
+
+// The stores a database can be held in, for the benchmarks below comparing
+// them directly
+var benchmarkStores = []struct {
+	name     string
+	newStore func() store.Store
+}{
+	{"btree", func() store.Store { return inmemory_btree.NewTree(treeDegree) }},
+	{"skiplist", func() store.Store { return skiplist.NewSkipList() }},
+}
+
+// benchmarkKeys returns n keys in random order
+func benchmarkKeys(n int) []string {
+	rng := rand.New(rand.NewSource(1))
+	keys := make([]string, n)
+	for i, j := range rng.Perm(n) {
+		keys[i] = fmt.Sprintf("key%08d", j)
+	}
+	return keys
+}
+
+func filledStore(newStore func() store.Store, keys []string) store.Store {
+	s := newStore()
+	for _, key := range keys {
+		s.Set(key, "some random value")
+	}
+	return s
+}
+
+func BenchmarkStoreSet(b *testing.B) {
+	keys := benchmarkKeys(1 << 16)
+	for _, bs := range benchmarkStores {
+		b.Run(bs.name, func(b *testing.B) {
+			s := bs.newStore()
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				s.Set(keys[i%len(keys)], "some random value")
+			}
+		})
+	}
+}
+
+func BenchmarkStoreGet(b *testing.B) {
+	keys := benchmarkKeys(1 << 16)
+	for _, bs := range benchmarkStores {
+		b.Run(bs.name, func(b *testing.B) {
+			s := filledStore(bs.newStore, keys)
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				s.Get(keys[i%len(keys)])
+			}
+		})
+	}
+}
+
+// Readers on every CPU, while one writer keeps overwriting keys, as a
+// memtable sees
+func BenchmarkStoreGetParallel(b *testing.B) {
+	keys := benchmarkKeys(1 << 16)
+	for _, bs := range benchmarkStores {
+		b.Run(bs.name, func(b *testing.B) {
+			s := filledStore(bs.newStore, keys)
+			done := make(chan struct{})
+			var wg sync.WaitGroup
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for i := 0; ; i++ {
+					select {
+					case <-done:
+						return
+					default:
+						s.Set(keys[i%len(keys)], "another random value")
+					}
+				}
+			}()
+
+			b.ReportAllocs()
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				for i := 0; pb.Next(); i++ {
+					s.Get(keys[i%len(keys)])
+				}
+			})
+			b.StopTimer()
+			close(done)
+			wg.Wait()
+		})
+	}
+}
+
+func BenchmarkStoreScan(b *testing.B) {
+	keys := benchmarkKeys(1 << 16)
+	for _, bs := range benchmarkStores {
+		b.Run(bs.name, func(b *testing.B) {
+			s := filledStore(bs.newStore, keys)
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				it := s.NewIterator(store.ScanOptions{Start: keys[i%len(keys)], Limit: 100})
+				for ; it.Valid(); it.Next() {
+				}
+				it.Close()
+			}
+		})
+	}
+}
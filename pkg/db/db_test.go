@@ -1,15 +1,26 @@
 package db
 
 import (
+	"fmt"
 	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
 	"testing"
 
+	"yadb-go/pkg/buffer"
+	"yadb-go/pkg/store"
+	"yadb-go/pkg/store/lsm"
+	"yadb-go/pkg/wal"
+
 	"github.com/stretchr/testify/assert"
 )
 
 func TestBasicApiCalls(t *testing.T) {
 	file, _ := os.CreateTemp("", "yadb_wal")
 	d := NewDatabase(file.Name())
+	defer d.Close()
 
 	key := "hello"
 	value := "world"
@@ -25,8 +36,143 @@ func TestBasicApiCalls(t *testing.T) {
 	assert.False(t, exists)
 }
 
+func TestScan(t *testing.T) {
+	file, _ := os.CreateTemp("", "yadb_wal")
+	d := NewDatabase(file.Name())
+	defer d.Close()
+	d.Set("b", "2")
+	d.Set("d", "4")
+	d.Set("a", "1")
+	d.Set("c", "3")
+
+	keys, values := collect(d.Scan("b", "d"))
+	assert.Equal(t, []string{"b", "c"}, keys)
+	assert.Equal(t, []string{"2", "3"}, values)
+
+	keys, _ = collect(d.NewIterator(store.ScanOptions{Start: "a", StartExclusive: true, Limit: 2}))
+	assert.Equal(t, []string{"b", "c"}, keys)
+}
+
+func TestReverseScanAndNearestKeys(t *testing.T) {
+	file, _ := os.CreateTemp("", "yadb_wal")
+	d := NewDatabase(file.Name())
+	defer d.Close()
+	for _, key := range []string{"event/1", "event/2", "event/3", "event/5"} {
+		d.Set(key, "v"+key[len(key)-1:])
+	}
+
+	keys, _ := collect(d.NewIterator(store.ScanOptions{Start: "event/", Limit: 2, Reverse: true}))
+	assert.Equal(t, []string{"event/5", "event/3"}, keys)
+
+	key, value, found := d.Floor("event/4")
+	assert.Equal(t, "event/3", key)
+	assert.Equal(t, "v3", value)
+	assert.True(t, found)
+
+	key, _, found = d.Ceiling("event/4")
+	assert.Equal(t, "event/5", key)
+	assert.True(t, found)
+
+	key, _, _ = d.First()
+	assert.Equal(t, "event/1", key)
+	key, _, _ = d.Last()
+	assert.Equal(t, "event/5", key)
+
+	_, _, found = d.Ceiling("z")
+	assert.False(t, found)
+}
+
+func TestDeletePrefix(t *testing.T) {
+	file, _ := os.CreateTemp("", "yadb_wal")
+	d := NewDatabase(file.Name())
+	defer d.Close()
+	d.Set("tenant/1/order/1", "a")
+	d.Set("tenant/1/order/2", "b")
+	d.Set("tenant/2/order/1", "c")
+	sizeBefore, _ := d.wal.Position()
+
+	d.DeletePrefix("tenant/1/")
+
+	keys, _ := collect(d.ScanPrefix("tenant/"))
+	assert.Equal(t, []string{"tenant/2/order/1"}, keys)
+
+	// A single record should have been logged, and replaying it should
+	// delete the same keys
+	sizeAfter, _ := d.wal.Position()
+	assert.Less(t, int(sizeAfter-sizeBefore), 30)
+
+	reloaded := LoadDatabaseFromWal(file.Name())
+	defer reloaded.Close()
+	keys, _ = collect(reloaded.ScanPrefix(""))
+	assert.Equal(t, []string{"tenant/2/order/1"}, keys)
+}
+
+func TestImportSorted(t *testing.T) {
+	file, _ := os.CreateTemp("", "yadb_wal")
+	d := NewDatabase(file.Name())
+	defer d.Close()
+	pairs := make([]store.KeyValuePair, 0)
+	for i := 0; i < 1000; i++ {
+		pairs = append(pairs, store.KeyValuePair{Key: fmt.Sprintf("key%04d", i), Value: strconv.Itoa(i)})
+	}
+
+	err := d.ImportSorted(store.NewSliceIterator(pairs))
+	assert.NoError(t, err)
+
+	value, exists := d.Get("key0500")
+	assert.True(t, exists)
+	assert.Equal(t, "500", value)
+
+	// The imported data should survive a reload from the WAL
+	reloaded := LoadDatabaseFromWal(file.Name())
+	defer reloaded.Close()
+	keys, _ := collect(reloaded.Scan("", ""))
+	assert.Len(t, keys, 1000)
+
+	// Importing again is refused, as the database is no longer empty
+	err = d.ImportSorted(store.NewSliceIterator(pairs))
+	assert.Error(t, err)
+}
+
+func TestImportSorted_KeepsTheTreeDegree(t *testing.T) {
+	// Given a database of trees with a larger degree than the default
+	d, err := Open(Options{TreeDegree: 64, DataDir: t.TempDir(), Sync: wal.SyncNever})
+	assert.NoError(t, err)
+	defer d.Close()
+
+	// When data is imported
+	pairs := make([]store.KeyValuePair, 0)
+	for i := 0; i < 1000; i++ {
+		pairs = append(pairs, store.KeyValuePair{Key: fmt.Sprintf("key%04d", i), Value: strconv.Itoa(i)})
+	}
+	assert.NoError(t, d.ImportSorted(store.NewSliceIterator(pairs)))
+
+	// Then the tree it is loaded into has the same degree, so far fewer
+	// leaves than the 100 or so a tree of degree 10 would need
+	stats, _ := d.Stats()
+	assert.Less(t, stats.LeafNodes, 30)
+}
+
+func TestImportSorted_RejectsUnsortedInput(t *testing.T) {
+	file, _ := os.CreateTemp("", "yadb_wal")
+	d := NewDatabase(file.Name())
+	defer d.Close()
+
+	err := d.ImportSorted(store.NewSliceIterator([]store.KeyValuePair{{Key: "b"}, {Key: "a"}}))
+
+	assert.Error(t, err)
+	_, exists := d.Get("b")
+	assert.False(t, exists)
+}
+
 func TestLoadDatabaseFromWal(t *testing.T) {
-	d := LoadDatabaseFromWal("test_data/wal")
+	// Closing the database checkpoints it, so it is loaded from a copy
+	data, err := os.ReadFile("../../test_data/wal")
+	assert.NoError(t, err)
+	filename := filepath.Join(t.TempDir(), "wal")
+	assert.NoError(t, os.WriteFile(filename, data, 0644))
+	d := LoadDatabaseFromWal(filename)
+	defer d.Close()
 
 	value, exists := d.Get("key")
 	assert.Equal(t, value, "")
@@ -35,3 +181,476 @@ func TestLoadDatabaseFromWal(t *testing.T) {
 	assert.Equal(t, value, "test")
 	assert.True(t, exists)
 }
+
+func TestComparatorIsRecorded(t *testing.T) {
+	// Given a database created with a comparator
+	file, _ := os.CreateTemp("", "yadb_wal")
+	defer os.Remove(file.Name())
+	defer os.Remove(file.Name() + ".checkpoint")
+	defer os.Remove(file.Name() + ".comparator")
+	defer os.Remove(file.Name() + ".checkpoint")
+	d, err := NewDatabaseWithComparator(file.Name(), store.CaseInsensitive)
+	assert.NoError(t, err)
+	defer d.Close()
+	d.Set("Hello", "world")
+	d.Set("apple", "pie")
+
+	// When it is reopened with the same comparator
+	reloaded, err := LoadDatabaseFromWalWithComparator(file.Name(), store.CaseInsensitive)
+
+	// Then keys are ordered by it
+	assert.NoError(t, err)
+	defer reloaded.Close()
+	keys, _ := collect(reloaded.Scan("", ""))
+	assert.Equal(t, []string{"apple", "Hello"}, keys)
+	value, exists := reloaded.Get("HELLO")
+	assert.Equal(t, "world", value)
+	assert.True(t, exists)
+
+	// Reopening with any other comparator is an error
+	_, err = LoadDatabaseFromWalWithComparator(file.Name(), store.Bytewise)
+	assert.Error(t, err)
+}
+
+func TestComparatorDefaultsToBytewise(t *testing.T) {
+	// Given a database created without a comparator
+	file, _ := os.CreateTemp("", "yadb_wal")
+	defer os.Remove(file.Name())
+	defer os.Remove(file.Name() + ".checkpoint")
+	d := NewDatabase(file.Name())
+	defer d.Close()
+	d.Set("key", "value")
+
+	// Then it can't be reopened with another comparator
+	_, err := LoadDatabaseFromWalWithComparator(file.Name(), store.Int64Tuple)
+	assert.Error(t, err)
+	reloaded, err := LoadDatabaseFromWalWithComparator(file.Name(), store.Bytewise)
+	assert.NoError(t, err)
+	reloaded.Close()
+}
+
+func TestBinaryKeysAndValues(t *testing.T) {
+	// Given keys and values which aren't valid UTF-8
+	file, _ := os.CreateTemp("", "yadb_wal")
+	defer os.Remove(file.Name())
+	defer os.Remove(file.Name() + ".checkpoint")
+	d := NewDatabase(file.Name())
+	defer d.Close()
+	key, value := []byte{0xff, 0x00, 0xfe}, []byte{0xc3, 0x28, 0x00, 0x01}
+
+	// When they are written, and the caller reuses its slices
+	d.SetBytes(key, value)
+	d.SetBytes([]byte{0x80}, []byte{})
+	d.DeleteBytes([]byte{0x80})
+	stored := append([]byte(nil), value...)
+	value[0] = 0
+
+	// Then they read back unchanged, including after replaying the WAL
+	reloaded := LoadDatabaseFromWal(file.Name())
+	defer reloaded.Close()
+	for _, db := range []*Database{d, reloaded} {
+		found, exists := db.GetBytes(key)
+		assert.True(t, exists)
+		assert.Equal(t, stored, found)
+		_, exists = db.GetBytes([]byte{0x80})
+		assert.False(t, exists)
+
+		it := db.Scan("", "")
+		assert.True(t, it.Valid())
+		assert.Equal(t, key, it.KeyBytes())
+		assert.Equal(t, stored, it.ValueBytes())
+		it.Close()
+	}
+}
+
+func TestStats(t *testing.T) {
+	// Given
+	file, _ := os.CreateTemp("", "yadb_wal")
+	defer os.Remove(file.Name())
+	defer os.Remove(file.Name() + ".checkpoint")
+	d := NewDatabase(file.Name())
+	defer d.Close()
+
+	// When
+	for i := 0; i < 100; i++ {
+		d.Set(fmt.Sprintf("key%03d", i), "value")
+	}
+	stats, ok := d.Stats()
+
+	// Then
+	assert.True(t, ok)
+	assert.Equal(t, 100, stats.Keys)
+	assert.Greater(t, stats.Height, 1)
+	assert.Greater(t, stats.LeafNodes, 100/treeDegree)
+	assert.Greater(t, stats.ApproximateBytes, 0)
+}
+
+func TestCountRankAndSelect(t *testing.T) {
+	for _, engine := range Engines() {
+		t.Run(engine, func(t *testing.T) {
+			// Given
+			d, err := Open(Options{Engine: engine, DataDir: t.TempDir(), Sync: wal.SyncNever})
+			assert.NoError(t, err)
+			defer d.Close()
+			for i := 0; i < 100; i++ {
+				d.Set(fmt.Sprintf("key%03d", i), strconv.Itoa(i))
+			}
+			d.Delete("key050")
+
+			// When
+			count := d.Count("key040", "key060")
+			rank := d.Rank("key060")
+			key, value, found := d.Select(50)
+			_, _, foundPastEnd := d.Select(99)
+
+			// Then, whether or not the store keeps order statistics
+			assert.Equal(t, 19, count)
+			assert.Equal(t, 59, rank)
+			assert.True(t, found)
+			assert.Equal(t, "key051", key)
+			assert.Equal(t, "51", value)
+			assert.False(t, foundPastEnd)
+			assert.Equal(t, 99, d.Count("", ""))
+			assert.Zero(t, d.Rank(""))
+
+			// And only B+ trees report their shape
+			_, ok := d.Stats()
+			assert.Equal(t, engine == "btree" || engine == "counting", ok)
+		})
+	}
+}
+
+func TestCloseRecordsCheckpoint(t *testing.T) {
+	file, _ := os.CreateTemp("", "yadb_wal")
+	defer os.Remove(file.Name() + ".checkpoint")
+	d := NewDatabase(file.Name())
+	defer d.Close()
+	d.Set("hello", "world")
+
+	err := d.Close()
+	assert.NoError(t, err)
+
+	position, _ := d.wal.Position()
+	checkpoint, err := d.wal.LastCheckpoint()
+	assert.NoError(t, err)
+	assert.NotZero(t, checkpoint)
+	assert.Equal(t, position, checkpoint)
+}
+
+func TestConcurrentWritesReplayIdentically(t *testing.T) {
+	// Given
+	file, _ := os.CreateTemp("", "yadb_wal")
+	defer os.Remove(file.Name())
+	defer os.Remove(file.Name() + ".checkpoint")
+	d := NewDatabase(file.Name())
+	defer d.Close()
+
+	// When goroutines write overlapping keys at the same time
+	var wg sync.WaitGroup
+	for w := 0; w < 8; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < 50; i++ {
+				key := "key" + strconv.Itoa(i%10)
+				if i%7 == w {
+					d.Delete(key)
+				} else {
+					d.Set(key, fmt.Sprintf("%d-%d", w, i))
+				}
+				d.Get(key)
+			}
+		}(w)
+	}
+	wg.Wait()
+
+	// Then replaying the WAL gives the same contents
+	keys, values := collect(d.Scan("", ""))
+	reloaded := LoadDatabaseFromWal(file.Name())
+	defer reloaded.Close()
+	replayedKeys, replayedValues := collect(reloaded.Scan("", ""))
+	assert.Equal(t, keys, replayedKeys)
+	assert.Equal(t, values, replayedValues)
+}
+
+func TestKeyLock(t *testing.T) {
+	// Keys which are the same under the comparator share a lock
+	d := &Database{cmp: store.CaseInsensitive}
+	assert.Same(t, d.keyLock("Key"), d.keyLock("kEY"))
+
+	// Otherwise, they are spread over the locks
+	locks := make(map[*sync.Mutex]bool)
+	for i := 0; i < 100; i++ {
+		locks[d.keyLock(fmt.Sprintf("key%03d", i))] = true
+	}
+	assert.Greater(t, len(locks), keyLockStripes/2)
+
+	// Unless the comparator can't normalize keys
+	d = &Database{cmp: struct{ store.Comparator }{store.CaseInsensitive}}
+	assert.Same(t, d.keyLock("a"), d.keyLock("b"))
+}
+
+func collect(it store.Iterator) ([]string, []string) {
+	defer it.Close()
+
+	keys, values := make([]string, 0), make([]string, 0)
+	for ; it.Valid(); it.Next() {
+		keys = append(keys, it.Key())
+		values = append(values, it.Value())
+	}
+	return keys, values
+}
+
+func TestLSMEngine(t *testing.T) {
+	// Given a database held in an LSM tree
+	file, _ := os.CreateTemp("", "yadb_wal")
+	defer os.Remove(file.Name())
+	defer os.Remove(file.Name() + ".checkpoint")
+	engine := LSMEngine{Dir: t.TempDir(), Options: lsm.Options{MemtableSize: 1024}}
+	d, err := NewDatabaseWithEngine(file.Name(), store.Bytewise, engine)
+	assert.NoError(t, err)
+
+	// When enough is written to flush the memtable
+	for i := 0; i < 200; i++ {
+		d.Set(fmt.Sprintf("key%03d", i), strconv.Itoa(i))
+	}
+	d.Delete("key100")
+	d.DeletePrefix("key19")
+
+	// Then nothing is logged to the database's WAL, and reopening the tree
+	// gives the same contents
+	position, _ := d.wal.Position()
+	assert.Zero(t, position)
+	keys, values := collect(d.Scan("", ""))
+	assert.Len(t, keys, 189)
+	assert.NoError(t, d.Close())
+
+	reopened, err := NewDatabaseWithEngine(file.Name(), store.Bytewise, engine)
+	assert.NoError(t, err)
+	defer reopened.Close()
+	reopenedKeys, reopenedValues := collect(reopened.Scan("", ""))
+	assert.Equal(t, keys, reopenedKeys)
+	assert.Equal(t, values, reopenedValues)
+	_, exists := reopened.Get("key100")
+	assert.False(t, exists)
+}
+
+func TestLSMEngine_RejectsLoggedWrites(t *testing.T) {
+	// Given a database which has logged writes to its WAL
+	file, _ := os.CreateTemp("", "yadb_wal")
+	defer os.Remove(file.Name())
+	defer os.Remove(file.Name() + ".checkpoint")
+	d := NewDatabase(file.Name())
+	d.Set("key", "value")
+	assert.NoError(t, d.Close())
+
+	// Then it can't be opened with an engine which wouldn't replay them
+	_, err := NewDatabaseWithEngine(file.Name(), store.Bytewise, LSMEngine{Dir: t.TempDir()})
+	assert.Error(t, err)
+}
+
+func TestBTreeEngine_LargeValues(t *testing.T) {
+	// Given a B+ tree database with a buffer pool too small to hold its
+	// large values
+	opts := Options{DataDir: t.TempDir(), BufferPoolSize: 8, InlineThreshold: 100, Sync: wal.SyncNever}
+	d, err := Open(opts)
+	assert.NoError(t, err)
+	large := strings.Repeat("v", 2*buffer.PageSizeInBytes)
+
+	// When large values are written, some overwritten and some deleted
+	for i := 0; i < 20; i++ {
+		d.Set(fmt.Sprintf("key%02d", i), strconv.Itoa(i)+large)
+	}
+	d.Set("key05", "small")
+	d.Delete("key06")
+
+	// Then they are moved to pages, which are written to the data file
+	stats, _ := d.Stats()
+	assert.Equal(t, 18*3, stats.OverflowPages)
+	value, _ := d.Get("key00")
+	assert.Equal(t, "0"+large, value)
+	assert.NoError(t, d.Close())
+	info, err := os.Stat(filepath.Join(opts.DataDir, dataFileName))
+	assert.NoError(t, err)
+	assert.Greater(t, info.Size(), int64(8*buffer.PageSizeInBytes))
+
+	// And the tree is rebuilt from the WAL when the database is reopened
+	reopened, err := Open(opts)
+	assert.NoError(t, err)
+	defer reopened.Close()
+	value, _ = reopened.Get("key19")
+	assert.Equal(t, "19"+large, value)
+	value, _ = reopened.Get("key05")
+	assert.Equal(t, "small", value)
+	_, exists := reopened.Get("key06")
+	assert.False(t, exists)
+}
+
+func TestHashEngine(t *testing.T) {
+	// Given a database held in a hash table
+	opts := Options{Engine: "hash", DataDir: t.TempDir(), BufferPoolSize: 8, Sync: wal.SyncNever}
+	d, err := Open(opts)
+	assert.NoError(t, err)
+
+	// When it is written to, closed and opened again
+	for i := 0; i < 1000; i++ {
+		d.Set(fmt.Sprintf("key%03d", i), strconv.Itoa(i))
+	}
+	d.Delete("key100")
+	d.DeletePrefix("key19")
+	assert.NoError(t, d.Close())
+
+	// Then the table is read back from the data file, not rebuilt from the
+	// WAL, so it still holds every key without it
+	assert.NoError(t, os.Remove(filepath.Join(opts.DataDir, "wal")))
+	reopened, err := Open(opts)
+	assert.NoError(t, err)
+	defer reopened.Close()
+
+	// And every key is found, and scans see them in order
+	value, exists := reopened.Get("key500")
+	assert.True(t, exists)
+	assert.Equal(t, "500", value)
+	_, exists = reopened.Get("key100")
+	assert.False(t, exists)
+	keys, _ := collect(reopened.Scan("key188", "key201"))
+	assert.Equal(t, []string{"key188", "key189", "key200"}, keys)
+}
+
+func TestHashEngine_RebuildsAnInconsistentTable(t *testing.T) {
+	// Given a hash table database whose data file was left inconsistent, as
+	// a crash between writing back its meta page and directory could leave it
+	opts := Options{Engine: "hash", DataDir: t.TempDir(), BufferPoolSize: 8, Sync: wal.SyncNever}
+	d, err := Open(opts)
+	assert.NoError(t, err)
+	for i := 0; i < 1000; i++ {
+		d.Set(fmt.Sprintf("key%03d", i), strconv.Itoa(i))
+	}
+	assert.NoError(t, d.Close())
+	file, err := os.OpenFile(filepath.Join(opts.DataDir, dataFileName), os.O_RDWR, 0)
+	assert.NoError(t, err)
+	_, err = file.WriteAt([]byte{30, 0, 0, 0}, 8) // the meta page's global depth
+	assert.NoError(t, err)
+	assert.NoError(t, file.Close())
+
+	// When it is opened again
+	reopened, err := Open(opts)
+	assert.NoError(t, err)
+	defer reopened.Close()
+
+	// Then the table is rebuilt from the WAL, and holds every key
+	keys, _ := collect(reopened.Scan("", ""))
+	assert.Len(t, keys, 1000)
+	value, exists := reopened.Get("key500")
+	assert.True(t, exists)
+	assert.Equal(t, "500", value)
+}
+
+func TestHashEngine_RejectsOtherComparators(t *testing.T) {
+	file, _ := os.CreateTemp("", "yadb_wal")
+	defer os.Remove(file.Name())
+	_, err := NewDatabaseWithEngine(file.Name(), store.CaseInsensitive, HashEngine{})
+	assert.Error(t, err)
+}
+
+func TestOpen(t *testing.T) {
+	for _, engine := range Engines() {
+		t.Run(engine, func(t *testing.T) {
+			// Given a database configured with only an engine and a directory
+			opts := Options{Engine: engine, DataDir: t.TempDir(), BufferPoolSize: 16, Sync: wal.SyncNever}
+			d, err := Open(opts)
+			assert.NoError(t, err)
+
+			// When it is written to, closed and opened again
+			for i := 0; i < 100; i++ {
+				d.Set(fmt.Sprintf("key%03d", i), strconv.Itoa(i))
+			}
+			d.Delete("key050")
+			assert.NoError(t, d.Close())
+
+			reopened, err := Open(opts)
+			assert.NoError(t, err)
+			defer reopened.Close()
+
+			// Then it holds the same keys, in order
+			keys, values := collect(reopened.Scan("", ""))
+			assert.Len(t, keys, 99)
+			assert.Equal(t, "key000", keys[0])
+			assert.Equal(t, "99", values[98])
+			_, exists := reopened.Get("key050")
+			assert.False(t, exists)
+		})
+	}
+}
+
+func TestOpen_InvalidOptions(t *testing.T) {
+	_, err := Open(Options{Engine: "missing", DataDir: t.TempDir()})
+	assert.Error(t, err)
+	_, err = Open(Options{})
+	assert.Error(t, err)
+	_, err = Open(Options{Engine: "lsm", WALPath: t.TempDir() + "/wal"})
+	assert.Error(t, err)
+}
+
+// countingEngine opens B+ trees, counting how many
+type countingEngine struct {
+	BTreeEngine
+	opened *int
+}
+
+func (e countingEngine) Open(cmp store.Comparator, pool buffer.Pool) (store.Store, error) {
+	*e.opened++
+	return e.BTreeEngine.Open(cmp, pool)
+}
+
+var registerCountingEngine sync.Once
+var countingEngineOpened int
+
+func TestRegisterEngine(t *testing.T) {
+	// Given an engine registered by the application
+	registerCountingEngine.Do(func() {
+		RegisterEngine("counting", func(opts Options) (Engine, error) {
+			return countingEngine{BTreeEngine{Degree: opts.TreeDegree}, &countingEngineOpened}, nil
+		})
+	})
+	opened := countingEngineOpened
+
+	// When a database is configured to use it
+	d, err := Open(Options{Engine: "counting", TreeDegree: 4, DataDir: t.TempDir()})
+	assert.NoError(t, err)
+	defer d.Close()
+	d.Set("key", "value")
+
+	// Then it holds the database, and can't be registered twice
+	assert.Equal(t, opened+1, countingEngineOpened)
+	assert.Contains(t, Engines(), "counting")
+	assert.Panics(t, func() {
+		RegisterEngine("counting", func(Options) (Engine, error) { return BTreeEngine{}, nil })
+	})
+}
+
+func TestLoadDatabaseFromWal_AfterTornWrite(t *testing.T) {
+	// Given a database whose last write was cut short by a crash
+	file, _ := os.CreateTemp("", "yadb_wal")
+	defer os.Remove(file.Name())
+	defer os.Remove(file.Name() + ".checkpoint")
+	d := NewDatabase(file.Name())
+	defer d.Close()
+	d.Set("key1", "value1")
+	d.Set("key2", "value2")
+	position, _ := d.wal.Position()
+	assert.NoError(t, os.Truncate(file.Name(), int64(position)-2))
+
+	// When it is reloaded, it opens with every complete write
+	reloaded := LoadDatabaseFromWal(file.Name())
+	defer reloaded.Close()
+	keys, _ := collect(reloaded.Scan("", ""))
+	assert.Equal(t, []string{"key1"}, keys)
+
+	// And it can be written to again
+	reloaded.Set("key3", "value3")
+	again := LoadDatabaseFromWal(file.Name())
+	defer again.Close()
+	keys, _ = collect(again.Scan("", ""))
+	assert.Equal(t, []string{"key1", "key3"}, keys)
+}
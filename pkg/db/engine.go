@@ -0,0 +1,185 @@
+package db
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"sync"
+
+	"yadb-go/pkg/buffer"
+	"yadb-go/pkg/store"
+	"yadb-go/pkg/store/extendible-hash"
+	"yadb-go/pkg/store/inmemory-btree"
+	"yadb-go/pkg/store/lsm"
+	"yadb-go/pkg/store/skiplist"
+)
+
+// Engine creates the store holding a database's keys. Applications can
+// provide their own, and make them available to Open with RegisterEngine.
+type Engine interface {
+	// Open opens the store, ordering keys by cmp. Stores held in pages keep
+	// them in pool, which the database writes back and checkpoints.
+	Open(cmp store.Comparator, pool buffer.Pool) (store.Store, error)
+	// LogsWrites reports whether the store makes writes durable itself, so
+	// the database needn't log them to its WAL
+	LogsWrites() bool
+}
+
+// EngineFactory creates an engine configured by opts
+type EngineFactory func(opts Options) (Engine, error)
+
+var engines = struct {
+	sync.RWMutex
+	factories map[string]EngineFactory
+}{factories: make(map[string]EngineFactory)}
+
+// RegisterEngine makes an engine available to Open under name. It panics if
+// the name is taken, so it is best called from an init function.
+func RegisterEngine(name string, factory EngineFactory) {
+	engines.Lock()
+	defer engines.Unlock()
+	if factory == nil {
+		panic("Engine factory is nil")
+	}
+	if _, taken := engines.factories[name]; taken {
+		panic("An engine is already registered as " + name)
+	}
+	engines.factories[name] = factory
+}
+
+// Engines returns the names of the registered engines, sorted
+func Engines() []string {
+	engines.RLock()
+	defer engines.RUnlock()
+	names := make([]string, 0, len(engines.factories))
+	for name := range engines.factories {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// newEngine creates the engine registered as opts.Engine
+func newEngine(opts Options) (Engine, error) {
+	engines.RLock()
+	factory, found := engines.factories[opts.Engine]
+	engines.RUnlock()
+	if !found {
+		return nil, fmt.Errorf("no engine is registered as %q", opts.Engine)
+	}
+	return factory(opts)
+}
+
+func init() {
+	RegisterEngine("btree", func(opts Options) (Engine, error) {
+		return BTreeEngine{Degree: opts.TreeDegree, InlineThreshold: opts.InlineThreshold}, nil
+	})
+	RegisterEngine("lsm", func(opts Options) (Engine, error) {
+		if opts.DataDir == "" {
+			return nil, errors.New("LSM trees need a data directory")
+		}
+		return LSMEngine{Dir: opts.DataDir, Options: lsm.Options{Sync: opts.Sync}}, nil
+	})
+	RegisterEngine("hash", func(opts Options) (Engine, error) {
+		if opts.DataDir == "" {
+			return nil, errors.New("hash tables need a data directory")
+		}
+		return HashEngine{}, nil
+	})
+	RegisterEngine("skiplist", func(Options) (Engine, error) {
+		return SkipListEngine{}, nil
+	})
+}
+
+// BTreeEngine holds a database in an in-memory B+ tree, which is rebuilt by
+// replaying the WAL when the database is loaded. It is the default. Values
+// longer than InlineThreshold are moved out of the tree's leaves, to overflow
+// pages in the database's buffer pool, so they can be written back to its
+// data file rather than all kept in memory.
+type BTreeEngine struct {
+	Degree          int // defaults to 10
+	InlineThreshold int // defaults to inmemory_btree.DefaultInlineThreshold
+}
+
+func (e BTreeEngine) Open(cmp store.Comparator, pool buffer.Pool) (store.Store, error) {
+	inlineThreshold := e.InlineThreshold
+	if inlineThreshold == 0 {
+		inlineThreshold = inmemory_btree.DefaultInlineThreshold
+	}
+	return inmemory_btree.NewTreeWithOverflow(e.degree(), cmp, pool, inlineThreshold), nil
+}
+
+// degree returns the degree of the trees the engine opens
+func (e BTreeEngine) degree() int {
+	if e.Degree == 0 {
+		return treeDegree
+	}
+	return e.Degree
+}
+
+func (BTreeEngine) LogsWrites() bool {
+	return false
+}
+
+// LSMEngine holds a database in an LSM tree in Dir, so it needn't fit in
+// memory. The tree logs writes to its memtable itself, so nothing is written
+// to the database's WAL, and reopening the tree is all there is to loading
+// the database.
+type LSMEngine struct {
+	Dir string
+	// Options tunes the tree. Their Comparator is ignored, in favour of the
+	// database's.
+	Options lsm.Options
+}
+
+func (e LSMEngine) Open(cmp store.Comparator, _ buffer.Pool) (store.Store, error) {
+	opts := e.Options
+	opts.Comparator = cmp
+	return lsm.Open(e.Dir, opts)
+}
+
+func (LSMEngine) LogsWrites() bool {
+	return true
+}
+
+// HashEngine holds a database in an extendible hash table, for databases
+// which are only read by key: lookups and writes cost O(1), but scans read
+// and sort the whole table. Keys must be ordered Bytewise. The table is kept
+// in the database's buffer pool, so is written to its data file, and reopened
+// from it when the database is loaded. Replaying the WAL then applies any
+// changes which hadn't been written back. If a crash left the data file
+// inconsistent, the table is started again, and the WAL, which holds every
+// write, rebuilds it.
+type HashEngine struct{}
+
+func (HashEngine) Open(cmp store.Comparator, pool buffer.Pool) (store.Store, error) {
+	if cmp.Name() != store.Bytewise.Name() {
+		return nil, errors.New("hash tables only support the bytewise comparator")
+	}
+	table, err := extendible_hash.OpenTable(pool)
+	if errors.Is(err, extendible_hash.ErrCorruptPage) {
+		log.Println("Hash table in the data file is inconsistent, rebuilding it from the WAL.")
+	}
+	if errors.Is(err, extendible_hash.ErrNoTable) || errors.Is(err, extendible_hash.ErrCorruptPage) {
+		return extendible_hash.NewTable(pool)
+	}
+	return table, err
+}
+
+func (HashEngine) LogsWrites() bool {
+	return false
+}
+
+// SkipListEngine holds a database in a skip list, whose reads never wait for
+// writers. Like the B+ tree, it is rebuilt by replaying the WAL when the
+// database is loaded.
+type SkipListEngine struct{}
+
+func (SkipListEngine) Open(cmp store.Comparator, _ buffer.Pool) (store.Store, error) {
+	return skiplist.NewSkipListWithComparator(cmp), nil
+}
+
+func (SkipListEngine) LogsWrites() bool {
+	return false
+}
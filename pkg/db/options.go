@@ -0,0 +1,111 @@
+package db
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+
+	"yadb-go/pkg/buffer"
+	"yadb-go/pkg/io"
+	"yadb-go/pkg/store"
+	"yadb-go/pkg/wal"
+)
+
+// Options configure a database opened with Open. Every field can be set from
+// configuration, engines included, which are chosen by name.
+type Options struct {
+	// Engine names the registered engine holding the database: "btree" (the
+	// default), "lsm", "hash", "skiplist", or any added with RegisterEngine
+	Engine string
+	// Comparator orders keys, defaulting to Bytewise
+	Comparator store.Comparator
+	// TreeDegree is the degree of B+ trees, defaulting to 10
+	TreeDegree int
+	// InlineThreshold is the longest value B+ trees keep in their leaves,
+	// defaulting to inmemory_btree.DefaultInlineThreshold. Longer values are
+	// moved to overflow pages in the buffer pool.
+	InlineThreshold int
+	// BufferPoolSize is the number of pages the buffer pool caching the data
+	// file holds, defaulting to buffer.MaxPoolSize. Only engines which keep
+	// data in pages, such as "hash", and "btree" for large values, use it.
+	BufferPoolSize int
+	// DataDir holds the data file, and the files of engines which keep data
+	// on disk themselves. It is created if it doesn't exist.
+	DataDir string
+	// WALPath is the database's WAL, defaulting to "wal" in DataDir
+	WALPath string
+	// Sync says when logged writes are made durable, by the database and by
+	// engines which log writes themselves
+	Sync wal.SyncMode
+	// FailOnCorruption makes opening a database whose WAL has a corrupt
+	// record before its end an error. Otherwise, everything from the corrupt
+	// record on is dropped, as an incomplete record at the end always is.
+	FailOnCorruption bool
+}
+
+const defaultEngine = "btree"
+
+// dataFileName is the file in DataDir holding the pages of the buffer pool
+const dataFileName = "data"
+
+func (opts Options) withDefaults() (Options, error) {
+	if opts.Engine == "" {
+		opts.Engine = defaultEngine
+	}
+	if opts.Comparator == nil {
+		opts.Comparator = store.Bytewise
+	}
+	if opts.BufferPoolSize < 0 {
+		return opts, errors.New("buffer pool size must be >= 0")
+	}
+	if opts.WALPath == "" {
+		if opts.DataDir == "" {
+			return opts, errors.New("a database needs a WAL path or a data directory")
+		}
+		opts.WALPath = filepath.Join(opts.DataDir, "wal")
+	}
+	return opts, nil
+}
+
+// Open opens the database configured by opts, creating it if it doesn't
+// exist. Unless the engine logs writes itself, the WAL is replayed into it.
+func Open(opts Options) (*Database, error) {
+	opts, err := opts.withDefaults()
+	if err != nil {
+		return nil, err
+	}
+	if opts.DataDir != "" {
+		if err := os.MkdirAll(opts.DataDir, 0755); err != nil {
+			return nil, err
+		}
+	}
+	engine, err := newEngine(opts)
+	if err != nil {
+		return nil, err
+	}
+
+	log := wal.NewWalFileWithOptions(opts.WALPath, wal.Options{Sync: opts.Sync, FailOnCorruption: opts.FailOnCorruption})
+	d, err := newDatabase(log, opts.Comparator, engine, newBufferPool(opts.DataDir, opts.BufferPoolSize))
+	if err != nil {
+		return nil, err
+	}
+	if err := d.replay(); err != nil {
+		return nil, err
+	}
+
+	return d, nil
+}
+
+// newBufferPool creates a pool of poolSize pages, or buffer.MaxPoolSize if it
+// is 0, caching the data file in dataDir. With no directory, pages are only
+// kept in memory.
+func newBufferPool(dataDir string, poolSize int) *buffer.BufferPool {
+	if poolSize == 0 {
+		poolSize = buffer.MaxPoolSize
+	}
+	var diskManager io.DiskManager = io.NewMemoryDiskManager()
+	if dataDir != "" {
+		diskManager = io.NewIODiskManager(filepath.Join(dataDir, dataFileName))
+	}
+	return buffer.NewBufferPoolWithSize(poolSize, diskManager)
+}
@@ -1,6 +1,9 @@
 package io
 
 import (
+	"errors"
+	"io"
+	"io/fs"
 	"log"
 	"os"
 
@@ -9,20 +12,29 @@ import (
 
 const PageSizeInBytes = 8192 // 8kB
 
+// IODiskManager keeps pages in a file, which is created when the first page
+// is written. Pages which were never written read as zeroes.
 type IODiskManager struct {
 	filename string
 }
 
+func NewIODiskManager(filename string) *IODiskManager {
+	return &IODiskManager{filename: filename}
+}
+
 func (d *IODiskManager) ReadPage(pageId PageId) ([]byte, error) {
+	data := make([]byte, PageSizeInBytes)
 	f, err := os.OpenFile(d.filename, os.O_RDONLY, 0644)
+	if errors.Is(err, fs.ErrNotExist) {
+		return data, nil
+	}
 	if err != nil {
 		log.Fatalln("Failed to open data file for reading.", err)
 	}
 	defer f.Close()
 
-	data := make([]byte, PageSizeInBytes)
 	_, err = f.ReadAt(data, int64(pageId)*PageSizeInBytes)
-	if err != nil {
+	if err != nil && err != io.EOF {
 		return nil, err
 	}
 
@@ -30,7 +42,7 @@ func (d *IODiskManager) ReadPage(pageId PageId) ([]byte, error) {
 }
 
 func (d *IODiskManager) FlushPage(pageId PageId, data []byte) error {
-	f, err := os.OpenFile(d.filename, os.O_WRONLY, 0644)
+	f, err := os.OpenFile(d.filename, os.O_WRONLY|os.O_CREATE, 0644)
 	if err != nil {
 		log.Fatalln("Failed to open data file for writing.", err)
 	}
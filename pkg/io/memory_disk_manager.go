@@ -0,0 +1,36 @@
+package io
+
+import (
+	"sync"
+
+	. "yadb-go/pkg/types"
+)
+
+// MemoryDiskManager keeps pages in memory rather than in a file. It is safe
+// for concurrent use, and is meant for tests and for stores which don't need
+// to outlive the process. Pages which were never written read as zeroes.
+type MemoryDiskManager struct {
+	mu    sync.Mutex
+	pages map[PageId][]byte
+}
+
+func NewMemoryDiskManager() *MemoryDiskManager {
+	return &MemoryDiskManager{pages: make(map[PageId][]byte)}
+}
+
+func (d *MemoryDiskManager) ReadPage(pageId PageId) ([]byte, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	data := make([]byte, PageSizeInBytes)
+	copy(data, d.pages[pageId])
+	return data, nil
+}
+
+func (d *MemoryDiskManager) FlushPage(pageId PageId, data []byte) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.pages[pageId] = append([]byte(nil), data...)
+	return nil
+}
@@ -0,0 +1,57 @@
+package store
+
+import "unsafe"
+
+// Keys and values are strings, which already hold arbitrary bytes. The []byte
+// variants below convert at the edges: writes copy the caller's slices, as a
+// store keeps them, while reads return views of the stored strings rather
+// than copies. The bytes of a view must never be modified.
+
+// GetBytes looks up a binary key, returning a read-only view of its value
+func GetBytes(s Store, key []byte) ([]byte, bool) {
+	// The key is only used for the lookup, so needn't be copied
+	pair := s.Get(unsafeString(key))
+	if pair == nil {
+		return nil, false
+	}
+	return pair.ValueBytes(), true
+}
+
+// SetBytes writes a binary key and value. Both are copied, so the caller is
+// free to reuse its slices.
+func SetBytes(s Store, key []byte, value []byte) {
+	s.Set(string(key), string(value))
+}
+
+// DeleteBytes removes a binary key. The key is copied, as a store may keep it,
+// e.g. as a tombstone, so the caller is free to reuse its slice.
+func DeleteBytes(s Store, key []byte) {
+	s.Delete(string(key))
+}
+
+// KeyBytes returns a read-only view of the pair's key
+func (kv *KeyValuePair) KeyBytes() []byte {
+	return unsafeBytes(kv.Key)
+}
+
+// ValueBytes returns a read-only view of the pair's value
+func (kv *KeyValuePair) ValueBytes() []byte {
+	return unsafeBytes(kv.Value)
+}
+
+// unsafeBytes returns the bytes of s without copying them
+func unsafeBytes(s string) []byte {
+	if s == "" {
+		return nil
+	}
+	return unsafe.Slice(unsafe.StringData(s), len(s))
+}
+
+// unsafeString returns b as a string without copying it. b must not be
+// modified while the string is in use.
+func unsafeString(b []byte) string {
+	if len(b) == 0 {
+		return ""
+	}
+	return unsafe.String(unsafe.SliceData(b), len(b))
+}
@@ -0,0 +1,185 @@
+package store
+
+import (
+	"encoding/binary"
+	"errors"
+	"strings"
+)
+
+// Comparator defines the order of keys in a store. Keys which compare equal
+// are the same key.
+type Comparator interface {
+	// Compare returns a negative number, 0 or a positive number as a is less
+	// than, equal to or greater than b
+	Compare(a, b string) int
+	// Name identifies the ordering. It is recorded with a database, which
+	// can't be reopened with a comparator of a different name, so it must not
+	// change for as long as data sorted by it exists.
+	Name() string
+	// Separator returns a key s with a < s <= b, given a < b. Trees use it for
+	// the keys in internal nodes, so the shorter s is, the better; b itself is
+	// always a valid answer.
+	Separator(a, b string) string
+}
+
+// Normalizer is implemented by comparators which can map every key to a
+// canonical spelling: Normalize returns the same bytes for keys which compare
+// equal, so they can be hashed. Every comparator here implements it.
+type Normalizer interface {
+	Normalize(key string) string
+}
+
+// Bytewise orders keys by their bytes, as strings.Compare does. It is the
+// default for every store.
+var Bytewise Comparator = bytewiseComparator{}
+
+// CaseInsensitive orders keys as Bytewise would after folding ASCII letters
+// to lower case, so "Key" and "key" are the same key. A store keeps whichever
+// spelling was written last.
+var CaseInsensitive Comparator = caseInsensitiveComparator{}
+
+// Int64Tuple orders keys made of signed 64-bit integers, each encoded as 8
+// big-endian bytes (see EncodeInt64Tuple), element by element. A single
+// integer is a tuple of one. Unlike Bytewise, negative numbers sort first.
+var Int64Tuple Comparator = int64TupleComparator{}
+
+type bytewiseComparator struct{}
+
+func (bytewiseComparator) Compare(a, b string) int {
+	return strings.Compare(a, b)
+}
+
+func (bytewiseComparator) Name() string {
+	return "yadb.Bytewise"
+}
+
+func (bytewiseComparator) Normalize(key string) string {
+	return key
+}
+
+// Separator returns the shortest prefix of b which is greater than a
+func (bytewiseComparator) Separator(a, b string) string {
+	// b can't be a prefix of a, so differs from it within its length
+	i := commonPrefixLength(a, b)
+	return strings.Clone(b[:i+1])
+}
+
+type caseInsensitiveComparator struct{}
+
+func (caseInsensitiveComparator) Compare(a, b string) int {
+	for i := 0; i < len(a) && i < len(b); i++ {
+		ca, cb := lowerASCII(a[i]), lowerASCII(b[i])
+		if ca != cb {
+			if ca < cb {
+				return -1
+			}
+			return 1
+		}
+	}
+	return len(a) - len(b)
+}
+
+func (caseInsensitiveComparator) Name() string {
+	return "yadb.CaseInsensitive"
+}
+
+// Normalize folds ASCII letters to lower case
+func (caseInsensitiveComparator) Normalize(key string) string {
+	var folded []byte
+	for i := 0; i < len(key); i++ {
+		if c := lowerASCII(key[i]); c != key[i] {
+			if folded == nil {
+				folded = []byte(key)
+			}
+			folded[i] = c
+		}
+	}
+	if folded == nil {
+		return key
+	}
+	return string(folded)
+}
+
+func (caseInsensitiveComparator) Separator(_, b string) string {
+	return b
+}
+
+func lowerASCII(c byte) byte {
+	if 'A' <= c && c <= 'Z' {
+		return c + 'a' - 'A'
+	}
+	return c
+}
+
+type int64TupleComparator struct{}
+
+func (int64TupleComparator) Compare(a, b string) int {
+	for len(a) >= 8 && len(b) >= 8 {
+		x, y := int64(binary.BigEndian.Uint64([]byte(a[:8]))), int64(binary.BigEndian.Uint64([]byte(b[:8])))
+		if x != y {
+			if x < y {
+				return -1
+			}
+			return 1
+		}
+		a, b = a[8:], b[8:]
+	}
+	// One tuple is a prefix of the other, or a key isn't a whole number of
+	// elements, in which case the remainder is compared bytewise
+	return strings.Compare(a, b)
+}
+
+func (int64TupleComparator) Name() string {
+	return "yadb.Int64Tuple"
+}
+
+// Normalize returns the key unchanged: each element has a single encoding,
+// and any remainder is compared bytewise, so equal keys have equal bytes
+func (int64TupleComparator) Normalize(key string) string {
+	return key
+}
+
+// Separator returns b cut short after the first element in which it differs
+// from a
+func (c int64TupleComparator) Separator(a, b string) string {
+	for i := 8; i <= len(b); i += 8 {
+		if c.Compare(a, b[:i]) < 0 {
+			return strings.Clone(b[:i])
+		}
+	}
+	return b
+}
+
+// EncodeInt64Tuple encodes integers as a key ordered by Int64Tuple
+func EncodeInt64Tuple(values ...int64) string {
+	key := make([]byte, 0, 8*len(values))
+	for _, value := range values {
+		key = binary.BigEndian.AppendUint64(key, uint64(value))
+	}
+	return string(key)
+}
+
+// DecodeInt64Tuple decodes a key encoded by EncodeInt64Tuple
+func DecodeInt64Tuple(key string) ([]int64, error) {
+	if len(key)%8 != 0 {
+		return nil, errors.New("key is not a whole number of 8 byte integers")
+	}
+	values := make([]int64, 0, len(key)/8)
+	for ; len(key) > 0; key = key[8:] {
+		values = append(values, int64(binary.BigEndian.Uint64([]byte(key[:8]))))
+	}
+	return values, nil
+}
+
+func commonPrefixLength(a, b string) int {
+	n := len(a)
+	if len(b) < n {
+		n = len(b)
+	}
+	for i := 0; i < n; i++ {
+		if a[i] != b[i] {
+			return i
+		}
+	}
+	return n
+}
@@ -0,0 +1,101 @@
+package store
+
+import (
+	"math"
+	"testing"
+)
+
+func TestBytewiseSeparator(t *testing.T) {
+	cases := []struct{ lower, upper, expected string }{
+		{"tenant/1/order/19", "tenant/1/order/20", "tenant/1/order/2"},
+		{"tenant/1/order/99", "tenant/2/order/00", "tenant/2"},
+		{"abc", "abcd", "abcd"},
+		{"", "a", "a"},
+		{"a", "b", "b"},
+	}
+	for _, c := range cases {
+		separator := Bytewise.Separator(c.lower, c.upper)
+		if separator != c.expected {
+			t.Fatalf("Separator(%q, %q) = %q, expected %q", c.lower, c.upper, separator, c.expected)
+		}
+		assertSeparates(t, Bytewise, c.lower, separator, c.upper)
+	}
+}
+
+func TestCaseInsensitive(t *testing.T) {
+	if CaseInsensitive.Compare("Key", "kEY") != 0 {
+		t.Fatalf("Expected keys differing only in case to be equal")
+	}
+	if CaseInsensitive.Compare("apple", "Banana") >= 0 || CaseInsensitive.Compare("KEY", "key2") >= 0 {
+		t.Fatalf("Expected keys to be ordered ignoring case")
+	}
+	// Letters are folded to lower case, so sort after '_'
+	if CaseInsensitive.Compare("_", "Z") >= 0 {
+		t.Fatalf("Expected '_' to sort before 'Z'")
+	}
+}
+
+func TestNormalize(t *testing.T) {
+	cases := []struct {
+		cmp        Comparator
+		key, equal string
+	}{
+		{Bytewise, "key", "key"},
+		{CaseInsensitive, "Tenant/KEY_1", "tenant/key_1"},
+		{CaseInsensitive, "lower", "lower"},
+		{Int64Tuple, EncodeInt64Tuple(-1, 2), EncodeInt64Tuple(-1, 2)},
+	}
+	for _, c := range cases {
+		n := c.cmp.(Normalizer)
+		if c.cmp.Compare(c.key, c.equal) != 0 || n.Normalize(c.key) != n.Normalize(c.equal) {
+			t.Fatalf("Expected %q and %q to normalize alike under %s", c.key, c.equal, c.cmp.Name())
+		}
+	}
+	if CaseInsensitive.(Normalizer).Normalize("Key") != "key" {
+		t.Fatalf("Expected keys to be normalized to lower case")
+	}
+}
+
+func TestInt64Tuple(t *testing.T) {
+	ordered := []string{
+		EncodeInt64Tuple(math.MinInt64),
+		EncodeInt64Tuple(-1),
+		EncodeInt64Tuple(-1, 5),
+		EncodeInt64Tuple(0),
+		EncodeInt64Tuple(1, -100),
+		EncodeInt64Tuple(1, 0),
+		EncodeInt64Tuple(1, 0) + "a",
+		EncodeInt64Tuple(256),
+		EncodeInt64Tuple(math.MaxInt64),
+	}
+	for i := 1; i < len(ordered); i++ {
+		if Int64Tuple.Compare(ordered[i-1], ordered[i]) >= 0 || Int64Tuple.Compare(ordered[i], ordered[i-1]) <= 0 {
+			t.Fatalf("Expected key %d to sort before key %d", i-1, i)
+		}
+		separator := Int64Tuple.Separator(ordered[i-1], ordered[i])
+		assertSeparates(t, Int64Tuple, ordered[i-1], separator, ordered[i])
+	}
+
+	separator := Int64Tuple.Separator(EncodeInt64Tuple(1, 2, 3), EncodeInt64Tuple(2, 0, 0))
+	if separator != EncodeInt64Tuple(2) {
+		t.Fatalf("Expected the separator to be cut after the first element")
+	}
+}
+
+func TestInt64Tuple__encodeDecode(t *testing.T) {
+	values, err := DecodeInt64Tuple(EncodeInt64Tuple(-7, 0, math.MaxInt64))
+	if err != nil || len(values) != 3 || values[0] != -7 || values[1] != 0 || values[2] != math.MaxInt64 {
+		t.Fatalf("Expected the tuple to round trip, found %v, %v", values, err)
+	}
+
+	if _, err = DecodeInt64Tuple("short"); err == nil {
+		t.Fatalf("Expected an error decoding a key which isn't a whole number of integers")
+	}
+}
+
+func assertSeparates(t *testing.T, cmp Comparator, lower, separator, upper string) {
+	t.Helper()
+	if !(cmp.Compare(lower, separator) < 0 && cmp.Compare(separator, upper) <= 0) {
+		t.Fatalf("Separator %q does not lie in (%q, %q]", separator, lower, upper)
+	}
+}
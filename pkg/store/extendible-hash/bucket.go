@@ -0,0 +1,134 @@
+package extendible_hash
+
+import (
+	"encoding/binary"
+
+	. "yadb-go/pkg/store"
+	. "yadb-go/pkg/types"
+)
+
+// Bucket layout
+//
+//	entry: uvarint key length | key | uvarint value length | value
+//
+// Entries are in no particular order. A bucket is split once its entries
+// outgrow a page, unless that can't help: the bucket holds a single pair, too
+// large for a page by itself, or the directory can't grow any further. Then
+// its chain grows instead.
+
+const bucketCapacity = chainChunkSize
+
+// bucket is the pairs held in a bucket, and the chain of pages holding them
+type bucket struct {
+	pageIds []PageId
+	pairs   []KeyValuePair
+}
+
+func (b *bucket) head() PageId {
+	return b.pageIds[0]
+}
+
+// put sets the value for key
+func (b *bucket) put(key string, value string) {
+	for i := range b.pairs {
+		if b.pairs[i].Key == key {
+			b.pairs[i].Value = value
+			return
+		}
+	}
+	b.pairs = append(b.pairs, KeyValuePair{Key: key, Value: value})
+}
+
+// remove removes key, reporting whether it was there
+func (b *bucket) remove(key string) bool {
+	for i := range b.pairs {
+		if b.pairs[i].Key == key {
+			b.pairs[i] = b.pairs[len(b.pairs)-1]
+			b.pairs = b.pairs[:len(b.pairs)-1]
+			return true
+		}
+	}
+	return false
+}
+
+func (b *bucket) size() int {
+	size := 0
+	for _, pair := range b.pairs {
+		size += uvarintLen(len(pair.Key)) + len(pair.Key) + uvarintLen(len(pair.Value)) + len(pair.Value)
+	}
+	return size
+}
+
+func encodePairs(pairs []KeyValuePair) []byte {
+	data := make([]byte, 0)
+	for _, pair := range pairs {
+		data = binary.AppendUvarint(data, uint64(len(pair.Key)))
+		data = append(data, pair.Key...)
+		data = binary.AppendUvarint(data, uint64(len(pair.Value)))
+		data = append(data, pair.Value...)
+	}
+	return data
+}
+
+// decodePairs decodes the entries of a bucket. The keys and values share
+// data's memory.
+func decodePairs(data string) ([]KeyValuePair, error) {
+	pairs := make([]KeyValuePair, 0)
+	for len(data) > 0 {
+		var pair KeyValuePair
+		var ok bool
+		if pair.Key, data, ok = readString(data); !ok {
+			return nil, ErrCorruptPage
+		}
+		if pair.Value, data, ok = readString(data); !ok {
+			return nil, ErrCorruptPage
+		}
+		pairs = append(pairs, pair)
+	}
+	return pairs, nil
+}
+
+// findPair looks for key in the entries of a bucket, without decoding the
+// others
+func findPair(data string, key string) (*KeyValuePair, error) {
+	for len(data) > 0 {
+		k, rest, ok := readString(data)
+		if !ok {
+			return nil, ErrCorruptPage
+		}
+		value, rest, ok := readString(rest)
+		if !ok {
+			return nil, ErrCorruptPage
+		}
+		if k == key {
+			return &KeyValuePair{Key: k, Value: value}, nil
+		}
+		data = rest
+	}
+	return nil, nil
+}
+
+// readString reads a uvarint length, then that many bytes
+func readString(data string) (string, string, bool) {
+	length := uint64(0)
+	for i, shift := 0, uint(0); i < len(data) && i < binary.MaxVarintLen64; i, shift = i+1, shift+7 {
+		b := data[i]
+		length |= uint64(b&0x7f) << shift
+		if b < 0x80 {
+			data = data[i+1:]
+			if length > uint64(len(data)) {
+				return "", "", false
+			}
+			return data[:length], data[length:], true
+		}
+	}
+	return "", "", false
+}
+
+func uvarintLen(n int) int {
+	length := 1
+	for ; n >= 0x80; n >>= 7 {
+		length++
+	}
+	return length
+}
@@ -0,0 +1,515 @@
+// Package extendible_hash implements a Store as an extendible hash table held
+// in pages, for tables which are only read by key.
+//
+// A directory of 2^global depth entries maps the low bits of a key's hash to
+// the bucket holding it. Each bucket is told apart by the low local depth
+// bits of its keys' hashes, so 2^(global depth - local depth) entries share
+// it. A bucket which outgrows its page is split in two by the next bit,
+// doubling the directory first if its local depth is already the global
+// depth. A bucket emptied by deletes is merged back into the bucket it was
+// split from, and the directory halves once no bucket needs all of it.
+//
+// Lookups, writes and deletes read a single bucket. The ordered parts of the
+// Store interface (iterators, First, Floor and so on) have to read every
+// bucket, so cost O(n), or O(n log n) to sort; pick a B+ tree for tables
+// which need them.
+package extendible_hash
+
+import (
+	"encoding/binary"
+	"fmt"
+	"log"
+	"sort"
+	"sync"
+
+	"yadb-go/pkg/buffer"
+	. "yadb-go/pkg/store"
+	. "yadb-go/pkg/types"
+)
+
+// maxGlobalDepth bounds the directory, at 2^20 entries
+const maxGlobalDepth = 20
+
+// bucketRef is a directory entry
+type bucketRef struct {
+	head       PageId // the first page of the bucket's chain
+	localDepth uint8
+}
+
+// Table is a Store held in an extendible hash table. Keys are compared by
+// their bytes. It is safe for concurrent use: reads share a lock, and writes
+// take it exclusively.
+type Table struct {
+	mu             sync.RWMutex
+	pages          *pageStore
+	globalDepth    uint32
+	directory      []bucketRef
+	directoryPages []PageId
+	metaNextPage   PageId // nextPage as last recorded in the meta page
+}
+
+// NewTable creates an empty table in pool, which must not hold another.
+// Page 0 is the meta page, through which the table can be reopened.
+func NewTable(pool buffer.Pool) (*Table, error) {
+	t := &Table{pages: newPageStore(pool)}
+	pageIds, err := t.pages.writeChain(nil, nil, 0)
+	if err != nil {
+		return nil, err
+	}
+	t.directory = []bucketRef{{head: pageIds[0]}}
+	if err := t.writeDirectory(0); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// OpenTable opens the table created in pool by NewTable. It returns
+// ErrNoTable if the pool's meta page was never written, and ErrCorruptPage if
+// its pages don't hold a consistent table, which a crash can leave behind.
+func OpenTable(pool buffer.Pool) (*Table, error) {
+	t := &Table{pages: newPageStore(pool)}
+	m, err := t.pages.readMeta()
+	if err != nil {
+		return nil, err
+	}
+	t.globalDepth = m.globalDepth
+	t.pages.nextPage, t.metaNextPage = m.nextPage, m.nextPage
+
+	data, pageIds, err := t.pages.readChain(m.directoryHead)
+	if err != nil {
+		return nil, err
+	}
+	t.directoryPages = pageIds
+	if len(data) != 9<<t.globalDepth {
+		return nil, ErrCorruptPage
+	}
+	t.directory = make([]bucketRef, 1<<t.globalDepth)
+	for i := range t.directory {
+		entry := []byte(data[i*9 : (i+1)*9])
+		t.directory[i] = bucketRef{head: PageId(binary.LittleEndian.Uint64(entry)), localDepth: entry[8]}
+	}
+
+	// Any page not in a chain is free
+	used := make(map[PageId]bool)
+	for _, pageId := range t.directoryPages {
+		used[pageId] = true
+	}
+	for _, ref := range t.directory {
+		if used[ref.head] {
+			continue
+		}
+		b, err := t.readBucket(ref.head)
+		if err != nil {
+			return nil, err
+		}
+		for _, pageId := range b.pageIds {
+			used[pageId] = true
+		}
+	}
+	for pageId := metaPage + 1; pageId < t.pages.nextPage; pageId++ {
+		if !used[pageId] {
+			t.pages.free = append(t.pages.free, pageId)
+		}
+	}
+	return t, nil
+}
+
+// hashKey hashes a key with 64-bit FNV-1a
+func hashKey(key string) uint64 {
+	h := uint64(14695981039346656037)
+	for i := 0; i < len(key); i++ {
+		h ^= uint64(key[i])
+		h *= 1099511628211
+	}
+	return h
+}
+
+// index returns the directory entry for a hash
+func (t *Table) index(h uint64) int {
+	return int(h & (1<<t.globalDepth - 1))
+}
+
+func (t *Table) readBucket(head PageId) (*bucket, error) {
+	data, pageIds, err := t.pages.readChain(head)
+	if err != nil {
+		return nil, err
+	}
+	pairs, err := decodePairs(data)
+	if err != nil {
+		return nil, err
+	}
+	return &bucket{pageIds: pageIds, pairs: pairs}, nil
+}
+
+func (t *Table) writeBucket(b *bucket, lsn LSN) error {
+	pageIds, err := t.pages.writeChain(b.pageIds, encodePairs(b.pairs), lsn)
+	b.pageIds = pageIds
+	return err
+}
+
+// writeDirectory writes the directory to fresh pages, then switches the meta
+// page to them, and only then frees the pages of the old directory
+func (t *Table) writeDirectory(lsn LSN) error {
+	data := make([]byte, 0, 9*len(t.directory))
+	for _, ref := range t.directory {
+		data = binary.LittleEndian.AppendUint64(data, uint64(ref.head))
+		data = append(data, ref.localDepth)
+	}
+	pageIds, err := t.pages.writeChain(nil, data, lsn)
+	if err != nil {
+		return err
+	}
+	old := t.directoryPages
+	t.directoryPages = pageIds
+	if err := t.writeMeta(lsn); err != nil {
+		return err
+	}
+	t.pages.release(old)
+	return nil
+}
+
+func (t *Table) writeMeta(lsn LSN) error {
+	m := meta{globalDepth: t.globalDepth, nextPage: t.pages.nextPage, directoryHead: t.directoryPages[0]}
+	if err := t.pages.writeMeta(m, lsn); err != nil {
+		return err
+	}
+	t.metaNextPage = m.nextPage
+	return nil
+}
+
+// Get returns the pair for a key, or nil if it doesn't exist
+func (t *Table) Get(key string) *KeyValuePair {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	data, _, err := t.pages.readChain(t.directory[t.index(hashKey(key))].head)
+	if err != nil {
+		log.Fatalln("Failed to read hash table bucket.", err)
+	}
+	pair, err := findPair(data, key)
+	if err != nil {
+		log.Fatalln("Failed to read hash table bucket.", err)
+	}
+	return pair
+}
+
+// Set writes a key-value pair, overwriting any existing value for the key
+func (t *Table) Set(key string, value string) {
+	t.SetLogged(key, value, 0)
+}
+
+// SetLogged is Set, for a write logged at lsn
+func (t *Table) SetLogged(key string, value string, lsn LSN) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if err := t.set(key, value, lsn); err != nil {
+		log.Fatalln("Failed to write to hash table.", err)
+	}
+}
+
+func (t *Table) set(key string, value string, lsn LSN) error {
+	h := hashKey(key)
+	i := t.index(h)
+	b, err := t.readBucket(t.directory[i].head)
+	if err != nil {
+		return err
+	}
+	b.put(key, value)
+
+	split := false
+	for t.needsSplit(i, b) {
+		if b, err = t.split(i, b, h, lsn); err != nil {
+			return err
+		}
+		i, split = t.index(h), true
+	}
+	if split {
+		err = t.writeDirectory(lsn)
+	} else if err = t.writeBucket(b, lsn); err == nil && t.pages.nextPage != t.metaNextPage {
+		err = t.writeMeta(lsn)
+	}
+	return err
+}
+
+// needsSplit reports whether the bucket at directory entry i has outgrown its
+// page, and splitting it could help
+func (t *Table) needsSplit(i int, b *bucket) bool {
+	return b.size() > bucketCapacity && len(b.pairs) > 1 && t.directory[i].localDepth < maxGlobalDepth
+}
+
+// split divides the bucket at directory entry i in two, by the next bit of
+// its keys' hashes, and writes both halves. If the bucket already uses as
+// many bits as the directory, the directory is doubled first. It returns the
+// half which hash h falls in.
+func (t *Table) split(i int, b *bucket, h uint64, lsn LSN) (*bucket, error) {
+	ref := t.directory[i]
+	if uint32(ref.localDepth) == t.globalDepth {
+		t.directory = append(t.directory, t.directory...)
+		t.globalDepth++
+	}
+
+	depth := ref.localDepth + 1
+	bit := uint64(1) << (depth - 1)
+	low, high := &bucket{pageIds: b.pageIds}, &bucket{}
+	for _, pair := range b.pairs {
+		if hashKey(pair.Key)&bit != 0 {
+			high.pairs = append(high.pairs, pair)
+		} else {
+			low.pairs = append(low.pairs, pair)
+		}
+	}
+	if err := t.writeBucket(low, lsn); err != nil {
+		return nil, err
+	}
+	if err := t.writeBucket(high, lsn); err != nil {
+		return nil, err
+	}
+
+	for j, entry := range t.directory {
+		if entry.head != ref.head {
+			continue
+		}
+		if uint64(j)&bit != 0 {
+			t.directory[j] = bucketRef{head: high.head(), localDepth: depth}
+		} else {
+			t.directory[j].localDepth = depth
+		}
+	}
+
+	if h&bit != 0 {
+		return high, nil
+	}
+	return low, nil
+}
+
+// Delete removes a key
+func (t *Table) Delete(key string) {
+	t.DeleteLogged(key, 0)
+}
+
+// DeleteLogged is Delete, for a delete logged at lsn
+func (t *Table) DeleteLogged(key string, lsn LSN) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if err := t.delete(key, lsn); err != nil {
+		log.Fatalln("Failed to delete from hash table.", err)
+	}
+}
+
+func (t *Table) delete(key string, lsn LSN) error {
+	i := t.index(hashKey(key))
+	b, err := t.readBucket(t.directory[i].head)
+	if err != nil {
+		return err
+	}
+	if !b.remove(key) {
+		return nil
+	}
+	if len(b.pairs) == 0 && t.merge(i, b) {
+		return t.writeDirectory(lsn)
+	}
+	return t.writeBucket(b, lsn)
+}
+
+// merge folds the empty bucket at directory entry i into the bucket it was
+// split from, if that hasn't been split further since, and halves the
+// directory for as long as no bucket uses every bit of it. It reports
+// whether it did anything.
+func (t *Table) merge(i int, b *bucket) bool {
+	ref := t.directory[i]
+	if ref.localDepth == 0 {
+		return false
+	}
+	bit := 1 << (ref.localDepth - 1)
+	image := t.directory[i^bit]
+	if image.localDepth != ref.localDepth {
+		return false
+	}
+
+	t.pages.release(b.pageIds)
+	for j, entry := range t.directory {
+		if entry.head == ref.head || entry.head == image.head {
+			t.directory[j] = bucketRef{head: image.head, localDepth: ref.localDepth - 1}
+		}
+	}
+
+	for t.globalDepth > 0 && !t.needsFullDirectory() {
+		t.directory = t.directory[:len(t.directory)/2]
+		t.globalDepth--
+	}
+	return true
+}
+
+func (t *Table) needsFullDirectory() bool {
+	for _, ref := range t.directory {
+		if uint32(ref.localDepth) == t.globalDepth {
+			return true
+		}
+	}
+	return false
+}
+
+// buckets calls visit with the pairs of each bucket in turn
+func (t *Table) buckets(visit func(pairs []KeyValuePair)) {
+	for i, ref := range t.directory {
+		// Each bucket first appears at the entry numbered by its own bits
+		if i >= 1<<ref.localDepth {
+			continue
+		}
+		b, err := t.readBucket(ref.head)
+		if err != nil {
+			log.Fatalln("Failed to read hash table bucket.", err)
+		}
+		visit(b.pairs)
+	}
+}
+
+// sortedPairs returns every pair in the table, in key order
+func (t *Table) sortedPairs() []KeyValuePair {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	all := make([]KeyValuePair, 0)
+	t.buckets(func(pairs []KeyValuePair) {
+		all = append(all, pairs...)
+	})
+	sort.Slice(all, func(i, j int) bool { return all[i].Key < all[j].Key })
+	return all
+}
+
+// NewIterator returns an iterator over the pairs in the range described by
+// opts, in key order. The table is read and sorted up front, so the iterator
+// doesn't see later writes.
+func (t *Table) NewIterator(opts ScanOptions) Iterator {
+	return NewSliceIteratorWithOptions(t.sortedPairs(), opts)
+}
+
+// ScanPrefix returns an iterator over the keys starting with prefix
+func (t *Table) ScanPrefix(prefix string) Iterator {
+	return t.NewIterator(ScanOptions{Prefix: prefix})
+}
+
+// nearest returns the pair whose key is best by better among those which
+// match, or nil if none do
+func (t *Table) nearest(match func(key string) bool, better func(a, b string) bool) *KeyValuePair {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	var best *KeyValuePair
+	t.buckets(func(pairs []KeyValuePair) {
+		for i := range pairs {
+			if match(pairs[i].Key) && (best == nil || better(pairs[i].Key, best.Key)) {
+				best = &pairs[i]
+			}
+		}
+	})
+	return best
+}
+
+func less(a, b string) bool {
+	return a < b
+}
+
+func greater(a, b string) bool {
+	return a > b
+}
+
+// First returns the pair with the smallest key, or nil if the table is empty
+func (t *Table) First() *KeyValuePair {
+	return t.nearest(func(string) bool { return true }, less)
+}
+
+// Last returns the pair with the largest key, or nil if the table is empty
+func (t *Table) Last() *KeyValuePair {
+	return t.nearest(func(string) bool { return true }, greater)
+}
+
+// Floor returns the pair with the largest key <= key, or nil if there is none
+func (t *Table) Floor(key string) *KeyValuePair {
+	return t.nearest(func(k string) bool { return k <= key }, greater)
+}
+
+// Ceiling returns the pair with the smallest key >= key, or nil if there is none
+func (t *Table) Ceiling(key string) *KeyValuePair {
+	return t.nearest(func(k string) bool { return k >= key }, less)
+}
+
+// Stats describes the shape of a table
+type Stats struct {
+	GlobalDepth int
+	Buckets     int
+	Keys        int
+	// Pages counts the pages holding the directory and buckets, but not the
+	// meta page
+	Pages int
+}
+
+// Stats reads every bucket, and reports the shape of the table
+func (t *Table) Stats() Stats {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	stats := Stats{GlobalDepth: int(t.globalDepth), Pages: len(t.directoryPages)}
+	for i, ref := range t.directory {
+		if i >= 1<<ref.localDepth {
+			continue
+		}
+		b, err := t.readBucket(ref.head)
+		if err != nil {
+			log.Fatalln("Failed to read hash table bucket.", err)
+		}
+		stats.Buckets++
+		stats.Keys += len(b.pairs)
+		stats.Pages += len(b.pageIds)
+	}
+	return stats
+}
+
+// Validate checks that every directory entry agrees with the others sharing
+// its bucket, and every key is in the bucket its hash leads to
+func (t *Table) Validate() error {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	if len(t.directory) != 1<<t.globalDepth {
+		return fmt.Errorf("directory has %d entries, expected %d for global depth %d", len(t.directory), 1<<t.globalDepth, t.globalDepth)
+	}
+	for i, ref := range t.directory {
+		if uint32(ref.localDepth) > t.globalDepth {
+			return fmt.Errorf("entry %d has local depth %d > global depth %d", i, ref.localDepth, t.globalDepth)
+		}
+		// Entries sharing a bucket are those which agree in its low bits
+		first := i & (1<<ref.localDepth - 1)
+		if t.directory[first] != ref {
+			return fmt.Errorf("entry %d points to page %d at depth %d, but entry %d to page %d at depth %d", i, ref.head, ref.localDepth, first, t.directory[first].head, t.directory[first].localDepth)
+		}
+		if i != first {
+			continue
+		}
+
+		b, err := t.readBucket(ref.head)
+		if err != nil {
+			return err
+		}
+		for _, pair := range b.pairs {
+			if int(hashKey(pair.Key)&(1<<ref.localDepth-1)) != first {
+				return fmt.Errorf("key %q is in the bucket for entry %d, which its hash doesn't lead to", pair.Key, i)
+			}
+		}
+		if t.needsSplit(i, b) && !sameHash(b.pairs) {
+			return fmt.Errorf("bucket for entry %d holds %d bytes, but wasn't split", i, b.size())
+		}
+	}
+	return nil
+}
+
+// sameHash reports whether every key has the same hash, so couldn't be split
+// between buckets
+func sameHash(pairs []KeyValuePair) bool {
+	for _, pair := range pairs[1:] {
+		if hashKey(pair.Key) != hashKey(pairs[0].Key) {
+			return false
+		}
+	}
+	return true
+}
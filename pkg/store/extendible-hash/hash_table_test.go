@@ -0,0 +1,233 @@
+package extendible_hash
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"yadb-go/pkg/buffer"
+	"yadb-go/pkg/io"
+	. "yadb-go/pkg/store"
+	"yadb-go/pkg/store/storetest"
+	. "yadb-go/pkg/types"
+)
+
+// newTable creates a table in a pool of poolSize frames, over an in-memory
+// disk
+func newTable(poolSize int) *Table {
+	table, err := NewTable(buffer.NewBufferPoolWithSize(poolSize, io.NewMemoryDiskManager()))
+	if err != nil {
+		panic(err)
+	}
+	return table
+}
+
+func key(i int) string {
+	return fmt.Sprintf("key%05d", i)
+}
+
+func validate(t *testing.T, table *Table) {
+	t.Helper()
+	if err := table.Validate(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Check the table against a map, over random sequences of operations
+func TestModel(t *testing.T) {
+	storetest.CheckRandom(t, func() Store { return newTable(64) }, 10, 2000)
+
+	// A pool of a few frames makes every operation go to disk
+	t.Run("small pool", func(t *testing.T) {
+		storetest.CheckRandom(t, func() Store { return newTable(4) }, 5, 1000)
+	})
+}
+
+func FuzzTable(f *testing.F) {
+	storetest.Fuzz(f, func() Store { return newTable(16) })
+}
+
+func TestSplit(t *testing.T) {
+	table := newTable(64)
+	value := strings.Repeat("v", 100)
+	for i := 0; i < 1000; i++ {
+		table.Set(key(i), value)
+	}
+	validate(t, table)
+
+	// 1000 pairs of ~110 bytes need at least 14 buckets of a page each
+	stats := table.Stats()
+	if stats.Keys != 1000 || stats.Buckets < 14 || stats.GlobalDepth < 4 {
+		t.Fatalf("Expected 1000 keys split over at least 14 buckets, found %+v", stats)
+	}
+	if stats.Buckets > 1<<stats.GlobalDepth {
+		t.Fatalf("Expected at most one bucket per directory entry, found %+v", stats)
+	}
+	for i := 0; i < 1000; i++ {
+		if pair := table.Get(key(i)); pair == nil || pair.Value != value {
+			t.Fatalf("Expected to find %s, found %v", key(i), pair)
+		}
+	}
+	if pair := table.Get("missing"); pair != nil {
+		t.Fatalf("Expected missing not to be found, found %v", pair)
+	}
+}
+
+func TestMerge(t *testing.T) {
+	table := newTable(64)
+	value := strings.Repeat("v", 100)
+	for i := 0; i < 1000; i++ {
+		table.Set(key(i), value)
+	}
+	pages := table.Stats().Pages
+
+	for i := 0; i < 1000; i++ {
+		table.Delete(key(i))
+		if i%100 == 0 {
+			validate(t, table)
+		}
+	}
+	validate(t, table)
+	stats := table.Stats()
+	if stats.Keys != 0 || stats.Buckets >= 14 {
+		t.Fatalf("Expected emptied buckets to be merged, found %+v", stats)
+	}
+
+	// Freed pages are reused, rather than new ones allocated
+	nextPage := table.pages.nextPage
+	for i := 0; i < 1000; i++ {
+		table.Set(key(i), value)
+	}
+	validate(t, table)
+	if stats := table.Stats(); stats.Pages != pages || table.pages.nextPage != nextPage {
+		t.Fatalf("Expected %d pages to be reused, found %+v and page %d allocated", pages, stats, table.pages.nextPage)
+	}
+}
+
+func TestLargeValues(t *testing.T) {
+	table := newTable(16)
+	large := strings.Repeat("0123456789", buffer.PageSizeInBytes/4)
+
+	for i := 0; i < 20; i++ {
+		table.Set(key(i), fmt.Sprint(i)+large)
+	}
+	validate(t, table)
+	for i := 0; i < 20; i++ {
+		if pair := table.Get(key(i)); pair == nil || pair.Value != fmt.Sprint(i)+large {
+			t.Fatalf("Expected to read back the large value of %s", key(i))
+		}
+	}
+
+	// Values spanning several pages give them back once overwritten
+	for i := 0; i < 20; i++ {
+		table.Set(key(i), "small")
+	}
+	validate(t, table)
+	if stats := table.Stats(); stats.Pages != stats.Buckets+1 {
+		t.Fatalf("Expected a page per bucket and one for the directory, found %+v", stats)
+	}
+}
+
+func TestReopen(t *testing.T) {
+	diskManager := io.NewMemoryDiskManager()
+	pool := buffer.NewBufferPoolWithSize(16, diskManager)
+	table, err := NewTable(pool)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 1000; i++ {
+		table.Set(key(i), fmt.Sprintf("value%d", i))
+	}
+	for i := 0; i < 1000; i += 3 {
+		table.Delete(key(i))
+	}
+	before := table.Stats()
+	for _, page := range pool.DirtyPages() {
+		if err := pool.FlushPage(page.PageId); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	table, err = OpenTable(buffer.NewBufferPoolWithSize(16, diskManager))
+	if err != nil {
+		t.Fatalf("Failed to reopen table: %v", err)
+	}
+	validate(t, table)
+	if after := table.Stats(); after != before {
+		t.Fatalf("Expected the reopened table to match, found %+v, expected %+v", after, before)
+	}
+	count := 0
+	for it := table.NewIterator(ScanOptions{}); it.Valid(); it.Next() {
+		if it.Value() != fmt.Sprintf("value%d", keyIndex(it.Key())) {
+			t.Fatalf("Expected %s to keep its value, found %s", it.Key(), it.Value())
+		}
+		count++
+	}
+	if count != 666 {
+		t.Fatalf("Expected 666 keys, found %d", count)
+	}
+}
+
+func keyIndex(key string) int {
+	var i int
+	fmt.Sscanf(key, "key%d", &i)
+	return i
+}
+
+func TestOpenTable__empty(t *testing.T) {
+	if _, err := OpenTable(buffer.NewBufferPoolWithSize(4, io.NewMemoryDiskManager())); err != ErrNoTable {
+		t.Fatalf("Expected a pool without a table not to open, found %v", err)
+	}
+}
+
+func TestSetLogged__marksPagesWithTheLSN(t *testing.T) {
+	pool := buffer.NewBufferPoolWithSize(64, io.NewMemoryDiskManager())
+	table, err := NewTable(pool)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, page := range pool.DirtyPages() {
+		if err := pool.FlushPage(page.PageId); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Enough writes to split buckets, rewriting the directory and meta page
+	for i := 0; i < 1000; i++ {
+		table.SetLogged(key(i), strings.Repeat("v", 20), LSN(100+i))
+	}
+	dirty := pool.DirtyPages()
+	if len(dirty) == 0 {
+		t.Fatal("Expected logged writes to dirty pages")
+	}
+	for _, page := range dirty {
+		if page.RecLSN < 100 {
+			t.Fatalf("Expected page %d to be marked with a logged write's LSN, found %d", page.PageId, page.RecLSN)
+		}
+	}
+}
+
+func TestOpenTable__metaWrittenBackWithoutTheDirectory(t *testing.T) {
+	diskManager := io.NewMemoryDiskManager()
+	pool := buffer.NewBufferPoolWithSize(64, diskManager)
+	table, err := NewTable(pool)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, page := range pool.DirtyPages() {
+		if err := pool.FlushPage(page.PageId); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := 0; i < 1000; i++ {
+		table.Set(key(i), strings.Repeat("v", 20))
+	}
+
+	// A crash after only the meta page was written back
+	if err := pool.FlushPage(metaPage); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := OpenTable(buffer.NewBufferPoolWithSize(64, diskManager)); err != ErrCorruptPage {
+		t.Fatalf("Expected the table not to open, found %v", err)
+	}
+}
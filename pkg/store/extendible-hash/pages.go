@@ -0,0 +1,204 @@
+package extendible_hash
+
+import (
+	"encoding/binary"
+	"errors"
+	"strings"
+
+	"yadb-go/pkg/buffer"
+	. "yadb-go/pkg/types"
+)
+
+// Page chains
+//
+// The directory and every bucket are stored as a chain of one or more pages,
+// so none has to fit in a page. Each page holds the id of the next page in
+// the chain (0 at the end), the number of bytes it holds, then those bytes.
+//
+// Page 0 is the meta page, which locates the directory:
+//
+//	magic uint64 | global depth uint32 | next page uint64 | directory head uint64
+//
+// The directory is never rewritten in place. Each new version goes to fresh
+// pages, and only becomes the table's once the meta page points to it, so
+// the meta page and the directory always agree in the pool. Pages are
+// written back in no particular order though, so after a crash they may not
+// on disk; OpenTable then returns ErrCorruptPage.
+//
+// Every page is written with the LSN of the logged write it is part of (0 if
+// it wasn't logged), so checkpoints know when it must be written back.
+
+const chainHeaderSize = 8 + 4
+const chainChunkSize = buffer.PageSizeInBytes - chainHeaderSize
+
+const metaPage PageId = 0
+const metaMagic = 0x7961646268617368 // "yadbhash"
+
+// noPage ends a chain. It is the meta page, so is never part of one.
+const noPage PageId = 0
+
+// ErrCorruptPage is returned when a page doesn't hold what the table expects
+// it to. OpenTable returns it if the pages written back before a crash
+// don't make up a consistent table.
+var ErrCorruptPage = errors.New("corrupt hash table page")
+
+// ErrNoTable is returned by OpenTable when nothing was ever written to the
+// meta page, so the pool holds no table
+var ErrNoTable = errors.New("pool holds no hash table")
+
+// pageStore allocates pages, and reads and writes chains of them through a
+// buffer pool. Freed pages are reused before new ones are allocated.
+type pageStore struct {
+	pool     buffer.Pool
+	nextPage PageId // the lowest page id never allocated
+	free     []PageId
+}
+
+func newPageStore(pool buffer.Pool) *pageStore {
+	return &pageStore{pool: pool, nextPage: metaPage + 1}
+}
+
+// readChain returns the bytes held by the chain starting at head, and the ids
+// of its pages
+func (p *pageStore) readChain(head PageId) (string, []PageId, error) {
+	pageIds := make([]PageId, 0, 1)
+	chunks := make([]string, 0, 1)
+	for pageId := head; pageId != noPage; {
+		// A chain only reaches pages which have been allocated, and each once
+		if pageId >= p.nextPage || len(pageIds) >= int(p.nextPage) {
+			return "", nil, ErrCorruptPage
+		}
+		next, chunk, err := p.readPage(pageId)
+		if err != nil {
+			return "", nil, err
+		}
+		pageIds = append(pageIds, pageId)
+		chunks = append(chunks, chunk)
+		pageId = next
+	}
+	if len(chunks) == 1 {
+		return chunks[0], pageIds, nil
+	}
+	return strings.Join(chunks, ""), pageIds, nil
+}
+
+func (p *pageStore) readPage(pageId PageId) (PageId, string, error) {
+	page, err := p.pool.FetchPage(pageId)
+	if err != nil {
+		return noPage, "", err
+	}
+	defer p.pool.ReleasePage(pageId)
+
+	data := page.Data()
+	if len(data) < chainHeaderSize {
+		return noPage, "", ErrCorruptPage
+	}
+	next := PageId(binary.LittleEndian.Uint64([]byte(data[:8])))
+	length := int(binary.LittleEndian.Uint32([]byte(data[8:chainHeaderSize])))
+	if length > len(data)-chainHeaderSize {
+		return noPage, "", ErrCorruptPage
+	}
+	return next, data[chainHeaderSize : chainHeaderSize+length], nil
+}
+
+// writeChain writes data to the chain made of pageIds, reusing as many of
+// them as it needs, freeing the rest, and allocating more if they aren't
+// enough. It returns the pages of the new chain, which starts at the same page
+// as the old one, if there was one.
+func (p *pageStore) writeChain(pageIds []PageId, data []byte, lsn LSN) ([]PageId, error) {
+	n := (len(data) + chainChunkSize - 1) / chainChunkSize
+	if n == 0 {
+		n = 1
+	}
+	if len(pageIds) > n {
+		p.release(pageIds[n:])
+		pageIds = pageIds[:n]
+	}
+	for len(pageIds) < n {
+		pageIds = append(pageIds, p.allocate())
+	}
+
+	for i, pageId := range pageIds {
+		next := noPage
+		if i < len(pageIds)-1 {
+			next = pageIds[i+1]
+		}
+		chunk := data[i*chainChunkSize:]
+		if len(chunk) > chainChunkSize {
+			chunk = chunk[:chainChunkSize]
+		}
+
+		page := make([]byte, buffer.PageSizeInBytes)
+		binary.LittleEndian.PutUint64(page, uint64(next))
+		binary.LittleEndian.PutUint32(page[8:], uint32(len(chunk)))
+		copy(page[chainHeaderSize:], chunk)
+		if err := p.writePage(pageId, page, lsn); err != nil {
+			return nil, err
+		}
+	}
+	return pageIds, nil
+}
+
+// writePage overwrites a page, without reading what it held
+func (p *pageStore) writePage(pageId PageId, data []byte, lsn LSN) error {
+	if _, err := p.pool.NewPage(pageId); err != nil {
+		return err
+	}
+	err := p.pool.WritePage(pageId, data, lsn)
+	if releaseErr := p.pool.ReleasePage(pageId); err == nil {
+		err = releaseErr
+	}
+	return err
+}
+
+func (p *pageStore) allocate() PageId {
+	if len(p.free) > 0 {
+		pageId := p.free[len(p.free)-1]
+		p.free = p.free[:len(p.free)-1]
+		return pageId
+	}
+	pageId := p.nextPage
+	p.nextPage++
+	return pageId
+}
+
+func (p *pageStore) release(pageIds []PageId) {
+	p.free = append(p.free, pageIds...)
+}
+
+// meta is the contents of the meta page
+type meta struct {
+	globalDepth   uint32
+	nextPage      PageId
+	directoryHead PageId
+}
+
+func (p *pageStore) writeMeta(m meta, lsn LSN) error {
+	data := make([]byte, buffer.PageSizeInBytes)
+	binary.LittleEndian.PutUint64(data, metaMagic)
+	binary.LittleEndian.PutUint32(data[8:], m.globalDepth)
+	binary.LittleEndian.PutUint64(data[12:], uint64(m.nextPage))
+	binary.LittleEndian.PutUint64(data[20:], uint64(m.directoryHead))
+	return p.writePage(metaPage, data, lsn)
+}
+
+func (p *pageStore) readMeta() (meta, error) {
+	page, err := p.pool.FetchPage(metaPage)
+	if err != nil {
+		return meta{}, err
+	}
+	defer p.pool.ReleasePage(metaPage)
+
+	data := []byte(page.Data())
+	if strings.Trim(page.Data(), "\x00") == "" {
+		return meta{}, ErrNoTable
+	}
+	if len(data) < 28 || binary.LittleEndian.Uint64(data) != metaMagic {
+		return meta{}, errors.New("page 0 does not hold a hash table")
+	}
+	return meta{
+		globalDepth:   binary.LittleEndian.Uint32(data[8:]),
+		nextPage:      PageId(binary.LittleEndian.Uint64(data[12:])),
+		directoryHead: PageId(binary.LittleEndian.Uint64(data[20:])),
+	}, nil
+}
@@ -11,247 +11,349 @@ package inmemory_btree
 
 import (
 	"sort"
-	"strings"
-	. "yadb-go/pkg/store"
+	"sync"
+	"sync/atomic"
 )
 
-type Tree struct {
-	root   *Node
-	degree int
+// BTree is a B+ Tree mapping keys of type K, in the order given by a KeyOrder,
+// to values of type V. It is safe for concurrent use; see latch.go for how
+// operations are synchronised. Tree, the store, is a BTree of string keys.
+type BTree[K any, V any] struct {
+	root      *Node[K, V]
+	rootLatch sync.RWMutex // guards which node is the root
+	degree    int
+	cmp       KeyOrder[K]
+
+	// load, if set, is applied to every value read out of a leaf, while the
+	// leaf is still latched
+	load func(key K, value V) V
 }
 
-// NewTree creates a new B-Tree with the given degree
-func NewTree(degree int) *Tree {
+// NewBTree creates a new B-Tree with the given degree, which orders keys by cmp
+func NewBTree[K any, V any](degree int, cmp KeyOrder[K]) *BTree[K, V] {
 	if degree < 2 {
 		panic("Degree must be >= 2")
 	}
 
-	tree := &Tree{
+	tree := &BTree[K, V]{
 		degree: degree,
+		cmp:    cmp,
 	}
 	tree.root = tree.NewEmptyNode(true)
 	return tree
 }
 
-// Get Returns a pointer to the KeyValuePair if the key exists in this Tree
-// otherwise returns nil
-func (tree *Tree) Get(key string) *KeyValuePair {
-	if tree.root == nil {
-		return nil
+// Get returns the value for key, and whether the key exists in this tree
+func (tree *BTree[K, V]) Get(key K) (V, bool) {
+	leaf := tree.findLeafShared(func(n *Node[K, V]) int { return n.findIndex(key) })
+	defer leaf.latch.RUnlock()
+
+	// try to find the specific key in the leaf node's entries
+	i, found := leaf.findKeyInLeaf(key)
+	if !found {
+		var zero V
+		return zero, false
 	}
-	return tree.root.get(key)
+	return tree.valueAt(leaf, i), true
 }
 
 // Set a key-value pair into the tree. The pair will be inserted at the bottom
 // of the tree, and changes propagate up to internal nodes if required for splits/merges
 // If an existing value for the key exists, Set will overwrite the existing value
-func (tree *Tree) Set(key string, value string) {
-	// Locate the appropriate leaf to insert into
-	leaf := tree.root.findLeafNodeForKey(key)
-	kvPair := &KeyValuePair{
-		Key:   key,
-		Value: value,
+// and return it
+func (tree *BTree[K, V]) Set(key K, value V) (V, bool) {
+	// Most inserts fit in the leaf, which is all the optimistic descent write
+	// latches
+	if leaf := tree.findLeafOptimistic(key, opInsert); leaf != nil {
+		replaced, found := leaf.insert(key, value)
+		if !found {
+			leaf.addToAncestorCounts(1)
+		}
+		leaf.releaseOptimistic()
+		return replaced, found
 	}
 
-	leaf.insert(kvPair)
+	path := tree.findLeafExclusive(key, opInsert)
+	leaf := path.leaf()
+	replaced, found := leaf.insert(key, value)
+	leaf.split()
+	path.release()
+	if path.stale {
+		tree.recountPath(key)
+	}
+	return replaced, found
 }
 
-// Delete removes a key from the tree
-func (tree *Tree) Delete(key string) {
-	leaf := tree.root.findLeafNodeForKey(key)
-	leaf.delete(key)
+// Delete removes a key from the tree, returning its value if it was present
+func (tree *BTree[K, V]) Delete(key K) (V, bool) {
+	if leaf := tree.findLeafOptimistic(key, opDelete); leaf != nil {
+		removed, found := leaf.delete(key)
+		if found {
+			leaf.addToAncestorCounts(-1)
+		}
+		leaf.releaseOptimistic()
+		return removed, found
+	}
+
+	path := tree.findLeafExclusive(key, opDelete)
+	removed, found := path.leaf().delete(key)
+	if found {
+		path.leaf().maybeMerge(path)
+	}
+	path.release()
+	if path.stale {
+		tree.recountPath(key)
+	}
+	return removed, found
+}
+
+// valueAt returns the value of the i-th entry of a latched leaf
+func (tree *BTree[K, V]) valueAt(leaf *Node[K, V], i int) V {
+	if tree.load == nil {
+		return leaf.values[i]
+	}
+	return tree.load(leaf.keys[i], leaf.values[i])
 }
 
 // Node represents a node in a B+ Tree.
 // Each internal node holds up to N keys and N+1 pointers to child nodes.
-// Each leaf node holds N pointers to heap data
+// Each leaf node holds up to N keys, and a value for each
 //
 // The occupancy of the tree is the number of children as a fraction of the total
 // capacity. We wish to keep a high occupancy. Splits and merges will be triggered
 // to maintain this property.
 //
 // Keys are stored in sorted order to allow for binary searches.
-type Node struct {
-	tree   *Tree
-	parent *Node // Retain parent for rebalancing / splitting operations
+type Node[K any, V any] struct {
+	tree   *BTree[K, V]
+	parent *Node[K, V] // Retain parent for rebalancing / splitting operations
 
-	keys     []string      // Only set for internal nodes.
-	pointers []interface{} // For internal nodes, points to other internal nodes. For leaves, points to KV-pairs
+	// Leaves are doubly linked to their siblings in key order (across parents
+	// too), so ordered scans never need to climb back through internal nodes
+	next *Node[K, V]
+	prev *Node[K, V]
 
-	isLeaf bool
-}
+	// For internal nodes, the separators between children. For leaves, the
+	// key of each entry, whose value is at the same index of values.
+	keys     []K
+	children []*Node[K, V] // Only set for internal nodes
+	values   []V           // Only set for leaves
 
-func (tree *Tree) NewEmptyNode(isLeaf bool) *Node {
-	return &Node{
-		tree:     tree,
-		parent:   nil,
-		keys:     make([]string, 0), // TODO maybe size shouldn't be 0 - resizing time
-		pointers: make([]interface{}, 0),
-		isLeaf:   isLeaf,
-	}
-}
+	isLeaf bool
 
-// get returns a pointer to the KV Pair if the key exists under this node (or
-// its children, recursively), otherwise returns nil.
-func (n *Node) get(key string) *KeyValuePair {
-	leaf := n.findLeafNodeForKey(key)
+	// count is the number of keys in the subtree under this node. It changes
+	// under a write latch on the node, or atomically under a read latch (see
+	// latch.go), so is always read atomically.
+	count atomic.Int64
 
-	// try to find the specific KV pair in the leaf node's tuples
-	pair, _ := leaf.findKeyInLeaf(key)
-	return pair
+	latch   sync.RWMutex
+	removed bool // set once a leaf has been merged into its sibling
 }
 
-// findIndex returns the index of the child node which should contain the key,
-// and whether there was an exact match
-func (n *Node) findIndex(key string) int {
-	var exact bool
-	i := sort.Search(len(n.keys), func(i int) bool {
-		ret := strings.Compare(n.keys[i], key)
-		if ret == 0 {
-			exact = true
-		}
-		return ret == 1
-	})
-
-	if !exact && len(n.keys) > 1 {
-		i--
+func (tree *BTree[K, V]) NewEmptyNode(isLeaf bool) *Node[K, V] {
+	return &Node[K, V]{
+		tree:   tree,
+		parent: nil,
+		isLeaf: isLeaf,
 	}
-
-	return i
 }
 
-// findLeafNodeForKey finds the leaf node that should contain the key
-func (n *Node) findLeafNodeForKey(key string) *Node {
-	if n.isLeaf {
-		return n
-	}
-
-	// Find the child internal Node under which the key would lie, if it were
-	// in the tree rooted by the current node
-	i := n.findIndex(key)
-	// TODO node potentially not loaded
-	return n.pointers[i].(*Node).findLeafNodeForKey(key)
+// findIndex returns the index of the child node which should contain the key.
+// Child i holds keys in the range [keys[i-1], keys[i]), so this is the number
+// of separator keys which are <= key.
+func (n *Node[K, V]) findIndex(key K) int {
+	return sort.Search(len(n.keys), func(i int) bool {
+		return n.tree.cmp.Compare(n.keys[i], key) > 0
+	})
 }
 
 // findKeyInLeaf searches a leaf node for the presence of a key.
-// If found, returns KV-pair and corresponding index
-// Otherwise returns nil and the expected index of its pointers
-func (n *Node) findKeyInLeaf(key string) (*KeyValuePair, int) {
-	var exact bool
-	i := sort.Search(len(n.pointers), func(i int) bool {
-		// TODO heap data potentially not loaded
-		ret := strings.Compare(n.pointers[i].(*KeyValuePair).Key, key)
-		if ret == 0 {
-			exact = true
-		}
-		return ret >= 0
+// Returns the index of the key if found, otherwise the index it would be
+// inserted at, and whether it was found
+func (n *Node[K, V]) findKeyInLeaf(key K) (int, bool) {
+	i := sort.Search(len(n.keys), func(i int) bool {
+		return n.tree.cmp.Compare(n.keys[i], key) >= 0
 	})
-
-	if exact {
-		return n.pointers[i].(*KeyValuePair), i
-	} else {
-		return nil, i
-	}
+	return i, i < len(n.keys) && n.tree.cmp.Compare(n.keys[i], key) == 0
 }
 
 // putKey promotes a key to an internal node
-func (n *Node) putKey(key string, pointer *Node) {
+func (n *Node[K, V]) putKey(key K, child *Node[K, V]) {
 	i := n.findIndex(key)
-
-	n.keys = append(n.keys, "")
-	n.pointers = append(n.pointers, nil)
-
-	// make space if index is not at the end
-	if i < len(n.keys) {
-		copy(n.keys[i+1:], n.keys[i:])
-		copy(n.pointers[i+2:], n.pointers[i+1:])
-	}
-
-	n.keys[i] = key
-	n.pointers[i+1] = pointer
+	n.keys = insertAt(n.keys, i, key)
+	n.children = insertAt(n.children, i+1, child)
 }
 
-// insert a key-value pair into a leaf node.
-func (n *Node) insert(pair *KeyValuePair) {
+// insert a key and value into a leaf node, returning the value it replaced,
+// if any. The caller is responsible for splitting the node if it overflows.
+func (n *Node[K, V]) insert(key K, value V) (V, bool) {
 	if !n.isLeaf {
 		panic("Tried to insert KV-Pair to non-leaf node")
 	}
 
 	// Find insertion index
-	existing, index := n.findKeyInLeaf(pair.Key)
-	if existing != nil {
-		// If key is already present, overwrite existing value
-		existing.Value = pair.Value
-	} else {
-		// Otherwise, allocate space for a new KV pair
-		n.pointers = append(n.pointers, nil)
-		copy(n.pointers[index+1:], n.pointers[index:])
-		n.pointers[index] = pair
+	index, found := n.findKeyInLeaf(key)
+	if found {
+		// If key is already present, overwrite existing value. The key is
+		// overwritten too, as keys which compare equal may still differ
+		replaced := n.values[index]
+		n.keys[index], n.values[index] = key, value
+		return replaced, true
 	}
 
-	n.split()
+	// Otherwise, make space for a new entry
+	n.keys = insertAt(n.keys, index, key)
+	n.values = insertAt(n.values, index, value)
+	n.count.Add(1)
+	var zero V
+	return zero, false
 }
 
-// delete removes a key from a leaf node
-func (n *Node) delete(key string) {
-	kv, i := n.findKeyInLeaf(key)
-	// if kv == nil, the key could not be found in the tree
-	// else
-	if kv != nil {
-		// remove the KV pair from the leaf's tuples
-		// n.keys = append(n.keys[:i], n.keys[i+1:]...)
-		n.pointers = append(n.pointers[:i], n.pointers[i+1:]...)
+// delete removes a key from a leaf node, returning its value, if it was
+// present. The caller is responsible for rebalancing the node if it
+// underflows.
+func (n *Node[K, V]) delete(key K) (V, bool) {
+	i, found := n.findKeyInLeaf(key)
+	// if not found, the key could not be found in the tree
+	if !found {
+		var zero V
+		return zero, false
 	}
 
-	n.maybeMerge()
+	// remove the entry from the leaf
+	removed := n.values[i]
+	n.keys = removeAt(n.keys, i)
+	n.values = removeAt(n.values, i)
+	n.count.Add(-1)
+
+	return removed, true
 }
 
 // Node maintenance operations
 
-// truncate functions remove items after & including index i, in a manner that
+// insertAt inserts an item into a slice at index i
+func insertAt[T any](s []T, i int, item T) []T {
+	var zero T
+	s = append(s, zero)
+	copy(s[i+1:], s[i:])
+	s[i] = item
+	return s
+}
+
+// removeAt removes the item at index i from a slice
+func removeAt[T any](s []T, i int) []T {
+	copy(s[i:], s[i+1:])
+	return truncate(s, len(s)-1)
+}
+
+// truncate removes items after & including index i, in a manner that
 // prevents memleaks. see https://utcc.utoronto.ca/~cks/space/blog/programming/GoSlicesMemoryLeak
+func truncate[T any](s []T, index int) []T {
+	var zero T
+	for i := index; i < len(s); i++ {
+		s[i] = zero
+	}
+	return s[:index]
+}
+
+// size is the number of entries in a leaf, or keys in an internal node, which
+// is what the degree of the tree bounds
+func (n *Node[K, V]) size() int {
+	return len(n.keys)
+}
+
+// minSize is the fewest entries (for leaves) or keys (for internal nodes) a
+// node other than the root may hold. Splitting an overfull node leaves both
+// halves with at least this many, and an underfull node can always be merged
+// with a sibling holding exactly this many without overflowing.
+func (n *Node[K, V]) minSize() int {
+	if n.isLeaf {
+		return (n.tree.degree + 1) / 2
+	}
+	return n.tree.degree / 2
+}
+
+// recount sets the subtree count of a node from its entries or children,
+// after entries have moved between nodes. The caller must hold a write latch
+// on the node, which also stops the counts of its children changing.
+func (n *Node[K, V]) recount() {
+	if n.isLeaf {
+		n.count.Store(int64(len(n.keys)))
+		return
+	}
+	count := int64(0)
+	for _, child := range n.children {
+		count += child.count.Load()
+	}
+	n.count.Store(count)
+}
 
-func (n *Node) truncateKeys(index int) {
-	n.keys = n.keys[:index]
+// childIndex returns the position of a child in this node's children
+func (n *Node[K, V]) childIndex(child *Node[K, V]) int {
+	for i, c := range n.children {
+		if c == child {
+			return i
+		}
+	}
+	panic("Node is not a child of its parent")
 }
 
-func (n *Node) truncatePointers(index int) {
-	for i := index; i < len(n.pointers); i++ {
-		n.pointers[i] = nil
+// adopt sets this node as the parent of the given children
+func (n *Node[K, V]) adopt(children []*Node[K, V]) {
+	for _, child := range children {
+		child.parent = n
 	}
-	n.pointers = n.pointers[:index]
 }
 
-// splitLeaf splits a leaf node into two, if needed
-func (n *Node) split() {
-	if len(n.keys) <= n.tree.degree {
+// split splits a node into two if it holds more than degree entries or keys.
+// The first key of the new right-hand node is promoted to the parent, which
+// may in turn need to split. The caller must hold write latches on every node
+// the split can reach.
+func (n *Node[K, V]) split() {
+	if n.size() <= n.tree.degree {
 		return
 	}
 
 	// Allocate a new node, transfer half of the tuples in this node to the
 	// new node. Set the parent of this new node as the original node's parent.
 	// Splitting is a recursive operation; the parents may also need to be split.
-
-	// Move items from index N/2 onwards to new node
-	splitIndex := n.tree.degree / 2
-	var splitIndexKey string
+	next := n.tree.NewEmptyNode(n.isLeaf)
+	var splitIndexKey K
 	if n.isLeaf {
-		splitIndexKey = n.pointers[splitIndex].(*KeyValuePair).Key
+		// Move items from index (N+1)/2 onwards to new node
+		splitIndex := (n.tree.degree + 1) / 2
+		// The separator only has to route lookups, so rather than a copy of
+		// the right-hand node's first key, the comparator picks a short key
+		// between the two nodes. Neighbouring keys often share long prefixes
+		// (tenant/123/order/456), so this saves a lot of memory.
+		splitIndexKey = n.tree.cmp.Separator(
+			n.keys[splitIndex-1],
+			n.keys[splitIndex],
+		)
+		next.keys = append(next.keys, n.keys[splitIndex:]...)
+		next.values = append(next.values, n.values[splitIndex:]...)
+		n.keys = truncate(n.keys, splitIndex)
+		n.values = truncate(n.values, splitIndex)
+		n.linkAfter(next)
 	} else {
+		// Keys after N/2 (and the children to their right) move to the new node.
+		// The key at N/2 is promoted, so is intentionally not kept in either node
+		splitIndex := n.tree.degree / 2
 		splitIndexKey = n.keys[splitIndex]
+		next.keys = append(next.keys, n.keys[splitIndex+1:]...)
+		next.children = append(next.children, n.children[splitIndex+1:]...)
+		next.adopt(next.children)
+		n.keys = truncate(n.keys, splitIndex)
+		n.children = truncate(n.children, splitIndex+1)
 	}
-	next := n.tree.NewEmptyNode(n.isLeaf)
-	next.pointers = append(next.pointers, n.pointers[splitIndex:]...)
-	if !n.isLeaf {
-		next.keys = append(next.keys, n.keys[splitIndex+1:]...) // intentionally not including key in next node, as it has been promoted
-		n.truncateKeys(splitIndex)
-	}
-	n.truncatePointers(splitIndex)
+	n.recount()
+	next.recount()
 
 	// If this is the root, we need to create a new root
 	if n.parent == nil {
 		newRoot := n.tree.NewEmptyNode(false)
-		newRoot.pointers = append(newRoot.pointers, n)
+		newRoot.children = append(newRoot.children, n)
+		newRoot.count.Store(n.count.Load() + next.count.Load())
 		n.tree.root = newRoot
 		n.parent = newRoot
 	}
@@ -261,7 +363,168 @@ func (n *Node) split() {
 	n.parent.split()
 }
 
-// TODO impl
-func (n *Node) maybeMerge() {
+// maybeMerge restores the occupancy of a node after a deletion. An underfull
+// node first tries to borrow an entry from a sibling with some to spare;
+// otherwise it is merged with a sibling, removing a separator key from the
+// parent, which may then be underfull itself. When the root is left with a
+// single child, that child becomes the new root and the tree shrinks.
+//
+// n must be the bottom node of path. Siblings are latched here, under their
+// parent, and each level is released before moving up to the next.
+func (n *Node[K, V]) maybeMerge(path *latchPath[K, V]) {
+	if path.isTop(n) {
+		// The top of the path was safe, so cannot underflow, unless it is the
+		// root (which is only in the path along with the rootLatch)
+		if path.rootLatched && !n.isLeaf && len(n.keys) == 0 {
+			child := n.children[0]
+			child.parent = nil
+			n.tree.root = child
+		}
+		return
+	}
+
+	if n.size() >= n.minSize() {
+		return
+	}
+
+	// Siblings are only taken from the same parent, so the separator between
+	// them is always parent.keys[i-1] (left) or parent.keys[i] (right)
+	parent := n.parent
+	i := parent.childIndex(n)
+	var left, right *Node[K, V]
+	if i > 0 {
+		left = parent.children[i-1]
+		left.latch.Lock()
+		if left.size() > left.minSize() {
+			n.borrowFromLeft(left, i-1)
+			left.latch.Unlock()
+			return
+		}
+	}
+	if i < len(parent.children)-1 {
+		right = parent.children[i+1]
+		right.latch.Lock()
+		if right.size() > right.minSize() {
+			n.borrowFromRight(right, i)
+			right.latch.Unlock()
+			if left != nil {
+				left.latch.Unlock()
+			}
+			return
+		}
+	}
+
+	if left != nil {
+		if right != nil {
+			// Merging unlinks n, which latches its right-hand neighbour
+			right.latch.Unlock()
+		}
+		left.mergeWithRight(n, i-1)
+		left.latch.Unlock()
+	} else {
+		n.mergeWithRight(right, i)
+		right.latch.Unlock()
+	}
+	path.pop()
+	parent.maybeMerge(path)
+}
+
+// borrowFromLeft moves the last entry of the left sibling to the front of
+// this node. separator is the index of the parent key between the two nodes.
+func (n *Node[K, V]) borrowFromLeft(left *Node[K, V], separator int) {
+	last := len(left.keys) - 1
+	if n.isLeaf {
+		n.keys = insertAt(n.keys, 0, left.keys[last])
+		n.values = insertAt(n.values, 0, left.values[last])
+		left.keys = truncate(left.keys, last)
+		left.values = truncate(left.values, last)
+		n.parent.keys[separator] = n.tree.cmp.Separator(
+			left.keys[last-1],
+			n.keys[0],
+		)
+	} else {
+		// Rotate keys through the parent
+		n.keys = insertAt(n.keys, 0, n.parent.keys[separator])
+		n.parent.keys[separator] = left.keys[last]
+		left.keys = truncate(left.keys, last)
+		n.children = insertAt(n.children, 0, left.children[last+1])
+		left.children = truncate(left.children, last+1)
+		n.adopt(n.children[:1])
+	}
+	n.recount()
+	left.recount()
+}
 
+// borrowFromRight moves the first entry of the right sibling to the end of
+// this node. separator is the index of the parent key between the two nodes.
+func (n *Node[K, V]) borrowFromRight(right *Node[K, V], separator int) {
+	if n.isLeaf {
+		n.keys = append(n.keys, right.keys[0])
+		n.values = append(n.values, right.values[0])
+		right.keys = removeAt(right.keys, 0)
+		right.values = removeAt(right.values, 0)
+		n.parent.keys[separator] = n.tree.cmp.Separator(
+			n.keys[len(n.keys)-1],
+			right.keys[0],
+		)
+	} else {
+		// Rotate keys through the parent
+		n.keys = append(n.keys, n.parent.keys[separator])
+		n.parent.keys[separator] = right.keys[0]
+		right.keys = removeAt(right.keys, 0)
+		n.children = append(n.children, right.children[0])
+		right.children = removeAt(right.children, 0)
+		n.adopt(n.children[len(n.children)-1:])
+	}
+	n.recount()
+	right.recount()
+}
+
+// mergeWithRight moves every entry of the right sibling into this node, and
+// removes the right sibling and the separator key between them from the parent
+func (n *Node[K, V]) mergeWithRight(right *Node[K, V], separator int) {
+	if !n.isLeaf {
+		// The separator comes back down between the two sets of keys
+		n.keys = append(n.keys, n.parent.keys[separator])
+		n.keys = append(n.keys, right.keys...)
+		n.children = append(n.children, right.children...)
+		n.adopt(right.children)
+	} else {
+		right.unlink()
+		n.keys = append(n.keys, right.keys...)
+		n.values = append(n.values, right.values...)
+	}
+	n.count.Add(right.count.Load())
+
+	parent := n.parent
+	parent.keys = removeAt(parent.keys, separator)
+	parent.children = removeAt(parent.children, separator+1)
+}
+
+// linkAfter inserts a new leaf into the sibling list, directly after this one.
+// This leaf must be write latched; the leaf to its right is latched here.
+func (n *Node[K, V]) linkAfter(leaf *Node[K, V]) {
+	leaf.prev, leaf.next = n, n.next
+	if next := n.next; next != nil {
+		next.latch.Lock()
+		next.prev = leaf
+		next.latch.Unlock()
+	}
+	n.next = leaf
+}
+
+// unlink removes a leaf from the sibling list, and marks it removed for any
+// cursor still positioned on it. Both it and the leaf to its left must be
+// write latched; the leaf to its right is latched here.
+func (n *Node[K, V]) unlink() {
+	if n.prev != nil {
+		n.prev.next = n.next
+	}
+	if next := n.next; next != nil {
+		next.latch.Lock()
+		next.prev = n.prev
+		next.latch.Unlock()
+	}
+	n.prev, n.next = nil, nil
+	n.removed = true
 }
@@ -0,0 +1,221 @@
+package inmemory_btree
+
+import (
+	"fmt"
+	"math/rand"
+	"sync"
+	"testing"
+)
+
+// Benchmarks of the store's tree on random string keys, against baselines
+// running the same workload: a BTree of the same keys without the store's
+// wrapping, a map, and a BTree of int64 keys. Keys are generated up front, so
+// only the structures' own allocations are reported.
+
+const benchmarkKeys = 100000
+
+func benchmarkKeySet() []string {
+	keys := make([]string, benchmarkKeys)
+	for i, n := range rand.New(rand.NewSource(1)).Perm(benchmarkKeys) {
+		keys[i] = fmt.Sprintf("key%08d", n)
+	}
+	return keys
+}
+
+func BenchmarkTree(b *testing.B) {
+	keys := benchmarkKeySet()
+	full := NewTree(32)
+	for _, key := range keys {
+		full.Set(key, "value")
+	}
+
+	b.Run("Set", func(b *testing.B) {
+		b.ReportAllocs()
+		tree := NewTree(32)
+		for i := 0; i < b.N; i++ {
+			tree.Set(keys[i%len(keys)], "value")
+		}
+	})
+
+	b.Run("Get", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			full.Get(keys[i%len(keys)])
+		}
+	})
+
+	b.Run("SetDelete", func(b *testing.B) {
+		b.ReportAllocs()
+		tree := NewTree(32)
+		for i := 0; i < b.N; i++ {
+			key := keys[i%len(keys)]
+			if i/len(keys)%2 == 0 {
+				tree.Set(key, "value")
+			} else {
+				tree.Delete(key)
+			}
+		}
+	})
+
+	b.Run("Scan100", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			it := full.Scan(keys[i%len(keys)], "")
+			for j := 0; j < 100 && it.Valid(); j++ {
+				it.Next()
+			}
+			it.Close()
+		}
+	})
+}
+
+// BenchmarkStringBTree runs the same operations on a BTree of the same keys,
+// holding string values directly, so the difference from BenchmarkTree is
+// what the store's slots and pairs cost
+func BenchmarkStringBTree(b *testing.B) {
+	keys := benchmarkKeySet()
+	newTree := func() *BTree[string, string] {
+		return NewBTree[string, string](32, NaturalOrder[string]())
+	}
+	full := newTree()
+	for _, key := range keys {
+		full.Set(key, "value")
+	}
+
+	b.Run("Set", func(b *testing.B) {
+		b.ReportAllocs()
+		tree := newTree()
+		for i := 0; i < b.N; i++ {
+			tree.Set(keys[i%len(keys)], "value")
+		}
+	})
+
+	b.Run("Get", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			full.Get(keys[i%len(keys)])
+		}
+	})
+
+	b.Run("SetDelete", func(b *testing.B) {
+		b.ReportAllocs()
+		tree := newTree()
+		for i := 0; i < b.N; i++ {
+			key := keys[i%len(keys)]
+			if i/len(keys)%2 == 0 {
+				tree.Set(key, "value")
+			} else {
+				tree.Delete(key)
+			}
+		}
+	})
+
+	b.Run("Scan100", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			j := 0
+			full.Ascend(keys[i%len(keys)], func(string, string) bool {
+				j++
+				return j < 100
+			})
+		}
+	})
+}
+
+// BenchmarkMap is the baseline for the point operations: a map of the same
+// keys, behind a lock as the trees are safe for concurrent use. It keeps no
+// order, so can't scan.
+func BenchmarkMap(b *testing.B) {
+	keys := benchmarkKeySet()
+	var mu sync.RWMutex
+	full := make(map[string]string)
+	for _, key := range keys {
+		full[key] = "value"
+	}
+
+	b.Run("Set", func(b *testing.B) {
+		b.ReportAllocs()
+		m := make(map[string]string)
+		for i := 0; i < b.N; i++ {
+			mu.Lock()
+			m[keys[i%len(keys)]] = "value"
+			mu.Unlock()
+		}
+	})
+
+	b.Run("Get", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			mu.RLock()
+			_ = full[keys[i%len(keys)]]
+			mu.RUnlock()
+		}
+	})
+
+	b.Run("SetDelete", func(b *testing.B) {
+		b.ReportAllocs()
+		m := make(map[string]string)
+		for i := 0; i < b.N; i++ {
+			key := keys[i%len(keys)]
+			mu.Lock()
+			if i/len(keys)%2 == 0 {
+				m[key] = "value"
+			} else {
+				delete(m, key)
+			}
+			mu.Unlock()
+		}
+	})
+}
+
+// BenchmarkBTree runs the same operations on a tree of int64 keys and values,
+// which holds them unboxed in its nodes
+func BenchmarkBTree(b *testing.B) {
+	keys := rand.New(rand.NewSource(1)).Perm(benchmarkKeys)
+	newTree := func() *BTree[int64, int64] {
+		return NewBTree[int64, int64](32, NaturalOrder[int64]())
+	}
+	full := newTree()
+	for _, key := range keys {
+		full.Set(int64(key), int64(key))
+	}
+
+	b.Run("Set", func(b *testing.B) {
+		b.ReportAllocs()
+		tree := newTree()
+		for i := 0; i < b.N; i++ {
+			tree.Set(int64(keys[i%len(keys)]), int64(i))
+		}
+	})
+
+	b.Run("Get", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			full.Get(int64(keys[i%len(keys)]))
+		}
+	})
+
+	b.Run("SetDelete", func(b *testing.B) {
+		b.ReportAllocs()
+		tree := newTree()
+		for i := 0; i < b.N; i++ {
+			key := int64(keys[i%len(keys)])
+			if i/len(keys)%2 == 0 {
+				tree.Set(key, int64(i))
+			} else {
+				tree.Delete(key)
+			}
+		}
+	})
+
+	b.Run("Scan100", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			j := 0
+			full.Ascend(int64(keys[i%len(keys)]), func(int64, int64) bool {
+				j++
+				return j < 100
+			})
+		}
+	})
+}
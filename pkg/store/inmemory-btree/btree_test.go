@@ -1,6 +1,15 @@
 package inmemory_btree
 
-import "testing"
+import (
+	"fmt"
+	"io"
+	"math/rand"
+	"strconv"
+	"strings"
+	"testing"
+
+	. "yadb-go/pkg/store"
+)
 
 // Test that we can get, insert, and delete into/from a b-tree
 func TestBranchOperations(t *testing.T) {
@@ -10,13 +19,16 @@ func TestBranchOperations(t *testing.T) {
 
 	// Test insert/get operations
 	tree.Set("key", "val")
+	checkInvariants(t, tree)
 	tree.Set("key2", "val2")
+	checkInvariants(t, tree)
 
 	assertKeyFound(t, tree, "key", "val")
 	assertKeyFound(t, tree, "key2", "val2")
 
 	// Test deletion operations
 	tree.Delete("key")
+	checkInvariants(t, tree)
 	assertKeyNotFound(t, tree, "key")
 }
 
@@ -26,14 +38,18 @@ func TestBranchOperations__limitedCapacity(t *testing.T) {
 	tree := NewTree(2)
 
 	tree.Set("key", "val")
+	checkInvariants(t, tree)
 	tree.Set("key2", "val2")
+	checkInvariants(t, tree)
 	tree.Set("key3", "val3")
+	checkInvariants(t, tree)
 
 	assertKeyFound(t, tree, "key", "val")
 	assertKeyFound(t, tree, "key2", "val2")
 	assertKeyFound(t, tree, "key3", "val3")
 
 	tree.Delete("key")
+	checkInvariants(t, tree)
 	assertKeyNotFound(t, tree, "key")
 }
 
@@ -42,11 +58,17 @@ func TestBranchOperations__largeHeight(t *testing.T) {
 	tree := NewTree(2)
 
 	tree.Set("key", "val")
+	checkInvariants(t, tree)
 	tree.Set("key2", "val2")
+	checkInvariants(t, tree)
 	tree.Set("key3", "val3")
+	checkInvariants(t, tree)
 	tree.Set("key4", "val4")
+	checkInvariants(t, tree)
 	tree.Set("key5", "val5")
+	checkInvariants(t, tree)
 	tree.Set("key6", "val6")
+	checkInvariants(t, tree)
 
 	assertKeyFound(t, tree, "key", "val")
 	assertKeyFound(t, tree, "key2", "val2")
@@ -56,19 +78,373 @@ func TestBranchOperations__largeHeight(t *testing.T) {
 	assertKeyFound(t, tree, "key6", "val6")
 
 	tree.Delete("key")
+	checkInvariants(t, tree)
 	assertKeyNotFound(t, tree, "key")
 }
 
-// TODO test odd degree too
+// Test that deleting every key shrinks the tree back to a single empty leaf
+func TestDelete__collapsesRoot(t *testing.T) {
+	tree := NewTree(3)
+	for i := 0; i < 100; i++ {
+		tree.Set(fmt.Sprintf("key%03d", i), "val")
+		checkInvariants(t, tree)
+	}
+	if tree.root.isLeaf {
+		t.Fatalf("Expected tree with 100 keys to have height > 1")
+	}
+
+	for i := 0; i < 100; i++ {
+		tree.Delete(fmt.Sprintf("key%03d", i))
+		checkInvariants(t, tree)
+	}
+
+	if !tree.root.isLeaf || len(tree.root.keys) != 0 {
+		t.Fatalf("Expected an empty leaf root after deleting every key")
+	}
+}
+
+// Test that an underfull node borrows from a sibling which has keys to spare,
+// rather than merging with it
+func TestDelete__borrowsFromSibling(t *testing.T) {
+	tree := NewTree(2)
+	tree.Set("a", "1")
+	tree.Set("b", "2")
+	tree.Set("c", "3") // splits into [a] [b c]
+	checkInvariants(t, tree)
+
+	tree.Delete("a")
+	checkInvariants(t, tree)
+
+	if tree.root.isLeaf || len(tree.root.children) != 2 {
+		t.Fatalf("Expected the root to keep both leaves")
+	}
+	assertKeyFound(t, tree, "b", "2")
+	assertKeyFound(t, tree, "c", "3")
+}
+
+// Randomly insert and delete keys, comparing against a map and checking the
+// structure of the tree after every operation. Covers odd and even degrees.
+func TestRandomInsertAndDelete(t *testing.T) {
+	for _, degree := range []int{2, 3, 4, 5, 10} {
+		t.Run("degree="+strconv.Itoa(degree), func(t *testing.T) {
+			rng := rand.New(rand.NewSource(int64(degree)))
+			tree := NewTree(degree)
+			expected := make(map[string]string)
+
+			for i := 0; i < 3000; i++ {
+				key := "key" + strconv.Itoa(rng.Intn(300))
+				if rng.Intn(3) == 0 {
+					tree.Delete(key)
+					delete(expected, key)
+				} else {
+					value := "val" + strconv.Itoa(i)
+					tree.Set(key, value)
+					expected[key] = value
+				}
+				checkInvariants(t, tree)
+			}
+
+			for i := 0; i < 300; i++ {
+				key := "key" + strconv.Itoa(i)
+				if value, found := expected[key]; found {
+					assertKeyFound(t, tree, key, value)
+				} else {
+					assertKeyNotFound(t, tree, key)
+				}
+			}
+
+			// Drain the tree, which must shrink back to a single leaf
+			for key := range expected {
+				tree.Delete(key)
+				checkInvariants(t, tree)
+			}
+			if !tree.root.isLeaf || len(tree.root.keys) != 0 {
+				t.Fatalf("Expected an empty leaf root after deleting every key")
+			}
+		})
+	}
+}
 
-// TODO implement
 func TestRangeScan(t *testing.T) {
+	tree := newTreeWithKeys(3, 100)
+
+	keys := collectKeys(tree.Scan("key010", "key020"))
+
+	assertKeys(t, keys, 10, 20)
+}
+
+func TestRangeScan__unbounded(t *testing.T) {
+	tree := newTreeWithKeys(3, 100)
+
+	assertKeys(t, collectKeys(tree.Scan("", "")), 0, 100)
+	assertKeys(t, collectKeys(tree.Scan("key095", "")), 95, 100)
+	assertKeys(t, collectKeys(tree.Scan("", "key005")), 0, 5)
+}
+
+func TestRangeScan__emptyTree(t *testing.T) {
+	tree := NewTree(3)
+
+	it := tree.Scan("", "")
+	defer it.Close()
+
+	if it.Valid() {
+		t.Fatalf("Expected iterator over an empty tree to be invalid")
+	}
+}
+
+func TestRangeScan__boundsAndLimit(t *testing.T) {
+	tree := newTreeWithKeys(4, 100)
+
+	keys := collectKeys(tree.NewIterator(ScanOptions{
+		Start:          "key010",
+		End:            "key020",
+		StartExclusive: true,
+		EndInclusive:   true,
+	}))
+	assertKeys(t, keys, 11, 21)
+
+	keys = collectKeys(tree.NewIterator(ScanOptions{Start: "key050", Limit: 3}))
+	assertKeys(t, keys, 50, 53)
+
+	// Bounds which are not keys in the tree
+	keys = collectKeys(tree.NewIterator(ScanOptions{Start: "key010a", End: "key012a"}))
+	assertKeys(t, keys, 11, 13)
+}
+
+func TestRangeScan__seek(t *testing.T) {
+	tree := newTreeWithKeys(3, 100)
+	it := tree.NewIterator(ScanOptions{Start: "key020", End: "key080", Limit: 5})
+	defer it.Close()
+
+	// Seeking before the start of the range clamps to the start
+	it.Seek("key000")
+	if !it.Valid() || it.Key() != "key020" {
+		t.Fatalf("Expected seek before range to land on key020")
+	}
+
+	// Seeking resets the limit
+	it.Seek("key070")
+	keys := make([]string, 0)
+	for ; it.Valid(); it.Next() {
+		keys = append(keys, it.Key())
+	}
+	assertKeys(t, keys, 70, 75)
+
+	// Seeking past the end of the range leaves the iterator invalid
+	it.Seek("key090")
+	if it.Valid() {
+		t.Fatalf("Expected seek past the range to be invalid")
+	}
+}
+
+// Deleting each key while scanning restructures the tree under the iterator,
+// which must still visit every key exactly once
+func TestRangeScan__deleteWhileIterating(t *testing.T) {
+	tree := newTreeWithKeys(3, 100)
+
+	visited := 0
+	it := tree.Scan("", "")
+	for ; it.Valid(); it.Next() {
+		if it.Key() != fmt.Sprintf("key%03d", visited) {
+			t.Fatalf("Expected key%03d, found %s", visited, it.Key())
+		}
+		tree.Delete(it.Key())
+		checkInvariants(t, tree)
+		visited++
+	}
+	it.Close()
+
+	if visited != 100 {
+		t.Fatalf("Expected to visit 100 keys, visited %d", visited)
+	}
+}
+
+func TestReverseScan(t *testing.T) {
+	tree := newTreeWithKeys(3, 100)
+
+	keys := collectKeys(tree.NewIterator(ScanOptions{Reverse: true}))
+	assertKeys(t, reversed(keys), 0, 100)
+
+	keys = collectKeys(tree.NewIterator(ScanOptions{Start: "key010", End: "key020", Reverse: true}))
+	assertKeys(t, reversed(keys), 10, 20)
+
+	keys = collectKeys(tree.NewIterator(ScanOptions{
+		Start:          "key010",
+		End:            "key020",
+		StartExclusive: true,
+		EndInclusive:   true,
+		Reverse:        true,
+	}))
+	assertKeys(t, reversed(keys), 11, 21)
 
+	// The latest N keys
+	keys = collectKeys(tree.NewIterator(ScanOptions{Limit: 3, Reverse: true}))
+	assertKeys(t, reversed(keys), 97, 100)
+}
+
+func TestReverseScan__seek(t *testing.T) {
+	tree := newTreeWithKeys(3, 100)
+	it := tree.NewIterator(ScanOptions{Start: "key020", End: "key080", Reverse: true})
+	defer it.Close()
+
+	// Seeking past the end of the range clamps to the end
+	it.Seek("key099")
+	if !it.Valid() || it.Key() != "key079" {
+		t.Fatalf("Expected seek past range to land on key079")
+	}
+
+	// Seeking to a missing key lands on the key before it
+	it.Seek("key050a")
+	if !it.Valid() || it.Key() != "key050" {
+		t.Fatalf("Expected seek to key050a to land on key050")
+	}
+
+	// Seeking before the start of the range leaves the iterator invalid
+	it.Seek("key010")
+	if it.Valid() {
+		t.Fatalf("Expected seek before the range to be invalid")
+	}
+}
+
+func TestReverseScan__deleteWhileIterating(t *testing.T) {
+	tree := newTreeWithKeys(3, 100)
+
+	visited := 0
+	it := tree.NewIterator(ScanOptions{Reverse: true})
+	for ; it.Valid(); it.Next() {
+		if it.Key() != fmt.Sprintf("key%03d", 99-visited) {
+			t.Fatalf("Expected key%03d, found %s", 99-visited, it.Key())
+		}
+		tree.Delete(it.Key())
+		checkInvariants(t, tree)
+		visited++
+	}
+	it.Close()
+
+	if visited != 100 {
+		t.Fatalf("Expected to visit 100 keys, visited %d", visited)
+	}
+}
+
+func TestFirstLastFloorCeiling(t *testing.T) {
+	tree := NewTree(3)
+	if tree.First() != nil || tree.Last() != nil || tree.Floor("a") != nil || tree.Ceiling("a") != nil {
+		t.Fatalf("Expected lookups on an empty tree to return nil")
+	}
+
+	for i := 0; i < 100; i += 10 {
+		tree.Set(fmt.Sprintf("key%03d", i), fmt.Sprintf("val%03d", i))
+	}
+
+	assertPair(t, tree.First(), "key000")
+	assertPair(t, tree.Last(), "key090")
+	assertPair(t, tree.Floor("key055"), "key050")
+	assertPair(t, tree.Floor("key050"), "key050")
+	assertPair(t, tree.Ceiling("key055"), "key060")
+	assertPair(t, tree.Ceiling("key060"), "key060")
+
+	if tree.Floor("a") != nil {
+		t.Fatalf("Expected no floor below the smallest key")
+	}
+	if tree.Ceiling("z") != nil {
+		t.Fatalf("Expected no ceiling above the largest key")
+	}
+}
+
+func TestScanPrefix(t *testing.T) {
+	tree := NewTree(3)
+	for _, key := range []string{"tenant/1/a", "tenant/12/a", "tenant/1/b", "tenant/2/a", "tenant/", "tenant0", "a\xff", "a\xff\xff", "b"} {
+		tree.Set(key, "val")
+	}
+
+	assertKeyList(t, collectKeys(tree.ScanPrefix("tenant/1/")), "tenant/1/a", "tenant/1/b")
+	assertKeyList(t, collectKeys(tree.ScanPrefix("tenant/1")), "tenant/1/a", "tenant/1/b", "tenant/12/a")
+	assertKeyList(t, collectKeys(tree.ScanPrefix("tenant/3")))
+	assertKeyList(t, collectKeys(tree.ScanPrefix("a\xff")), "a\xff", "a\xff\xff")
+
+	keys := collectKeys(tree.NewIterator(ScanOptions{Prefix: "tenant/", Reverse: true}))
+	assertKeyList(t, keys, "tenant/2/a", "tenant/12/a", "tenant/1/b", "tenant/1/a", "tenant/")
+
+	// Bounds narrower than the prefix still apply
+	keys = collectKeys(tree.NewIterator(ScanOptions{Prefix: "tenant/", Start: "tenant/1/b", End: "tenant/2"}))
+	assertKeyList(t, keys, "tenant/1/b", "tenant/12/a")
+
+	// An inclusive end at the first key past the prefix must not be included
+	keys = collectKeys(tree.NewIterator(ScanOptions{Prefix: "a", End: "b", EndInclusive: true, Reverse: true}))
+	assertKeyList(t, keys, "a\xff\xff", "a\xff")
+}
+
+func assertKeyList(t *testing.T, keys []string, expected ...string) {
+	t.Helper()
+	if strings.Join(keys, ",") != strings.Join(expected, ",") {
+		t.Fatalf("Expected keys %q, found %q", expected, keys)
+	}
+}
+
+func assertPair(t *testing.T, pair *KeyValuePair, key string) {
+	t.Helper()
+	if pair == nil || pair.Key != key || pair.Value != "val"+strings.TrimPrefix(key, "key") {
+		t.Fatalf("Expected pair with key '%s', found %s", key, pair.String())
+	}
+}
+
+func reversed(keys []string) []string {
+	for i, j := 0, len(keys)-1; i < j; i, j = i+1, j-1 {
+		keys[i], keys[j] = keys[j], keys[i]
+	}
+	return keys
+}
+
+// newTreeWithKeys returns a tree holding key000 to key<n-1>, each with the
+// value val<i>
+func newTreeWithKeys(degree int, n int) *Tree {
+	tree := NewTree(degree)
+	for _, i := range rand.New(rand.NewSource(int64(n))).Perm(n) {
+		tree.Set(fmt.Sprintf("key%03d", i), fmt.Sprintf("val%03d", i))
+	}
+	return tree
+}
+
+// collectKeys drains and closes an iterator, returning the keys it visited
+func collectKeys(it Iterator) []string {
+	defer it.Close()
+
+	keys := make([]string, 0)
+	for ; it.Valid(); it.Next() {
+		keys = append(keys, it.Key())
+	}
+	return keys
+}
+
+// assertKeys checks that keys are exactly key<from> to key<to-1>, in order
+func assertKeys(t *testing.T, keys []string, from int, to int) {
+	t.Helper()
+	expected := make([]string, 0)
+	for i := from; i < to; i++ {
+		expected = append(expected, fmt.Sprintf("key%03d", i))
+	}
+	if strings.Join(keys, ",") != strings.Join(expected, ",") {
+		t.Fatalf("Expected keys %v, found %v", expected, keys)
+	}
+}
+
+// checkInvariants fails the test if the structure of the tree, a Tree or any
+// BTree, is invalid
+func checkInvariants(t *testing.T, tree interface {
+	Validate() error
+	Dump(w io.Writer) error
+}) {
+	t.Helper()
+	if err := tree.Validate(); err != nil {
+		var dump strings.Builder
+		tree.Dump(&dump)
+		t.Fatalf("Invalid tree: %v\n%s", err, dump.String())
+	}
 }
 
 func assertKeyFound(t *testing.T, tree *Tree, key string, expectedValue string) {
 	res := tree.Get(key)
-	if res == nil || res.key != key || res.value != expectedValue {
+	if res == nil || res.Key != key || res.Value != expectedValue {
 		t.Fatalf("Key '%s' did not have expected value '%s'. Found: %s", key, expectedValue, res.String())
 	}
 }
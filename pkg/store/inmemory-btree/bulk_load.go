@@ -0,0 +1,228 @@
+package inmemory_btree
+
+import (
+	"fmt"
+	"math"
+
+	. "yadb-go/pkg/store"
+)
+
+// DefaultFillFactor leaves some room in each node, so that the first inserts
+// after a bulk load do not immediately split every leaf
+const DefaultFillFactor = 0.9
+
+// BulkLoad builds a tree from pairs which are already sorted by key, reading
+// the iterator to the end. Rather than inserting pairs one at a time (which
+// splits nodes over and over and leaves them half full), the tree is built
+// bottom-up: leaves are packed left to right, then each level of internal
+// nodes is built over the one below until a single root remains.
+//
+// fillFactor, in (0, 1], is the fraction of each node's capacity to use.
+// Nodes are never filled below the minimum occupancy, and the last node of
+// each level is balanced with its neighbour so it does not underflow.
+// Returns an error if the keys are not strictly increasing.
+func BulkLoad(pairs Iterator, degree int, fillFactor float64) (*Tree, error) {
+	return BulkLoadWithComparator(pairs, degree, fillFactor, Bytewise)
+}
+
+// BulkLoadWithComparator builds a tree ordered by cmp from pairs which are
+// already sorted by it
+func BulkLoadWithComparator(pairs Iterator, degree int, fillFactor float64, cmp Comparator) (*Tree, error) {
+	return NewTreeWithComparator(degree, cmp).BulkLoad(pairs, fillFactor)
+}
+
+// BulkLoad builds a new tree from pairs sorted by this tree's comparator, as
+// the function BulkLoad does. The new tree has this tree's degree and
+// comparator, and moves large values to the same overflow pages, so this tree
+// must be empty, and is replaced by the new one. Overflow pages are written
+// as if unlogged, with LSN 0.
+func (tree *Tree) BulkLoad(pairs Iterator, fillFactor float64) (*Tree, error) {
+	defer pairs.Close()
+	loaded := NewTreeWithComparator(tree.degree, tree.comparator)
+	if tree.overflow != nil {
+		loaded.overflow = tree.overflow
+		loaded.load = loaded.loadSlot
+	}
+
+	// A load which fails frees the overflow pages it wrote
+	written := make([]slot, 0)
+	started := false
+	var err error
+	next := func() (string, slot, bool) {
+		if started {
+			pairs.Next()
+		}
+		started = true
+		if !pairs.Valid() {
+			return "", slot{}, false
+		}
+		key := pairs.Key()
+		var s slot
+		if s, err = loaded.slotFor(key, pairs.Value(), 0); err != nil {
+			return "", slot{}, false
+		}
+		if s.pair == nil {
+			written = append(written, s)
+		}
+		return key, s, true
+	}
+	if buildErr := loaded.build(next, fillFactor); buildErr != nil {
+		err = buildErr
+	}
+	if err != nil {
+		for _, s := range written {
+			loaded.freeSlot(s)
+		}
+		return nil, err
+	}
+	return loaded, nil
+}
+
+// build fills an empty tree bottom-up from the entries returned by next,
+// which returns false once there are none left
+func (tree *BTree[K, V]) build(next func() (K, V, bool), fillFactor float64) error {
+	if fillFactor <= 0 || fillFactor > 1 {
+		panic("Fill factor must be in (0, 1]")
+	}
+
+	leaves, err := tree.buildLeaves(next, fillFactor)
+	if err != nil {
+		return err
+	}
+	if len(leaves) == 0 {
+		return nil
+	}
+
+	level := leaves
+	for len(level) > 1 {
+		level = tree.buildInternalLevel(level, fillFactor)
+	}
+	tree.root = level[0]
+	return nil
+}
+
+// nodeTarget is how many entries (for leaves) or children (for internal nodes)
+// to pack into each node, given the node's capacity and minimum occupancy
+func nodeTarget(capacity int, minimum int, fillFactor float64) int {
+	target := int(math.Round(float64(capacity) * fillFactor))
+	if target < minimum {
+		return minimum
+	}
+	return target
+}
+
+// buildLeaves packs the entries into linked leaves
+func (tree *BTree[K, V]) buildLeaves(next func() (K, V, bool), fillFactor float64) ([]*Node[K, V], error) {
+	leaves := make([]*Node[K, V], 0)
+	target := nodeTarget(tree.degree, (tree.degree+1)/2, fillFactor)
+	var leaf *Node[K, V]
+	var lastKey K
+
+	for key, value, ok := next(); ok; key, value, ok = next() {
+		if leaf != nil && tree.cmp.Compare(key, lastKey) <= 0 {
+			return nil, fmt.Errorf("bulk load input is not sorted: %s follows %s", formatKey(key), formatKey(lastKey))
+		}
+		lastKey = key
+
+		if leaf == nil || len(leaf.keys) == target {
+			next := tree.NewEmptyNode(true)
+			if leaf != nil {
+				leaf.linkAfter(next)
+			}
+			leaf = next
+			leaves = append(leaves, leaf)
+		}
+		leaf.keys = append(leaf.keys, key)
+		leaf.values = append(leaf.values, value)
+	}
+
+	if len(leaves) > 1 && rebalanceLast(leaves[len(leaves)-2], leaves[len(leaves)-1]) {
+		leaves[len(leaves)-1].unlink()
+		leaves = leaves[:len(leaves)-1]
+	}
+	for _, leaf := range leaves {
+		leaf.recount()
+	}
+	return leaves, nil
+}
+
+// buildInternalLevel creates the parents of a level of nodes, each holding
+// the target number of children
+func (tree *BTree[K, V]) buildInternalLevel(children []*Node[K, V], fillFactor float64) []*Node[K, V] {
+	parents := make([]*Node[K, V], 0)
+	target := nodeTarget(tree.degree+1, tree.degree/2+1, fillFactor)
+
+	for i := 0; i < len(children); i += target {
+		end := i + target
+		if end > len(children) {
+			end = len(children)
+		}
+
+		parent := tree.NewEmptyNode(false)
+		parent.children = append(parent.children, children[i:end]...)
+		parents = append(parents, parent)
+	}
+
+	if len(parents) > 1 && rebalanceLast(parents[len(parents)-2], parents[len(parents)-1]) {
+		parents = parents[:len(parents)-1]
+	}
+	for _, parent := range parents {
+		parent.adopt(parent.children)
+		parent.recount()
+		for i, child := range parent.children[1:] {
+			previous := parent.children[i]
+			parent.keys = append(parent.keys, tree.cmp.Separator(previous.highestKey(), child.lowestKey()))
+		}
+	}
+	return parents
+}
+
+// rebalanceLast fixes up the last two nodes of a level if the last one fell
+// below the minimum occupancy. If their entries fit in one node, they are
+// all moved into prev and true is returned, meaning last should be dropped.
+// Otherwise there are more than a full node's worth, so splitting them evenly
+// leaves both nodes above the minimum.
+// Separator keys are not yet set, so internal nodes only need children moving.
+func rebalanceLast[K any, V any](prev *Node[K, V], last *Node[K, V]) bool {
+	size, prevSize := len(last.keys), len(prev.keys)
+	minimum, capacity := last.minSize(), last.tree.degree
+	if !last.isLeaf {
+		size, prevSize = len(last.children), len(prev.children)
+		minimum, capacity = minimum+1, capacity+1
+	}
+	if size >= minimum {
+		return false
+	}
+
+	split := prevSize + size
+	if split > capacity {
+		split /= 2
+	}
+	if last.isLeaf {
+		prev.keys, last.keys = redistribute(prev.keys, last.keys, split)
+		prev.values, last.values = redistribute(prev.values, last.values, split)
+	} else {
+		prev.children, last.children = redistribute(prev.children, last.children, split)
+	}
+	return split == prevSize+size
+}
+
+// redistribute moves items between two slices so that the first holds the
+// first n of them, and the second the rest
+func redistribute[T any](first []T, second []T, n int) ([]T, []T) {
+	all := append(append(make([]T, 0, len(first)+len(second)), first...), second...)
+	return append(first[:0], all[:n]...), append(second[:0], all[n:]...)
+}
+
+// lowestKey returns the smallest key under this node
+func (n *Node[K, V]) lowestKey() K {
+	return n.leftmostLeaf().keys[0]
+}
+
+// highestKey returns the largest key under this node
+func (n *Node[K, V]) highestKey() K {
+	for !n.isLeaf {
+		n = n.children[len(n.children)-1]
+	}
+	return n.keys[len(n.keys)-1]
+}
@@ -0,0 +1,89 @@
+package inmemory_btree
+
+import (
+	"fmt"
+	"testing"
+
+	. "yadb-go/pkg/store"
+)
+
+func TestBulkLoad(t *testing.T) {
+	for _, degree := range []int{2, 3, 4, 10} {
+		for _, fillFactor := range []float64{0.1, 0.5, 0.9, 1} {
+			for _, n := range []int{0, 1, 2, 3, 7, 50, 333} {
+				name := fmt.Sprintf("degree=%d/fill=%.1f/n=%d", degree, fillFactor, n)
+				t.Run(name, func(t *testing.T) {
+					tree, err := BulkLoad(NewSliceIterator(sortedPairs(n)), degree, fillFactor)
+					if err != nil {
+						t.Fatal(err)
+					}
+
+					checkInvariants(t, tree)
+					assertKeys(t, collectKeys(tree.Scan("", "")), 0, n)
+					assertKeys(t, reversed(collectKeys(tree.NewIterator(ScanOptions{Reverse: true}))), 0, n)
+					for i := 0; i < n; i++ {
+						assertKeyFound(t, tree, fmt.Sprintf("key%03d", i), fmt.Sprintf("val%03d", i))
+					}
+				})
+			}
+		}
+	}
+}
+
+// With a fill factor of 1, every leaf but the last should be full
+func TestBulkLoad__packsLeaves(t *testing.T) {
+	tree, err := BulkLoad(NewSliceIterator(sortedPairs(100)), 10, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	leaves := 0
+	for leaf := tree.root.leftmostLeaf(); leaf != nil; leaf = leaf.next {
+		leaves++
+		if len(leaf.keys) != 10 {
+			t.Fatalf("Expected full leaves, found one with %d pairs", len(leaf.keys))
+		}
+	}
+	if leaves != 10 {
+		t.Fatalf("Expected 10 leaves, found %d", leaves)
+	}
+}
+
+func TestBulkLoad__rejectsUnsortedInput(t *testing.T) {
+	unsorted := []KeyValuePair{{Key: "b"}, {Key: "a"}}
+	if _, err := BulkLoad(NewSliceIterator(unsorted), 3, 1); err == nil {
+		t.Fatalf("Expected an error for unsorted input")
+	}
+
+	duplicates := []KeyValuePair{{Key: "a"}, {Key: "a"}}
+	if _, err := BulkLoad(NewSliceIterator(duplicates), 3, 1); err == nil {
+		t.Fatalf("Expected an error for duplicate keys")
+	}
+}
+
+// A bulk loaded tree should behave like any other under later modifications
+func TestBulkLoad__thenModify(t *testing.T) {
+	tree, err := BulkLoad(NewSliceIterator(sortedPairs(200)), 4, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 200; i += 2 {
+		tree.Delete(fmt.Sprintf("key%03d", i))
+		checkInvariants(t, tree)
+	}
+	for i := 0; i < 200; i += 2 {
+		tree.Set(fmt.Sprintf("key%03d", i), "new")
+		checkInvariants(t, tree)
+	}
+	assertKeys(t, collectKeys(tree.Scan("", "")), 0, 200)
+}
+
+// sortedPairs returns key000 to key<n-1>, each with the value val<i>
+func sortedPairs(n int) []KeyValuePair {
+	pairs := make([]KeyValuePair, n)
+	for i := range pairs {
+		pairs[i] = KeyValuePair{Key: fmt.Sprintf("key%03d", i), Value: fmt.Sprintf("val%03d", i)}
+	}
+	return pairs
+}
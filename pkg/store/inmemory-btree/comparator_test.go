@@ -0,0 +1,96 @@
+package inmemory_btree
+
+import (
+	"math/rand"
+	"testing"
+
+	. "yadb-go/pkg/store"
+)
+
+func TestComparator__caseInsensitive(t *testing.T) {
+	tree := NewTreeWithComparator(3, CaseInsensitive)
+	for _, key := range []string{"banana", "Apple", "cherry", "apple", "BANANA", "Date"} {
+		tree.Set(key, key)
+		checkInvariants(t, tree)
+	}
+
+	// Keys differing only in case are the same key, so later writes overwrite
+	// earlier ones, key and all
+	if pair := tree.Get("APPLE"); pair == nil || pair.Key != "apple" || pair.Value != "apple" {
+		t.Fatalf("Expected to find the pair last written as apple, found %s", pair.String())
+	}
+	assertKeyList(t, collectKeys(tree.Scan("", "")), "apple", "BANANA", "cherry", "Date")
+	assertKeyList(t, collectKeys(tree.Scan("b", "d")), "BANANA", "cherry")
+
+	tree.Delete("CHERRY")
+	assertKeyNotFound(t, tree, "cherry")
+	if pair := tree.Floor("c"); pair == nil || pair.Key != "BANANA" {
+		t.Fatalf("Expected the floor of 'c' to be BANANA, found %s", pair.String())
+	}
+}
+
+func TestComparator__caseInsensitivePrefix(t *testing.T) {
+	tree := NewTreeWithComparator(3, CaseInsensitive)
+	for _, key := range []string{"a/1", "A/2", "a/3", "A/4", "b"} {
+		tree.Set(key, "val")
+	}
+
+	// Keys with the prefix aren't adjacent, so the rest are skipped over
+	assertKeyList(t, collectKeys(tree.ScanPrefix("a/")), "a/1", "a/3")
+	keys := collectKeys(tree.NewIterator(ScanOptions{Prefix: "A/", Reverse: true}))
+	assertKeyList(t, keys, "A/4", "A/2")
+	keys = collectKeys(tree.NewIterator(ScanOptions{Prefix: "a/", Limit: 1}))
+	assertKeyList(t, keys, "a/1")
+}
+
+func TestComparator__int64Tuple(t *testing.T) {
+	for _, degree := range []int{2, 3, 5} {
+		tree := NewTreeWithComparator(degree, Int64Tuple)
+		rng := rand.New(rand.NewSource(int64(degree)))
+		for _, i := range rng.Perm(200) {
+			tree.Set(EncodeInt64Tuple(int64(i-100), int64(i%3)), "val")
+			checkInvariants(t, tree)
+		}
+		for i := 0; i < 200; i += 2 {
+			tree.Delete(EncodeInt64Tuple(int64(i-100), int64(i%3)))
+			checkInvariants(t, tree)
+		}
+
+		// Negative ids sort first, and each id is ordered numerically
+		it := tree.Scan(EncodeInt64Tuple(-10), EncodeInt64Tuple(10))
+		expected := int64(-9)
+		for ; it.Valid(); it.Next() {
+			values, err := DecodeInt64Tuple(it.Key())
+			if err != nil || values[0] != expected {
+				t.Fatalf("Expected id %d, found %v", expected, values)
+			}
+			expected += 2
+		}
+		it.Close()
+		if expected != 11 {
+			t.Fatalf("Expected to scan up to id 9, stopped before %d", expected)
+		}
+	}
+}
+
+func TestComparator__bulkLoad(t *testing.T) {
+	pairs := make([]KeyValuePair, 0)
+	for i := -50; i < 50; i++ {
+		pairs = append(pairs, KeyValuePair{Key: EncodeInt64Tuple(int64(i)), Value: "val"})
+	}
+
+	tree, err := BulkLoadWithComparator(NewSliceIterator(pairs), 4, DefaultFillFactor, Int64Tuple)
+	if err != nil {
+		t.Fatalf("Bulk load failed: %v", err)
+	}
+	checkInvariants(t, tree)
+	if first := tree.First(); first == nil || first.Key != EncodeInt64Tuple(-50) {
+		t.Fatalf("Expected the first key to be -50")
+	}
+
+	// Sorted bytewise, but not numerically
+	_, err = BulkLoadWithComparator(NewSliceIterator(pairs[49:51]), 4, DefaultFillFactor, Bytewise)
+	if err == nil {
+		t.Fatalf("Expected an error loading keys out of order for the comparator")
+	}
+}
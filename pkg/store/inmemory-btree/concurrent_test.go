@@ -0,0 +1,250 @@
+package inmemory_btree
+
+import (
+	"fmt"
+	"math/rand"
+	"strconv"
+	"sync"
+	"testing"
+
+	. "yadb-go/pkg/store"
+)
+
+// These tests are most useful under the race detector: go test -race
+
+// Each writer owns a range of keys, so it knows exactly what Get must return,
+// while the ranges interleave to make writers share leaves
+func TestConcurrentSetGetDelete(t *testing.T) {
+	for _, degree := range []int{2, 3, 10} {
+		t.Run("degree="+strconv.Itoa(degree), func(t *testing.T) {
+			tree := NewTree(degree)
+			const writers, keysPerWriter, ops = 8, 100, 2000
+
+			expected := make([]map[string]string, writers)
+			var wg sync.WaitGroup
+			for w := 0; w < writers; w++ {
+				expected[w] = make(map[string]string)
+				wg.Add(1)
+				go func(w int, owned map[string]string) {
+					defer wg.Done()
+					rng := rand.New(rand.NewSource(int64(w)))
+					for i := 0; i < ops; i++ {
+						key := fmt.Sprintf("key%04d", rng.Intn(keysPerWriter)*writers+w)
+						switch rng.Intn(3) {
+						case 0:
+							tree.Delete(key)
+							delete(owned, key)
+						case 1:
+							value := "val" + strconv.Itoa(i)
+							tree.Set(key, value)
+							owned[key] = value
+						}
+
+						pair := tree.Get(key)
+						value, found := owned[key]
+						if found != (pair != nil) || found && pair.Value != value {
+							t.Errorf("Get(%s) = %v, expected %q (present: %v)", key, pair, value, found)
+							return
+						}
+					}
+				}(w, expected[w])
+			}
+			wg.Wait()
+
+			checkInvariants(t, tree)
+			count := 0
+			for _, owned := range expected {
+				for key, value := range owned {
+					assertKeyFound(t, tree, key, value)
+				}
+				count += len(owned)
+			}
+			if keys := collectKeys(tree.Scan("", "")); len(keys) != count {
+				t.Fatalf("Expected %d keys in the tree, found %d", count, len(keys))
+			}
+		})
+	}
+}
+
+// Writers fight over the same few keys, forcing the same leaves to split and
+// merge repeatedly
+func TestConcurrentSetDelete__sameKeys(t *testing.T) {
+	tree := NewTree(2)
+	var wg sync.WaitGroup
+	for w := 0; w < 8; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			rng := rand.New(rand.NewSource(int64(w)))
+			for i := 0; i < 3000; i++ {
+				key := "key" + strconv.Itoa(rng.Intn(40))
+				if rng.Intn(2) == 0 {
+					tree.Delete(key)
+				} else {
+					tree.Set(key, key)
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+
+	checkInvariants(t, tree)
+	for _, key := range collectKeys(tree.Scan("", "")) {
+		assertKeyFound(t, tree, key, key)
+	}
+}
+
+// Scans running alongside writers must always see keys in order, and must see
+// every key which is never modified
+func TestConcurrentScans(t *testing.T) {
+	tree := NewTree(3)
+	// Even keys are stable, odd keys are churned by the writers
+	for i := 0; i < 500; i += 2 {
+		tree.Set(fmt.Sprintf("key%04d", i), "stable")
+	}
+
+	var writers, readers sync.WaitGroup
+	done := make(chan struct{})
+	for w := 0; w < 4; w++ {
+		writers.Add(1)
+		go func(w int) {
+			defer writers.Done()
+			rng := rand.New(rand.NewSource(int64(w)))
+			for i := 0; i < 3000; i++ {
+				key := fmt.Sprintf("key%04d", rng.Intn(250)*2+1)
+				if rng.Intn(2) == 0 {
+					tree.Delete(key)
+				} else {
+					tree.Set(key, "churn")
+				}
+			}
+		}(w)
+	}
+
+	for r := 0; r < 4; r++ {
+		readers.Add(1)
+		go func(reverse bool) {
+			defer readers.Done()
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				if !checkConcurrentScan(t, tree.NewIterator(ScanOptions{Reverse: reverse}), reverse) {
+					return
+				}
+			}
+		}(r%2 == 1)
+	}
+
+	writers.Wait()
+	close(done)
+	readers.Wait()
+	checkInvariants(t, tree)
+}
+
+func checkConcurrentScan(t *testing.T, it Iterator, reverse bool) bool {
+	defer it.Close()
+
+	stable := 0
+	previous := ""
+	for ; it.Valid(); it.Next() {
+		key := it.Key()
+		if previous != "" && (key <= previous) != reverse || key == previous {
+			t.Errorf("Scan returned %s after %s", key, previous)
+			return false
+		}
+		if it.Value() == "stable" {
+			stable++
+		}
+		previous = key
+	}
+
+	if stable != 250 {
+		t.Errorf("Expected a scan to see all 250 stable keys, saw %d", stable)
+		return false
+	}
+	return true
+}
+
+// A pessimistic insert releases every node above the lowest safe one, so
+// writers elsewhere in the tree aren't held up behind it
+func TestFindLeafExclusive__releasesSafeAncestors(t *testing.T) {
+	tree, key := treeWithFullLeafUnderSafeNode(t, false)
+	length := tree.Len()
+
+	path := tree.findLeafExclusive(key, opInsert)
+	if path.rootLatched || path.isTop(tree.root) {
+		t.Fatalf("Expected the root to be released")
+	}
+	if !tree.rootLatch.TryLock() || !tree.root.latch.TryLock() {
+		t.Fatalf("Expected the root to be unlatched")
+	}
+	tree.root.latch.Unlock()
+	tree.rootLatch.Unlock()
+
+	leaf := path.leaf()
+	leaf.insert(key, slot{pair: &KeyValuePair{Key: key, Value: key}})
+	leaf.split()
+	path.release()
+
+	checkInvariants(t, tree)
+	if tree.Len() != length+1 {
+		t.Fatalf("Expected %d keys, found %d", length+1, tree.Len())
+	}
+}
+
+// If another writer inserts the key between the optimistic and pessimistic
+// descents, the pessimistic insert is an overwrite, which doesn't change the
+// counts it has already adjusted
+func TestFindLeafExclusive__correctsAWrongGuess(t *testing.T) {
+	tree, key := treeWithFullLeafUnderSafeNode(t, true)
+	length := tree.Len()
+
+	path := tree.findLeafExclusive(key, opInsert)
+	if !path.stale {
+		t.Fatalf("Expected the released nodes to be adjusted by the wrong delta")
+	}
+	path.leaf().insert(key, slot{pair: &KeyValuePair{Key: key, Value: "new"}})
+	path.release()
+	if tree.Validate() == nil {
+		t.Fatalf("Expected the counts of the released nodes to be wrong")
+	}
+
+	tree.recountPath(key)
+	checkInvariants(t, tree)
+	if tree.Len() != length {
+		t.Fatalf("Expected %d keys, found %d", length, tree.Len())
+	}
+}
+
+// treeWithFullLeafUnderSafeNode returns a tree and a key (present or not)
+// whose leaf is full, while a node between it and the root has room for
+// another key
+func treeWithFullLeafUnderSafeNode(t *testing.T, present bool) (*Tree, string) {
+	tree := NewTree(3)
+	for _, i := range rand.New(rand.NewSource(1)).Perm(100) {
+		tree.Set(fmt.Sprintf("key%03d", 2*i), "value")
+	}
+
+	for i := 0; i < 200; i++ {
+		key := fmt.Sprintf("key%03d", i)
+		if (i%2 == 0) != present {
+			continue
+		}
+		n := tree.root
+		safe := false
+		for !n.isLeaf {
+			if n != tree.root && n.isSafe(opInsert, key, false) {
+				safe = true
+			}
+			n = n.children[n.findIndex(key)]
+		}
+		if safe && n.size() == tree.degree {
+			return tree, key
+		}
+	}
+	t.Fatalf("Found no full leaf under a safe node")
+	return nil, ""
+}
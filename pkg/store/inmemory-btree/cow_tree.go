@@ -0,0 +1,592 @@
+package inmemory_btree
+
+import (
+	"sort"
+	"sync"
+	"sync/atomic"
+
+	. "yadb-go/pkg/store"
+)
+
+// CowTree is a copy-on-write (path copying) B+ Tree. Snapshot returns a
+// read-only view of the tree as it is at that moment, which stays valid and
+// unchanged however the tree is modified afterwards.
+//
+// Nodes are reference counted, by the nodes and versions pointing at them. A
+// node which is shared, because a snapshot can still reach it, is copied
+// before being modified, along with the path from the root to it, so every
+// change produces a new root. A node referenced only by the current version is
+// modified in place instead. Releasing a snapshot drops its references, and
+// the nodes which only it could reach become garbage.
+//
+// Unlike Tree, nodes have no parent or sibling pointers, as a shared node may
+// have a different parent and siblings in each version.
+type CowTree struct {
+	mu     sync.RWMutex // held exclusively by writers, which modify unshared nodes in place
+	root   *cowNode
+	degree int
+	cmp    Comparator
+}
+
+type cowNode struct {
+	refs     atomic.Int32
+	keys     []string        // separator keys, only set for internal nodes
+	children []*cowNode      // only set for internal nodes
+	pairs    []*KeyValuePair // only set for leaves
+}
+
+// NewCowTree creates a new copy-on-write B-Tree with the given degree, which
+// orders keys bytewise
+func NewCowTree(degree int) *CowTree {
+	return NewCowTreeWithComparator(degree, Bytewise)
+}
+
+// NewCowTreeWithComparator creates a new copy-on-write B-Tree which orders
+// keys by cmp
+func NewCowTreeWithComparator(degree int, cmp Comparator) *CowTree {
+	if degree < 2 {
+		panic("Degree must be >= 2")
+	}
+
+	return &CowTree{
+		root:   newCowNode(),
+		degree: degree,
+		cmp:    cmp,
+	}
+}
+
+func newCowNode() *cowNode {
+	n := &cowNode{}
+	n.refs.Store(1)
+	return n
+}
+
+// Get Returns a pointer to the KeyValuePair if the key exists in this Tree
+// otherwise returns nil
+func (t *CowTree) Get(key string) *KeyValuePair {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return t.root.get(key, t.cmp)
+}
+
+// Set a key-value pair into the tree, overwriting any existing value
+func (t *CowTree) Set(key string, value string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.root = t.root.exclusive()
+	separator, right := t.root.insert(&KeyValuePair{Key: key, Value: value}, t.cmp, t.degree)
+	if right != nil {
+		// The old root and its new sibling are now referenced by the new root
+		// rather than the tree, so their counts are unchanged
+		newRoot := newCowNode()
+		newRoot.keys = []string{separator}
+		newRoot.children = []*cowNode{t.root, right}
+		t.root = newRoot
+	}
+}
+
+// Delete removes a key from the tree
+func (t *CowTree) Delete(key string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	// Don't copy the path to a key which isn't there
+	if t.root.get(key, t.cmp) == nil {
+		return
+	}
+	t.root = t.root.exclusive()
+	t.root.delete(key, t.cmp, t.degree)
+	if !t.root.isLeaf() && len(t.root.keys) == 0 {
+		// The tree takes over the old root's reference to its only child
+		t.root = t.root.children[0]
+	}
+}
+
+// Snapshot returns a read-only view of the tree as it is now. It should be
+// released once finished with, so that nodes it shares with the tree no
+// longer need to be copied before being modified.
+func (t *CowTree) Snapshot() *Snapshot {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	t.root.refs.Add(1)
+	return &Snapshot{root: t.root, cmp: t.cmp}
+}
+
+// NewIterator returns an iterator over the pairs in the range described by
+// opts, in key order. It reads from a snapshot, so is not affected by changes
+// made to the tree while it is open.
+func (t *CowTree) NewIterator(opts ScanOptions) Iterator {
+	snapshot := t.Snapshot()
+	return NewRangeIteratorWithComparator(&cowCursor{root: snapshot.root, cmp: t.cmp, snapshot: snapshot}, opts, t.cmp)
+}
+
+// ScanPrefix returns an iterator over the keys starting with prefix
+func (t *CowTree) ScanPrefix(prefix string) Iterator {
+	return t.NewIterator(ScanOptions{Prefix: prefix})
+}
+
+// First returns the pair with the smallest key, or nil if the tree is empty
+func (t *CowTree) First() *KeyValuePair {
+	return t.Ceiling("")
+}
+
+// Last returns the pair with the largest key, or nil if the tree is empty
+func (t *CowTree) Last() *KeyValuePair {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	c := &cowCursor{root: t.root, cmp: t.cmp}
+	c.SeekLast()
+	return c.pair()
+}
+
+// Floor returns the pair with the largest key <= key, or nil if there is none
+func (t *CowTree) Floor(key string) *KeyValuePair {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	c := &cowCursor{root: t.root, cmp: t.cmp}
+	c.SeekLE(key)
+	return c.pair()
+}
+
+// Ceiling returns the pair with the smallest key >= key, or nil if there is none
+func (t *CowTree) Ceiling(key string) *KeyValuePair {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	c := &cowCursor{root: t.root, cmp: t.cmp}
+	c.SeekGE(key)
+	return c.pair()
+}
+
+// Snapshot is an immutable version of a CowTree. It implements Store so it
+// can be read like any other, but Set and Delete panic. It is safe for
+// concurrent use, without any locking.
+type Snapshot struct {
+	root     *cowNode
+	cmp      Comparator
+	released atomic.Bool
+}
+
+func (s *Snapshot) Get(key string) *KeyValuePair {
+	return s.root.get(key, s.cmp)
+}
+
+func (s *Snapshot) Set(key string, value string) {
+	panic("Snapshot is read-only")
+}
+
+func (s *Snapshot) Delete(key string) {
+	panic("Snapshot is read-only")
+}
+
+func (s *Snapshot) NewIterator(opts ScanOptions) Iterator {
+	return NewRangeIteratorWithComparator(&cowCursor{root: s.root, cmp: s.cmp}, opts, s.cmp)
+}
+
+func (s *Snapshot) ScanPrefix(prefix string) Iterator {
+	return s.NewIterator(ScanOptions{Prefix: prefix})
+}
+
+func (s *Snapshot) First() *KeyValuePair {
+	return s.Ceiling("")
+}
+
+func (s *Snapshot) Last() *KeyValuePair {
+	c := &cowCursor{root: s.root, cmp: s.cmp}
+	c.SeekLast()
+	return c.pair()
+}
+
+func (s *Snapshot) Floor(key string) *KeyValuePair {
+	c := &cowCursor{root: s.root, cmp: s.cmp}
+	c.SeekLE(key)
+	return c.pair()
+}
+
+func (s *Snapshot) Ceiling(key string) *KeyValuePair {
+	c := &cowCursor{root: s.root, cmp: s.cmp}
+	c.SeekGE(key)
+	return c.pair()
+}
+
+// Release drops the snapshot's reference to its version of the tree. The
+// snapshot, and any iterators over it, must not be used afterwards. Releasing
+// more than once has no effect.
+func (s *Snapshot) Release() {
+	if s.released.CompareAndSwap(false, true) {
+		s.root.decRef()
+	}
+}
+
+func (n *cowNode) isLeaf() bool {
+	return n.children == nil
+}
+
+// decRef drops a reference to this node. Once nothing references it, it
+// drops its own references to its children.
+func (n *cowNode) decRef() {
+	if n.refs.Add(-1) > 0 {
+		return
+	}
+	for _, child := range n.children {
+		child.decRef()
+	}
+}
+
+// exclusive returns a node which may be modified in place, to use instead of
+// this one: either this node, if only one version references it, or a copy. The
+// caller must replace its reference to n with the returned node.
+func (n *cowNode) exclusive() *cowNode {
+	if n.refs.Load() == 1 {
+		return n
+	}
+
+	c := newCowNode()
+	if n.isLeaf() {
+		c.pairs = append(make([]*KeyValuePair, 0, len(n.pairs)+1), n.pairs...)
+	} else {
+		c.keys = append(make([]string, 0, len(n.keys)+1), n.keys...)
+		c.children = append(make([]*cowNode, 0, len(n.children)+1), n.children...)
+		for _, child := range c.children {
+			child.refs.Add(1)
+		}
+	}
+	n.decRef()
+	return c
+}
+
+// exclusiveChild makes child i of this (exclusive) node exclusive, and returns it
+func (n *cowNode) exclusiveChild(i int) *cowNode {
+	n.children[i] = n.children[i].exclusive()
+	return n.children[i]
+}
+
+func (n *cowNode) get(key string, cmp Comparator) *KeyValuePair {
+	for !n.isLeaf() {
+		n = n.children[n.childIndex(key, cmp)]
+	}
+	i := n.pairIndex(key, cmp)
+	if i < len(n.pairs) && cmp.Compare(n.pairs[i].Key, key) == 0 {
+		return n.pairs[i]
+	}
+	return nil
+}
+
+// childIndex returns the index of the child which should contain the key,
+// the number of separator keys which are <= key
+func (n *cowNode) childIndex(key string, cmp Comparator) int {
+	return sort.Search(len(n.keys), func(i int) bool {
+		return cmp.Compare(n.keys[i], key) > 0
+	})
+}
+
+// pairIndex returns the index of the first pair in a leaf with a key >= key
+func (n *cowNode) pairIndex(key string, cmp Comparator) int {
+	return sort.Search(len(n.pairs), func(i int) bool {
+		return cmp.Compare(n.pairs[i].Key, key) >= 0
+	})
+}
+
+func (n *cowNode) size() int {
+	if n.isLeaf() {
+		return len(n.pairs)
+	}
+	return len(n.keys)
+}
+
+// minSize is the fewest entries or keys a node other than the root may hold,
+// as for Node.minSize
+func (n *cowNode) minSize(degree int) int {
+	if n.isLeaf() {
+		return (degree + 1) / 2
+	}
+	return degree / 2
+}
+
+// insert adds a pair under this exclusive node. If the node overflows it is
+// split, and the new right-hand node is returned with the key separating it
+// from this one.
+func (n *cowNode) insert(pair *KeyValuePair, cmp Comparator, degree int) (string, *cowNode) {
+	if n.isLeaf() {
+		i := n.pairIndex(pair.Key, cmp)
+		if i < len(n.pairs) && cmp.Compare(n.pairs[i].Key, pair.Key) == 0 {
+			// Snapshots may share the old pair, so it is replaced rather than
+			// modified. As in Tree, the key is replaced too, as keys which
+			// compare equal may still differ.
+			n.pairs[i] = pair
+			return "", nil
+		}
+		n.pairs = append(n.pairs, nil)
+		copy(n.pairs[i+1:], n.pairs[i:])
+		n.pairs[i] = pair
+	} else {
+		i := n.childIndex(pair.Key, cmp)
+		separator, right := n.exclusiveChild(i).insert(pair, cmp, degree)
+		if right != nil {
+			n.keys = append(n.keys, "")
+			copy(n.keys[i+1:], n.keys[i:])
+			n.keys[i] = separator
+			n.children = append(n.children, nil)
+			copy(n.children[i+2:], n.children[i+1:])
+			n.children[i+1] = right
+		}
+	}
+
+	if n.size() <= degree {
+		return "", nil
+	}
+	return n.split(cmp, degree)
+}
+
+// split moves the upper half of an overfull node into a new right-hand node,
+// using the same split points as Node.split
+func (n *cowNode) split(cmp Comparator, degree int) (string, *cowNode) {
+	right := newCowNode()
+	if n.isLeaf() {
+		splitIndex := (degree + 1) / 2
+		right.pairs = append(right.pairs, n.pairs[splitIndex:]...)
+		for i := splitIndex; i < len(n.pairs); i++ {
+			n.pairs[i] = nil
+		}
+		n.pairs = n.pairs[:splitIndex]
+		return cmp.Separator(n.pairs[splitIndex-1].Key, right.pairs[0].Key), right
+	}
+
+	splitIndex := degree / 2
+	separator := n.keys[splitIndex]
+	right.keys = append(right.keys, n.keys[splitIndex+1:]...)
+	right.children = append(right.children, n.children[splitIndex+1:]...)
+	for i := splitIndex + 1; i < len(n.children); i++ {
+		n.children[i] = nil
+	}
+	n.keys = n.keys[:splitIndex]
+	n.children = n.children[:splitIndex+1]
+	return separator, right
+}
+
+// delete removes a key from under this exclusive node, rebalancing any child
+// left underfull
+func (n *cowNode) delete(key string, cmp Comparator, degree int) {
+	if n.isLeaf() {
+		i := n.pairIndex(key, cmp)
+		if i < len(n.pairs) && cmp.Compare(n.pairs[i].Key, key) == 0 {
+			copy(n.pairs[i:], n.pairs[i+1:])
+			n.pairs[len(n.pairs)-1] = nil
+			n.pairs = n.pairs[:len(n.pairs)-1]
+		}
+		return
+	}
+
+	i := n.childIndex(key, cmp)
+	child := n.exclusiveChild(i)
+	child.delete(key, cmp, degree)
+	if child.size() < child.minSize(degree) {
+		n.rebalance(i, cmp, degree)
+	}
+}
+
+// rebalance fixes underfull child i by borrowing from or merging with a
+// sibling, as Node.maybeMerge does. Siblings are only copied if they change.
+func (n *cowNode) rebalance(i int, cmp Comparator, degree int) {
+	child := n.children[i]
+	if i > 0 && n.children[i-1].size() > n.children[i-1].minSize(degree) {
+		left := n.exclusiveChild(i - 1)
+		if child.isLeaf() {
+			last := len(left.pairs) - 1
+			child.pairs = append([]*KeyValuePair{left.pairs[last]}, child.pairs...)
+			left.pairs[last] = nil
+			left.pairs = left.pairs[:last]
+			n.keys[i-1] = cmp.Separator(left.pairs[last-1].Key, child.pairs[0].Key)
+		} else {
+			last := len(left.children) - 1
+			child.keys = append([]string{n.keys[i-1]}, child.keys...)
+			child.children = append([]*cowNode{left.children[last]}, child.children...)
+			n.keys[i-1] = left.keys[len(left.keys)-1]
+			left.keys = left.keys[:len(left.keys)-1]
+			left.children[last] = nil
+			left.children = left.children[:last]
+		}
+		return
+	}
+
+	if i < len(n.children)-1 && n.children[i+1].size() > n.children[i+1].minSize(degree) {
+		right := n.exclusiveChild(i + 1)
+		if child.isLeaf() {
+			child.pairs = append(child.pairs, right.pairs[0])
+			right.pairs = append(right.pairs[:0], right.pairs[1:]...)
+			n.keys[i] = cmp.Separator(child.pairs[len(child.pairs)-1].Key, right.pairs[0].Key)
+		} else {
+			child.keys = append(child.keys, n.keys[i])
+			child.children = append(child.children, right.children[0])
+			n.keys[i] = right.keys[0]
+			right.keys = append(right.keys[:0], right.keys[1:]...)
+			right.children = append(right.children[:0], right.children[1:]...)
+		}
+		return
+	}
+
+	// Merge the right-hand node of the pair into the left. The right node is
+	// dropped, and its references to its children pass to the left node.
+	if i == 0 {
+		i++
+	}
+	left, right := n.exclusiveChild(i-1), n.exclusiveChild(i)
+	if left.isLeaf() {
+		left.pairs = append(left.pairs, right.pairs...)
+	} else {
+		left.keys = append(left.keys, n.keys[i-1])
+		left.keys = append(left.keys, right.keys...)
+		left.children = append(left.children, right.children...)
+	}
+	copy(n.keys[i-1:], n.keys[i:])
+	n.keys = n.keys[:len(n.keys)-1]
+	copy(n.children[i:], n.children[i+1:])
+	n.children[len(n.children)-1] = nil
+	n.children = n.children[:len(n.children)-1]
+}
+
+// cowCursor walks an immutable version of a CowTree. As nodes have no sibling
+// links, it keeps the path from the root to its position.
+type cowCursor struct {
+	root     *cowNode
+	cmp      Comparator
+	path     []cowFrame
+	snapshot *Snapshot // released on Close, if the cursor owns one
+}
+
+type cowFrame struct {
+	node  *cowNode
+	index int
+}
+
+func (c *cowCursor) SeekGE(key string) {
+	leaf := c.descend(func(n *cowNode) int { return n.childIndex(key, c.cmp) })
+	c.path = append(c.path, cowFrame{leaf, leaf.pairIndex(key, c.cmp)})
+	c.settleForward()
+}
+
+func (c *cowCursor) SeekLE(key string) {
+	leaf := c.descend(func(n *cowNode) int { return n.childIndex(key, c.cmp) })
+	i := leaf.pairIndex(key, c.cmp)
+	if i == len(leaf.pairs) || c.cmp.Compare(leaf.pairs[i].Key, key) != 0 {
+		i--
+	}
+	c.path = append(c.path, cowFrame{leaf, i})
+	c.settleBackward()
+}
+
+func (c *cowCursor) SeekLast() {
+	leaf := c.descend(func(n *cowNode) int { return len(n.children) - 1 })
+	c.path = append(c.path, cowFrame{leaf, len(leaf.pairs) - 1})
+	c.settleBackward()
+}
+
+func (c *cowCursor) Next() {
+	if c.Valid() {
+		c.path[len(c.path)-1].index++
+		c.settleForward()
+	}
+}
+
+func (c *cowCursor) Prev() {
+	if c.Valid() {
+		c.path[len(c.path)-1].index--
+		c.settleBackward()
+	}
+}
+
+func (c *cowCursor) Valid() bool {
+	return len(c.path) > 0
+}
+
+func (c *cowCursor) Key() string {
+	return c.pair().Key
+}
+
+func (c *cowCursor) Value() string {
+	return c.pair().Value
+}
+
+func (c *cowCursor) Close() {
+	c.path = nil
+	if c.snapshot != nil {
+		c.snapshot.Release()
+	}
+}
+
+// pair returns the pair the cursor is positioned at, or nil
+func (c *cowCursor) pair() *KeyValuePair {
+	if !c.Valid() {
+		return nil
+	}
+	top := c.path[len(c.path)-1]
+	return top.node.pairs[top.index]
+}
+
+// descend resets the path to lead from the root to a leaf, excluding the
+// leaf itself, which is returned. choose picks which child to follow.
+func (c *cowCursor) descend(choose func(*cowNode) int) *cowNode {
+	c.path = c.path[:0]
+	n := c.root
+	for !n.isLeaf() {
+		i := choose(n)
+		c.path = append(c.path, cowFrame{n, i})
+		n = n.children[i]
+	}
+	return n
+}
+
+// settleForward moves a position past the end of a leaf onto the first pair
+// of the next leaf, emptying the path if there is none
+func (c *cowCursor) settleForward() {
+	top := c.path[len(c.path)-1]
+	if top.index < len(top.node.pairs) {
+		return
+	}
+
+	// Climb to the nearest ancestor with a child further right
+	c.path = c.path[:len(c.path)-1]
+	for len(c.path) > 0 && c.path[len(c.path)-1].index == len(c.path[len(c.path)-1].node.children)-1 {
+		c.path = c.path[:len(c.path)-1]
+	}
+	if len(c.path) == 0 {
+		return
+	}
+	c.path[len(c.path)-1].index++
+
+	// Then descend along leftmost children
+	n := c.path[len(c.path)-1].node.children[c.path[len(c.path)-1].index]
+	for !n.isLeaf() {
+		c.path = append(c.path, cowFrame{n, 0})
+		n = n.children[0]
+	}
+	c.path = append(c.path, cowFrame{n, 0})
+}
+
+// settleBackward moves a position before the start of a leaf onto the last
+// pair of the previous leaf, emptying the path if there is none
+func (c *cowCursor) settleBackward() {
+	top := c.path[len(c.path)-1]
+	if top.index >= 0 {
+		return
+	}
+
+	// Climb to the nearest ancestor with a child further left
+	c.path = c.path[:len(c.path)-1]
+	for len(c.path) > 0 && c.path[len(c.path)-1].index == 0 {
+		c.path = c.path[:len(c.path)-1]
+	}
+	if len(c.path) == 0 {
+		return
+	}
+	c.path[len(c.path)-1].index--
+
+	// Then descend along rightmost children
+	n := c.path[len(c.path)-1].node.children[c.path[len(c.path)-1].index]
+	for !n.isLeaf() {
+		c.path = append(c.path, cowFrame{n, len(n.children) - 1})
+		n = n.children[len(n.children)-1]
+	}
+	c.path = append(c.path, cowFrame{n, len(n.pairs) - 1})
+}
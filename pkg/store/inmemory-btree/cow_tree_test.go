@@ -0,0 +1,273 @@
+package inmemory_btree
+
+import (
+	"math/rand"
+	"sort"
+	"strconv"
+	"sync"
+	"testing"
+
+	. "yadb-go/pkg/store"
+)
+
+func TestCowTree(t *testing.T) {
+	for _, degree := range []int{2, 3, 4, 10} {
+		t.Run("degree="+strconv.Itoa(degree), func(t *testing.T) {
+			rng := rand.New(rand.NewSource(int64(degree)))
+			tree := NewCowTree(degree)
+			expected := make(map[string]string)
+
+			// Take snapshots along the way, each of which must keep seeing the
+			// contents of the tree at the time it was taken
+			snapshots := make([]*Snapshot, 0)
+			snapshotContents := make([]map[string]string, 0)
+
+			for i := 0; i < 3000; i++ {
+				key := "key" + strconv.Itoa(rng.Intn(300))
+				if rng.Intn(3) == 0 {
+					tree.Delete(key)
+					delete(expected, key)
+				} else {
+					value := "val" + strconv.Itoa(i)
+					tree.Set(key, value)
+					expected[key] = value
+				}
+				checkCowNode(t, tree.root, tree.cmp, degree, true)
+
+				if i%250 == 0 {
+					snapshots = append(snapshots, tree.Snapshot())
+					snapshotContents = append(snapshotContents, copyMap(expected))
+				}
+			}
+
+			assertStoreContents(t, tree, expected)
+			for i, snapshot := range snapshots {
+				assertStoreContents(t, snapshot, snapshotContents[i])
+				snapshot.Release()
+			}
+
+			// With every snapshot released, nothing is shared any more
+			checkCowRefs(t, tree.root)
+		})
+	}
+}
+
+func TestCowTree__releasedNodesAreModifiedInPlace(t *testing.T) {
+	tree := NewCowTree(3)
+	for i := 0; i < 100; i++ {
+		tree.Set("key"+strconv.Itoa(i), "val")
+	}
+
+	root := tree.root
+	tree.Set("key1", "changed")
+	if tree.root != root {
+		t.Fatalf("Expected an unshared root to be modified in place")
+	}
+
+	snapshot := tree.Snapshot()
+	tree.Set("key1", "changed again")
+	if tree.root == root {
+		t.Fatalf("Expected a root shared with a snapshot to be copied")
+	}
+	assertKeyValue(t, snapshot.Get("key1"), "changed")
+	assertKeyValue(t, tree.Get("key1"), "changed again")
+
+	snapshot.Release()
+	checkCowRefs(t, tree.root)
+}
+
+func TestCowTree__snapshotIsReadOnly(t *testing.T) {
+	snapshot := NewCowTree(3).Snapshot()
+	defer snapshot.Release()
+	defer func() {
+		if recover() == nil {
+			t.Fatalf("Expected Set on a snapshot to panic")
+		}
+	}()
+
+	snapshot.Set("key", "value")
+}
+
+func TestCowTree__iteratorIsUnaffectedByWrites(t *testing.T) {
+	tree := NewCowTree(3)
+	for i := 0; i < 100; i++ {
+		tree.Set("key"+strconv.Itoa(1000+i), "val")
+	}
+
+	it := tree.NewIterator(ScanOptions{})
+	count := 0
+	for ; it.Valid(); it.Next() {
+		tree.Delete(it.Key())
+		tree.Set("new"+it.Key(), "val")
+		count++
+	}
+	it.Close()
+
+	if count != 100 {
+		t.Fatalf("Expected to iterate over the 100 original keys, saw %d", count)
+	}
+	checkCowRefs(t, tree.root)
+}
+
+func TestCowTree__concurrentSnapshotReads(t *testing.T) {
+	tree := NewCowTree(4)
+	for i := 0; i < 500; i++ {
+		tree.Set("key"+strconv.Itoa(i), "before")
+	}
+	snapshot := tree.Snapshot()
+
+	var wg sync.WaitGroup
+	for r := 0; r < 4; r++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 20; i++ {
+				keys := collectKeys(snapshot.NewIterator(ScanOptions{}))
+				if len(keys) != 500 {
+					t.Errorf("Expected the snapshot to hold 500 keys, found %d", len(keys))
+					return
+				}
+			}
+		}()
+	}
+	for i := 0; i < 500; i++ {
+		tree.Delete("key" + strconv.Itoa(i))
+	}
+	wg.Wait()
+
+	snapshot.Release()
+	checkCowRefs(t, tree.root)
+	if tree.First() != nil {
+		t.Fatalf("Expected the tree to be empty")
+	}
+}
+
+func TestCowTree__comparator(t *testing.T) {
+	tree := NewCowTreeWithComparator(3, CaseInsensitive)
+	for _, key := range []string{"banana", "Apple", "cherry", "apple", "BANANA", "Date"} {
+		tree.Set(key, key)
+		checkCowNode(t, tree.root, tree.cmp, tree.degree, true)
+	}
+	snapshot := tree.Snapshot()
+	defer snapshot.Release()
+	tree.Delete("CHERRY")
+	checkCowNode(t, tree.root, tree.cmp, tree.degree, true)
+
+	// Keys differing only in case are the same key, so later writes overwrite
+	// earlier ones, key and all
+	if pair := tree.Get("APPLE"); pair == nil || pair.Key != "apple" {
+		t.Fatalf("Expected to find the pair last written as apple, found %s", pair.String())
+	}
+	assertKeyList(t, collectKeys(tree.NewIterator(ScanOptions{})), "apple", "BANANA", "Date")
+	assertKeyList(t, collectKeys(tree.NewIterator(ScanOptions{Prefix: "B"})), "BANANA")
+	if pair := tree.Floor("c"); pair == nil || pair.Key != "BANANA" {
+		t.Fatalf("Expected the floor of 'c' to be BANANA, found %s", pair.String())
+	}
+
+	// And the snapshot, still holding cherry, is read in the same order
+	assertKeyList(t, collectKeys(snapshot.NewIterator(ScanOptions{Start: "b", End: "d"})), "BANANA", "cherry")
+	if pair := snapshot.Get("Cherry"); pair == nil || pair.Key != "cherry" {
+		t.Fatalf("Expected the snapshot to find cherry, found %s", pair.String())
+	}
+}
+
+func TestCowTree__int64Tuple(t *testing.T) {
+	tree := NewCowTreeWithComparator(3, Int64Tuple)
+	rng := rand.New(rand.NewSource(1))
+	for _, i := range rng.Perm(200) {
+		tree.Set(EncodeInt64Tuple(int64(i-100)), "val")
+	}
+	for i := 0; i < 200; i += 2 {
+		tree.Delete(EncodeInt64Tuple(int64(i - 100)))
+	}
+	checkCowNode(t, tree.root, tree.cmp, tree.degree, true)
+
+	// Negative ids sort first, and ids are ordered numerically
+	expected := int64(-99)
+	it := tree.NewIterator(ScanOptions{})
+	for ; it.Valid(); it.Next() {
+		values, err := DecodeInt64Tuple(it.Key())
+		if err != nil || values[0] != expected {
+			t.Fatalf("Expected id %d, found %v", expected, values)
+		}
+		expected += 2
+	}
+	it.Close()
+	if expected != 101 {
+		t.Fatalf("Expected to scan up to id 99, stopped before %d", expected)
+	}
+}
+
+func copyMap(m map[string]string) map[string]string {
+	c := make(map[string]string, len(m))
+	for k, v := range m {
+		c[k] = v
+	}
+	return c
+}
+
+func assertStoreContents(t *testing.T, s Store, expected map[string]string) {
+	keys := make([]string, 0, len(expected))
+	for key, value := range expected {
+		keys = append(keys, key)
+		assertKeyValue(t, s.Get(key), value)
+	}
+	sort.Strings(keys)
+	assertKeyList(t, collectKeys(s.NewIterator(ScanOptions{})), keys...)
+	assertKeyList(t, collectKeys(s.NewIterator(ScanOptions{Reverse: true})), reversed(keys)...)
+}
+
+func assertKeyValue(t *testing.T, pair *KeyValuePair, value string) {
+	if pair == nil || pair.Value != value {
+		t.Fatalf("Expected value %q, got %v", value, pair)
+	}
+}
+
+// checkCowNode checks key order and occupancy under a node
+func checkCowNode(t *testing.T, n *cowNode, cmp Comparator, degree int, isRoot bool) {
+	if n.size() > degree || !isRoot && n.size() < n.minSize(degree) {
+		t.Fatalf("Node has size %d, outside the bounds for degree %d", n.size(), degree)
+	}
+	if n.isLeaf() {
+		for i := 1; i < len(n.pairs); i++ {
+			if cmp.Compare(n.pairs[i-1].Key, n.pairs[i].Key) >= 0 {
+				t.Fatalf("Leaf keys out of order: %s >= %s", n.pairs[i-1].Key, n.pairs[i].Key)
+			}
+		}
+		return
+	}
+
+	if len(n.children) != len(n.keys)+1 {
+		t.Fatalf("Internal node has %d keys and %d children", len(n.keys), len(n.children))
+	}
+	for i, child := range n.children {
+		if i > 0 && cmp.Compare(child.lowestKey(), n.keys[i-1]) < 0 || i < len(n.keys) && cmp.Compare(child.highestKey(), n.keys[i]) >= 0 {
+			t.Fatalf("Child %d is outside the bounds of its separators", i)
+		}
+		checkCowNode(t, child, cmp, degree, false)
+	}
+}
+
+// checkCowRefs checks that no node is shared, as when there are no snapshots
+func checkCowRefs(t *testing.T, n *cowNode) {
+	if refs := n.refs.Load(); refs != 1 {
+		t.Fatalf("Expected an unshared node to have 1 reference, has %d", refs)
+	}
+	for _, child := range n.children {
+		checkCowRefs(t, child)
+	}
+}
+
+func (n *cowNode) lowestKey() string {
+	for !n.isLeaf() {
+		n = n.children[0]
+	}
+	return n.pairs[0].Key
+}
+
+func (n *cowNode) highestKey() string {
+	for !n.isLeaf() {
+		n = n.children[len(n.children)-1]
+	}
+	return n.pairs[len(n.pairs)-1].Key
+}
@@ -0,0 +1,105 @@
+package inmemory_btree
+
+import (
+	"math/rand"
+	"strconv"
+	"testing"
+)
+
+// Randomly insert and delete int keys in a BTree, comparing against a map and
+// checking the structure of the tree after every operation
+func TestBTree__intKeys(t *testing.T) {
+	for _, degree := range []int{2, 3, 8} {
+		t.Run("degree="+strconv.Itoa(degree), func(t *testing.T) {
+			rng := rand.New(rand.NewSource(int64(degree)))
+			tree := NewBTree[int, int](degree, NaturalOrder[int]())
+			expected := make(map[int]int)
+
+			for i := 0; i < 2000; i++ {
+				key := rng.Intn(300) - 150
+				if rng.Intn(3) == 0 {
+					old, found := tree.Delete(key)
+					if value, ok := expected[key]; found != ok || old != value {
+						t.Fatalf("Delete(%d) returned (%d, %v), expected (%d, %v)", key, old, found, value, ok)
+					}
+					delete(expected, key)
+				} else {
+					old, replaced := tree.Set(key, i)
+					if value, ok := expected[key]; replaced != ok || old != value {
+						t.Fatalf("Set(%d) returned (%d, %v), expected (%d, %v)", key, old, replaced, value, ok)
+					}
+					expected[key] = i
+				}
+				checkInvariants(t, tree)
+			}
+
+			for key := -150; key < 150; key++ {
+				value, found := tree.Get(key)
+				if expectedValue, ok := expected[key]; found != ok || value != expectedValue {
+					t.Fatalf("Get(%d) returned (%d, %v), expected (%d, %v)", key, value, found, expectedValue, ok)
+				}
+			}
+			if tree.Len() != len(expected) {
+				t.Fatalf("Expected %d keys, found %d", len(expected), tree.Len())
+			}
+		})
+	}
+}
+
+func TestBTree__ordering(t *testing.T) {
+	tree := NewBTree[int64, string](3, NaturalOrder[int64]())
+	keys := []int64{-20, -3, 0, 7, 42, 1000}
+	for _, i := range rand.New(rand.NewSource(1)).Perm(len(keys)) {
+		tree.Set(keys[i], strconv.FormatInt(keys[i], 10))
+	}
+	checkInvariants(t, tree)
+
+	ascending := make([]int64, 0)
+	tree.Ascend(-3, func(key int64, value string) bool {
+		ascending = append(ascending, key)
+		return key < 42
+	})
+	if !equalKeys(ascending, keys[1:5]) {
+		t.Fatalf("Expected to ascend through %v, found %v", keys[1:5], ascending)
+	}
+
+	descending := make([]int64, 0)
+	tree.Descend(8, func(key int64, value string) bool {
+		descending = append(descending, key)
+		return true
+	})
+	if !equalKeys(descending, []int64{7, 0, -3, -20}) {
+		t.Fatalf("Expected to descend from 7, found %v", descending)
+	}
+
+	if key, value, ok := tree.Floor(41); !ok || key != 7 || value != "7" {
+		t.Fatalf("Expected the floor of 41 to be 7, found (%d, %q, %v)", key, value, ok)
+	}
+	if key, _, ok := tree.Ceiling(-19); !ok || key != -3 {
+		t.Fatalf("Expected the ceiling of -19 to be -3, found (%d, %v)", key, ok)
+	}
+	if _, _, ok := tree.Ceiling(1001); ok {
+		t.Fatalf("Expected no ceiling past the last key")
+	}
+	if first, _, _ := tree.First(); first != -20 {
+		t.Fatalf("Expected the first key to be -20, found %d", first)
+	}
+	if last, _, _ := tree.Last(); last != 1000 {
+		t.Fatalf("Expected the last key to be 1000, found %d", last)
+	}
+	if key, _, ok := tree.Select(2); !ok || key != 0 || tree.Rank(0) != 2 || tree.Count(-3, 42) != 3 {
+		t.Fatalf("Expected 0 at position 2, found %d", key)
+	}
+}
+
+func equalKeys(a, b []int64) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
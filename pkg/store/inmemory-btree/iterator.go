@@ -0,0 +1,262 @@
+package inmemory_btree
+
+import "runtime"
+
+// First returns the smallest key and its value, or false if the tree is empty
+func (tree *BTree[K, V]) First() (K, V, bool) {
+	c := tree.newCursor()
+	c.SeekFirst()
+	return c.key, c.value, c.valid
+}
+
+// Last returns the largest key and its value, or false if the tree is empty
+func (tree *BTree[K, V]) Last() (K, V, bool) {
+	c := tree.newCursor()
+	c.SeekLast()
+	return c.key, c.value, c.valid
+}
+
+// Floor returns the largest key <= key and its value, or false if there is none
+func (tree *BTree[K, V]) Floor(key K) (K, V, bool) {
+	c := tree.newCursor()
+	c.SeekLE(key)
+	return c.key, c.value, c.valid
+}
+
+// Ceiling returns the smallest key >= key and its value, or false if there is
+// none
+func (tree *BTree[K, V]) Ceiling(key K) (K, V, bool) {
+	c := tree.newCursor()
+	c.SeekGE(key)
+	return c.key, c.value, c.valid
+}
+
+// Ascend calls visit for each key >= start and its value, in key order, until
+// visit returns false
+func (tree *BTree[K, V]) Ascend(start K, visit func(key K, value V) bool) {
+	c := tree.newCursor()
+	for c.SeekGE(start); c.valid && visit(c.key, c.value); c.Next() {
+	}
+}
+
+// Descend calls visit for each key <= start and its value, in reverse key
+// order, until visit returns false
+func (tree *BTree[K, V]) Descend(start K, visit func(key K, value V) bool) {
+	c := tree.newCursor()
+	for c.SeekLE(start); c.valid && visit(c.key, c.value); c.Prev() {
+	}
+}
+
+// cursor walks the leaves of a tree in key order, following their sibling links.
+//
+// A cursor only holds a latch while moving, so the tree may be modified while
+// it is open (for example, deleting each key as it is visited). Stepping from
+// a leaf only trusts what is found there if the leaf is still in the tree and
+// still covers the current key; otherwise the cursor seeks again from the root.
+type cursor[K any, V any] struct {
+	tree  *BTree[K, V]
+	leaf  *Node[K, V]
+	key   K // the entry the cursor is positioned at, if valid
+	value V
+	valid bool
+}
+
+// seekMode is which pair, relative to a key, a cursor is moving to
+type seekMode int
+
+const (
+	seekGE seekMode = iota
+	seekGT
+	seekLE
+	seekLT
+)
+
+func (m seekMode) forward() bool {
+	return m == seekGE || m == seekGT
+}
+
+// accepts reports whether a pair is where the seek can stop, given how its
+// key compares to the key sought
+func (m seekMode) accepts(cmp int) bool {
+	switch m {
+	case seekGE:
+		return cmp >= 0
+	case seekGT:
+		return cmp > 0
+	case seekLE:
+		return cmp <= 0
+	default:
+		return cmp < 0
+	}
+}
+
+func (tree *BTree[K, V]) newCursor() *cursor[K, V] {
+	return &cursor[K, V]{tree: tree}
+}
+
+func (c *cursor[K, V]) SeekGE(key K) {
+	c.seek(key, seekGE)
+}
+
+func (c *cursor[K, V]) SeekLE(key K) {
+	c.seek(key, seekLE)
+}
+
+func (c *cursor[K, V]) SeekFirst() {
+	leaf := c.tree.findLeafShared(func(n *Node[K, V]) int { return 0 })
+	defer leaf.latch.RUnlock()
+
+	// Only an empty root has no entries
+	if len(leaf.keys) == 0 {
+		c.setPosition(nil, 0)
+		return
+	}
+	c.setPosition(leaf, 0)
+}
+
+func (c *cursor[K, V]) SeekLast() {
+	leaf := c.tree.findLeafShared(func(n *Node[K, V]) int { return len(n.children) - 1 })
+	defer leaf.latch.RUnlock()
+
+	// Only an empty root has no entries
+	if len(leaf.keys) == 0 {
+		c.setPosition(nil, 0)
+		return
+	}
+	c.setPosition(leaf, len(leaf.keys)-1)
+}
+
+func (c *cursor[K, V]) Next() {
+	c.step(seekGT)
+}
+
+func (c *cursor[K, V]) Prev() {
+	c.step(seekLT)
+}
+
+func (c *cursor[K, V]) Valid() bool {
+	return c.valid
+}
+
+func (c *cursor[K, V]) Key() K {
+	return c.key
+}
+
+func (c *cursor[K, V]) Value() V {
+	return c.value
+}
+
+func (c *cursor[K, V]) Close() {
+	c.setPosition(nil, 0)
+}
+
+// seek descends from the root to position the cursor relative to key
+func (c *cursor[K, V]) seek(key K, mode seekMode) {
+	for {
+		leaf := c.tree.findLeafShared(func(n *Node[K, V]) int { return n.findIndex(key) })
+		ok := c.positionIn(leaf, key, mode, true)
+		leaf.latch.RUnlock()
+		if ok {
+			return
+		}
+		runtime.Gosched()
+	}
+}
+
+// step moves to the next or previous pair from the current one, starting
+// from the leaf the cursor is on if it can
+func (c *cursor[K, V]) step(mode seekMode) {
+	if !c.valid {
+		return
+	}
+
+	key, leaf := c.key, c.leaf
+	leaf.latch.RLock()
+	ok := !leaf.removed && c.positionIn(leaf, key, mode, false)
+	leaf.latch.RUnlock()
+	if !ok {
+		c.seek(key, mode)
+	}
+}
+
+// positionIn positions the cursor relative to key within a read latched leaf,
+// or the first or last pair of its sibling if the position falls off the end.
+//
+// anchored says that the leaf is known to cover key, as it was reached by a
+// descent. Otherwise entries may have moved between the leaf and its siblings
+// since the cursor was there, so the leaf must hold a key on the near side of
+// key to show that nothing in between could be elsewhere.
+//
+// Returns false if the cursor could not be positioned, and the caller should
+// seek again from the root.
+func (c *cursor[K, V]) positionIn(leaf *Node[K, V], key K, mode seekMode, anchored bool) bool {
+	ge, found := leaf.findKeyInLeaf(key)
+	gt := ge
+	if found {
+		gt++
+	}
+
+	var index int
+	switch mode {
+	case seekGE:
+		index = ge
+	case seekGT:
+		index = gt
+	case seekLE:
+		index = gt - 1
+	case seekLT:
+		index = ge - 1
+	}
+	if !anchored && (mode.forward() && gt == 0 || !mode.forward() && ge == len(leaf.keys)) {
+		return false
+	}
+	if index >= 0 && index < len(leaf.keys) {
+		c.setPosition(leaf, index)
+		return true
+	}
+
+	sibling := leaf.prev
+	if mode.forward() {
+		sibling = leaf.next
+	}
+	if sibling == nil {
+		c.setPosition(nil, 0)
+		return true
+	}
+
+	// Stepping onto a sibling never waits for its latch, as a writer may hold
+	// it while waiting for this leaf
+	if !sibling.latch.TryRLock() {
+		return false
+	}
+	defer sibling.latch.RUnlock()
+
+	index = len(sibling.keys) - 1
+	if mode.forward() {
+		index = 0
+	}
+	if !mode.accepts(c.tree.cmp.Compare(sibling.keys[index], key)) {
+		return false
+	}
+	c.setPosition(sibling, index)
+	return true
+}
+
+func (c *cursor[K, V]) setPosition(leaf *Node[K, V], index int) {
+	c.leaf = leaf
+	if leaf == nil {
+		var zeroKey K
+		var zeroValue V
+		c.key, c.value, c.valid = zeroKey, zeroValue, false
+	} else {
+		c.key, c.value, c.valid = leaf.keys[index], c.tree.valueAt(leaf, index), true
+	}
+}
+
+// leftmostLeaf returns the first leaf under this node
+func (n *Node[K, V]) leftmostLeaf() *Node[K, V] {
+	for !n.isLeaf {
+		n = n.children[0]
+	}
+	return n
+}
@@ -0,0 +1,41 @@
+package inmemory_btree
+
+// KeyOrder defines the order of the keys of a BTree. store.Comparator is a
+// KeyOrder of strings, so any comparator can order a tree of string keys.
+type KeyOrder[K any] interface {
+	// Compare returns a negative number, 0 or a positive number as a is less
+	// than, equal to or greater than b
+	Compare(a, b K) int
+	// Separator returns a key s with a < s <= b, given a < b, for use in
+	// internal nodes. b itself is always a valid answer.
+	Separator(a, b K) K
+}
+
+// Ordered is the set of types with a natural order, given by <
+type Ordered interface {
+	~int | ~int8 | ~int16 | ~int32 | ~int64 |
+		~uint | ~uint8 | ~uint16 | ~uint32 | ~uint64 | ~uintptr |
+		~float32 | ~float64 | ~string
+}
+
+// NaturalOrder returns the KeyOrder of an ordered type, which orders keys by <.
+// Floating point NaNs are not supported as keys.
+func NaturalOrder[K Ordered]() KeyOrder[K] {
+	return naturalOrder[K]{}
+}
+
+type naturalOrder[K Ordered] struct{}
+
+func (naturalOrder[K]) Compare(a, b K) int {
+	if a < b {
+		return -1
+	}
+	if a > b {
+		return 1
+	}
+	return 0
+}
+
+func (naturalOrder[K]) Separator(_, b K) K {
+	return b
+}
@@ -0,0 +1,264 @@
+package inmemory_btree
+
+// Concurrency control
+//
+// Every node has a read/write latch, and the tree has one more (rootLatch)
+// guarding which node is the root. Readers descend with latch crabbing: a
+// child is latched before its parent is released, so no writer can slip in
+// between and restructure the path being followed.
+//
+// Writers first make an optimistic descent, taking read latches on internal
+// nodes and a write latch on just the leaf. This succeeds whenever the leaf is
+// safe, i.e. the change cannot make it split or merge, which is nearly always.
+// Otherwise the writer starts again with a pessimistic descent, write-latching
+// every node on the way down but releasing all ancestors of any safe node, as
+// no split or merge can propagate past it. Whatever is still latched when the
+// leaf is reached is exactly what the change may touch.
+//
+// Inserting or deleting a key changes the subtree count (see
+// order_statistics.go) of every node above it. An optimistic writer keeps its
+// read latches on the whole path until it is done, and adjusts the counts
+// atomically, which is enough to stop any node on the path being split or
+// merged meanwhile. It also stops parent pointers on the path changing, so
+// the path is found again from the leaf rather than being recorded on the way
+// down. A pessimistic writer can't wait until it reaches the leaf, as it has
+// released the ancestors by then, so it adjusts each node's count as it
+// latches it, guessing that an insert adds a key and a delete removes one.
+// It only guesses wrong if another writer changes the same key in between the
+// two descents, in which case the nodes still latched are corrected at the
+// leaf, and the rest afterwards by recounting the path to the key.
+//
+// Latches are taken top-down, and between siblings left to right. The one
+// exception, taking a left sibling during a merge, only happens while the
+// common parent is write-latched, so nobody else can be waiting on it from the
+// other side. Readers stepping back to a previous leaf never wait: they try
+// the latch, and if it is held they start again from the root.
+
+type operation int
+
+const (
+	opInsert operation = iota
+	opDelete
+)
+
+// isSafe reports whether applying op to key beneath this node can not cause
+// it to split or merge. Leaves also know whether key is present, so an
+// overwrite or a delete of a missing key is always safe.
+func (n *Node[K, V]) isSafe(op operation, key K, isRoot bool) bool {
+	if n.isLeaf {
+		_, found := n.findKeyInLeaf(key)
+		if op == opInsert {
+			return found || n.size() < n.tree.degree
+		}
+		return !found || isRoot || n.size() > n.minSize()
+	}
+
+	if op == opInsert {
+		return n.size() < n.tree.degree
+	}
+	if isRoot {
+		// The root only shrinks away once it has a single child
+		return len(n.keys) > 1
+	}
+	return n.size() > n.minSize()
+}
+
+// countDelta returns how applying op to key in this leaf changes the number
+// of keys in it
+func (n *Node[K, V]) countDelta(op operation, key K) int {
+	_, found := n.findKeyInLeaf(key)
+	switch {
+	case op == opInsert && !found:
+		return 1
+	case op == opDelete && found:
+		return -1
+	}
+	return 0
+}
+
+// findLeafShared descends to a leaf holding read latches, returning it read
+// latched. choose picks which child of an internal node to follow.
+func (tree *BTree[K, V]) findLeafShared(choose func(*Node[K, V]) int) *Node[K, V] {
+	tree.rootLatch.RLock()
+	n := tree.root
+	n.latch.RLock()
+	tree.rootLatch.RUnlock()
+
+	for !n.isLeaf {
+		child := n.children[choose(n)]
+		child.latch.RLock()
+		n.latch.RUnlock()
+		n = child
+	}
+	return n
+}
+
+// findLeafOptimistic descends to the leaf for key with read latches, and write
+// latches the leaf, keeping its ancestors read latched. If the leaf is not
+// safe for op, nothing is left latched and nil is returned.
+func (tree *BTree[K, V]) findLeafOptimistic(key K, op operation) *Node[K, V] {
+	tree.rootLatch.RLock()
+	n := tree.root
+	isRoot := true
+	for !n.isLeaf {
+		n.latch.RLock()
+		if isRoot {
+			tree.rootLatch.RUnlock()
+			isRoot = false
+		}
+		n = n.children[n.findIndex(key)]
+	}
+	n.latch.Lock()
+	if isRoot {
+		tree.rootLatch.RUnlock()
+	}
+
+	if !n.isSafe(op, key, isRoot) {
+		n.releaseOptimistic()
+		return nil
+	}
+	return n
+}
+
+// addToAncestorCounts adjusts the subtree counts of the ancestors of a leaf
+// found by findLeafOptimistic
+func (n *Node[K, V]) addToAncestorCounts(delta int) {
+	for p := n.parent; p != nil; p = p.parent {
+		p.count.Add(int64(delta))
+	}
+}
+
+// releaseOptimistic unlatches a leaf found by findLeafOptimistic, and its
+// ancestors. Each parent pointer is read before the node holding it is
+// released.
+func (n *Node[K, V]) releaseOptimistic() {
+	p := n.parent
+	n.latch.Unlock()
+	for p != nil {
+		parent := p.parent
+		p.latch.RUnlock()
+		p = parent
+	}
+}
+
+// findLeafExclusive descends to the leaf for key with write latches, keeping
+// only those nodes which a split or merge caused by op could reach. The
+// counts of the nodes on the way are adjusted for the key op adds or removes.
+func (tree *BTree[K, V]) findLeafExclusive(key K, op operation) *latchPath[K, V] {
+	tree.rootLatch.Lock()
+	path := &latchPath[K, V]{tree: tree, rootLatched: true, delta: 1}
+	if op == opDelete {
+		path.delta = -1
+	}
+
+	n := tree.root
+	n.latch.Lock()
+	isRoot := true
+	for !n.isLeaf {
+		// The count changes before the node's parent is released, so nobody
+		// recounts the parent in between
+		n.count.Add(int64(path.delta))
+		path.push(n, n.isSafe(op, key, isRoot))
+		n = n.children[n.findIndex(key)]
+		n.latch.Lock()
+		isRoot = false
+	}
+
+	if delta := n.countDelta(op, key); delta != path.delta {
+		path.correct(delta)
+	}
+	path.push(n, n.isSafe(op, key, isRoot))
+	return path
+}
+
+// recountPath recomputes the subtree counts on the path to key, bottom up,
+// with the whole path write latched. A pessimistic writer which guessed its
+// change to the counts wrong calls it once it is done, to correct the nodes
+// it had released by then.
+func (tree *BTree[K, V]) recountPath(key K) {
+	tree.rootLatch.Lock()
+	path := &latchPath[K, V]{tree: tree, rootLatched: true}
+
+	n := tree.root
+	n.latch.Lock()
+	path.nodes = append(path.nodes, n)
+	for !n.isLeaf {
+		n = n.children[n.findIndex(key)]
+		n.latch.Lock()
+		path.nodes = append(path.nodes, n)
+	}
+	for i := len(path.nodes) - 2; i >= 0; i-- {
+		path.nodes[i].recount()
+	}
+	path.release()
+}
+
+// latchPath is the set of write latched nodes from a pessimistic descent, top
+// down. If rootLatched is set, the path starts at the root and the tree's
+// rootLatch is held too, so the root may be replaced.
+type latchPath[K any, V any] struct {
+	tree        *BTree[K, V]
+	rootLatched bool
+	nodes       []*Node[K, V]
+
+	delta    int  // what the counts of the nodes on the path were adjusted by
+	released bool // whether nodes on the path were released during the descent
+	stale    bool // whether released nodes were adjusted by the wrong delta
+}
+
+// push adds a newly latched node to the path. If it is safe, its ancestors
+// are released.
+func (p *latchPath[K, V]) push(n *Node[K, V], safe bool) {
+	if safe {
+		p.released = p.released || len(p.nodes) > 0
+		p.release()
+	}
+	p.nodes = append(p.nodes, n)
+}
+
+// correct readjusts the counts of the nodes on the path, once the leaf shows
+// the change alters the number of keys by delta rather than the guess. The
+// top node is left alone if its parent has been released, and with it the
+// path is stale until recounted.
+func (p *latchPath[K, V]) correct(delta int) {
+	nodes := p.nodes
+	if p.released {
+		nodes = nodes[1:]
+		p.stale = true
+	}
+	for _, n := range nodes {
+		n.count.Add(int64(delta - p.delta))
+	}
+	p.delta = delta
+}
+
+// leaf returns the bottom node of the path
+func (p *latchPath[K, V]) leaf() *Node[K, V] {
+	return p.nodes[len(p.nodes)-1]
+}
+
+// isTop reports whether n is the highest node in the path, so its parent is
+// not latched and must not be touched
+func (p *latchPath[K, V]) isTop(n *Node[K, V]) bool {
+	return p.nodes[0] == n
+}
+
+// pop releases the bottom node of the path, once a level has been fixed up
+func (p *latchPath[K, V]) pop() {
+	last := len(p.nodes) - 1
+	p.nodes[last].latch.Unlock()
+	p.nodes[last] = nil
+	p.nodes = p.nodes[:last]
+}
+
+// release unlatches every node in the path
+func (p *latchPath[K, V]) release() {
+	for _, n := range p.nodes {
+		n.latch.Unlock()
+	}
+	p.nodes = p.nodes[:0]
+	if p.rootLatched {
+		p.tree.rootLatch.Unlock()
+		p.rootLatched = false
+	}
+}
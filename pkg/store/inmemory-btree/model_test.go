@@ -0,0 +1,34 @@
+package inmemory_btree
+
+import (
+	"strconv"
+	"testing"
+
+	. "yadb-go/pkg/store"
+	"yadb-go/pkg/store/storetest"
+)
+
+// Check the trees against a map, over random sequences of operations
+func TestModel(t *testing.T) {
+	for _, degree := range []int{2, 3, 4, 16} {
+		t.Run("degree="+strconv.Itoa(degree), func(t *testing.T) {
+			storetest.CheckRandom(t, func() Store { return NewTree(degree) }, 10, 2000)
+		})
+	}
+
+	t.Run("overflow", func(t *testing.T) {
+		storetest.CheckRandom(t, func() Store { return newOverflowTree(16) }, 5, 1000)
+	})
+
+	t.Run("cow", func(t *testing.T) {
+		storetest.CheckRandom(t, func() Store { return NewCowTree(3) }, 10, 2000)
+	})
+}
+
+func FuzzTree(f *testing.F) {
+	storetest.Fuzz(f, func() Store { return NewTree(3) })
+}
+
+func FuzzCowTree(f *testing.F) {
+	storetest.Fuzz(f, func() Store { return NewCowTree(3) })
+}
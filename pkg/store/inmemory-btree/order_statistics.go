@@ -0,0 +1,79 @@
+package inmemory_btree
+
+// Order statistics
+//
+// Every node keeps a count of the keys in its subtree, so the position of a
+// key in the tree can be found in a single descent: the keys before it are
+// those in the children to the left of the path to it. This answers how many
+// keys fall in a range, and which key is at a given position, without
+// scanning.
+//
+// Like other reads, these descend with latch crabbing, so aren't held up by
+// writers. Each node's count is exact for the moment it is read, but while
+// the tree is being modified, counts read at different levels may be from
+// slightly different moments.
+
+// Len returns the number of keys in the tree
+func (tree *BTree[K, V]) Len() int {
+	tree.rootLatch.RLock()
+	defer tree.rootLatch.RUnlock()
+	return int(tree.root.count.Load())
+}
+
+// Rank returns the number of keys less than key, which is the position key
+// has, or would have, in key order
+func (tree *BTree[K, V]) Rank(key K) int {
+	rank := 0
+	leaf := tree.findLeafShared(func(n *Node[K, V]) int {
+		i := n.findIndex(key)
+		for _, child := range n.children[:i] {
+			rank += int(child.count.Load())
+		}
+		return i
+	})
+	defer leaf.latch.RUnlock()
+
+	i, _ := leaf.findKeyInLeaf(key)
+	return rank + i
+}
+
+// Count returns the number of keys in [start, end)
+func (tree *BTree[K, V]) Count(start, end K) int {
+	return clampCount(tree.Rank(end) - tree.Rank(start))
+}
+
+// clampCount stops a count taken from two ranks going negative, which it can
+// if the range is empty, or keys are added between taking the ranks
+func clampCount(count int) int {
+	if count < 0 {
+		return 0
+	}
+	return count
+}
+
+// Select returns the key at position i in key order, counting from 0, and
+// its value, or false if i is out of range
+func (tree *BTree[K, V]) Select(i int) (K, V, bool) {
+	var key K
+	var value V
+	if i < 0 {
+		return key, value, false
+	}
+
+	leaf := tree.findLeafShared(func(n *Node[K, V]) int {
+		for j, child := range n.children {
+			count := int(child.count.Load())
+			if i < count || j == len(n.children)-1 {
+				return j
+			}
+			i -= count
+		}
+		panic("Internal node has no children")
+	})
+	defer leaf.latch.RUnlock()
+
+	if i >= len(leaf.keys) {
+		return key, value, false
+	}
+	return leaf.keys[i], tree.valueAt(leaf, i), true
+}
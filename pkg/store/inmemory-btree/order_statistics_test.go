@@ -0,0 +1,110 @@
+package inmemory_btree
+
+import (
+	"fmt"
+	"math/rand"
+	"sort"
+	"strconv"
+	"testing"
+
+	. "yadb-go/pkg/store"
+)
+
+// Randomly insert and delete keys, checking every order statistic against a
+// sorted list of the keys present
+func TestOrderStatistics(t *testing.T) {
+	for _, degree := range []int{2, 3, 4, 10} {
+		t.Run("degree="+strconv.Itoa(degree), func(t *testing.T) {
+			rng := rand.New(rand.NewSource(int64(degree)))
+			tree := NewTree(degree)
+			present := make(map[string]bool)
+
+			for i := 0; i < 1500; i++ {
+				key := fmt.Sprintf("key%03d", rng.Intn(200))
+				if rng.Intn(3) == 0 {
+					tree.Delete(key)
+					delete(present, key)
+				} else {
+					tree.Set(key, "val")
+					present[key] = true
+				}
+				checkInvariants(t, tree)
+
+				if i%50 == 0 {
+					checkOrderStatistics(t, tree, present)
+				}
+			}
+			checkOrderStatistics(t, tree, present)
+		})
+	}
+}
+
+func TestOrderStatistics__bulkLoad(t *testing.T) {
+	tree, err := BulkLoad(NewSliceIterator(sortedPairs(333)), 4, DefaultFillFactor)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkInvariants(t, tree)
+
+	if tree.Len() != 333 {
+		t.Fatalf("Expected 333 keys, found %d", tree.Len())
+	}
+	if pair := tree.Select(123); pair == nil || pair.Key != "key123" {
+		t.Fatalf("Expected key123 at position 123, found %s", pair.String())
+	}
+	if count := tree.Count("key100", "key200"); count != 100 {
+		t.Fatalf("Expected 100 keys in [key100, key200), found %d", count)
+	}
+}
+
+func TestOrderStatistics__emptyTree(t *testing.T) {
+	tree := NewTree(3)
+
+	if tree.Len() != 0 || tree.Rank("key") != 0 || tree.Count("", "") != 0 {
+		t.Fatalf("Expected an empty tree to count no keys")
+	}
+	if tree.Select(0) != nil || tree.Select(-1) != nil {
+		t.Fatalf("Expected no key at any position of an empty tree")
+	}
+}
+
+func checkOrderStatistics(t *testing.T, tree *Tree, present map[string]bool) {
+	t.Helper()
+	keys := make([]string, 0, len(present))
+	for key := range present {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	if tree.Len() != len(keys) {
+		t.Fatalf("Expected %d keys, found %d", len(keys), tree.Len())
+	}
+	for i, key := range keys {
+		if pair := tree.Select(i); pair == nil || pair.Key != key {
+			t.Fatalf("Expected %s at position %d, found %s", key, i, pair.String())
+		}
+	}
+	if pair := tree.Select(len(keys)); pair != nil {
+		t.Fatalf("Expected no key past the end, found %s", pair.String())
+	}
+
+	for i := 0; i <= 200; i += 7 {
+		key := fmt.Sprintf("key%03d", i)
+		rank := sort.SearchStrings(keys, key)
+		if tree.Rank(key) != rank {
+			t.Fatalf("Expected rank %d for %s, found %d", rank, key, tree.Rank(key))
+		}
+
+		end := fmt.Sprintf("key%03d", i+25)
+		expected := sort.SearchStrings(keys, end) - rank
+		if count := tree.Count(key, end); count != expected {
+			t.Fatalf("Expected %d keys in [%s, %s), found %d", expected, key, end, count)
+		}
+	}
+	if count := tree.Count("", ""); count != len(keys) {
+		t.Fatalf("Expected an unbounded count of %d, found %d", len(keys), count)
+	}
+	if count := tree.Count("key150", "key100"); count != 0 {
+		t.Fatalf("Expected an empty range to count 0, found %d", count)
+	}
+}
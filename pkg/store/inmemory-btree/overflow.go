@@ -0,0 +1,188 @@
+package inmemory_btree
+
+import (
+	"encoding/binary"
+	"errors"
+	"sync"
+
+	"yadb-go/pkg/buffer"
+	. "yadb-go/pkg/store"
+	. "yadb-go/pkg/types"
+)
+
+// Overflow pages
+//
+// A leaf has to fit in a page, so a value too large to keep inline (longer
+// than the tree's inline threshold) is moved out to a chain of overflow pages,
+// and the leaf slot references the first page of the chain instead of holding
+// a KeyValuePair. The value is reassembled whenever the pair is read, and the
+// chain is freed when the key is overwritten or deleted.
+//
+// Each overflow page holds the id of the next page in the chain (0 at the
+// end), the number of bytes of the value it holds, then those bytes.
+
+// DefaultInlineThreshold is the longest value kept in a leaf slot by default.
+// It leaves room for several large-ish pairs in a page.
+const DefaultInlineThreshold = buffer.PageSizeInBytes / 4
+
+const overflowHeaderSize = 8 + 4
+const overflowChunkSize = buffer.PageSizeInBytes - overflowHeaderSize
+
+// noPage ends an overflow chain. Page 0 is never allocated.
+const noPage PageId = 0
+
+var errCorruptOverflowPage = errors.New("corrupt overflow page")
+
+// slot is the value held in a leaf of the store's tree for each key: the pair
+// itself, or if its value has been moved to overflow pages, where to find it
+type slot struct {
+	pair   *KeyValuePair // nil if the value is in overflow pages
+	head   PageId        // the first page of the chain
+	length int
+}
+
+// overflowPages allocates and frees the pages of overflow chains, which are
+// read and written through a buffer pool. Freed pages are reused before new
+// ones are allocated.
+type overflowPages struct {
+	pool            buffer.Pool
+	inlineThreshold int
+
+	mu        sync.Mutex
+	nextPage  PageId // the lowest page id never allocated
+	freePages []PageId
+}
+
+func newOverflowPages(pool buffer.Pool, inlineThreshold int) *overflowPages {
+	return &overflowPages{
+		pool:            pool,
+		inlineThreshold: inlineThreshold,
+		nextPage:        noPage + 1,
+	}
+}
+
+// write stores a value in a new chain of overflow pages, marked with the LSN
+// of the write which set it, and returns the first page of the chain
+func (o *overflowPages) write(value string, lsn LSN) (PageId, error) {
+	// Pages are allocated up front, so each page can be written knowing the next
+	chunks := (len(value) + overflowChunkSize - 1) / overflowChunkSize
+	pageIds := o.allocate(chunks)
+
+	for i, pageId := range pageIds {
+		next := noPage
+		if i < len(pageIds)-1 {
+			next = pageIds[i+1]
+		}
+		chunk := value[i*overflowChunkSize:]
+		if len(chunk) > overflowChunkSize {
+			chunk = chunk[:overflowChunkSize]
+		}
+
+		data := make([]byte, buffer.PageSizeInBytes)
+		binary.LittleEndian.PutUint64(data, uint64(next))
+		binary.LittleEndian.PutUint32(data[8:], uint32(len(chunk)))
+		copy(data[overflowHeaderSize:], chunk)
+		if err := o.writePage(pageId, data, lsn); err != nil {
+			o.release(pageIds)
+			return noPage, err
+		}
+	}
+
+	return pageIds[0], nil
+}
+
+func (o *overflowPages) writePage(pageId PageId, data []byte, lsn LSN) error {
+	if _, err := o.pool.NewPage(pageId); err != nil {
+		return err
+	}
+	err := o.pool.WritePage(pageId, data, lsn)
+	if releaseErr := o.pool.ReleasePage(pageId); err == nil {
+		err = releaseErr
+	}
+	return err
+}
+
+// read reassembles the value held in the chain starting at head
+func (o *overflowPages) read(head PageId, length int) (string, error) {
+	value := make([]byte, 0, length)
+	for pageId := head; pageId != noPage; {
+		next, chunk, err := o.readPage(pageId)
+		if err != nil {
+			return "", err
+		}
+		value = append(value, chunk...)
+		pageId = next
+	}
+
+	if len(value) != length {
+		return "", errCorruptOverflowPage
+	}
+	return string(value), nil
+}
+
+// readPage returns the next page in the chain and the part of the value held
+// in this page
+func (o *overflowPages) readPage(pageId PageId) (PageId, string, error) {
+	page, err := o.pool.FetchPage(pageId)
+	if err != nil {
+		return noPage, "", err
+	}
+	defer o.pool.ReleasePage(pageId)
+
+	data := page.Data()
+	if len(data) < overflowHeaderSize {
+		return noPage, "", errCorruptOverflowPage
+	}
+	next := PageId(binary.LittleEndian.Uint64([]byte(data[:8])))
+	length := int(binary.LittleEndian.Uint32([]byte(data[8:overflowHeaderSize])))
+	if length > len(data)-overflowHeaderSize {
+		return noPage, "", errCorruptOverflowPage
+	}
+	return next, data[overflowHeaderSize : overflowHeaderSize+length], nil
+}
+
+// free returns every page in the chain starting at head for reuse
+func (o *overflowPages) free(head PageId) error {
+	pageIds := make([]PageId, 0)
+	for pageId := head; pageId != noPage; {
+		next, _, err := o.readPage(pageId)
+		if err != nil {
+			return err
+		}
+		pageIds = append(pageIds, pageId)
+		pageId = next
+	}
+
+	o.release(pageIds)
+	return nil
+}
+
+// allocate returns n page ids, taking freed pages first
+func (o *overflowPages) allocate(n int) []PageId {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	pageIds := make([]PageId, 0, n)
+	for len(pageIds) < n && len(o.freePages) > 0 {
+		pageIds = append(pageIds, o.freePages[len(o.freePages)-1])
+		o.freePages = o.freePages[:len(o.freePages)-1]
+	}
+	for len(pageIds) < n {
+		pageIds = append(pageIds, o.nextPage)
+		o.nextPage++
+	}
+	return pageIds
+}
+
+func (o *overflowPages) release(pageIds []PageId) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.freePages = append(o.freePages, pageIds...)
+}
+
+// pagesInUse returns the number of pages holding overflow values
+func (o *overflowPages) pagesInUse() int {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return int(o.nextPage-noPage-1) - len(o.freePages)
+}
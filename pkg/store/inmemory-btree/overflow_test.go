@@ -0,0 +1,244 @@
+package inmemory_btree
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"yadb-go/pkg/buffer"
+	"yadb-go/pkg/io"
+	. "yadb-go/pkg/store"
+	. "yadb-go/pkg/types"
+)
+
+func newOverflowTree(inlineThreshold int) *Tree {
+	pool := buffer.NewBufferPoolWithSize(64, io.NewMemoryDiskManager())
+	return NewTreeWithOverflow(3, Bytewise, pool, inlineThreshold)
+}
+
+func TestOverflow__largeValuesAreReassembled(t *testing.T) {
+	tree := newOverflowTree(DefaultInlineThreshold)
+	large := strings.Repeat("0123456789", 3*buffer.PageSizeInBytes/10)
+
+	for i := 0; i < 20; i++ {
+		tree.Set("key"+strconv.Itoa(i), strconv.Itoa(i)+large)
+		checkInvariants(t, tree)
+	}
+	tree.Set("small", "value")
+	checkInvariants(t, tree)
+
+	for i := 0; i < 20; i++ {
+		assertKeyFound(t, tree, "key"+strconv.Itoa(i), strconv.Itoa(i)+large)
+	}
+	assertKeyFound(t, tree, "small", "value")
+
+	// Each large value spans 4 pages; the small one stays in its leaf
+	if pages := tree.overflow.pagesInUse(); pages != 80 {
+		t.Fatalf("Expected 80 overflow pages in use, found %d", pages)
+	}
+
+	it := tree.NewIterator(ScanOptions{Reverse: true, Limit: 2})
+	defer it.Close()
+	it.Next()
+	if it.Key() != "key9" || it.Value() != "9"+large {
+		t.Fatalf("Expected to iterate over the reassembled value of key9, found key %s", it.Key())
+	}
+}
+
+func TestOverflow__overwriteAndDeleteFreePages(t *testing.T) {
+	tree := newOverflowTree(100)
+	large := strings.Repeat("x", buffer.PageSizeInBytes+1)
+
+	tree.Set("key", large)
+	if pages := tree.overflow.pagesInUse(); pages != 2 {
+		t.Fatalf("Expected 2 overflow pages in use, found %d", pages)
+	}
+
+	// Overwriting reuses the freed pages, rather than allocating more
+	for i := 0; i < 10; i++ {
+		tree.Set("key", large+strconv.Itoa(i))
+		checkInvariants(t, tree)
+	}
+	assertKeyFound(t, tree, "key", large+"9")
+	if pages, allocated := tree.overflow.pagesInUse(), tree.overflow.nextPage-1; pages != 2 || allocated > 4 {
+		t.Fatalf("Expected 2 pages in use out of at most 4 allocated, found %d of %d", pages, allocated)
+	}
+
+	tree.Set("key", "now small")
+	assertKeyFound(t, tree, "key", "now small")
+	if pages := tree.overflow.pagesInUse(); pages != 0 {
+		t.Fatalf("Expected overwriting with a small value to free the overflow pages, %d in use", pages)
+	}
+
+	tree.Set("key", large)
+	tree.Delete("key")
+	checkInvariants(t, tree)
+	assertKeyNotFound(t, tree, "key")
+	if pages := tree.overflow.pagesInUse(); pages != 0 {
+		t.Fatalf("Expected deleting to free the overflow pages, %d in use", pages)
+	}
+}
+
+func TestOverflow__inlineThreshold(t *testing.T) {
+	tree := newOverflowTree(10)
+
+	tree.Set("inline", strings.Repeat("x", 10))
+	tree.Set("overflow", strings.Repeat("x", 11))
+
+	if pages := tree.overflow.pagesInUse(); pages != 1 {
+		t.Fatalf("Expected only the value over the threshold to overflow, %d pages in use", pages)
+	}
+	assertKeyFound(t, tree, "inline", strings.Repeat("x", 10))
+	assertKeyFound(t, tree, "overflow", strings.Repeat("x", 11))
+}
+
+func TestOverflow__concurrentOverwrites(t *testing.T) {
+	tree := newOverflowTree(100)
+	values := make([]string, 4)
+	for i := range values {
+		values[i] = strings.Repeat(strconv.Itoa(i), 5000)
+	}
+
+	var wg sync.WaitGroup
+	for w := 0; w < 4; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < 200; i++ {
+				key := "key" + strconv.Itoa(i%5)
+				tree.Set(key, values[w])
+				if pair := tree.Get(key); pair != nil && len(pair.Value) != 5000 {
+					t.Errorf("Read a value of length %d, expected 5000", len(pair.Value))
+					return
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+
+	if pages := tree.overflow.pagesInUse(); pages != 5 {
+		t.Fatalf("Expected one overflow page for each of the 5 keys, %d in use", pages)
+	}
+}
+
+// failingDiskManager fails every read and write while fail is set
+type failingDiskManager struct {
+	*io.MemoryDiskManager
+	fail bool
+}
+
+var errDiskFailed = errors.New("disk failed")
+
+func (d *failingDiskManager) ReadPage(pageId PageId) ([]byte, error) {
+	if d.fail {
+		return nil, errDiskFailed
+	}
+	return d.MemoryDiskManager.ReadPage(pageId)
+}
+
+func (d *failingDiskManager) FlushPage(pageId PageId, data []byte) error {
+	if d.fail {
+		return errDiskFailed
+	}
+	return d.MemoryDiskManager.FlushPage(pageId, data)
+}
+
+func TestOverflow__ioErrors(t *testing.T) {
+	// A pool of one frame has to evict a page for every other one it reads
+	diskManager := &failingDiskManager{MemoryDiskManager: io.NewMemoryDiskManager()}
+	tree := NewTreeWithOverflow(3, Bytewise, buffer.NewBufferPoolWithSize(1, diskManager), 10)
+	large := strings.Repeat("v", 100)
+	tree.Set("a", large)
+	tree.Set("b", large)
+
+	// Values which can't be read are missing, values which can't be written
+	// aren't set, and pages which can't be freed are leaked
+	diskManager.fail = true
+	if pair := tree.Get("a"); pair != nil {
+		t.Fatalf("Expected a value which can't be read to be missing, found %v", pair)
+	}
+	tree.Set("c", large)
+	tree.Set("b", "small")
+	if tree.Err() != errDiskFailed {
+		t.Fatalf("Expected the disk's error, found %v", tree.Err())
+	}
+
+	// Once the disk recovers, every value which was set is there
+	diskManager.fail = false
+	for key, value := range map[string]string{"a": large, "b": "small"} {
+		if pair := tree.Get(key); pair == nil || pair.Value != value {
+			t.Fatalf("Expected %s = %s, found %v", key, value, pair)
+		}
+	}
+	if pair := tree.Get("c"); pair != nil {
+		t.Fatalf("Expected a failed write not to be set, found %v", pair)
+	}
+}
+
+func TestOverflow__comparator(t *testing.T) {
+	pool := buffer.NewBufferPoolWithSize(64, io.NewMemoryDiskManager())
+	tree := NewTreeWithOverflow(3, CaseInsensitive, pool, 10)
+	large := strings.Repeat("v", 100)
+	for _, key := range []string{"b", "A", "c", "B"} {
+		tree.Set(key, large)
+	}
+	checkInvariants(t, tree)
+
+	// Keys which differ only by case are the same key
+	if keys := collectKeys(tree.Scan("", "")); strings.Join(keys, ",") != "A,B,c" {
+		t.Fatalf("Expected keys ordered ignoring case, found %v", keys)
+	}
+	if pages := tree.overflow.pagesInUse(); pages != 3 {
+		t.Fatalf("Expected the overwritten value's page to be freed, %d in use", pages)
+	}
+}
+
+func TestOverflow__pagesAreMarkedWithTheLSN(t *testing.T) {
+	pool := buffer.NewBufferPoolWithSize(64, io.NewMemoryDiskManager())
+	tree := NewTreeWithOverflow(3, Bytewise, pool, 10)
+	tree.SetLogged("a", strings.Repeat("v", 3*buffer.PageSizeInBytes), 42)
+
+	dirty := pool.DirtyPages()
+	// Each page holds a little less than a page of the value
+	if len(dirty) != 4 {
+		t.Fatalf("Expected the value to dirty 4 pages, found %d", len(dirty))
+	}
+	for _, page := range dirty {
+		if page.RecLSN != 42 {
+			t.Fatalf("Expected page %d to be marked with LSN 42, found %d", page.PageId, page.RecLSN)
+		}
+	}
+}
+
+func TestOverflow__bulkLoad(t *testing.T) {
+	tree := newOverflowTree(10)
+	large := strings.Repeat("v", 100)
+	pairs := sortedPairs(50)
+	for i := 0; i < len(pairs); i += 5 {
+		pairs[i].Value = large
+	}
+
+	loaded, err := tree.BulkLoad(NewSliceIterator(pairs), DefaultFillFactor)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkInvariants(t, loaded)
+	for _, pair := range pairs {
+		assertKeyFound(t, loaded, pair.Key, pair.Value)
+	}
+	if pages := loaded.overflow.pagesInUse(); pages != 10 {
+		t.Fatalf("Expected the 10 large values in overflow pages, %d in use", pages)
+	}
+
+	// A load which fails frees what it wrote
+	unsorted := []KeyValuePair{{Key: "b", Value: large}, {Key: "a", Value: large}}
+	empty := newOverflowTree(10)
+	if _, err := empty.BulkLoad(NewSliceIterator(unsorted), 1); err == nil {
+		t.Fatalf("Expected an error for unsorted input")
+	}
+	if pages := empty.overflow.pagesInUse(); pages != 0 {
+		t.Fatalf("Expected a failed load to free its overflow pages, %d in use", pages)
+	}
+}
@@ -0,0 +1,94 @@
+package inmemory_btree
+
+import (
+	"encoding/binary"
+
+	. "yadb-go/pkg/store"
+)
+
+// Keys are often hierarchical (tenant/123/order/456), so neighbouring keys
+// share long prefixes. Two things take advantage of that:
+//
+// Separator keys in internal nodes only have to route lookups, so rather than
+// copying the first key of the right-hand node, the tree's comparator picks a
+// short key which falls between the two nodes (for Bytewise, the shortest
+// prefix of the right-hand key). Shorter separators take less memory, and
+// once internal nodes live in pages, more of them fit in each page.
+//
+// Leaves are written to pages front-coded: each key is stored as the length
+// of the prefix it shares with the previous key, followed by the rest of it.
+// Stats reports how many bytes the tree's leaves take written this way.
+
+func commonPrefixLength(a, b string) int {
+	n := len(a)
+	if len(b) < n {
+		n = len(b)
+	}
+	for i := 0; i < n; i++ {
+		if a[i] != b[i] {
+			return i
+		}
+	}
+	return n
+}
+
+// Leaf page layout
+//
+//	entry:   uvarint shared | uvarint suffix length | uvarint value length | suffix | value
+//	trailer: uint32 offset of each restart point | uint32 number of restart points
+//
+// Every restartInterval entries, a restart point stores its key in full
+// (shared is 0). A lookup can binary search the restart points, then only
+// decode forward from the nearest one, rather than from the start of the page.
+
+// leafRestartInterval is how many entries of a leaf page share each restart
+// point. A restart interval of 1 disables front coding.
+const leafRestartInterval = 16
+
+// encodeLeafPage front-codes the pairs of a leaf, which must be sorted by key
+func encodeLeafPage(pairs []*KeyValuePair, restartInterval int) []byte {
+	if restartInterval < 1 {
+		panic("Restart interval must be >= 1")
+	}
+
+	data := make([]byte, 0)
+	restarts := make([]uint32, 0)
+	previous := ""
+	for i, pair := range pairs {
+		shared := 0
+		if i%restartInterval == 0 {
+			restarts = append(restarts, uint32(len(data)))
+		} else {
+			shared = commonPrefixLength(previous, pair.Key)
+		}
+
+		data = binary.AppendUvarint(data, uint64(shared))
+		data = binary.AppendUvarint(data, uint64(len(pair.Key)-shared))
+		data = binary.AppendUvarint(data, uint64(len(pair.Value)))
+		data = append(data, pair.Key[shared:]...)
+		data = append(data, pair.Value...)
+		previous = pair.Key
+	}
+
+	for _, restart := range restarts {
+		data = binary.LittleEndian.AppendUint32(data, restart)
+	}
+	return binary.LittleEndian.AppendUint32(data, uint32(len(restarts)))
+}
+
+// leafPairs returns the pairs a latched leaf of the store's tree writes to a
+// page. A value moved to overflow pages is written as a reference to them.
+func leafPairs(leaf *Node[string, slot]) []*KeyValuePair {
+	pairs := make([]*KeyValuePair, len(leaf.keys))
+	for i, key := range leaf.keys {
+		s := leaf.values[i]
+		if s.pair != nil {
+			pairs[i] = &KeyValuePair{Key: key, Value: s.pair.Value}
+			continue
+		}
+		reference := binary.LittleEndian.AppendUint64(nil, uint64(s.head))
+		reference = binary.LittleEndian.AppendUint32(reference, uint32(s.length))
+		pairs[i] = &KeyValuePair{Key: key, Value: string(reference)}
+	}
+	return pairs
+}
@@ -0,0 +1,78 @@
+package inmemory_btree
+
+import (
+	"math/rand"
+	"strconv"
+	"testing"
+)
+
+// Benchmarks on hierarchical keys, which share long prefixes. Alongside the
+// timings, they report how many bytes keys take up in internal nodes, and
+// how many bytes each entry takes in front-coded leaf pages.
+
+func BenchmarkHierarchicalKeys(b *testing.B) {
+	pairs := hierarchicalPairs(100000)
+	rand.New(rand.NewSource(1)).Shuffle(len(pairs), func(i, j int) {
+		pairs[i], pairs[j] = pairs[j], pairs[i]
+	})
+
+	b.Run("Set", func(b *testing.B) {
+		tree := NewTree(64)
+		for i := 0; i < b.N; i++ {
+			pair := pairs[i%len(pairs)]
+			tree.Set(pair.Key, pair.Value)
+		}
+		b.StopTimer()
+		b.ReportMetric(averageSeparatorLength(tree), "separator-bytes")
+		b.ReportMetric(float64(len(pairs[0].Key)), "key-bytes")
+		stats := tree.Stats()
+		b.ReportMetric(float64(stats.LeafPageBytes)/float64(stats.Keys), "leaf-page-bytes/entry")
+	})
+
+	b.Run("Get", func(b *testing.B) {
+		tree := NewTree(64)
+		for _, pair := range pairs {
+			tree.Set(pair.Key, pair.Value)
+		}
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			tree.Get(pairs[i%len(pairs)].Key)
+		}
+	})
+}
+
+func BenchmarkLeafPage(b *testing.B) {
+	pairs := hierarchicalPairs(64)
+	for _, restartInterval := range []int{1, leafRestartInterval} {
+		b.Run("restartInterval="+strconv.Itoa(restartInterval), func(b *testing.B) {
+			var data []byte
+			for i := 0; i < b.N; i++ {
+				data = encodeLeafPage(pairs, restartInterval)
+			}
+			b.ReportMetric(float64(len(data))/float64(len(pairs)), "page-bytes/entry")
+		})
+	}
+}
+
+func averageSeparatorLength(tree *Tree) float64 {
+	total, count := 0, 0
+	var visit func(n *Node[string, slot])
+	visit = func(n *Node[string, slot]) {
+		if n.isLeaf {
+			return
+		}
+		for _, key := range n.keys {
+			total += len(key)
+			count++
+		}
+		for _, child := range n.children {
+			visit(child)
+		}
+	}
+	visit(tree.root)
+
+	if count == 0 {
+		return 0
+	}
+	return float64(total) / float64(count)
+}
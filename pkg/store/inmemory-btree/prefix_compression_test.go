@@ -0,0 +1,148 @@
+package inmemory_btree
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"testing"
+
+	. "yadb-go/pkg/store"
+)
+
+func TestSplit__usesShortestSeparators(t *testing.T) {
+	tree := NewTree(4)
+	pairs := hierarchicalPairs(500)
+	for _, pair := range pairs {
+		tree.Set(pair.Key, pair.Value)
+		checkInvariants(t, tree)
+	}
+
+	separatorBytes, keys := 0, 0
+	var visit func(n *Node[string, slot])
+	visit = func(n *Node[string, slot]) {
+		if n.isLeaf {
+			return
+		}
+		for _, key := range n.keys {
+			separatorBytes += len(key)
+			keys++
+		}
+		for _, child := range n.children {
+			visit(child)
+		}
+	}
+	visit(tree.root)
+
+	if average := separatorBytes / keys; average >= len(pairs[0].Key) {
+		t.Fatalf("Expected separators to be shorter than keys of length %d, averaged %d", len(pairs[0].Key), average)
+	}
+	for _, pair := range pairs {
+		assertKeyFound(t, tree, pair.Key, pair.Value)
+	}
+}
+
+func TestLeafPage(t *testing.T) {
+	pairs := hierarchicalPairs(100)
+	for _, restartInterval := range []int{1, 3, leafRestartInterval} {
+		decoded, err := decodeLeafPage(encodeLeafPage(pairs, restartInterval))
+		if err != nil {
+			t.Fatalf("Failed to decode leaf page: %v", err)
+		}
+		if len(decoded) != len(pairs) {
+			t.Fatalf("Expected %d pairs, decoded %d", len(pairs), len(decoded))
+		}
+		for i, pair := range pairs {
+			if *decoded[i] != *pair {
+				t.Fatalf("Expected %v, decoded %v", pair, decoded[i])
+			}
+		}
+	}
+}
+
+func TestLeafPage__frontCodingSavesSpace(t *testing.T) {
+	pairs := hierarchicalPairs(100)
+	plain := encodeLeafPage(pairs, 1)
+	frontCoded := encodeLeafPage(pairs, leafRestartInterval)
+
+	if len(frontCoded) >= len(plain)/2 {
+		t.Fatalf("Expected front coding to at least halve the page, from %d bytes to %d", len(plain), len(frontCoded))
+	}
+}
+
+func TestLeafPage__empty(t *testing.T) {
+	pairs, err := decodeLeafPage(encodeLeafPage(nil, leafRestartInterval))
+	if err != nil || len(pairs) != 0 {
+		t.Fatalf("Expected an empty page to decode to no pairs, got %v (%v)", pairs, err)
+	}
+}
+
+func TestStats__leafPageBytes(t *testing.T) {
+	tree := NewTree(16)
+	pairs := hierarchicalPairs(500)
+	plain := 0
+	for _, pair := range pairs {
+		tree.Set(pair.Key, pair.Value)
+		plain += len(pair.Key) + len(pair.Value)
+	}
+
+	stats := tree.Stats()
+	if stats.LeafPageBytes == 0 || stats.LeafPageBytes >= plain*3/4 {
+		t.Fatalf("Expected front-coded leaves to be well under the %d bytes of keys and values, found %d", plain, stats.LeafPageBytes)
+	}
+}
+
+func TestStats__leafPageBytesOfOverflowValues(t *testing.T) {
+	tree := newOverflowTree(8)
+	tree.Set("key", string(make([]byte, 10000)))
+
+	// The leaf holds a reference to the overflow pages, not the value
+	if stats := tree.Stats(); stats.LeafPageBytes > 100 {
+		t.Fatalf("Expected the leaf page to hold a reference to the value, found %d bytes", stats.LeafPageBytes)
+	}
+}
+
+// decodeLeafPage returns every pair in a leaf page
+func decodeLeafPage(data []byte) ([]*KeyValuePair, error) {
+	errCorrupt := errors.New("corrupt leaf page")
+	if len(data) < 4 {
+		return nil, errCorrupt
+	}
+	restarts := int(binary.LittleEndian.Uint32(data[len(data)-4:]))
+	end := len(data) - 4 - 4*restarts
+	if end < 0 {
+		return nil, errCorrupt
+	}
+
+	pairs := make([]*KeyValuePair, 0)
+	for offset, previous := 0, ""; offset < end; {
+		var lengths [3]uint64
+		for i := range lengths {
+			length, n := binary.Uvarint(data[offset:end])
+			if n <= 0 {
+				return nil, errCorrupt
+			}
+			lengths[i], offset = length, offset+n
+		}
+		shared, suffixLength, valueLength := int(lengths[0]), int(lengths[1]), int(lengths[2])
+		if shared > len(previous) || offset+suffixLength+valueLength > end {
+			return nil, errCorrupt
+		}
+
+		key := previous[:shared] + string(data[offset:offset+suffixLength])
+		offset += suffixLength
+		pairs = append(pairs, &KeyValuePair{Key: key, Value: string(data[offset : offset+valueLength])})
+		offset += valueLength
+		previous = key
+	}
+	return pairs, nil
+}
+
+// hierarchicalPairs returns sorted pairs with keys like tenant/0001/order/00000042
+func hierarchicalPairs(n int) []*KeyValuePair {
+	pairs := make([]*KeyValuePair, 0, n)
+	for i := 0; i < n; i++ {
+		key := fmt.Sprintf("tenant/%04d/order/%08d", i/50+1, i%50*37)
+		pairs = append(pairs, &KeyValuePair{Key: key, Value: fmt.Sprintf("value%d", i)})
+	}
+	return pairs
+}
@@ -0,0 +1,128 @@
+package inmemory_btree
+
+import "unsafe"
+
+// Stats describes the shape of a tree
+type Stats struct {
+	// Height is the number of levels, so 1 for a tree which is a single leaf
+	Height        int
+	InternalNodes int
+	LeafNodes     int
+	Keys          int
+	// AverageFill and MinFill are the average and smallest fraction of their
+	// capacity (the degree) that nodes use. The root may legitimately be
+	// almost empty, so is left out unless it is the only node.
+	AverageFill float64
+	MinFill     float64
+	// ApproximateBytes estimates the memory held by nodes, keys and values.
+	// Values moved to overflow pages live in the buffer pool, so aren't
+	// counted.
+	ApproximateBytes int
+	// LeafPageBytes is how many bytes the leaves of the store's tree take
+	// written to pages, with their keys front-coded. It is 0 for other trees.
+	LeafPageBytes int
+	// OverflowPages is how many pages hold values moved out of the leaves of
+	// the store's tree
+	OverflowPages int
+}
+
+// Stats walks the tree and reports its shape. Nodes are latched one at a
+// time, so writers aren't held up, but the result is only approximate while
+// the tree is being modified.
+func (tree *BTree[K, V]) Stats() Stats {
+	tree.rootLatch.RLock()
+	root := tree.root
+	tree.rootLatch.RUnlock()
+
+	var node Node[K, V]
+	var key K
+	var value V
+	nodeBytes, keyBytes, valueBytes := int(unsafe.Sizeof(node)), int(unsafe.Sizeof(key)), int(unsafe.Sizeof(value))
+	childBytes := int(unsafe.Sizeof(root))
+
+	stats := Stats{MinFill: 1}
+	fills := 0.0
+	nodes := 0
+	var visit func(n *Node[K, V], depth int)
+	visit = func(n *Node[K, V], depth int) {
+		n.latch.RLock()
+		fill := float64(n.size()) / float64(tree.degree)
+		bytes := nodeBytes + cap(n.keys)*keyBytes + cap(n.children)*childBytes + cap(n.values)*valueBytes
+		for _, key := range n.keys {
+			bytes += heapBytes(key)
+		}
+		for _, value := range n.values {
+			bytes += heapBytes(value)
+		}
+		children := append([]*Node[K, V](nil), n.children...)
+		if n.isLeaf {
+			stats.LeafNodes++
+			stats.Keys += len(n.keys)
+		} else {
+			stats.InternalNodes++
+		}
+		n.latch.RUnlock()
+
+		if depth+1 > stats.Height {
+			stats.Height = depth + 1
+		}
+		stats.ApproximateBytes += bytes
+		if n != root || len(children) == 0 {
+			fills += fill
+			nodes++
+			if fill < stats.MinFill {
+				stats.MinFill = fill
+			}
+		}
+		for _, child := range children {
+			visit(child, depth+1)
+		}
+	}
+	visit(root, 0)
+
+	stats.AverageFill = fills / float64(nodes)
+	return stats
+}
+
+// Stats reports the shape of the tree, and how many bytes its leaves take
+// written to pages. Leaves are latched one at a time, left to right.
+func (tree *Tree) Stats() Stats {
+	stats := tree.BTree.Stats()
+
+	leaf := tree.findLeafShared(func(*Node[string, slot]) int { return 0 })
+	for leaf != nil {
+		stats.LeafPageBytes += len(encodeLeafPage(leafPairs(leaf), leafRestartInterval))
+		next := leaf.next
+		if next != nil {
+			next.latch.RLock()
+		}
+		leaf.latch.RUnlock()
+		leaf = next
+	}
+	if tree.overflow != nil {
+		stats.OverflowPages = tree.overflow.pagesInUse()
+	}
+	return stats
+}
+
+// heapBytes estimates the memory a key or value refers to, beyond its own size
+func heapBytes(x any) int {
+	switch x := x.(type) {
+	case string:
+		return len(x)
+	case []byte:
+		return cap(x)
+	case interface{ heapBytes() int }:
+		return x.heapBytes()
+	}
+	return 0
+}
+
+// heapBytes counts the pair held in a slot. Its key shares its bytes with the
+// key held in the leaf, so only the value is counted.
+func (s slot) heapBytes() int {
+	if s.pair == nil {
+		return 0
+	}
+	return int(unsafe.Sizeof(*s.pair)) + len(s.pair.Value)
+}
@@ -0,0 +1,78 @@
+package inmemory_btree
+
+import (
+	"fmt"
+	"testing"
+
+	. "yadb-go/pkg/store"
+)
+
+func TestStats__emptyTree(t *testing.T) {
+	stats := NewTree(4).Stats()
+
+	if stats.Height != 1 || stats.LeafNodes != 1 || stats.InternalNodes != 0 || stats.Keys != 0 {
+		t.Fatalf("Expected a single empty leaf, found %+v", stats)
+	}
+	if stats.AverageFill != 0 || stats.MinFill != 0 {
+		t.Fatalf("Expected an empty leaf to be unfilled, found %+v", stats)
+	}
+}
+
+func TestStats__packedTree(t *testing.T) {
+	tree, err := BulkLoad(NewSliceIterator(sortedPairs(100)), 10, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stats := tree.Stats()
+	if stats.Height != 2 || stats.LeafNodes != 10 || stats.InternalNodes != 1 || stats.Keys != 100 {
+		t.Fatalf("Expected a root over 10 leaves holding 100 keys, found %+v", stats)
+	}
+	if stats.AverageFill != 1 || stats.MinFill != 1 {
+		t.Fatalf("Expected every leaf to be full, found %+v", stats)
+	}
+	// Each pair holds a 6 byte key and 6 byte value
+	if stats.ApproximateBytes < 100*12 {
+		t.Fatalf("Expected at least the keys and values to be counted, found %d bytes", stats.ApproximateBytes)
+	}
+}
+
+func TestStats__afterInsertsAndDeletes(t *testing.T) {
+	tree := NewTree(5)
+	for i := 0; i < 1000; i++ {
+		tree.Set(fmt.Sprintf("key%04d", i), "val")
+	}
+	for i := 0; i < 1000; i += 3 {
+		tree.Delete(fmt.Sprintf("key%04d", i))
+	}
+
+	stats := tree.Stats()
+	if stats.Keys != 666 {
+		t.Fatalf("Expected 666 keys, found %d", stats.Keys)
+	}
+	if leaves := len(collectLeaves(tree.root)); stats.LeafNodes != leaves {
+		t.Fatalf("Expected %d leaves, found %d", leaves, stats.LeafNodes)
+	}
+	height := 1
+	for n := tree.root; !n.isLeaf; n = n.children[0] {
+		height++
+	}
+	if stats.Height != height || stats.InternalNodes == 0 {
+		t.Fatalf("Expected %d levels of nodes, found %+v", height, stats)
+	}
+	// Nodes other than the root are at least (d+1)/2 or d/2 full
+	if stats.MinFill < 0.4 || stats.AverageFill < stats.MinFill || stats.AverageFill > 1 {
+		t.Fatalf("Fill factors outside the occupancy bounds: %+v", stats)
+	}
+}
+
+func collectLeaves[K any, V any](n *Node[K, V]) []*Node[K, V] {
+	if n.isLeaf {
+		return []*Node[K, V]{n}
+	}
+	leaves := make([]*Node[K, V], 0)
+	for _, child := range n.children {
+		leaves = append(leaves, collectLeaves(child)...)
+	}
+	return leaves
+}
@@ -0,0 +1,224 @@
+package inmemory_btree
+
+import (
+	"sync"
+
+	"yadb-go/pkg/buffer"
+	. "yadb-go/pkg/store"
+	. "yadb-go/pkg/types"
+)
+
+// Tree is the B+ Tree used as a Store: a BTree of string keys, ordered by a
+// Comparator, whose leaves hold KeyValuePairs. Large values may be moved out
+// of the leaves, to overflow pages.
+type Tree struct {
+	*BTree[string, slot]
+	comparator Comparator
+	overflow   *overflowPages // nil if large values are kept inline
+
+	errMu sync.Mutex
+	err   error // the first overflow page I/O error
+}
+
+// NewTree creates a new B-Tree with the given degree, which orders keys
+// bytewise
+func NewTree(degree int) *Tree {
+	return NewTreeWithComparator(degree, Bytewise)
+}
+
+// NewTreeWithComparator creates a new B-Tree which orders keys by cmp
+func NewTreeWithComparator(degree int, cmp Comparator) *Tree {
+	return &Tree{
+		BTree:      NewBTree[string, slot](degree, cmp),
+		comparator: cmp,
+	}
+}
+
+// NewTreeWithOverflow creates a new B-Tree which orders keys by cmp, and moves
+// values longer than inlineThreshold bytes out of its leaves, into overflow
+// pages held in pool
+func NewTreeWithOverflow(degree int, cmp Comparator, pool buffer.Pool, inlineThreshold int) *Tree {
+	if inlineThreshold < 0 {
+		panic("Inline threshold must be >= 0")
+	}
+
+	tree := NewTreeWithComparator(degree, cmp)
+	tree.overflow = newOverflowPages(pool, inlineThreshold)
+	tree.load = tree.loadSlot
+	return tree
+}
+
+// Err returns the first error the tree met reading or writing overflow
+// pages, or nil. A Set whose value couldn't be written leaves the tree as it
+// was, and a value which couldn't be read is treated as missing.
+func (tree *Tree) Err() error {
+	tree.errMu.Lock()
+	defer tree.errMu.Unlock()
+	return tree.err
+}
+
+func (tree *Tree) fail(err error) {
+	tree.errMu.Lock()
+	defer tree.errMu.Unlock()
+	if tree.err == nil {
+		tree.err = err
+	}
+}
+
+// Get Returns a pointer to the KeyValuePair if the key exists in this Tree
+// otherwise returns nil
+func (tree *Tree) Get(key string) *KeyValuePair {
+	s, found := tree.BTree.Get(key)
+	if !found {
+		return nil
+	}
+	return s.pair
+}
+
+// Set a key-value pair into the tree, overwriting any existing value for the key
+func (tree *Tree) Set(key string, value string) {
+	tree.SetLogged(key, value, 0)
+}
+
+// SetLogged is Set, for a write logged at lsn. Overflow pages the value is
+// written to are marked with it.
+func (tree *Tree) SetLogged(key string, value string, lsn LSN) {
+	s, err := tree.slotFor(key, value, lsn)
+	if err != nil {
+		tree.fail(err)
+		return
+	}
+	if replaced, ok := tree.BTree.Set(key, s); ok {
+		tree.freeSlot(replaced)
+	}
+}
+
+// Delete removes a key from the tree
+func (tree *Tree) Delete(key string) {
+	if removed, ok := tree.BTree.Delete(key); ok {
+		tree.freeSlot(removed)
+	}
+}
+
+// DeleteLogged is Delete, for a delete logged at lsn. Freeing overflow pages
+// doesn't write them, so the LSN isn't needed.
+func (tree *Tree) DeleteLogged(key string, _ LSN) {
+	tree.Delete(key)
+}
+
+// NewIterator returns an iterator over the pairs in the range described by
+// opts, in key order
+func (tree *Tree) NewIterator(opts ScanOptions) Iterator {
+	c := &storeCursor{cursor[string, slot]{tree: tree.BTree}}
+	return NewRangeIteratorWithComparator(c, opts, tree.comparator)
+}
+
+// Scan returns an iterator over the keys in [start, end). An empty end leaves
+// the range unbounded.
+func (tree *Tree) Scan(start, end string) Iterator {
+	return tree.NewIterator(ScanOptions{Start: start, End: end})
+}
+
+// ScanPrefix returns an iterator over the keys starting with prefix
+func (tree *Tree) ScanPrefix(prefix string) Iterator {
+	return tree.NewIterator(ScanOptions{Prefix: prefix})
+}
+
+// First returns the pair with the smallest key, or nil if the tree is empty
+func (tree *Tree) First() *KeyValuePair {
+	return pairOf(tree.BTree.First())
+}
+
+// Last returns the pair with the largest key, or nil if the tree is empty
+func (tree *Tree) Last() *KeyValuePair {
+	return pairOf(tree.BTree.Last())
+}
+
+// Floor returns the pair with the largest key <= key, or nil if there is none
+func (tree *Tree) Floor(key string) *KeyValuePair {
+	return pairOf(tree.BTree.Floor(key))
+}
+
+// Ceiling returns the pair with the smallest key >= key, or nil if there is none
+func (tree *Tree) Ceiling(key string) *KeyValuePair {
+	return pairOf(tree.BTree.Ceiling(key))
+}
+
+// Count returns the number of keys in [start, end). An empty end leaves the
+// range unbounded.
+func (tree *Tree) Count(start, end string) int {
+	if end == "" {
+		return clampCount(tree.Len() - tree.Rank(start))
+	}
+	return tree.BTree.Count(start, end)
+}
+
+// Select returns the pair at position i in key order, counting from 0, or nil
+// if i is out of range
+func (tree *Tree) Select(i int) *KeyValuePair {
+	return pairOf(tree.BTree.Select(i))
+}
+
+// pairOf returns the pair held in a slot which has been read out of the tree,
+// or nil if none was found
+func pairOf(_ string, s slot, found bool) *KeyValuePair {
+	if !found {
+		return nil
+	}
+	return s.pair
+}
+
+// storeCursor is a cursor over the tree's slots which provides the values of
+// their pairs, as a store.Cursor
+type storeCursor struct {
+	cursor[string, slot]
+}
+
+func (c *storeCursor) Value() string {
+	if c.value.pair == nil {
+		return "" // it couldn't be read from overflow pages
+	}
+	return c.value.pair.Value
+}
+
+// slotFor returns what to hold in a leaf slot for a pair: the pair itself, or
+// a reference to overflow pages holding its value if that is too large
+func (tree *Tree) slotFor(key string, value string, lsn LSN) (slot, error) {
+	if tree.overflow == nil || len(value) <= tree.overflow.inlineThreshold {
+		return slot{pair: &KeyValuePair{Key: key, Value: value}}, nil
+	}
+
+	head, err := tree.overflow.write(value, lsn)
+	if err != nil {
+		return slot{}, err
+	}
+	return slot{head: head, length: len(value)}, nil
+}
+
+// loadSlot reads the value of a slot back from overflow pages, if it was
+// moved there. The leaf must be latched, so that the pages are not freed
+// meanwhile. If the value can't be read, the slot returned holds no pair.
+func (tree *Tree) loadSlot(key string, s slot) slot {
+	if s.pair != nil {
+		return s
+	}
+
+	value, err := tree.overflow.read(s.head, s.length)
+	if err != nil {
+		tree.fail(err)
+		return slot{}
+	}
+	return slot{pair: &KeyValuePair{Key: key, Value: value}}
+}
+
+// freeSlot frees the overflow pages of a slot which has been replaced or
+// removed, once it is no longer latched. Any reader which found the slot did
+// so under the leaf latch, so has already finished reading the pages.
+func (tree *Tree) freeSlot(s slot) {
+	if s.pair != nil {
+		return
+	}
+	if err := tree.overflow.free(s.head); err != nil {
+		tree.fail(err)
+	}
+}
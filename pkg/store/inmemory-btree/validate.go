@@ -0,0 +1,172 @@
+package inmemory_btree
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// Validate checks the structure of the tree, returning an error describing
+// the first problem found. It checks that keys are ordered and lie within the
+// bounds set by separators, parent pointers are consistent, all leaves are at
+// the same depth, every node other than the root is within its occupancy
+// bounds, subtree counts are right, and the leaf sibling links match an
+// in-order traversal.
+//
+// Validate takes no latches, so must not run concurrently with writes. It is
+// meant for tests and debugging.
+func (tree *BTree[K, V]) Validate() error {
+	if tree.root.parent != nil {
+		return errors.New("root has a parent")
+	}
+	if !tree.root.isLeaf && len(tree.root.keys) == 0 {
+		return errors.New("internal root has a single child")
+	}
+
+	v := &validator[K, V]{tree: tree, leafDepth: -1}
+	if err := v.validateNode(tree.root, nil, nil, 0); err != nil {
+		return err
+	}
+	return validateLeafLinks(v.leaves)
+}
+
+// validator holds what Validate has learned about the tree so far
+type validator[K any, V any] struct {
+	tree      *BTree[K, V]
+	leafDepth int           // the depth of the first leaf, or -1
+	leaves    []*Node[K, V] // the leaves visited, in order
+}
+
+// validateNode checks a node and its subtree, whose keys must lie in
+// [lower, upper)
+func (v *validator[K, V]) validateNode(n *Node[K, V], lower *K, upper *K, depth int) error {
+	tree := v.tree
+	if n.tree != tree {
+		return fmt.Errorf("node at depth %d belongs to another tree", depth)
+	}
+	if n.parent != nil && (n.size() < n.minSize() || n.size() > tree.degree) {
+		return fmt.Errorf("node at depth %d has size %d outside [%d, %d]", depth, n.size(), n.minSize(), tree.degree)
+	}
+
+	inBounds := func(key K) bool {
+		return (lower == nil || tree.cmp.Compare(key, *lower) >= 0) && (upper == nil || tree.cmp.Compare(key, *upper) < 0)
+	}
+
+	if n.isLeaf {
+		if v.leafDepth == -1 {
+			v.leafDepth = depth
+		} else if v.leafDepth != depth {
+			return fmt.Errorf("leaves found at depths %d and %d", v.leafDepth, depth)
+		}
+		if n.removed {
+			return fmt.Errorf("leaf at depth %d is marked removed", depth)
+		}
+		if len(n.values) != len(n.keys) || len(n.children) != 0 {
+			return fmt.Errorf("leaf at depth %d has %d keys, %d values and %d children", depth, len(n.keys), len(n.values), len(n.children))
+		}
+		for i, key := range n.keys {
+			if !inBounds(key) {
+				return fmt.Errorf("leaf key %s lies outside its separators", formatKey(key))
+			}
+			if i > 0 && tree.cmp.Compare(n.keys[i-1], key) >= 0 {
+				return fmt.Errorf("leaf keys out of order at %s", formatKey(key))
+			}
+		}
+		if count := n.count.Load(); count != int64(len(n.keys)) {
+			return fmt.Errorf("leaf at depth %d has count %d but %d entries", depth, count, len(n.keys))
+		}
+		v.leaves = append(v.leaves, n)
+		return nil
+	}
+
+	if len(n.children) != len(n.keys)+1 || len(n.values) != 0 {
+		return fmt.Errorf("internal node has %d keys, %d children and %d values", len(n.keys), len(n.children), len(n.values))
+	}
+	for i, key := range n.keys {
+		if !inBounds(key) {
+			return fmt.Errorf("separator %s lies outside its parent's separators", formatKey(key))
+		}
+		if i > 0 && tree.cmp.Compare(n.keys[i-1], key) >= 0 {
+			return fmt.Errorf("separators out of order at %s", formatKey(key))
+		}
+	}
+	count := int64(0)
+	for i, child := range n.children {
+		count += child.count.Load()
+		if child.parent != n {
+			return fmt.Errorf("child %d of node at depth %d has the wrong parent", i, depth)
+		}
+		childLower, childUpper := lower, upper
+		if i > 0 {
+			childLower = &n.keys[i-1]
+		}
+		if i < len(n.keys) {
+			childUpper = &n.keys[i]
+		}
+		if err := v.validateNode(child, childLower, childUpper, depth+1); err != nil {
+			return err
+		}
+	}
+	if n.count.Load() != count {
+		return fmt.Errorf("node at depth %d has count %d but %d keys beneath it", depth, n.count.Load(), count)
+	}
+	return nil
+}
+
+// validateLeafLinks compares the leaf sibling links to the leaves found by an
+// in-order traversal
+func validateLeafLinks[K any, V any](leaves []*Node[K, V]) error {
+	if leaves[0].prev != nil {
+		return errors.New("first leaf has a prev link")
+	}
+	if leaves[len(leaves)-1].next != nil {
+		return errors.New("last leaf has a next link")
+	}
+	for i, leaf := range leaves {
+		if i > 0 && leaf.prev != leaves[i-1] {
+			return fmt.Errorf("leaf %d has the wrong prev link", i)
+		}
+		if i < len(leaves)-1 && leaf.next != leaves[i+1] {
+			return fmt.Errorf("leaf %d has the wrong next link", i)
+		}
+	}
+	return nil
+}
+
+// Dump writes the structure of the tree to w, one node per line, indented by
+// depth. Internal nodes list their separator keys, and leaves their keys.
+// Like Validate, it must not run concurrently with writes.
+func (tree *BTree[K, V]) Dump(w io.Writer) error {
+	return tree.dumpNode(w, tree.root, 0)
+}
+
+func (tree *BTree[K, V]) dumpNode(w io.Writer, n *Node[K, V], depth int) error {
+	keys := make([]string, len(n.keys))
+	for i, key := range n.keys {
+		keys[i] = formatKey(key)
+	}
+	kind := "internal"
+	if n.isLeaf {
+		kind = "leaf"
+	}
+	if _, err := fmt.Fprintf(w, "%s%s [%s]\n", strings.Repeat("  ", depth), kind, strings.Join(keys, " ")); err != nil {
+		return err
+	}
+
+	for _, child := range n.children {
+		if err := tree.dumpNode(w, child, depth+1); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// formatKey formats a key for Dump and error messages, quoting strings
+func formatKey(key any) string {
+	if s, ok := key.(string); ok {
+		return strconv.Quote(s)
+	}
+	return fmt.Sprint(key)
+}
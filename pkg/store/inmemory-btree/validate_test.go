@@ -0,0 +1,73 @@
+package inmemory_btree
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestValidate__detectsCorruption(t *testing.T) {
+	corruptions := map[string]func(tree *Tree){
+		"unordered leaf": func(tree *Tree) {
+			leaf := tree.root.children[0]
+			leaf.keys[0], leaf.keys[1] = leaf.keys[1], leaf.keys[0]
+		},
+		"wrong separator": func(tree *Tree) {
+			tree.root.keys[0] = "key000"
+		},
+		"wrong parent": func(tree *Tree) {
+			tree.root.children[1].parent = nil
+		},
+		"underfull leaf": func(tree *Tree) {
+			leaf := tree.root.children[0]
+			leaf.keys = truncate(leaf.keys, 1)
+			leaf.values = truncate(leaf.values, 1)
+		},
+		"broken leaf link": func(tree *Tree) {
+			tree.root.children[0].next = nil
+		},
+		"uneven depth": func(tree *Tree) {
+			leaf := tree.root.children[0]
+			parent := tree.NewEmptyNode(false)
+			parent.children = []*Node[string, slot]{leaf}
+			parent.adopt(parent.children)
+			parent.parent = tree.root
+			tree.root.children[0] = parent
+		},
+	}
+
+	for name, corrupt := range corruptions {
+		t.Run(name, func(t *testing.T) {
+			tree := NewTree(4)
+			for _, key := range []string{"key000", "key001", "key002", "key003", "key004", "key005"} {
+				tree.Set(key, "val")
+			}
+			checkInvariants(t, tree)
+
+			corrupt(tree)
+			if err := tree.Validate(); err == nil {
+				t.Fatalf("Expected Validate to detect the corruption")
+			}
+		})
+	}
+}
+
+func TestDump(t *testing.T) {
+	tree := NewTree(2)
+	for _, key := range []string{"a", "b", "c", "d"} {
+		tree.Set(key, "val")
+	}
+
+	var dump strings.Builder
+	if err := tree.Dump(&dump); err != nil {
+		t.Fatalf("Dump failed: %v", err)
+	}
+
+	expected := `internal ["b" "c"]
+  leaf ["a"]
+  leaf ["b"]
+  leaf ["c" "d"]
+`
+	if dump.String() != expected {
+		t.Fatalf("Expected dump\n%s\nfound\n%s", expected, dump.String())
+	}
+}
@@ -0,0 +1,276 @@
+package store
+
+import (
+	"strings"
+
+	. "yadb-go/pkg/types"
+)
+
+// Iterator walks over key-value pairs in key order, or in descending order if
+// created with ScanOptions.Reverse. A newly created iterator is already
+// positioned at the first pair it visits, so the usual loop is
+//
+//	for it := s.NewIterator(opts); it.Valid(); it.Next() { ... }
+//
+// Key and Value may only be called while Valid returns true. Iterators should
+// be closed once finished with.
+type Iterator interface {
+	// Seek positions the iterator at the first pair in range whose key is >= key
+	// or, for reverse iterators, the last pair in range whose key is <= key
+	Seek(key string)
+	// Next advances the iterator to the following pair
+	Next()
+	// Valid reports whether the iterator is positioned at a pair
+	Valid() bool
+	Key() string
+	Value() string
+	// KeyBytes and ValueBytes return read-only views of the key and value,
+	// without copying them
+	KeyBytes() []byte
+	ValueBytes() []byte
+	Close()
+}
+
+// ScanOptions describes the range of keys an Iterator visits. By default
+// Start is inclusive and End is exclusive. An empty End leaves the range
+// unbounded above, and as the empty string sorts first, an empty Start
+// leaves it unbounded below.
+type ScanOptions struct {
+	Start          string
+	End            string
+	StartExclusive bool
+	EndInclusive   bool
+	// Limit is the maximum number of pairs visited after the iterator is
+	// created or repositioned with Seek. 0 means no limit.
+	Limit int
+	// Reverse visits the range in descending key order, starting from End
+	Reverse bool
+	// Prefix further restricts the range to keys starting with Prefix. The
+	// iterator seeks straight to the prefix and stops at the first key
+	// without it, rather than filtering the whole range. Under a comparator
+	// other than Bytewise, keys sharing a prefix needn't be adjacent, so the
+	// prefix only filters the range.
+	Prefix string
+}
+
+// Cursor is the raw ordered traversal a Store provides to support iteration.
+// NewRangeIterator applies ScanOptions on top of it, so each Store only has to
+// know how to walk its own structure.
+type Cursor interface {
+	// SeekGE positions the cursor at the first pair whose key is >= key
+	SeekGE(key string)
+	// SeekLE positions the cursor at the last pair whose key is <= key
+	SeekLE(key string)
+	// SeekLast positions the cursor at the pair with the largest key
+	SeekLast()
+	Next()
+	Prev()
+	Valid() bool
+	Key() string
+	Value() string
+	Close()
+}
+
+// rangeIterator restricts a Cursor to the range described by ScanOptions
+type rangeIterator struct {
+	cursor  Cursor
+	opts    ScanOptions
+	cmp     Comparator
+	visited int
+}
+
+// NewRangeIterator wraps a cursor in an Iterator over the range in opts, and
+// positions it at the first pair in range
+func NewRangeIterator(cursor Cursor, opts ScanOptions) Iterator {
+	return NewRangeIteratorWithComparator(cursor, opts, Bytewise)
+}
+
+// NewRangeIteratorWithComparator wraps a cursor over keys ordered by cmp
+func NewRangeIteratorWithComparator(cursor Cursor, opts ScanOptions, cmp Comparator) Iterator {
+	if cmp == Bytewise {
+		opts = opts.withPrefixBounds()
+	}
+	it := &rangeIterator{
+		cursor: cursor,
+		opts:   opts,
+		cmp:    cmp,
+	}
+	if opts.Reverse {
+		it.seekToEnd()
+	} else {
+		it.Seek(opts.Start)
+	}
+	return it
+}
+
+func (it *rangeIterator) Seek(key string) {
+	it.visited = 0
+	defer it.skipToPrefix()
+	if it.opts.Reverse {
+		if it.opts.End != "" && it.cmp.Compare(key, it.opts.End) >= 0 {
+			it.seekToEnd()
+		} else {
+			it.cursor.SeekLE(key)
+		}
+		return
+	}
+
+	if it.cmp.Compare(key, it.opts.Start) <= 0 {
+		it.cursor.SeekGE(it.opts.Start)
+		if it.opts.StartExclusive && it.cursor.Valid() && it.cmp.Compare(it.cursor.Key(), it.opts.Start) == 0 {
+			it.cursor.Next()
+		}
+		return
+	}
+	it.cursor.SeekGE(key)
+}
+
+// seekToEnd positions a reverse iterator at the last pair in range
+func (it *rangeIterator) seekToEnd() {
+	defer it.skipToPrefix()
+	if it.opts.End == "" {
+		it.cursor.SeekLast()
+		return
+	}
+	it.cursor.SeekLE(it.opts.End)
+	if !it.opts.EndInclusive && it.cursor.Valid() && it.cmp.Compare(it.cursor.Key(), it.opts.End) == 0 {
+		it.cursor.Prev()
+	}
+}
+
+func (it *rangeIterator) Next() {
+	if !it.Valid() {
+		return
+	}
+	it.visited++
+	it.step()
+	it.skipToPrefix()
+}
+
+func (it *rangeIterator) step() {
+	if it.opts.Reverse {
+		it.cursor.Prev()
+	} else {
+		it.cursor.Next()
+	}
+}
+
+// skipToPrefix moves past keys without the prefix, when the prefix doesn't
+// bound the range. With Bytewise, the first key without the prefix is past
+// the end of the range.
+func (it *rangeIterator) skipToPrefix() {
+	if it.cmp == Bytewise {
+		return
+	}
+	for it.inRange() && !strings.HasPrefix(it.cursor.Key(), it.opts.Prefix) {
+		it.step()
+	}
+}
+
+func (it *rangeIterator) Valid() bool {
+	if it.opts.Limit > 0 && it.visited >= it.opts.Limit {
+		return false
+	}
+	return it.inRange() && strings.HasPrefix(it.cursor.Key(), it.opts.Prefix)
+}
+
+// inRange reports whether the cursor is at a pair within the bounds
+func (it *rangeIterator) inRange() bool {
+	if !it.cursor.Valid() {
+		return false
+	}
+	key := it.cursor.Key()
+	if it.opts.Reverse {
+		return it.opts.AfterStart(key, it.cmp)
+	}
+	return it.opts.BeforeEnd(key, it.cmp)
+}
+
+func (it *rangeIterator) Key() string {
+	return it.cursor.Key()
+}
+
+func (it *rangeIterator) Value() string {
+	return it.cursor.Value()
+}
+
+func (it *rangeIterator) KeyBytes() []byte {
+	return unsafeBytes(it.cursor.Key())
+}
+
+func (it *rangeIterator) ValueBytes() []byte {
+	return unsafeBytes(it.cursor.Value())
+}
+
+func (it *rangeIterator) Close() {
+	it.cursor.Close()
+}
+
+// BeforeEnd reports whether key, ordered by cmp, lies below the upper bound
+// of the range
+func (opts *ScanOptions) BeforeEnd(key string, cmp Comparator) bool {
+	if opts.End == "" {
+		return true
+	}
+	c := cmp.Compare(key, opts.End)
+	return c < 0 || (c == 0 && opts.EndInclusive)
+}
+
+// AfterStart reports whether key, ordered by cmp, lies above the lower bound
+// of the range
+func (opts *ScanOptions) AfterStart(key string, cmp Comparator) bool {
+	c := cmp.Compare(key, opts.Start)
+	return c > 0 || (c == 0 && !opts.StartExclusive)
+}
+
+// withPrefixBounds narrows Start and End to the keys starting with Prefix, so
+// that seeking to either end of the range lands inside the prefix. Only
+// Bytewise keeps the keys with a prefix together, between the prefix and its
+// successor, so the bounds only apply to ranges ordered by it.
+func (opts ScanOptions) withPrefixBounds() ScanOptions {
+	if opts.Prefix == "" {
+		return opts
+	}
+
+	if Bytewise.Compare(opts.Start, opts.Prefix) < 0 {
+		opts.Start, opts.StartExclusive = opts.Prefix, false
+	}
+	successor, bounded := PrefixSuccessor(opts.Prefix)
+	if bounded && (opts.End == "" || Bytewise.Compare(opts.End, successor) >= 0) {
+		opts.End, opts.EndInclusive = successor, false
+	}
+	return opts
+}
+
+// PrefixSuccessor returns the smallest key greater than every key starting
+// with prefix. If there is no such key (the prefix is all 0xff bytes), it
+// returns false.
+func PrefixSuccessor(prefix string) (string, bool) {
+	for i := len(prefix) - 1; i >= 0; i-- {
+		if prefix[i] != 0xff {
+			return prefix[:i] + string([]byte{prefix[i] + 1}), true
+		}
+	}
+	return "", false
+}
+
+// DeletePrefix removes every key starting with prefix from s, and returns how
+// many keys were removed
+func DeletePrefix(s Store, prefix string) int {
+	return DeletePrefixLogged(s, prefix, 0)
+}
+
+// DeletePrefixLogged is DeletePrefix, for a delete logged at lsn
+func DeletePrefixLogged(s Store, prefix string, lsn LSN) int {
+	keys := make([]string, 0)
+	it := s.ScanPrefix(prefix)
+	for ; it.Valid(); it.Next() {
+		keys = append(keys, it.Key())
+	}
+	it.Close()
+
+	for _, key := range keys {
+		DeleteLogged(s, key, lsn)
+	}
+	return len(keys)
+}
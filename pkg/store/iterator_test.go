@@ -0,0 +1,26 @@
+package store
+
+import "testing"
+
+func TestScanOptions__boundsFollowTheComparator(t *testing.T) {
+	opts := ScanOptions{Start: "b", End: "D"}
+
+	// Bytewise, upper case sorts first, so nothing is in [b, D)
+	if opts.AfterStart("c", Bytewise) && opts.BeforeEnd("c", Bytewise) {
+		t.Fatalf("Expected c to be outside [b, D) bytewise")
+	}
+	// Ignoring case, c is in [b, D), and so is C, equal to c
+	for _, key := range []string{"c", "C", "B"} {
+		if !opts.AfterStart(key, CaseInsensitive) || !opts.BeforeEnd(key, CaseInsensitive) {
+			t.Fatalf("Expected %s to be inside [b, D) ignoring case", key)
+		}
+	}
+	if opts.BeforeEnd("d", CaseInsensitive) {
+		t.Fatalf("Expected d to be at the exclusive end of [b, D) ignoring case")
+	}
+
+	opts.StartExclusive, opts.EndInclusive = true, true
+	if opts.AfterStart("B", CaseInsensitive) || !opts.BeforeEnd("d", CaseInsensitive) {
+		t.Fatalf("Expected (b, D] to exclude B and include d ignoring case")
+	}
+}
@@ -0,0 +1,161 @@
+package lsm
+
+import (
+	"sort"
+
+	. "yadb-go/pkg/store"
+)
+
+// Leveled compaction
+//
+// Level 0 is compacted once it holds L0CompactionTrigger tables: they may
+// overlap, so all of them are merged, along with every table in level 1 they
+// overlap. Each level below is compacted once it holds more than its share of
+// bytes, by merging one of its tables with those it overlaps in the next
+// level. The tables of a level are taken in turn, so that every key range is
+// compacted in time.
+//
+// Merging keeps the newest entry for each key. Tombstones are kept for as long
+// as a deeper level may still hold an older value which they hide.
+
+// compaction merges tables at a level into the level below
+type compaction struct {
+	level int
+	// inputs holds the tables being merged from level, and from level+1
+	inputs [2][]*table
+}
+
+// compact runs compactions until every level is within its limits
+func (tree *Tree) compact() error {
+	for {
+		c := tree.pickCompaction()
+		if c == nil {
+			return nil
+		}
+		if err := tree.runCompaction(c); err != nil {
+			return err
+		}
+	}
+}
+
+// pickCompaction returns the compaction most needed, or nil if none is
+func (tree *Tree) pickCompaction() *compaction {
+	v := tree.version
+	if len(v.levels[0]) >= tree.opts.L0CompactionTrigger {
+		smallest, largest := keyRange(v.levels[0], tree.cmp)
+		return &compaction{level: 0, inputs: [2][]*table{v.levels[0], v.overlapping(1, smallest, largest)}}
+	}
+
+	for level := 1; level < numLevels-1; level++ {
+		if v.levelBytes(level) <= tree.maxLevelBytes(level) {
+			continue
+		}
+		t := tree.pickTable(v.levels[level], level)
+		return &compaction{level: level, inputs: [2][]*table{{t}, v.overlapping(level+1, t.smallest, t.largest)}}
+	}
+	return nil
+}
+
+// maxLevelBytes is how many bytes a level below 0 holds before it is compacted
+func (tree *Tree) maxLevelBytes(level int) int64 {
+	limit := tree.opts.BaseLevelSize
+	for i := 1; i < level; i++ {
+		limit *= int64(tree.opts.LevelSizeMultiplier)
+	}
+	return limit
+}
+
+// pickTable returns the table after the one last compacted out of a level,
+// wrapping around to the first
+func (tree *Tree) pickTable(tables []*table, level int) *table {
+	pointer := tree.compactPointers[level]
+	for _, t := range tables {
+		if pointer == "" || tree.cmp.Compare(t.smallest, pointer) > 0 {
+			return t
+		}
+	}
+	return tables[0]
+}
+
+func (tree *Tree) runCompaction(c *compaction) error {
+	v := tree.version
+	output := c.level + 1
+	tree.compactPointers[c.level] = c.inputs[0][len(c.inputs[0])-1].largest
+
+	// A table which overlaps nothing below can simply move down
+	if c.level > 0 && len(c.inputs[1]) == 0 {
+		return tree.installCompaction(c, c.inputs[0])
+	}
+
+	sources := make([]entryCursor, 0)
+	for _, t := range c.inputs[0] {
+		sources = append(sources, newTableCursor(t))
+	}
+	sources = append(sources, newLevelCursor(tree.cmp, c.inputs[1]))
+
+	tables, err := tree.writeTables(newMergeCursor(tree.cmp, sources), tree.opts.TableSize, func(key string, e entry) bool {
+		return !e.tombstone || !v.isBottommost(output, key, tree.cmp)
+	})
+	if err != nil {
+		return err
+	}
+	return tree.installCompaction(c, tables)
+}
+
+// installCompaction replaces a compaction's inputs with its outputs, in a
+// new version. Inputs which were rewritten are removed once no reader needs
+// them.
+func (tree *Tree) installCompaction(c *compaction, outputs []*table) error {
+	v := tree.version.with(func(_, _ **memtable, levels *[numLevels][]*table) {
+		levels[c.level] = without(levels[c.level], c.inputs[0])
+		levels[c.level+1] = append(without(levels[c.level+1], c.inputs[1]), outputs...)
+		sortTables(levels[c.level+1], tree.cmp)
+	})
+	if err := tree.writeManifest(v); err != nil {
+		v.release()
+		return err
+	}
+	for _, level := range c.inputs {
+		for _, t := range without(level, outputs) {
+			t.obsolete.Store(true)
+		}
+	}
+	tree.install(v)
+	return nil
+}
+
+// without returns the tables which aren't in removed
+func without(tables []*table, removed []*table) []*table {
+	kept := make([]*table, 0, len(tables))
+	for _, t := range tables {
+		found := false
+		for _, r := range removed {
+			found = found || t == r
+		}
+		if !found {
+			kept = append(kept, t)
+		}
+	}
+	return kept
+}
+
+// sortTables sorts the tables of a level below 0 by key
+func sortTables(tables []*table, cmp Comparator) {
+	sort.Slice(tables, func(i, j int) bool {
+		return cmp.Compare(tables[i].smallest, tables[j].smallest) < 0
+	})
+}
+
+// keyRange returns the smallest and largest keys in a set of tables
+func keyRange(tables []*table, cmp Comparator) (string, string) {
+	smallest, largest := tables[0].smallest, tables[0].largest
+	for _, t := range tables[1:] {
+		if cmp.Compare(t.smallest, smallest) < 0 {
+			smallest = t.smallest
+		}
+		if cmp.Compare(t.largest, largest) > 0 {
+			largest = t.largest
+		}
+	}
+	return smallest, largest
+}
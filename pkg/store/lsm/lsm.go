@@ -0,0 +1,589 @@
+// Package lsm implements a Store as a log-structured merge tree.
+//
+// Writes go to a memtable, an in-memory B+ tree logged to its own WAL file.
+// Once the memtable grows past Options.MemtableSize it is flushed to an
+// immutable sorted string table at level 0, and its log is removed. Tables at
+// level 0 may overlap; once there are Options.L0CompactionTrigger of them,
+// they are merged into level 1. Each level below holds tables which don't
+// overlap, and up to Options.LevelSizeMultiplier times as many bytes as the
+// level above, beyond which a table is merged into the next level down.
+//
+// Reads merge the memtables and every level, newest first, so the latest
+// write to a key wins, and tombstones hide the writes beneath them.
+//
+// A store lives in a directory of its own, holding its tables, logs and a
+// manifest recording which tables make up each level (see manifest.go).
+// Flushes and compactions run on the write which fills the memtable, so
+// writes are held up while they run.
+package lsm
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+
+	. "yadb-go/pkg/store"
+	"yadb-go/pkg/wal"
+)
+
+// Options tunes the shape of a store
+type Options struct {
+	// Comparator orders keys. It is recorded in the manifest, and a store can't
+	// be reopened with a different one.
+	Comparator Comparator
+	// MemtableSize is roughly how many bytes of writes a memtable holds before
+	// it is flushed
+	MemtableSize int
+	// BlockSize is roughly the size of the data blocks in tables, which are
+	// read whole
+	BlockSize int
+	// TableSize is roughly the size of the tables compactions write
+	TableSize int64
+	// L0CompactionTrigger is how many tables level 0 holds before they are
+	// compacted into level 1
+	L0CompactionTrigger int
+	// BaseLevelSize is how many bytes level 1 holds before it is compacted
+	BaseLevelSize int64
+	// LevelSizeMultiplier is how many times more bytes each level below 1
+	// holds than the one above
+	LevelSizeMultiplier int
+	// Sync says when writes logged by memtables are made durable
+	Sync wal.SyncMode
+}
+
+// DefaultOptions are used for any zero fields of the options a store is
+// opened with
+var DefaultOptions = Options{
+	Comparator:          Bytewise,
+	MemtableSize:        4 << 20,
+	BlockSize:           4 << 10,
+	TableSize:           2 << 20,
+	L0CompactionTrigger: 4,
+	BaseLevelSize:       10 << 20,
+	LevelSizeMultiplier: 10,
+}
+
+func (opts Options) withDefaults() Options {
+	if opts.Comparator == nil {
+		opts.Comparator = DefaultOptions.Comparator
+	}
+	if opts.MemtableSize <= 0 {
+		opts.MemtableSize = DefaultOptions.MemtableSize
+	}
+	if opts.BlockSize <= 0 {
+		opts.BlockSize = DefaultOptions.BlockSize
+	}
+	if opts.TableSize <= 0 {
+		opts.TableSize = DefaultOptions.TableSize
+	}
+	if opts.L0CompactionTrigger <= 0 {
+		opts.L0CompactionTrigger = DefaultOptions.L0CompactionTrigger
+	}
+	if opts.BaseLevelSize <= 0 {
+		opts.BaseLevelSize = DefaultOptions.BaseLevelSize
+	}
+	if opts.LevelSizeMultiplier <= 1 {
+		opts.LevelSizeMultiplier = DefaultOptions.LevelSizeMultiplier
+	}
+	return opts
+}
+
+// Tree is a Store held in an LSM tree. It is safe for concurrent use.
+type Tree struct {
+	dir  string
+	opts Options
+	cmp  Comparator
+
+	// writeMu serialises writes, flushes and compactions. Only they change
+	// the version, so while it is held, the version can be read without mu.
+	writeMu  sync.Mutex
+	nextFile uint64
+	// queue holds writes waiting for writeMu. The first to join it leads:
+	// once it holds writeMu it logs and applies the whole queue, so writers
+	// arriving while the log is synced share the next fsync.
+	queueMu sync.Mutex
+	queue   []*pendingWrite
+	// compactPointers holds the largest key last compacted out of each level,
+	// so that compactions work through a level in turn
+	compactPointers [numLevels]string
+
+	mu      sync.RWMutex
+	version *version // nil once the store is closed
+}
+
+// Open opens the store in dir, creating it if there is none. Any writes
+// which hadn't been flushed when the store was last closed are replayed from
+// their logs.
+func Open(dir string, opts Options) (*Tree, error) {
+	opts = opts.withDefaults()
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	m, exists, err := readManifest(dir)
+	if err != nil {
+		return nil, err
+	}
+	if exists && m.comparator != opts.Comparator.Name() {
+		return nil, fmt.Errorf("store in %s is ordered by %s, not %s", dir, m.comparator, opts.Comparator.Name())
+	}
+
+	tree := &Tree{dir: dir, opts: opts, cmp: opts.Comparator, nextFile: m.nextFile}
+	levels, err := tree.openTables(m)
+	if err != nil {
+		return nil, err
+	}
+	logs, err := tree.removeStrayFiles(m)
+	if err != nil {
+		return nil, err
+	}
+
+	tree.version = newVersion(tree.newMemtable(), nil, levels)
+	for _, number := range logs {
+		err = wal.NewWalFile(logFileName(dir, number)).ReplayIntoStore(replayer{tree})
+		if err != nil {
+			tree.Close()
+			return nil, err
+		}
+	}
+	if !tree.version.mem.empty() {
+		err = tree.flush()
+	} else {
+		err = tree.writeManifest(tree.version)
+	}
+	if err != nil {
+		tree.Close()
+		return nil, err
+	}
+	return tree, nil
+}
+
+// openTables opens the tables listed in a manifest
+func (tree *Tree) openTables(m manifest) ([numLevels][]*table, error) {
+	var levels [numLevels][]*table
+	for level, numbers := range m.tables {
+		for _, number := range numbers {
+			t, err := openTable(tableFileName(tree.dir, number), number, tree.cmp)
+			if err != nil {
+				for _, opened := range levels {
+					for _, t := range opened {
+						t.file.Close()
+					}
+				}
+				return levels, fmt.Errorf("failed to open table %d: %w", number, err)
+			}
+			levels[level] = append(levels[level], t)
+		}
+	}
+
+	sort.Slice(levels[0], func(i, j int) bool {
+		return levels[0][i].number > levels[0][j].number
+	})
+	for _, tables := range levels[1:] {
+		sortTables(tables, tree.cmp)
+	}
+	return levels, nil
+}
+
+// removeStrayFiles removes tables which aren't in the manifest, and returns
+// the logs which must be replayed, in the order they were written. File
+// numbers are taken from beyond any file found, in case a flush which
+// created files had not recorded them in the manifest.
+func (tree *Tree) removeStrayFiles(m manifest) ([]uint64, error) {
+	entries, err := os.ReadDir(tree.dir)
+	if err != nil {
+		return nil, err
+	}
+	live := make(map[uint64]bool)
+	for _, numbers := range m.tables {
+		for _, number := range numbers {
+			live[number] = true
+		}
+	}
+
+	logs := make([]uint64, 0)
+	for _, e := range entries {
+		number, ext, ok := parseFileName(e.Name())
+		if !ok {
+			continue
+		}
+		if number >= tree.nextFile {
+			tree.nextFile = number + 1
+		}
+		switch {
+		case ext == ".log" && number >= m.logNumber:
+			logs = append(logs, number)
+		case ext == ".sst" && live[number]:
+		default:
+			if err := os.Remove(filepath.Join(tree.dir, e.Name())); err != nil && !errors.Is(err, os.ErrNotExist) {
+				// A stray file is harmless, beyond the space it takes
+				log.Println("Failed to remove stray file.", err)
+			}
+		}
+	}
+	sort.Slice(logs, func(i, j int) bool { return logs[i] < logs[j] })
+	return logs, nil
+}
+
+// replayer applies logged writes to the memtable, without logging them again
+type replayer struct {
+	*Tree
+}
+
+func (r replayer) Set(key string, value string) {
+	r.version.mem.apply(key, entry{value: value})
+}
+
+func (r replayer) Delete(key string) {
+	r.version.mem.apply(key, entry{tombstone: true})
+}
+
+// Close closes the store's tables. Writes are durable as soon as they're
+// made, so there is nothing to flush.
+func (tree *Tree) Close() error {
+	tree.writeMu.Lock()
+	defer tree.writeMu.Unlock()
+
+	tree.mu.Lock()
+	v := tree.version
+	tree.version = nil
+	tree.mu.Unlock()
+	if v == nil {
+		return nil
+	}
+	err := v.mem.log.Close()
+	v.release()
+	return err
+}
+
+// acquire returns the current version, which must be released once read
+func (tree *Tree) acquire() *version {
+	tree.mu.RLock()
+	defer tree.mu.RUnlock()
+	if tree.version == nil {
+		panic("Tree is closed")
+	}
+	tree.version.ref()
+	return tree.version
+}
+
+// install makes v the current version
+func (tree *Tree) install(v *version) {
+	tree.mu.Lock()
+	old := tree.version
+	tree.version = v
+	tree.mu.Unlock()
+	old.release()
+}
+
+func (tree *Tree) newFileNumber() uint64 {
+	number := tree.nextFile
+	tree.nextFile++
+	return number
+}
+
+func (tree *Tree) newMemtable() *memtable {
+	number := tree.newFileNumber()
+	return newMemtable(tree.cmp, wal.NewWalFileWithOptions(logFileName(tree.dir, number), wal.Options{Sync: tree.opts.Sync}), number)
+}
+
+// writeManifest records the tables of v as the store's contents
+func (tree *Tree) writeManifest(v *version) error {
+	m := manifest{comparator: tree.cmp.Name(), nextFile: tree.nextFile, logNumber: v.mem.logNumber}
+	if v.imm != nil {
+		m.logNumber = v.imm.logNumber
+	}
+	for level, tables := range v.levels {
+		for _, t := range tables {
+			m.tables[level] = append(m.tables[level], t.number)
+		}
+	}
+	if err := m.write(tree.dir); err != nil {
+		return err
+	}
+	tree.removeObsoleteLogs(m.logNumber)
+	return nil
+}
+
+// removeObsoleteLogs removes the logs of memtables which have been flushed
+func (tree *Tree) removeObsoleteLogs(logNumber uint64) {
+	entries, err := os.ReadDir(tree.dir)
+	if err != nil {
+		log.Println("Failed to list obsolete logs.", err)
+		return
+	}
+	for _, e := range entries {
+		if number, ext, ok := parseFileName(e.Name()); ok && ext == ".log" && number < logNumber {
+			os.Remove(logFileName(tree.dir, number))
+		}
+	}
+}
+
+// Get returns the pair for a key, or nil if it doesn't exist
+func (tree *Tree) Get(key string) *KeyValuePair {
+	v := tree.acquire()
+	defer v.release()
+
+	found, e, ok := v.get(key, tree.cmp)
+	if !ok || e.tombstone {
+		return nil
+	}
+	return &KeyValuePair{Key: found, Value: e.value}
+}
+
+// Set writes a key-value pair, overwriting any existing value for the key
+func (tree *Tree) Set(key string, value string) {
+	tree.write(key, entry{value: value})
+}
+
+// Delete removes a key, by writing a tombstone over it
+func (tree *Tree) Delete(key string) {
+	tree.write(key, entry{tombstone: true})
+}
+
+// pendingWrite is a write waiting in the queue
+type pendingWrite struct {
+	key    string
+	entry  entry
+	done   chan struct{} // closed once the write is applied
+	closed bool          // set if the tree was closed instead
+}
+
+func (tree *Tree) write(key string, e entry) {
+	w := &pendingWrite{key: key, entry: e, done: make(chan struct{})}
+	tree.queueMu.Lock()
+	tree.queue = append(tree.queue, w)
+	leader := len(tree.queue) == 1
+	tree.queueMu.Unlock()
+	if leader {
+		tree.writeGroup()
+	}
+	<-w.done
+	if w.closed {
+		panic("Tree is closed")
+	}
+}
+
+// writeGroup logs and applies every queued write
+func (tree *Tree) writeGroup() {
+	tree.writeMu.Lock()
+	tree.queueMu.Lock()
+	group := tree.queue
+	tree.queue = nil
+	tree.queueMu.Unlock()
+	defer func() {
+		tree.writeMu.Unlock()
+		for _, w := range group {
+			close(w.done)
+		}
+	}()
+	if tree.version == nil {
+		for _, w := range group {
+			w.closed = true
+		}
+		return
+	}
+
+	mem := tree.version.mem
+	mem.write(group)
+	if mem.bytes.Load() >= int64(tree.opts.MemtableSize) {
+		if err := tree.flush(); err != nil {
+			log.Fatalln("Failed to flush memtable.", err)
+		}
+	}
+}
+
+// Flush writes the memtable to a table, and runs any compactions that makes
+// necessary
+func (tree *Tree) Flush() error {
+	tree.writeMu.Lock()
+	defer tree.writeMu.Unlock()
+	return tree.flush()
+}
+
+func (tree *Tree) flush() error {
+	mem := tree.version.mem
+	if mem.empty() {
+		return nil
+	}
+	// The memtable stays readable while it is written out
+	tree.install(tree.version.with(func(m, imm **memtable, _ *[numLevels][]*table) {
+		*m, *imm = tree.newMemtable(), mem
+	}))
+	// Nothing more is written to the memtable, so its log can be closed
+	if err := mem.log.Close(); err != nil {
+		return err
+	}
+
+	tables, err := tree.writeTables(newMemtableCursor(mem), 0, func(string, entry) bool { return true })
+	if err != nil {
+		return err
+	}
+	v := tree.version.with(func(_, imm **memtable, levels *[numLevels][]*table) {
+		*imm = nil
+		levels[0] = append(tables, levels[0]...)
+	})
+	if err := tree.writeManifest(v); err != nil {
+		v.release()
+		return err
+	}
+	tree.install(v)
+	return tree.compact()
+}
+
+// writeTables writes the entries of a cursor which are to be kept to new
+// tables, starting a new table once one reaches maxSize bytes, if set
+func (tree *Tree) writeTables(c entryCursor, maxSize int64, keep func(key string, e entry) bool) ([]*table, error) {
+	tables := make([]*table, 0)
+	var tw *tableWriter
+	var number uint64
+	var err error
+
+	finish := func() error {
+		if err := tw.finish(); err != nil {
+			return err
+		}
+		t, err := openTable(tableFileName(tree.dir, number), number, tree.cmp)
+		if err != nil {
+			return err
+		}
+		tables, tw = append(tables, t), nil
+		return nil
+	}
+
+	for c.SeekFirst(); c.Valid(); c.Next() {
+		key, e := c.Key(), c.Entry()
+		if !keep(key, e) {
+			continue
+		}
+		if tw == nil {
+			number = tree.newFileNumber()
+			if tw, err = newTableWriter(tableFileName(tree.dir, number), tree.opts.BlockSize); err != nil {
+				return nil, err
+			}
+		}
+		if err := tw.add(key, e); err != nil {
+			tw.abandon()
+			return nil, err
+		}
+		if maxSize > 0 && int64(tw.size()) >= maxSize {
+			if err := finish(); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if tw != nil {
+		if err := finish(); err != nil {
+			return nil, err
+		}
+	}
+	return tables, nil
+}
+
+// newCursor returns a cursor over the current version, which must be closed
+func (tree *Tree) newCursor() *storeCursor {
+	v := tree.acquire()
+	return &storeCursor{mergeCursor: v.cursor(tree.cmp), version: v}
+}
+
+// NewIterator returns an iterator over the pairs in the range described by
+// opts, in key order. It reads the store as it was when the iterator was
+// created, except for later writes to the memtable, which it may see.
+func (tree *Tree) NewIterator(opts ScanOptions) Iterator {
+	return NewRangeIteratorWithComparator(tree.newCursor(), opts, tree.cmp)
+}
+
+// ScanPrefix returns an iterator over the keys starting with prefix
+func (tree *Tree) ScanPrefix(prefix string) Iterator {
+	return tree.NewIterator(ScanOptions{Prefix: prefix})
+}
+
+// First returns the pair with the smallest key, or nil if the store is empty
+func (tree *Tree) First() *KeyValuePair {
+	c := tree.newCursor()
+	defer c.Close()
+	c.SeekFirst()
+	return c.pair()
+}
+
+// Last returns the pair with the largest key, or nil if the store is empty
+func (tree *Tree) Last() *KeyValuePair {
+	c := tree.newCursor()
+	defer c.Close()
+	c.SeekLast()
+	return c.pair()
+}
+
+// Floor returns the pair with the largest key <= key, or nil if there is none
+func (tree *Tree) Floor(key string) *KeyValuePair {
+	c := tree.newCursor()
+	defer c.Close()
+	c.SeekLE(key)
+	return c.pair()
+}
+
+// Ceiling returns the pair with the smallest key >= key, or nil if there is none
+func (tree *Tree) Ceiling(key string) *KeyValuePair {
+	c := tree.newCursor()
+	defer c.Close()
+	c.SeekGE(key)
+	return c.pair()
+}
+
+// LevelStats describes the tables at one level
+type LevelStats struct {
+	Tables int
+	Bytes  int64
+}
+
+// Stats describes the shape of a store
+type Stats struct {
+	// MemtableBytes approximates the writes held in memtables
+	MemtableBytes int64
+	// Levels describes each level, from level 0 down
+	Levels []LevelStats
+}
+
+// Stats reports how much data is in memtables, and at each level
+func (tree *Tree) Stats() Stats {
+	v := tree.acquire()
+	defer v.release()
+
+	stats := Stats{MemtableBytes: v.mem.bytes.Load(), Levels: make([]LevelStats, numLevels)}
+	if v.imm != nil {
+		stats.MemtableBytes += v.imm.bytes.Load()
+	}
+	for level, tables := range v.levels {
+		stats.Levels[level] = LevelStats{Tables: len(tables), Bytes: v.levelBytes(level)}
+	}
+	return stats
+}
+
+// Validate checks the levels are in order: level 0 from newest to oldest, and
+// the others by key, without overlapping
+func (tree *Tree) Validate() error {
+	v := tree.acquire()
+	defer v.release()
+
+	for level, tables := range v.levels {
+		for i, t := range tables {
+			if tree.cmp.Compare(t.smallest, t.largest) > 0 {
+				return fmt.Errorf("table %d at level %d has smallest key %q > largest key %q", t.number, level, t.smallest, t.largest)
+			}
+			if i == 0 {
+				continue
+			}
+			prev := tables[i-1]
+			if level == 0 && prev.number < t.number {
+				return fmt.Errorf("table %d at level 0 is older than table %d after it", prev.number, t.number)
+			}
+			if level > 0 && tree.cmp.Compare(prev.largest, t.smallest) >= 0 {
+				return fmt.Errorf("tables %d and %d at level %d overlap", prev.number, t.number, level)
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,412 @@
+package lsm
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	. "yadb-go/pkg/store"
+	"yadb-go/pkg/store/storetest"
+)
+
+// smallOptions flush and compact after a few writes, so tests exercise every
+// level
+var smallOptions = Options{
+	MemtableSize:        512,
+	BlockSize:           128,
+	TableSize:           1024,
+	L0CompactionTrigger: 2,
+	BaseLevelSize:       2048,
+	LevelSizeMultiplier: 2,
+}
+
+func openTree(t testing.TB, dir string, opts Options) *Tree {
+	t.Helper()
+	tree, err := Open(dir, opts)
+	if err != nil {
+		t.Fatalf("Failed to open tree: %v", err)
+	}
+	return tree
+}
+
+// newTree opens a tree in a new directory, closing it when the test ends
+func newTree(t testing.TB, opts Options) *Tree {
+	tree := openTree(t, t.TempDir(), opts)
+	t.Cleanup(func() { tree.Close() })
+	return tree
+}
+
+func key(i int) string {
+	return fmt.Sprintf("key%05d", i)
+}
+
+// Check the tree against a map, over random sequences of operations
+func TestModel(t *testing.T) {
+	storetest.CheckRandom(t, func() Store { return newTree(t, smallOptions) }, 5, 1000)
+}
+
+func FuzzTree(f *testing.F) {
+	// Each input gets its own directory, which the fuzzer can't provide
+	dir := f.TempDir()
+	var runs atomic.Int64
+	storetest.Fuzz(f, func() Store {
+		tree, err := Open(filepath.Join(dir, strconv.FormatInt(runs.Add(1), 10)), smallOptions)
+		if err != nil {
+			panic(err)
+		}
+		return tree
+	})
+}
+
+func TestCompaction(t *testing.T) {
+	tree := newTree(t, smallOptions)
+	for i := 0; i < 2000; i++ {
+		tree.Set(key(i%500), fmt.Sprintf("value%d", i))
+	}
+	if err := tree.Validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	stats := tree.Stats()
+	if stats.Levels[0].Tables >= smallOptions.L0CompactionTrigger {
+		t.Fatalf("Expected level 0 to be compacted, found %d tables", stats.Levels[0].Tables)
+	}
+	for level := 1; level < 3; level++ {
+		if stats.Levels[level].Tables == 0 {
+			t.Fatalf("Expected tables at level %d, found %+v", level, stats.Levels)
+		}
+	}
+	for i := 1500; i < 2000; i++ {
+		if pair := tree.Get(key(i % 500)); pair == nil || pair.Value != fmt.Sprintf("value%d", i) {
+			t.Fatalf("Expected the latest value for %s, found %v", key(i%500), pair)
+		}
+	}
+}
+
+func TestCompaction__dropsTombstones(t *testing.T) {
+	// Tables are only flushed when asked, and never get past level 1
+	tree := newTree(t, Options{MemtableSize: 1 << 20, L0CompactionTrigger: 2})
+	flush := func() {
+		if err := tree.Flush(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for i := 0; i < 500; i++ {
+		tree.Set(key(i), "value")
+	}
+	flush()
+	tree.Set("y", "value")
+	flush()
+	full := totalBytes(tree.Stats())
+
+	for i := 0; i < 500; i++ {
+		tree.Delete(key(i))
+	}
+	flush()
+	tree.Set("z", "value")
+	flush()
+
+	stats := tree.Stats()
+	if stats.Levels[0].Tables != 0 || stats.Levels[1].Tables == 0 {
+		t.Fatalf("Expected every table to be compacted into level 1, found %+v", stats.Levels)
+	}
+	if pair := tree.First(); pair == nil || pair.Key != "y" {
+		t.Fatalf("Expected only y and z to be left, found %v", pair)
+	}
+	if remaining := totalBytes(stats); remaining >= full/10 {
+		t.Fatalf("Expected compaction to drop deleted keys and their tombstones, but %d bytes of %d remain", remaining, full)
+	}
+}
+
+func totalBytes(stats Stats) int64 {
+	total := int64(0)
+	for _, level := range stats.Levels {
+		total += level.Bytes
+	}
+	return total
+}
+
+func TestReopen(t *testing.T) {
+	dir := t.TempDir()
+	tree := openTree(t, dir, smallOptions)
+	for i := 0; i < 300; i++ {
+		tree.Set(key(i), fmt.Sprintf("value%d", i))
+	}
+	for i := 0; i < 300; i += 3 {
+		tree.Delete(key(i))
+	}
+	tree.Close()
+
+	tree = openTree(t, dir, smallOptions)
+	defer tree.Close()
+	checkContents(t, tree, 300)
+}
+
+// Writes which were never flushed are replayed from the memtable's log
+func TestReopen__afterCrash(t *testing.T) {
+	dir := t.TempDir()
+	tree := openTree(t, dir, Options{})
+	for i := 0; i < 300; i++ {
+		tree.Set(key(i), fmt.Sprintf("value%d", i))
+	}
+	for i := 0; i < 300; i += 3 {
+		tree.Delete(key(i))
+	}
+	if stats := tree.Stats(); stats.Levels[0].Tables != 0 {
+		t.Fatalf("Expected nothing to be flushed yet, found %+v", stats.Levels)
+	}
+
+	// The first tree is abandoned without being closed
+	recovered := openTree(t, dir, Options{})
+	defer recovered.Close()
+	checkContents(t, recovered, 300)
+}
+
+// checkContents checks a tree holds keys [0, n) but every third, by iterating
+// over it in both directions
+func checkContents(t *testing.T, tree *Tree, n int) {
+	t.Helper()
+	expected := make([]string, 0)
+	for i := 0; i < n; i++ {
+		if i%3 != 0 {
+			expected = append(expected, key(i))
+		}
+	}
+
+	for _, reverse := range []bool{false, true} {
+		it := tree.NewIterator(ScanOptions{Reverse: reverse})
+		i := 0
+		for ; it.Valid(); it.Next() {
+			want := expected[i]
+			if reverse {
+				want = expected[len(expected)-1-i]
+			}
+			if it.Key() != want || it.Value() != fmt.Sprintf("value%d", keyIndex(want)) {
+				t.Fatalf("Expected %s, found %s = %s", want, it.Key(), it.Value())
+			}
+			i++
+		}
+		it.Close()
+		if i != len(expected) {
+			t.Fatalf("Expected %d keys, found %d", len(expected), i)
+		}
+	}
+}
+
+func keyIndex(key string) int {
+	var i int
+	fmt.Sscanf(key, "key%d", &i)
+	return i
+}
+
+func TestIterator__outlivesCompaction(t *testing.T) {
+	dir := t.TempDir()
+	tree := openTree(t, dir, smallOptions)
+	defer tree.Close()
+	for i := 0; i < 200; i++ {
+		tree.Set(key(i), "old")
+	}
+	if err := tree.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	it := tree.NewIterator(ScanOptions{})
+	for i := 0; i < 200; i++ {
+		tree.Set(key(i), "new")
+	}
+	for i := 0; i < 200; i++ {
+		tree.Set(key(i), "newer")
+	}
+	if err := tree.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	tablesDuring := countFiles(t, dir, ".sst")
+
+	// The iterator still reads the tables which were compacted away. It may
+	// also see writes to the memtable which was current when it was created.
+	count := 0
+	for ; it.Valid(); it.Next() {
+		if it.Value() == "newer" {
+			t.Fatalf("Expected the iterator not to see tables written after it was created, found %s = %s", it.Key(), it.Value())
+		}
+		count++
+	}
+	if count != 200 {
+		t.Fatalf("Expected 200 keys, found %d", count)
+	}
+
+	it.Close()
+	if after := countFiles(t, dir, ".sst"); after >= tablesDuring {
+		t.Fatalf("Expected compacted tables to be removed once the iterator closed, found %d files, then %d", tablesDuring, after)
+	}
+}
+
+func countFiles(t *testing.T, dir string, ext string) int {
+	t.Helper()
+	matches, err := filepath.Glob(filepath.Join(dir, "*"+ext))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return len(matches)
+}
+
+func TestOpen__removesStrayTables(t *testing.T) {
+	dir := t.TempDir()
+	tree := openTree(t, dir, smallOptions)
+	for i := 0; i < 100; i++ {
+		tree.Set(key(i), "value")
+	}
+	tree.Close()
+
+	// As left by a compaction which didn't finish
+	stray := tableFileName(dir, 999999)
+	if err := os.WriteFile(stray, []byte("partial"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	tree = openTree(t, dir, smallOptions)
+	defer tree.Close()
+	if _, err := os.Stat(stray); !os.IsNotExist(err) {
+		t.Fatalf("Expected the stray table to be removed")
+	}
+	if pair := tree.Get(key(50)); pair == nil {
+		t.Fatalf("Expected %s to survive reopening", key(50))
+	}
+}
+
+func TestOpen__differentComparator(t *testing.T) {
+	dir := t.TempDir()
+	openTree(t, dir, Options{}).Close()
+	if _, err := Open(dir, Options{Comparator: CaseInsensitive}); err == nil {
+		t.Fatalf("Expected a tree ordered bytewise not to open with another comparator")
+	}
+}
+
+func TestComparator(t *testing.T) {
+	opts := smallOptions
+	opts.Comparator = CaseInsensitive
+	tree := newTree(t, opts)
+
+	tree.Set("Key", "1")
+	if err := tree.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	tree.Set("KEY", "2")
+	tree.Set("apple", "3")
+	tree.Set("Banana", "4")
+
+	if pair := tree.Get("key"); pair == nil || pair.Key != "KEY" || pair.Value != "2" {
+		t.Fatalf("Expected KEY = 2, found %v", pair)
+	}
+	keys := make([]string, 0)
+	for it := tree.NewIterator(ScanOptions{}); it.Valid(); it.Next() {
+		keys = append(keys, it.Key())
+	}
+	if fmt.Sprint(keys) != "[apple Banana KEY]" {
+		t.Fatalf("Expected keys in case-insensitive order, found %v", keys)
+	}
+}
+
+func TestConcurrentAccess(t *testing.T) {
+	tree := newTree(t, smallOptions)
+	var wg sync.WaitGroup
+	for w := 0; w < 4; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < 200; i++ {
+				k := fmt.Sprintf("%d-%s", w, key(i))
+				tree.Set(k, "value")
+				if pair := tree.Get(k); pair == nil {
+					t.Errorf("Expected to read back %s", k)
+				}
+				if i%50 == 0 {
+					it := tree.NewIterator(ScanOptions{Prefix: strconv.Itoa(w)})
+					for ; it.Valid(); it.Next() {
+					}
+					it.Close()
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+
+	if err := tree.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	count := 0
+	for it := tree.NewIterator(ScanOptions{}); it.Valid(); it.Next() {
+		count++
+	}
+	if count != 800 {
+		t.Fatalf("Expected 800 keys, found %d", count)
+	}
+}
+
+// Concurrent writes are logged in groups, in the order they are applied, so
+// replaying the log after a crash gives the same contents
+func TestConcurrentWrites__replayInOrder(t *testing.T) {
+	dir := t.TempDir()
+	tree := openTree(t, dir, Options{})
+	var wg sync.WaitGroup
+	for w := 0; w < 16; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < 100; i++ {
+				if i%7 == w%7 {
+					tree.Delete(key(i % 20))
+				} else {
+					tree.Set(key(i%20), fmt.Sprintf("%d-%d", w, i))
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+
+	// The first tree is abandoned without being closed
+	recovered := openTree(t, dir, Options{})
+	defer recovered.Close()
+	for i := 0; i < 20; i++ {
+		expected, found := tree.Get(key(i)), recovered.Get(key(i))
+		if (expected == nil) != (found == nil) || (expected != nil && *expected != *found) {
+			t.Fatalf("Expected %s to be %v after replay, found %v", key(i), expected, found)
+		}
+	}
+}
+
+func TestWrite__closedTree(t *testing.T) {
+	tree := openTree(t, t.TempDir(), Options{})
+	tree.Close()
+	defer func() {
+		if recover() == nil {
+			t.Fatalf("Expected writing to a closed tree to panic")
+		}
+	}()
+	tree.Set("key", "value")
+}
+
+// A tombstone keeps its own copy of the key, whatever the caller does with
+// the slice it deleted through
+func TestDeleteBytes__callerReusesKey(t *testing.T) {
+	tree := newTree(t, Options{})
+	tree.Set("ccc", "value")
+	if err := tree.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	buf := []byte("ccc")
+	DeleteBytes(tree, buf)
+	copy(buf, "bbb")
+
+	if pair := tree.Get("ccc"); pair != nil {
+		t.Fatalf("Expected ccc to stay deleted, found %v", pair)
+	}
+	if pair := tree.Get("bbb"); pair != nil {
+		t.Fatalf("Expected bbb not to exist, found %v", pair)
+	}
+}
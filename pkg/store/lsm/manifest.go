@@ -0,0 +1,153 @@
+package lsm
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// The manifest records which tables make up a store, and at which levels. It
+// is rewritten in full after every flush and compaction, by writing a new
+// file and renaming it over the old one, so it is never seen half written.
+//
+//	comparator yadb.Bytewise
+//	next-file 12
+//	log 11
+//	table 0 10
+//	table 1 7
+//
+// Files numbered before the log aren't needed any more: their memtables have
+// been flushed. Any tables found in the directory but not in the manifest
+// were written by a flush or compaction which didn't finish.
+
+const manifestName = "MANIFEST"
+
+type manifest struct {
+	comparator string
+	nextFile   uint64
+	logNumber  uint64
+	tables     [numLevels][]uint64
+}
+
+// readManifest reads a store's manifest, returning false if it has none
+func readManifest(dir string) (manifest, bool, error) {
+	m := manifest{}
+	f, err := os.Open(filepath.Join(dir, manifestName))
+	if errors.Is(err, fs.ErrNotExist) {
+		return m, false, nil
+	} else if err != nil {
+		return m, false, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 {
+			continue
+		}
+		if err := m.parse(fields); err != nil {
+			return m, false, fmt.Errorf("invalid manifest line %q: %w", scanner.Text(), err)
+		}
+	}
+	return m, true, scanner.Err()
+}
+
+func (m *manifest) parse(fields []string) error {
+	var err error
+	switch {
+	case fields[0] == "comparator" && len(fields) == 2:
+		m.comparator = fields[1]
+	case fields[0] == "next-file" && len(fields) == 2:
+		m.nextFile, err = strconv.ParseUint(fields[1], 10, 64)
+	case fields[0] == "log" && len(fields) == 2:
+		m.logNumber, err = strconv.ParseUint(fields[1], 10, 64)
+	case fields[0] == "table" && len(fields) == 3:
+		var level int
+		var number uint64
+		if level, err = strconv.Atoi(fields[1]); err != nil {
+			return err
+		}
+		if level < 0 || level >= numLevels {
+			return errors.New("level out of range")
+		}
+		if number, err = strconv.ParseUint(fields[2], 10, 64); err != nil {
+			return err
+		}
+		m.tables[level] = append(m.tables[level], number)
+	default:
+		return errors.New("unknown record")
+	}
+	return err
+}
+
+// write durably replaces the store's manifest
+func (m *manifest) write(dir string) error {
+	var b strings.Builder
+	fmt.Fprintf(&b, "comparator %s\n", m.comparator)
+	fmt.Fprintf(&b, "next-file %d\n", m.nextFile)
+	fmt.Fprintf(&b, "log %d\n", m.logNumber)
+	for level, tables := range m.tables {
+		for _, number := range tables {
+			fmt.Fprintf(&b, "table %d %d\n", level, number)
+		}
+	}
+
+	filename := filepath.Join(dir, manifestName)
+	tmp := filename + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	_, err = f.WriteString(b.String())
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if err := os.Rename(tmp, filename); err != nil {
+		return err
+	}
+	return syncDir(dir)
+}
+
+// syncDir makes the creation, renaming and removal of files in dir durable
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+func tableFileName(dir string, number uint64) string {
+	return filepath.Join(dir, fmt.Sprintf("%06d.sst", number))
+}
+
+func logFileName(dir string, number uint64) string {
+	return filepath.Join(dir, fmt.Sprintf("%06d.log", number))
+}
+
+// parseFileName returns the number of a table or log file, and its extension
+func parseFileName(name string) (uint64, string, bool) {
+	ext := filepath.Ext(name)
+	if ext != ".sst" && ext != ".log" {
+		return 0, "", false
+	}
+	number, err := strconv.ParseUint(strings.TrimSuffix(name, ext), 10, 64)
+	if err != nil {
+		return 0, "", false
+	}
+	return number, ext, true
+}
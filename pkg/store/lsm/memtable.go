@@ -0,0 +1,139 @@
+package lsm
+
+import (
+	"sync/atomic"
+
+	. "yadb-go/pkg/store"
+	inmemory_btree "yadb-go/pkg/store/inmemory-btree"
+	"yadb-go/pkg/wal"
+	"yadb-go/protoc"
+)
+
+// memtableDegree is the degree of the B+ tree holding a memtable
+const memtableDegree = 32
+
+// entryOverhead approximates the memory an entry costs beyond its key and
+// value, so that memtables of many small entries are still flushed
+const entryOverhead = 32
+
+// memtable holds the latest writes in memory, in a B+ tree, until it is
+// flushed to a table. Every write is logged first, so a memtable lost in a
+// crash is rebuilt by replaying its log.
+type memtable struct {
+	tree      *inmemory_btree.BTree[string, entry]
+	cmp       Comparator
+	log       *wal.LogFile
+	logNumber uint64
+	bytes     atomic.Int64
+}
+
+func newMemtable(cmp Comparator, log *wal.LogFile, logNumber uint64) *memtable {
+	return &memtable{
+		tree:      inmemory_btree.NewBTree[string, entry](memtableDegree, cmp),
+		cmp:       cmp,
+		log:       log,
+		logNumber: logNumber,
+	}
+}
+
+// write logs a group of writes with a single append to the log, then applies
+// them in order
+func (m *memtable) write(group []*pendingWrite) {
+	entries := make([]*protoc.WalEntry, len(group))
+	for i, w := range group {
+		entries[i] = &protoc.WalEntry{Key: []byte(w.key), Value: []byte(w.entry.value), Tombstone: w.entry.tombstone}
+	}
+	m.log.Write(entries...)
+	for _, w := range group {
+		m.apply(w.key, w.entry)
+	}
+}
+
+// apply adds an entry without logging it
+func (m *memtable) apply(key string, e entry) {
+	m.tree.Set(key, e)
+	m.bytes.Add(int64(len(key) + len(e.value) + entryOverhead))
+}
+
+// get returns the entry for a key, and the key as it was written
+func (m *memtable) get(key string) (string, entry, bool) {
+	found, e, ok := m.tree.Ceiling(key)
+	if !ok || m.cmp.Compare(found, key) != 0 {
+		return "", entry{}, false
+	}
+	return found, e, true
+}
+
+func (m *memtable) empty() bool {
+	_, _, ok := m.tree.First()
+	return !ok
+}
+
+// memtableCursor walks a memtable by key, seeking from the root at every
+// step, so it is unaffected by writes made while it is open
+type memtableCursor struct {
+	mem   *memtable
+	key   string
+	entry entry
+	valid bool
+}
+
+func newMemtableCursor(m *memtable) *memtableCursor {
+	return &memtableCursor{mem: m}
+}
+
+func (c *memtableCursor) set(key string, e entry, ok bool) {
+	c.key, c.entry, c.valid = key, e, ok
+}
+
+func (c *memtableCursor) SeekGE(key string) {
+	c.set(c.mem.tree.Ceiling(key))
+}
+
+func (c *memtableCursor) SeekLE(key string) {
+	c.set(c.mem.tree.Floor(key))
+}
+
+func (c *memtableCursor) SeekFirst() {
+	c.set(c.mem.tree.First())
+}
+
+func (c *memtableCursor) SeekLast() {
+	c.set(c.mem.tree.Last())
+}
+
+func (c *memtableCursor) Next() {
+	current := c.key
+	c.valid = false
+	c.mem.tree.Ascend(current, func(key string, e entry) bool {
+		if c.mem.cmp.Compare(key, current) == 0 {
+			return true
+		}
+		c.set(key, e, true)
+		return false
+	})
+}
+
+func (c *memtableCursor) Prev() {
+	current := c.key
+	c.valid = false
+	c.mem.tree.Descend(current, func(key string, e entry) bool {
+		if c.mem.cmp.Compare(key, current) == 0 {
+			return true
+		}
+		c.set(key, e, true)
+		return false
+	})
+}
+
+func (c *memtableCursor) Valid() bool {
+	return c.valid
+}
+
+func (c *memtableCursor) Key() string {
+	return c.key
+}
+
+func (c *memtableCursor) Entry() entry {
+	return c.entry
+}
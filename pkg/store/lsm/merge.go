@@ -0,0 +1,275 @@
+package lsm
+
+import (
+	"sort"
+
+	. "yadb-go/pkg/store"
+)
+
+// entryCursor walks the entries of one source, tombstones included
+type entryCursor interface {
+	SeekGE(key string)
+	SeekLE(key string)
+	SeekFirst()
+	SeekLast()
+	Next()
+	Prev()
+	Valid() bool
+	Key() string
+	Entry() entry
+}
+
+// mergeCursor merges sources, ordered from newest to oldest, into one
+// ordered walk visiting each key once, with its entry from the newest source
+// holding it.
+//
+// Moving forward, every source is positioned at or after the current key, and
+// the current key is the smallest among them; moving backward, the reverse.
+// Changing direction re-seeks the sources around the current key.
+type mergeCursor struct {
+	cmp     Comparator
+	sources []entryCursor
+	current int // the source positioned at the current key, or -1
+	forward bool
+}
+
+func newMergeCursor(cmp Comparator, sources []entryCursor) *mergeCursor {
+	return &mergeCursor{cmp: cmp, sources: sources, current: -1}
+}
+
+func (c *mergeCursor) SeekGE(key string) {
+	for _, s := range c.sources {
+		s.SeekGE(key)
+	}
+	c.findSmallest()
+}
+
+func (c *mergeCursor) SeekLE(key string) {
+	for _, s := range c.sources {
+		s.SeekLE(key)
+	}
+	c.findLargest()
+}
+
+func (c *mergeCursor) SeekFirst() {
+	for _, s := range c.sources {
+		s.SeekFirst()
+	}
+	c.findSmallest()
+}
+
+func (c *mergeCursor) SeekLast() {
+	for _, s := range c.sources {
+		s.SeekLast()
+	}
+	c.findLargest()
+}
+
+func (c *mergeCursor) Next() {
+	key := c.Key()
+	for _, s := range c.sources {
+		if !c.forward {
+			s.SeekGE(key)
+		}
+		// Older versions of the current key are skipped along with it
+		if s.Valid() && c.cmp.Compare(s.Key(), key) == 0 {
+			s.Next()
+		}
+	}
+	c.findSmallest()
+}
+
+func (c *mergeCursor) Prev() {
+	key := c.Key()
+	for _, s := range c.sources {
+		if c.forward {
+			s.SeekLE(key)
+		}
+		if s.Valid() && c.cmp.Compare(s.Key(), key) == 0 {
+			s.Prev()
+		}
+	}
+	c.findLargest()
+}
+
+// findSmallest makes the source with the smallest key current, preferring the
+// newest where sources share it
+func (c *mergeCursor) findSmallest() {
+	c.forward, c.current = true, -1
+	for i, s := range c.sources {
+		if s.Valid() && (c.current < 0 || c.cmp.Compare(s.Key(), c.Key()) < 0) {
+			c.current = i
+		}
+	}
+}
+
+func (c *mergeCursor) findLargest() {
+	c.forward, c.current = false, -1
+	for i, s := range c.sources {
+		if s.Valid() && (c.current < 0 || c.cmp.Compare(s.Key(), c.Key()) > 0) {
+			c.current = i
+		}
+	}
+}
+
+func (c *mergeCursor) Valid() bool {
+	return c.current >= 0
+}
+
+func (c *mergeCursor) Key() string {
+	return c.sources[c.current].Key()
+}
+
+func (c *mergeCursor) Entry() entry {
+	return c.sources[c.current].Entry()
+}
+
+// levelCursor walks the tables of a level below level 0, which are sorted and
+// don't overlap, as one source
+type levelCursor struct {
+	cmp    Comparator
+	tables []*table
+	index  int
+	cursor *tableCursor // over tables[index], or nil if invalid
+}
+
+func newLevelCursor(cmp Comparator, tables []*table) *levelCursor {
+	return &levelCursor{cmp: cmp, tables: tables}
+}
+
+// open positions the cursor in the i-th table, or invalidates it if there is
+// no such table
+func (c *levelCursor) open(i int) bool {
+	if i < 0 || i >= len(c.tables) {
+		c.cursor = nil
+		return false
+	}
+	if c.cursor == nil || c.index != i {
+		c.index, c.cursor = i, newTableCursor(c.tables[i])
+	}
+	return true
+}
+
+func (c *levelCursor) SeekGE(key string) {
+	i := sort.Search(len(c.tables), func(i int) bool {
+		return c.cmp.Compare(c.tables[i].largest, key) >= 0
+	})
+	if c.open(i) {
+		c.cursor.SeekGE(key)
+	}
+}
+
+func (c *levelCursor) SeekLE(key string) {
+	i := sort.Search(len(c.tables), func(i int) bool {
+		return c.cmp.Compare(c.tables[i].smallest, key) > 0
+	}) - 1
+	if c.open(i) {
+		c.cursor.SeekLE(key)
+	}
+}
+
+func (c *levelCursor) SeekFirst() {
+	if c.open(0) {
+		c.cursor.SeekFirst()
+	}
+}
+
+func (c *levelCursor) SeekLast() {
+	if c.open(len(c.tables) - 1) {
+		c.cursor.SeekLast()
+	}
+}
+
+func (c *levelCursor) Next() {
+	c.cursor.Next()
+	if !c.cursor.Valid() && c.open(c.index+1) {
+		c.cursor.SeekFirst()
+	}
+}
+
+func (c *levelCursor) Prev() {
+	c.cursor.Prev()
+	if !c.cursor.Valid() && c.open(c.index-1) {
+		c.cursor.SeekLast()
+	}
+}
+
+func (c *levelCursor) Valid() bool {
+	return c.cursor != nil && c.cursor.Valid()
+}
+
+func (c *levelCursor) Key() string {
+	return c.cursor.Key()
+}
+
+func (c *levelCursor) Entry() entry {
+	return c.cursor.Entry()
+}
+
+// storeCursor is the Cursor behind a Tree's iterators. It merges every
+// source in a version, and skips deleted keys.
+type storeCursor struct {
+	*mergeCursor
+	version *version
+}
+
+func (c *storeCursor) SeekGE(key string) {
+	c.mergeCursor.SeekGE(key)
+	c.skipForward()
+}
+
+func (c *storeCursor) SeekLE(key string) {
+	c.mergeCursor.SeekLE(key)
+	c.skipBackward()
+}
+
+func (c *storeCursor) SeekFirst() {
+	c.mergeCursor.SeekFirst()
+	c.skipForward()
+}
+
+func (c *storeCursor) SeekLast() {
+	c.mergeCursor.SeekLast()
+	c.skipBackward()
+}
+
+func (c *storeCursor) Next() {
+	c.mergeCursor.Next()
+	c.skipForward()
+}
+
+func (c *storeCursor) Prev() {
+	c.mergeCursor.Prev()
+	c.skipBackward()
+}
+
+func (c *storeCursor) skipForward() {
+	for c.Valid() && c.Entry().tombstone {
+		c.mergeCursor.Next()
+	}
+}
+
+func (c *storeCursor) skipBackward() {
+	for c.Valid() && c.Entry().tombstone {
+		c.mergeCursor.Prev()
+	}
+}
+
+func (c *storeCursor) Value() string {
+	return c.Entry().value
+}
+
+// pair returns the current pair, or nil if the cursor is invalid
+func (c *storeCursor) pair() *KeyValuePair {
+	if !c.Valid() {
+		return nil
+	}
+	return &KeyValuePair{Key: c.Key(), Value: c.Value()}
+}
+
+func (c *storeCursor) Close() {
+	if c.version != nil {
+		c.version.release()
+		c.version = nil
+	}
+}
@@ -0,0 +1,455 @@
+package lsm
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"log"
+	"os"
+	"sort"
+	"sync/atomic"
+
+	. "yadb-go/pkg/store"
+)
+
+// Sorted string tables
+//
+// A memtable is flushed to an immutable file holding its entries in key
+// order, and compactions merge tables into new ones. A table is laid out as
+//
+//	data block*  index block  footer
+//
+// Each data block holds whole entries, up to about Options.BlockSize bytes:
+//
+//	entry: uvarint key length | key | kind byte | uvarint value length | value
+//
+// The index block lists every data block's offset and length, and its first
+// and last keys, so a lookup reads a single data block. Blocks are followed
+// by the CRC32C of their contents, and the footer holds the offset and length
+// of the index block, then a magic number.
+//
+// Tables are read with ReadAt, so are safe for concurrent readers. Nothing is
+// cached beyond what the operating system caches.
+
+const (
+	kindValue     byte = 0
+	kindTombstone byte = 1
+
+	blockTrailerSize = 4
+	footerSize       = 8 + 8 + 8
+	tableMagic       = 0x7961646273737462 // "yadbsstb"
+)
+
+var errCorruptTable = errors.New("corrupt sstable")
+
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+// entry is the latest write to a key: a value, or a tombstone if the key was
+// deleted. Tombstones are kept until compaction reaches the last level which
+// could hold an older value for the key.
+type entry struct {
+	value     string
+	tombstone bool
+}
+
+// blockHandle locates a data block, and gives the range of keys in it
+type blockHandle struct {
+	offset, length uint64
+	first, last    string
+}
+
+// tableWriter writes entries, which must be added in key order, to a new table
+type tableWriter struct {
+	file      *os.File
+	w         *bufio.Writer
+	blockSize int
+
+	offset uint64
+	block  []byte
+	first  string
+	last   string
+	index  []blockHandle
+}
+
+func newTableWriter(filename string, blockSize int) (*tableWriter, error) {
+	f, err := os.OpenFile(filename, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return &tableWriter{file: f, w: bufio.NewWriter(f), blockSize: blockSize}, nil
+}
+
+func (tw *tableWriter) add(key string, e entry) error {
+	if len(tw.block) == 0 {
+		tw.first = key
+	}
+	tw.last = key
+
+	tw.block = binary.AppendUvarint(tw.block, uint64(len(key)))
+	tw.block = append(tw.block, key...)
+	if e.tombstone {
+		tw.block = append(tw.block, kindTombstone)
+	} else {
+		tw.block = append(tw.block, kindValue)
+	}
+	tw.block = binary.AppendUvarint(tw.block, uint64(len(e.value)))
+	tw.block = append(tw.block, e.value...)
+
+	if len(tw.block) >= tw.blockSize {
+		return tw.flushBlock()
+	}
+	return nil
+}
+
+// size is the number of bytes written so far
+func (tw *tableWriter) size() uint64 {
+	return tw.offset + uint64(len(tw.block))
+}
+
+func (tw *tableWriter) flushBlock() error {
+	if len(tw.block) == 0 {
+		return nil
+	}
+	tw.index = append(tw.index, blockHandle{offset: tw.offset, length: uint64(len(tw.block)), first: tw.first, last: tw.last})
+	if err := tw.writeBlock(tw.block); err != nil {
+		return err
+	}
+	tw.block = tw.block[:0]
+	return nil
+}
+
+// writeBlock writes a block followed by its checksum
+func (tw *tableWriter) writeBlock(block []byte) error {
+	if _, err := tw.w.Write(block); err != nil {
+		return err
+	}
+	if _, err := tw.w.Write(binary.LittleEndian.AppendUint32(nil, crc32.Checksum(block, castagnoli))); err != nil {
+		return err
+	}
+	tw.offset += uint64(len(block)) + blockTrailerSize
+	return nil
+}
+
+// finish writes the index and footer, and durably closes the table
+func (tw *tableWriter) finish() error {
+	if err := tw.flushBlock(); err != nil {
+		tw.abandon()
+		return err
+	}
+
+	index := make([]byte, 0)
+	for _, h := range tw.index {
+		index = binary.AppendUvarint(index, h.offset)
+		index = binary.AppendUvarint(index, h.length)
+		index = binary.AppendUvarint(index, uint64(len(h.first)))
+		index = append(index, h.first...)
+		index = binary.AppendUvarint(index, uint64(len(h.last)))
+		index = append(index, h.last...)
+	}
+	footer := binary.LittleEndian.AppendUint64(nil, tw.offset)
+	footer = binary.LittleEndian.AppendUint64(footer, uint64(len(index)))
+	footer = binary.LittleEndian.AppendUint64(footer, tableMagic)
+
+	err := tw.writeBlock(index)
+	if err == nil {
+		_, err = tw.w.Write(footer)
+	}
+	if err == nil {
+		err = tw.w.Flush()
+	}
+	if err == nil {
+		err = tw.file.Sync()
+	}
+	if closeErr := tw.file.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// abandon closes and removes a table which won't be finished
+func (tw *tableWriter) abandon() {
+	tw.file.Close()
+	os.Remove(tw.file.Name())
+}
+
+// table is an open, immutable sorted string table
+type table struct {
+	number   uint64
+	file     *os.File
+	size     int64
+	cmp      Comparator
+	index    []blockHandle
+	smallest string
+	largest  string
+
+	// refs counts the versions holding the table. Once none do, the file is
+	// closed, and if a compaction has replaced the table, removed.
+	refs     atomic.Int32
+	obsolete atomic.Bool
+}
+
+// openTable opens a table and reads its index
+func openTable(filename string, number uint64, cmp Comparator) (*table, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	t, err := readTable(f, number, cmp)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return t, nil
+}
+
+func readTable(f *os.File, number uint64, cmp Comparator) (*table, error) {
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if info.Size() < footerSize {
+		return nil, errCorruptTable
+	}
+	footer := make([]byte, footerSize)
+	if _, err := f.ReadAt(footer, info.Size()-footerSize); err != nil {
+		return nil, err
+	}
+	if binary.LittleEndian.Uint64(footer[16:]) != tableMagic {
+		return nil, errCorruptTable
+	}
+
+	t := &table{number: number, file: f, size: info.Size(), cmp: cmp}
+	data, err := t.readBlock(binary.LittleEndian.Uint64(footer), binary.LittleEndian.Uint64(footer[8:]))
+	if err != nil {
+		return nil, err
+	}
+	for len(data) > 0 {
+		var h blockHandle
+		var ok bool
+		if h.offset, data, ok = readUvarint(data); !ok {
+			return nil, errCorruptTable
+		}
+		if h.length, data, ok = readUvarint(data); !ok {
+			return nil, errCorruptTable
+		}
+		if h.first, data, ok = readString(data); !ok {
+			return nil, errCorruptTable
+		}
+		if h.last, data, ok = readString(data); !ok {
+			return nil, errCorruptTable
+		}
+		t.index = append(t.index, h)
+	}
+	if len(t.index) == 0 {
+		return nil, errCorruptTable
+	}
+	t.smallest, t.largest = t.index[0].first, t.index[len(t.index)-1].last
+	return t, nil
+}
+
+// readBlock reads a block, checking it against its checksum
+func (t *table) readBlock(offset uint64, length uint64) ([]byte, error) {
+	if offset+length+blockTrailerSize > uint64(t.size) {
+		return nil, errCorruptTable
+	}
+	data := make([]byte, length+blockTrailerSize)
+	if _, err := t.file.ReadAt(data, int64(offset)); err != nil {
+		return nil, err
+	}
+	block, trailer := data[:length], data[length:]
+	if crc32.Checksum(block, castagnoli) != binary.LittleEndian.Uint32(trailer) {
+		return nil, errCorruptTable
+	}
+	return block, nil
+}
+
+// blockEntry is an entry decoded from a data block
+type blockEntry struct {
+	key string
+	entry
+}
+
+// readDataBlock reads and decodes the i-th data block
+func (t *table) readDataBlock(i int) ([]blockEntry, error) {
+	h := t.index[i]
+	data, err := t.readBlock(h.offset, h.length)
+	if err != nil {
+		return nil, err
+	}
+
+	entries := make([]blockEntry, 0)
+	for len(data) > 0 {
+		var e blockEntry
+		var ok bool
+		if e.key, data, ok = readString(data); !ok || len(data) == 0 {
+			return nil, errCorruptTable
+		}
+		kind := data[0]
+		if kind != kindValue && kind != kindTombstone {
+			return nil, errCorruptTable
+		}
+		e.tombstone = kind == kindTombstone
+		if e.value, data, ok = readString(data[1:]); !ok {
+			return nil, errCorruptTable
+		}
+		entries = append(entries, e)
+	}
+	return entries, nil
+}
+
+// get looks up a key, returning the key as it was written and its entry
+func (t *table) get(key string) (blockEntry, bool, error) {
+	// The only block which can hold key is the first whose last key is >= key
+	i := sort.Search(len(t.index), func(i int) bool {
+		return t.cmp.Compare(t.index[i].last, key) >= 0
+	})
+	if i == len(t.index) || t.cmp.Compare(t.index[i].first, key) > 0 {
+		return blockEntry{}, false, nil
+	}
+
+	entries, err := t.readDataBlock(i)
+	if err != nil {
+		return blockEntry{}, false, err
+	}
+	j := sort.Search(len(entries), func(j int) bool {
+		return t.cmp.Compare(entries[j].key, key) >= 0
+	})
+	if j == len(entries) || t.cmp.Compare(entries[j].key, key) != 0 {
+		return blockEntry{}, false, nil
+	}
+	return entries[j], true, nil
+}
+
+// overlaps reports whether the table may hold keys in [smallest, largest]
+func (t *table) overlaps(smallest, largest string) bool {
+	return t.cmp.Compare(t.largest, smallest) >= 0 && t.cmp.Compare(t.smallest, largest) <= 0
+}
+
+func (t *table) ref() {
+	t.refs.Add(1)
+}
+
+func (t *table) unref() {
+	if t.refs.Add(-1) > 0 {
+		return
+	}
+	t.file.Close()
+	if t.obsolete.Load() {
+		os.Remove(t.file.Name())
+	}
+}
+
+func readUvarint(data []byte) (uint64, []byte, bool) {
+	v, n := binary.Uvarint(data)
+	if n <= 0 {
+		return 0, nil, false
+	}
+	return v, data[n:], true
+}
+
+// readString reads a uvarint length, then that many bytes
+func readString(data []byte) (string, []byte, bool) {
+	length, data, ok := readUvarint(data)
+	if !ok || length > uint64(len(data)) {
+		return "", nil, false
+	}
+	return string(data[:length]), data[length:], true
+}
+
+// tableCursor walks the entries of a table, a data block at a time
+type tableCursor struct {
+	table   *table
+	block   int // the index of the block held in entries
+	entries []blockEntry
+	i       int // the position in entries, or -1 or len(entries) if invalid
+}
+
+func newTableCursor(t *table) *tableCursor {
+	return &tableCursor{table: t, block: -1}
+}
+
+// load reads the i-th block. Read errors leave nothing more to be done than
+// stop, as the Store interface has no way to report them.
+func (c *tableCursor) load(block int) {
+	if block == c.block {
+		return
+	}
+	entries, err := c.table.readDataBlock(block)
+	if err != nil {
+		log.Fatalln("Failed to read sstable.", err)
+	}
+	c.block, c.entries = block, entries
+}
+
+func (c *tableCursor) SeekGE(key string) {
+	t := c.table
+	block := sort.Search(len(t.index), func(i int) bool {
+		return t.cmp.Compare(t.index[i].last, key) >= 0
+	})
+	if block == len(t.index) {
+		c.invalidate()
+		return
+	}
+	c.load(block)
+	c.i = sort.Search(len(c.entries), func(i int) bool {
+		return t.cmp.Compare(c.entries[i].key, key) >= 0
+	})
+}
+
+func (c *tableCursor) SeekLE(key string) {
+	t := c.table
+	block := sort.Search(len(t.index), func(i int) bool {
+		return t.cmp.Compare(t.index[i].first, key) > 0
+	}) - 1
+	if block < 0 {
+		c.invalidate()
+		return
+	}
+	c.load(block)
+	c.i = sort.Search(len(c.entries), func(i int) bool {
+		return t.cmp.Compare(c.entries[i].key, key) > 0
+	}) - 1
+}
+
+func (c *tableCursor) SeekFirst() {
+	c.load(0)
+	c.i = 0
+}
+
+func (c *tableCursor) SeekLast() {
+	c.load(len(c.table.index) - 1)
+	c.i = len(c.entries) - 1
+}
+
+func (c *tableCursor) Next() {
+	c.i++
+	if c.i == len(c.entries) && c.block+1 < len(c.table.index) {
+		c.load(c.block + 1)
+		c.i = 0
+	}
+}
+
+func (c *tableCursor) Prev() {
+	c.i--
+	if c.i < 0 && c.block > 0 {
+		c.load(c.block - 1)
+		c.i = len(c.entries) - 1
+	}
+}
+
+func (c *tableCursor) invalidate() {
+	c.i = -1
+}
+
+func (c *tableCursor) Valid() bool {
+	return c.block >= 0 && c.i >= 0 && c.i < len(c.entries)
+}
+
+func (c *tableCursor) Key() string {
+	return c.entries[c.i].key
+}
+
+func (c *tableCursor) Entry() entry {
+	return c.entries[c.i].entry
+}
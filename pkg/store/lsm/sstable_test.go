@@ -0,0 +1,101 @@
+package lsm
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	. "yadb-go/pkg/store"
+)
+
+// writeTable writes n entries to a table, with a tombstone for every fifth key
+func writeTable(t *testing.T, n int) string {
+	t.Helper()
+	filename := filepath.Join(t.TempDir(), "000001.sst")
+	tw, err := newTableWriter(filename, 256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < n; i++ {
+		if err := tw.add(key(i), entry{value: fmt.Sprintf("value%d", i), tombstone: i%5 == 0}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.finish(); err != nil {
+		t.Fatal(err)
+	}
+	return filename
+}
+
+func TestTable(t *testing.T) {
+	tbl, err := openTable(writeTable(t, 1000), 1, Bytewise)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tbl.file.Close()
+
+	if len(tbl.index) < 10 || tbl.smallest != key(0) || tbl.largest != key(999) {
+		t.Fatalf("Expected many blocks spanning %s to %s, found %d from %s to %s", key(0), key(999), len(tbl.index), tbl.smallest, tbl.largest)
+	}
+	for i := 0; i < 1000; i++ {
+		e, ok, err := tbl.get(key(i))
+		if err != nil || !ok || e.value != fmt.Sprintf("value%d", i) || e.tombstone != (i%5 == 0) {
+			t.Fatalf("Expected to find %s, found %+v, %v, %v", key(i), e, ok, err)
+		}
+	}
+	for _, missing := range []string{"", "key", "key00000a", "zzz"} {
+		if _, ok, _ := tbl.get(missing); ok {
+			t.Fatalf("Expected not to find %q", missing)
+		}
+	}
+
+	// Walk the whole table in both directions, across blocks
+	c := newTableCursor(tbl)
+	i := 0
+	for c.SeekFirst(); c.Valid(); c.Next() {
+		if c.Key() != key(i) {
+			t.Fatalf("Expected %s, found %s", key(i), c.Key())
+		}
+		i++
+	}
+	for c.SeekLast(); c.Valid(); c.Prev() {
+		i--
+		if c.Key() != key(i) {
+			t.Fatalf("Expected %s, found %s", key(i), c.Key())
+		}
+	}
+	if i != 0 {
+		t.Fatalf("Expected to walk back to the first key, stopped at %d", i)
+	}
+
+	c.SeekGE("key00123a")
+	if !c.Valid() || c.Key() != key(124) {
+		t.Fatalf("Expected SeekGE to find %s", key(124))
+	}
+	c.SeekLE("key00123a")
+	if !c.Valid() || c.Key() != key(123) {
+		t.Fatalf("Expected SeekLE to find %s", key(123))
+	}
+}
+
+func TestTable__detectsCorruption(t *testing.T) {
+	filename := writeTable(t, 100)
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data[10] ^= 0xff
+	if err := os.WriteFile(filename, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	tbl, err := openTable(filename, 1, Bytewise)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tbl.file.Close()
+	if _, _, err := tbl.get(key(0)); err != errCorruptTable {
+		t.Fatalf("Expected the corrupt block to be detected, found %v", err)
+	}
+}
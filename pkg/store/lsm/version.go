@@ -0,0 +1,162 @@
+package lsm
+
+import (
+	"log"
+	"sort"
+	"sync/atomic"
+
+	. "yadb-go/pkg/store"
+)
+
+// numLevels is the number of levels of tables. Level 0 holds flushed
+// memtables, which may overlap; every other level holds tables which don't.
+const numLevels = 7
+
+// version is an immutable snapshot of where a store's data lives: its
+// memtables and tables. Writes go to the current version's memtable; flushes
+// and compactions replace the current version with a new one.
+//
+// Readers hold a reference to the version they read, so its tables stay open
+// until they're done, even once a compaction has replaced them.
+type version struct {
+	mem *memtable
+	imm *memtable // the memtable being flushed, if any
+
+	// levels[0] is ordered from newest to oldest, and the others by key
+	levels [numLevels][]*table
+
+	refs atomic.Int32
+}
+
+// newVersion creates a version holding a reference to each of its tables
+func newVersion(mem, imm *memtable, levels [numLevels][]*table) *version {
+	v := &version{mem: mem, imm: imm, levels: levels}
+	for _, level := range v.levels {
+		for _, t := range level {
+			t.ref()
+		}
+	}
+	v.refs.Store(1)
+	return v
+}
+
+// with copies the version, so that it can be changed
+func (v *version) with(change func(mem, imm **memtable, levels *[numLevels][]*table)) *version {
+	mem, imm := v.mem, v.imm
+	var levels [numLevels][]*table
+	for i, level := range v.levels {
+		levels[i] = append([]*table(nil), level...)
+	}
+	change(&mem, &imm, &levels)
+	return newVersion(mem, imm, levels)
+}
+
+func (v *version) ref() {
+	v.refs.Add(1)
+}
+
+// release drops a reference, and once none are left, the version's
+// references to its tables
+func (v *version) release() {
+	if v.refs.Add(-1) > 0 {
+		return
+	}
+	for _, level := range v.levels {
+		for _, t := range level {
+			t.unref()
+		}
+	}
+}
+
+// get looks up a key, in order from the newest data to the oldest
+func (v *version) get(key string, cmp Comparator) (string, entry, bool) {
+	for _, m := range []*memtable{v.mem, v.imm} {
+		if m == nil {
+			continue
+		}
+		if found, e, ok := m.get(key); ok {
+			return found, e, true
+		}
+	}
+
+	for level, tables := range v.levels {
+		if level > 0 {
+			i := findTable(tables, key, cmp)
+			if i == len(tables) || cmp.Compare(tables[i].smallest, key) > 0 {
+				continue
+			}
+			tables = tables[i : i+1]
+		}
+		for _, t := range tables {
+			e, ok, err := t.get(key)
+			if err != nil {
+				log.Fatalln("Failed to read sstable.", err)
+			}
+			if ok {
+				return e.key, e.entry, true
+			}
+		}
+	}
+	return "", entry{}, false
+}
+
+// findTable returns the index of the first table in a level whose largest key
+// is >= key: the only table in the level which can hold key
+func findTable(tables []*table, key string, cmp Comparator) int {
+	return sort.Search(len(tables), func(i int) bool {
+		return cmp.Compare(tables[i].largest, key) >= 0
+	})
+}
+
+// cursor merges everything in the version, from newest to oldest
+func (v *version) cursor(cmp Comparator) *mergeCursor {
+	sources := make([]entryCursor, 0)
+	for _, m := range []*memtable{v.mem, v.imm} {
+		if m != nil {
+			sources = append(sources, newMemtableCursor(m))
+		}
+	}
+	for _, t := range v.levels[0] {
+		sources = append(sources, newTableCursor(t))
+	}
+	for _, tables := range v.levels[1:] {
+		if len(tables) > 0 {
+			sources = append(sources, newLevelCursor(cmp, tables))
+		}
+	}
+	return newMergeCursor(cmp, sources)
+}
+
+// levelBytes is the total size of the tables in a level
+func (v *version) levelBytes(level int) int64 {
+	total := int64(0)
+	for _, t := range v.levels[level] {
+		total += t.size
+	}
+	return total
+}
+
+// overlapping returns the tables in a level which may hold keys within
+// [smallest, largest]
+func (v *version) overlapping(level int, smallest, largest string) []*table {
+	tables := make([]*table, 0)
+	for _, t := range v.levels[level] {
+		if t.overlaps(smallest, largest) {
+			tables = append(tables, t)
+		}
+	}
+	return tables
+}
+
+// isBottommost reports whether no level below the given one may hold key, so
+// that a tombstone for it written to the level hides nothing, and can be
+// dropped
+func (v *version) isBottommost(level int, key string, cmp Comparator) bool {
+	for _, tables := range v.levels[level+1:] {
+		i := findTable(tables, key, cmp)
+		if i < len(tables) && cmp.Compare(tables[i].smallest, key) <= 0 {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,89 @@
+package skiplist
+
+import . "yadb-go/pkg/store"
+
+// cursor is a Cursor over a skip list. It reads each node's value as it
+// reaches it, and skips nodes deleted by then. Nodes only link forwards, so
+// Prev searches from the head again.
+type cursor struct {
+	list  *SkipList
+	node  *node // nil once the cursor has moved past either end
+	value string
+}
+
+// settle moves forwards from n to the first node which hasn't been deleted
+func (c *cursor) settle(n *node) {
+	for ; n != nil; n = n.next[0].Load() {
+		if value := n.value.Load(); value != nil {
+			c.node, c.value = n, *value
+			return
+		}
+	}
+	c.node = nil
+}
+
+// settleBack moves backwards from n to the last node which hasn't been
+// deleted
+func (c *cursor) settleBack(n *node) {
+	for n != c.list.head {
+		if value := n.value.Load(); value != nil {
+			c.node, c.value = n, *value
+			return
+		}
+		n = c.list.findLessThan(n.key)
+	}
+	c.node = nil
+}
+
+func (c *cursor) seekFirst() {
+	c.settle(c.list.head.next[0].Load())
+}
+
+func (c *cursor) SeekGE(key string) {
+	c.settle(c.list.findGreaterOrEqual(key, nil))
+}
+
+func (c *cursor) SeekLE(key string) {
+	n := c.list.findGreaterOrEqual(key, nil)
+	if n != nil && c.list.cmp.Compare(n.key, key) == 0 {
+		if value := n.value.Load(); value != nil {
+			c.node, c.value = n, *value
+			return
+		}
+	}
+	c.settleBack(c.list.findLessThan(key))
+}
+
+func (c *cursor) SeekLast() {
+	c.settleBack(c.list.findLast())
+}
+
+func (c *cursor) Next() {
+	c.settle(c.node.next[0].Load())
+}
+
+func (c *cursor) Prev() {
+	c.settleBack(c.list.findLessThan(c.node.key))
+}
+
+func (c *cursor) Valid() bool {
+	return c.node != nil
+}
+
+func (c *cursor) Key() string {
+	return c.node.key
+}
+
+func (c *cursor) Value() string {
+	return c.value
+}
+
+func (c *cursor) Close() {}
+
+// pair returns the pair the cursor is at, or nil if it isn't valid
+func (c *cursor) pair() *KeyValuePair {
+	if c.node == nil {
+		return nil
+	}
+	return &KeyValuePair{Key: c.node.key, Value: c.value}
+}
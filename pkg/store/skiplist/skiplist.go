@@ -0,0 +1,284 @@
+// Package skiplist implements a Store as a concurrent skip list, for use as a
+// memtable.
+//
+// Readers never lock: every link is an atomic pointer, and a node is fully
+// built before the single link which publishes it at the bottom level. Writers
+// are serialised by a mutex, so a skip list suits workloads with many readers
+// and one writer at a time, as a memtable in front of a persistent tree has.
+//
+// Deleted nodes are unlinked, but keep their own links, so a reader standing
+// on one can still move on. Their value is cleared first, which is how readers
+// tell them apart from live nodes.
+package skiplist
+
+import (
+	"fmt"
+	"math/rand"
+	"sync"
+	"sync/atomic"
+
+	. "yadb-go/pkg/store"
+)
+
+// maxHeight bounds the number of levels, which suits up to 4^maxHeight keys
+const maxHeight = 16
+
+// branching is the inverse of the chance a node of height h also has height
+// h+1
+const branching = 4
+
+type node struct {
+	key   string
+	value atomic.Pointer[string] // nil once the node is deleted
+	next  []atomic.Pointer[node]
+}
+
+func newNode(key string, value string, height int) *node {
+	n := &node{key: key, next: make([]atomic.Pointer[node], height)}
+	n.value.Store(&value)
+	return n
+}
+
+// SkipList is a Store held in a skip list. It is safe for concurrent use:
+// reads are lock-free, and writes are serialised.
+type SkipList struct {
+	head   *node // a sentinel, with no key, linked to the first node at every level
+	height atomic.Int32
+	cmp    Comparator
+	size   atomic.Int64
+	length atomic.Int64
+
+	writeMu sync.Mutex // held by writers
+	rng     *rand.Rand // guarded by writeMu
+}
+
+// NewSkipList creates an empty skip list, which orders keys bytewise
+func NewSkipList() *SkipList {
+	return NewSkipListWithComparator(Bytewise)
+}
+
+// NewSkipListWithComparator creates an empty skip list, which orders keys by
+// cmp
+func NewSkipListWithComparator(cmp Comparator) *SkipList {
+	s := &SkipList{
+		head: &node{next: make([]atomic.Pointer[node], maxHeight)},
+		cmp:  cmp,
+		rng:  rand.New(rand.NewSource(0xdb)),
+	}
+	s.height.Store(1)
+	return s
+}
+
+// Len returns the number of keys in the skip list
+func (s *SkipList) Len() int {
+	return int(s.length.Load())
+}
+
+// Size returns the approximate number of bytes held by the keys and values,
+// which a memtable can use to decide when to flush
+func (s *SkipList) Size() int64 {
+	return s.size.Load()
+}
+
+func (s *SkipList) randomHeight() int {
+	height := 1
+	for height < maxHeight && s.rng.Intn(branching) == 0 {
+		height++
+	}
+	return height
+}
+
+// findGreaterOrEqual returns the first node whose key is >= key, or nil. If
+// preds isn't nil, it is filled with the last node before key at each level.
+func (s *SkipList) findGreaterOrEqual(key string, preds []*node) *node {
+	x := s.head
+	for level := int(s.height.Load()) - 1; level >= 0; level-- {
+		next := x.next[level].Load()
+		for next != nil && s.cmp.Compare(next.key, key) < 0 {
+			x, next = next, next.next[level].Load()
+		}
+		if preds != nil {
+			preds[level] = x
+		}
+		if level == 0 {
+			return next
+		}
+	}
+	return nil
+}
+
+// findLessThan returns the last node whose key is < key, or the head if
+// there is none
+func (s *SkipList) findLessThan(key string) *node {
+	x := s.head
+	for level := int(s.height.Load()) - 1; level >= 0; level-- {
+		for next := x.next[level].Load(); next != nil && s.cmp.Compare(next.key, key) < 0; next = x.next[level].Load() {
+			x = next
+		}
+	}
+	return x
+}
+
+// findLast returns the last node, or the head if the skip list is empty
+func (s *SkipList) findLast() *node {
+	x := s.head
+	for level := int(s.height.Load()) - 1; level >= 0; level-- {
+		for next := x.next[level].Load(); next != nil; next = x.next[level].Load() {
+			x = next
+		}
+	}
+	return x
+}
+
+// Get returns a pointer to the KeyValuePair if the key exists, otherwise nil
+func (s *SkipList) Get(key string) *KeyValuePair {
+	n := s.findGreaterOrEqual(key, nil)
+	if n == nil || s.cmp.Compare(n.key, key) != 0 {
+		return nil
+	}
+	return pairOf(n)
+}
+
+// pairOf returns the pair held by n, or nil if it has been deleted
+func pairOf(n *node) *KeyValuePair {
+	value := n.value.Load()
+	if value == nil {
+		return nil
+	}
+	return &KeyValuePair{Key: n.key, Value: *value}
+}
+
+// Set writes a key-value pair, overwriting any existing value for the key
+func (s *SkipList) Set(key string, value string) {
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+
+	var preds [maxHeight]*node
+	if n := s.findGreaterOrEqual(key, preds[:]); n != nil && s.cmp.Compare(n.key, key) == 0 {
+		old := n.value.Swap(&value)
+		s.size.Add(int64(len(value) - len(*old)))
+		return
+	}
+
+	height := s.randomHeight()
+	if current := int(s.height.Load()); height > current {
+		for level := current; level < height; level++ {
+			preds[level] = s.head
+		}
+		// Readers which see the new height before the node only find nil
+		// links from the head at the new levels, which is harmless
+		s.height.Store(int32(height))
+	}
+
+	// The node is linked bottom up, so it is in the list at level 0 before
+	// any reader can reach it through a higher level
+	n := newNode(key, value, height)
+	for level := 0; level < height; level++ {
+		n.next[level].Store(preds[level].next[level].Load())
+		preds[level].next[level].Store(n)
+	}
+	s.size.Add(int64(len(key) + len(value)))
+	s.length.Add(1)
+}
+
+// Delete removes a key
+func (s *SkipList) Delete(key string) {
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+
+	var preds [maxHeight]*node
+	n := s.findGreaterOrEqual(key, preds[:])
+	if n == nil || s.cmp.Compare(n.key, key) != 0 {
+		return
+	}
+
+	// Readers already on the node see it is deleted, and those reaching it
+	// from a higher level step over it at level 0
+	value := n.value.Swap(nil)
+	for level := len(n.next) - 1; level >= 0; level-- {
+		preds[level].next[level].Store(n.next[level].Load())
+	}
+	for height := s.height.Load(); height > 1 && s.head.next[height-1].Load() == nil; height-- {
+		s.height.Store(height - 1)
+	}
+	s.size.Add(-int64(len(n.key) + len(*value)))
+	s.length.Add(-1)
+}
+
+// NewIterator returns an iterator over the pairs in the range described by
+// opts, in key order. It sees some of the writes made while it is open: it
+// is neither a snapshot, nor blocks writers.
+func (s *SkipList) NewIterator(opts ScanOptions) Iterator {
+	return NewRangeIteratorWithComparator(&cursor{list: s}, opts, s.cmp)
+}
+
+// ScanPrefix returns an iterator over the keys starting with prefix
+func (s *SkipList) ScanPrefix(prefix string) Iterator {
+	return s.NewIterator(ScanOptions{Prefix: prefix})
+}
+
+// First returns the pair with the smallest key, or nil if the list is empty
+func (s *SkipList) First() *KeyValuePair {
+	c := &cursor{list: s}
+	c.seekFirst()
+	return c.pair()
+}
+
+// Last returns the pair with the largest key, or nil if the list is empty
+func (s *SkipList) Last() *KeyValuePair {
+	c := &cursor{list: s}
+	c.SeekLast()
+	return c.pair()
+}
+
+// Floor returns the pair with the largest key <= key, or nil if there is none
+func (s *SkipList) Floor(key string) *KeyValuePair {
+	c := &cursor{list: s}
+	c.SeekLE(key)
+	return c.pair()
+}
+
+// Ceiling returns the pair with the smallest key >= key, or nil if there is none
+func (s *SkipList) Ceiling(key string) *KeyValuePair {
+	c := &cursor{list: s}
+	c.SeekGE(key)
+	return c.pair()
+}
+
+// Validate checks that every level is in key order, and holds only nodes
+// which are also in the level below
+func (s *SkipList) Validate() error {
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+
+	height := int(s.height.Load())
+	for level := height; level < maxHeight; level++ {
+		if s.head.next[level].Load() != nil {
+			return fmt.Errorf("level %d is linked, but the height is %d", level, height)
+		}
+	}
+
+	below := make(map[*node]bool)
+	for level := 0; level < height; level++ {
+		here := make(map[*node]bool)
+		var prev *node
+		for n := s.head.next[level].Load(); n != nil; n = n.next[level].Load() {
+			if prev != nil && s.cmp.Compare(prev.key, n.key) >= 0 {
+				return fmt.Errorf("level %d has %q before %q", level, prev.key, n.key)
+			}
+			if level > 0 && !below[n] {
+				return fmt.Errorf("level %d has %q, which level %d doesn't", level, n.key, level-1)
+			}
+			if n.value.Load() == nil {
+				return fmt.Errorf("level %d has deleted key %q", level, n.key)
+			}
+			here[n] = true
+			prev = n
+		}
+		if level == 0 && len(here) != s.Len() {
+			return fmt.Errorf("level 0 has %d keys, expected %d", len(here), s.Len())
+		}
+		below = here
+	}
+	return nil
+}
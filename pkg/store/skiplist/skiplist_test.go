@@ -0,0 +1,130 @@
+package skiplist
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+
+	. "yadb-go/pkg/store"
+	"yadb-go/pkg/store/storetest"
+)
+
+func key(i int) string {
+	return fmt.Sprintf("key%05d", i)
+}
+
+// Check the skip list against a map, over random sequences of operations
+func TestModel(t *testing.T) {
+	storetest.CheckRandom(t, func() Store { return NewSkipList() }, 20, 2000)
+}
+
+func FuzzSkipList(f *testing.F) {
+	storetest.Fuzz(f, func() Store { return NewSkipList() })
+}
+
+func TestLenAndSize(t *testing.T) {
+	s := NewSkipList()
+	for i := 0; i < 100; i++ {
+		s.Set(key(i), "value")
+	}
+	s.Set(key(0), "longer value")
+	for i := 50; i < 100; i++ {
+		s.Delete(key(i))
+	}
+	s.Delete("missing")
+
+	if s.Len() != 50 {
+		t.Fatalf("Expected 50 keys, found %d", s.Len())
+	}
+	if expected := int64(50*len(key(0)) + 49*len("value") + len("longer value")); s.Size() != expected {
+		t.Fatalf("Expected %d bytes, found %d", expected, s.Size())
+	}
+}
+
+func TestComparator(t *testing.T) {
+	s := NewSkipListWithComparator(CaseInsensitive)
+	s.Set("Key", "1")
+	s.Set("KEY", "2")
+	s.Set("apple", "3")
+	s.Set("Banana", "4")
+
+	if pair := s.Get("key"); pair == nil || pair.Key != "Key" || pair.Value != "2" {
+		t.Fatalf("Expected Key = 2, found %v", pair)
+	}
+	keys := make([]string, 0)
+	for it := s.NewIterator(ScanOptions{Reverse: true}); it.Valid(); it.Next() {
+		keys = append(keys, it.Key())
+	}
+	if fmt.Sprint(keys) != "[Key Banana apple]" {
+		t.Fatalf("Expected keys in reverse case-insensitive order, found %v", keys)
+	}
+	if pair := s.Floor("B"); pair == nil || pair.Key != "apple" {
+		t.Fatalf("Expected the floor of B to be apple, found %v", pair)
+	}
+}
+
+// Readers iterate while a writer inserts and deletes keys. Run with -race.
+func TestConcurrentReaders(t *testing.T) {
+	s := NewSkipList()
+	// Even keys are never deleted, so readers must always see them
+	for i := 0; i < 1000; i += 2 {
+		s.Set(key(i), "even")
+	}
+
+	var wg sync.WaitGroup
+	done := make(chan struct{})
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		defer close(done)
+		for round := 0; round < 20; round++ {
+			for i := 1; i < 1000; i += 2 {
+				s.Set(key(i), "odd")
+			}
+			for i := 1; i < 1000; i += 2 {
+				s.Delete(key(i))
+			}
+		}
+	}()
+
+	for r := 0; r < 4; r++ {
+		wg.Add(1)
+		go func(reverse bool) {
+			defer wg.Done()
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				evens, last := 0, ""
+				for it := s.NewIterator(ScanOptions{Reverse: reverse}); it.Valid(); it.Next() {
+					if last != "" && (it.Key() > last) == reverse {
+						t.Errorf("Expected keys in order, found %s after %s", it.Key(), last)
+						return
+					}
+					if it.Value() == "even" {
+						evens++
+					}
+					last = it.Key()
+				}
+				if evens != 500 {
+					t.Errorf("Expected to see all 500 even keys, found %d", evens)
+					return
+				}
+				if pair := s.Get(key(500)); pair == nil {
+					t.Errorf("Expected to find %s", key(500))
+					return
+				}
+			}
+		}(r%2 == 1)
+	}
+	wg.Wait()
+
+	if err := s.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	if s.Len() != 500 {
+		t.Fatalf("Expected 500 keys, found %d", s.Len())
+	}
+}
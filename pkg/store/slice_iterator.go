@@ -0,0 +1,62 @@
+package store
+
+import (
+	"sort"
+	"strings"
+)
+
+// NewSliceIterator returns an Iterator over pairs, which must be sorted by key.
+// It is mostly useful as input to bulk loads.
+func NewSliceIterator(pairs []KeyValuePair) Iterator {
+	return NewSliceIteratorWithOptions(pairs, ScanOptions{})
+}
+
+// NewSliceIteratorWithOptions returns an Iterator over the pairs within the
+// range described by opts. pairs must be sorted by key.
+func NewSliceIteratorWithOptions(pairs []KeyValuePair, opts ScanOptions) Iterator {
+	return NewRangeIterator(&sliceCursor{pairs: pairs}, opts)
+}
+
+// sliceCursor is a Cursor over a sorted slice of pairs
+type sliceCursor struct {
+	pairs []KeyValuePair
+	index int
+}
+
+func (c *sliceCursor) SeekGE(key string) {
+	c.index = sort.Search(len(c.pairs), func(i int) bool {
+		return strings.Compare(c.pairs[i].Key, key) >= 0
+	})
+}
+
+func (c *sliceCursor) SeekLE(key string) {
+	c.index = sort.Search(len(c.pairs), func(i int) bool {
+		return strings.Compare(c.pairs[i].Key, key) > 0
+	}) - 1
+}
+
+func (c *sliceCursor) SeekLast() {
+	c.index = len(c.pairs) - 1
+}
+
+func (c *sliceCursor) Next() {
+	c.index++
+}
+
+func (c *sliceCursor) Prev() {
+	c.index--
+}
+
+func (c *sliceCursor) Valid() bool {
+	return c.index >= 0 && c.index < len(c.pairs)
+}
+
+func (c *sliceCursor) Key() string {
+	return c.pairs[c.index].Key
+}
+
+func (c *sliceCursor) Value() string {
+	return c.pairs[c.index].Value
+}
+
+func (c *sliceCursor) Close() {}
@@ -1,11 +1,57 @@
 package store
 
-import "fmt"
+import (
+	"fmt"
+
+	. "yadb-go/pkg/types"
+)
 
 type Store interface {
 	Get(key string) *KeyValuePair
 	Set(key string, value string)
 	Delete(key string)
+	// NewIterator returns an iterator over the pairs within the range described
+	// by opts, in key order
+	NewIterator(opts ScanOptions) Iterator
+	// ScanPrefix returns an iterator over the keys starting with prefix
+	ScanPrefix(prefix string) Iterator
+
+	// First and Last return the pairs with the smallest and largest keys.
+	// Floor returns the pair with the largest key <= key, and Ceiling the pair
+	// with the smallest key >= key. All return nil if there is no such pair.
+	First() *KeyValuePair
+	Last() *KeyValuePair
+	Floor(key string) *KeyValuePair
+	Ceiling(key string) *KeyValuePair
+}
+
+// LoggedStore is implemented by stores held in pages, which a database writes
+// back and checkpoints. SetLogged and DeleteLogged are Set and Delete, given
+// the LSN of the log record of the write, which the pages they dirty are
+// marked with, so a checkpoint knows which pages it has to write. Set and
+// Delete are the same as logging at LSN 0.
+type LoggedStore interface {
+	Store
+	SetLogged(key string, value string, lsn LSN)
+	DeleteLogged(key string, lsn LSN)
+}
+
+// SetLogged writes a pair whose write was logged at lsn
+func SetLogged(s Store, key string, value string, lsn LSN) {
+	if logged, ok := s.(LoggedStore); ok {
+		logged.SetLogged(key, value, lsn)
+		return
+	}
+	s.Set(key, value)
+}
+
+// DeleteLogged removes a key whose delete was logged at lsn
+func DeleteLogged(s Store, key string, lsn LSN) {
+	if logged, ok := s.(LoggedStore); ok {
+		logged.DeleteLogged(key, lsn)
+		return
+	}
+	s.Delete(key)
 }
 
 type KeyValuePair struct {
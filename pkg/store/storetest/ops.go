@@ -0,0 +1,182 @@
+package storetest
+
+import (
+	"fmt"
+	"math/rand"
+	"strings"
+
+	. "yadb-go/pkg/store"
+)
+
+// OpKind is the Store method an Op calls
+type OpKind uint8
+
+const (
+	OpSet OpKind = iota
+	OpDelete
+	OpGet
+	// OpScan creates an iterator with Op.Scan, then if Op.Key is set, seeks it
+	// to Op.Key, and reads it to the end
+	OpScan
+	OpScanPrefix // reads ScanPrefix(Op.Key) to the end
+	OpFirst
+	OpLast
+	OpFloor
+	OpCeiling
+	numOpKinds
+)
+
+var opNames = [numOpKinds]string{"Set", "Delete", "Get", "Scan", "ScanPrefix", "First", "Last", "Floor", "Ceiling"}
+
+func (k OpKind) String() string {
+	if k < numOpKinds {
+		return opNames[k]
+	}
+	return fmt.Sprintf("OpKind(%d)", k)
+}
+
+// Op is a single call to a Store
+type Op struct {
+	Kind  OpKind
+	Key   string
+	Value string      // only for OpSet
+	Scan  ScanOptions // only for OpScan
+}
+
+func (op Op) String() string {
+	switch op.Kind {
+	case OpSet:
+		return fmt.Sprintf("Set(%q, %s)", op.Key, describeValue(op.Value))
+	case OpScan:
+		return fmt.Sprintf("Scan(%+v, seek=%q)", op.Scan, op.Key)
+	case OpFirst, OpLast:
+		return op.Kind.String() + "()"
+	default:
+		return fmt.Sprintf("%s(%q)", op.Kind, op.Key)
+	}
+}
+
+// describeValue abbreviates long values in failure messages
+func describeValue(value string) string {
+	if len(value) > 32 {
+		return fmt.Sprintf("%q... (%d bytes)", value[:32], len(value))
+	}
+	return fmt.Sprintf("%q", value)
+}
+
+// Keys are 1 to 3 bytes drawn from a small alphabet, so that operations often
+// hit the same keys and share prefixes. The alphabet includes the smallest and
+// largest bytes, to catch stores which don't order keys bytewise.
+const keyAlphabet = "abc\x00\xff"
+
+// longValueLength is the length of the occasional large value, which is
+// enough to be moved out of line by stores which do that
+const longValueLength = 3000
+
+// DecodeOps turns arbitrary bytes, such as a fuzzer's input, into a sequence
+// of operations. Every input decodes to some sequence, and small changes to
+// the input make small changes to the sequence.
+func DecodeOps(data []byte) []Op {
+	d := &decoder{data: data}
+	ops := make([]Op, 0)
+	for i := 0; len(d.data) > 0; i++ {
+		ops = append(ops, d.op(i))
+	}
+	return ops
+}
+
+// maxOpBytes is the most bytes decoding an operation can read
+const maxOpBytes = 32
+
+// RandomOps generates n random operations
+func RandomOps(rng *rand.Rand, n int) []Op {
+	data := make([]byte, maxOpBytes)
+	d := &decoder{}
+	ops := make([]Op, 0, n)
+	for i := 0; i < n; i++ {
+		rng.Read(data)
+		d.data = data
+		ops = append(ops, d.op(i))
+	}
+	return ops
+}
+
+// decoder reads operations from bytes, reading zeros once they run out
+type decoder struct {
+	data []byte
+}
+
+func (d *decoder) byte() byte {
+	if len(d.data) == 0 {
+		return 0
+	}
+	b := d.data[0]
+	d.data = d.data[1:]
+	return b
+}
+
+// op decodes the i-th operation. Sets are the most common, so that stores grow.
+func (d *decoder) op(i int) Op {
+	var kind OpKind
+	switch b := d.byte() % 16; {
+	case b < 6:
+		kind = OpSet
+	case b < 8:
+		kind = OpDelete
+	case b < 10:
+		kind = OpGet
+	default:
+		// Scan through Ceiling take one value each
+		kind = OpScan + OpKind(b-10)
+	}
+
+	op := Op{Kind: kind}
+	switch kind {
+	case OpSet:
+		op.Key = d.key()
+		op.Value = fmt.Sprintf("v%d", i)
+		if d.byte() < 8 {
+			op.Value = strings.Repeat(op.Value, longValueLength/len(op.Value))
+		}
+	case OpScan:
+		op.Scan, op.Key = d.scan()
+	case OpFirst, OpLast:
+	default:
+		op.Key = d.key()
+	}
+	return op
+}
+
+func (d *decoder) key() string {
+	key := make([]byte, 1+int(d.byte())%3)
+	for i := range key {
+		key[i] = keyAlphabet[int(d.byte())%len(keyAlphabet)]
+	}
+	return string(key)
+}
+
+// scan decodes scan options, and a key to seek to
+func (d *decoder) scan() (ScanOptions, string) {
+	flags := d.byte()
+	opts := ScanOptions{
+		Reverse:        flags&1 != 0,
+		StartExclusive: flags&2 != 0,
+		EndInclusive:   flags&4 != 0,
+		Limit:          int(flags>>6) * 2,
+	}
+	if flags&8 != 0 {
+		opts.Start = d.key()
+	}
+	if flags&16 != 0 {
+		opts.End = d.key()
+	}
+	if flags&32 != 0 {
+		opts.Prefix = d.key()
+	}
+
+	seek := ""
+	if d.byte()&1 != 0 {
+		seek = d.key()
+	}
+	return opts, seek
+}
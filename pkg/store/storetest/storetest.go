@@ -0,0 +1,258 @@
+// Package storetest checks Store implementations against a model: a map,
+// which is obviously correct. Sequences of operations are applied to both,
+// and every result the store returns is compared with the model's.
+//
+// Any Store ordering keys bytewise can be checked, using random sequences
+// (CheckRandom) or a fuzzer (Fuzz):
+//
+//	func TestModel(t *testing.T) {
+//		storetest.CheckRandom(t, func() Store { return NewMyStore() }, 20, 2000)
+//	}
+//
+//	func FuzzMyStore(f *testing.F) {
+//		storetest.Fuzz(f, func() Store { return NewMyStore() })
+//	}
+package storetest
+
+import (
+	"fmt"
+	"math/rand"
+	"sort"
+	"strings"
+	"testing"
+
+	. "yadb-go/pkg/store"
+)
+
+// Validator is implemented by stores which can check their own structure.
+// Such stores are validated after every Set and Delete.
+type Validator interface {
+	Validate() error
+}
+
+// Check applies ops to s, which must start empty, failing t at the first
+// result which differs from the model's
+func Check(t testing.TB, s Store, ops []Op) {
+	t.Helper()
+	if err := Run(s, ops); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// CheckRandom checks the given number of runs, each applying a sequence of n
+// random operations to a new store
+func CheckRandom(t *testing.T, newStore func() Store, runs int, n int) {
+	t.Helper()
+	for seed := 0; seed < runs; seed++ {
+		ops := RandomOps(rand.New(rand.NewSource(int64(seed))), n)
+		if err := Run(newStore(), ops); err != nil {
+			t.Fatalf("seed %d: %v", seed, err)
+		}
+	}
+}
+
+// Fuzz runs a fuzz target which decodes each input into operations, and
+// checks them on a new store. It is seeded with a few random sequences.
+func Fuzz(f *testing.F, newStore func() Store) {
+	rng := rand.New(rand.NewSource(1))
+	for _, n := range []int{1, 10, 100} {
+		seed := make([]byte, n*8)
+		rng.Read(seed)
+		f.Add(seed)
+	}
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		Check(t, newStore(), DecodeOps(data))
+	})
+}
+
+// Run applies ops to s, which must start empty, and to the model. It returns
+// an error describing the first result which differs, or if the contents of
+// s differ from the model's once every op has been applied.
+func Run(s Store, ops []Op) error {
+	m := model{}
+	for i, op := range ops {
+		if err := m.apply(s, op); err != nil {
+			return fmt.Errorf("step %d, %s: %w\n%s", i, op, err, describeOps(ops[:i+1]))
+		}
+	}
+
+	// Check everything is still there, in order
+	all := Op{Kind: OpScan}
+	if err := m.apply(s, all); err != nil {
+		return fmt.Errorf("after %d steps: %w\n%s", len(ops), err, describeOps(ops))
+	}
+	return nil
+}
+
+// describeOps lists the operations which led to a failure
+func describeOps(ops []Op) string {
+	lines := make([]string, len(ops))
+	for i, op := range ops {
+		lines[i] = fmt.Sprintf("  %d: %s", i, op)
+	}
+	return "operations:\n" + strings.Join(lines, "\n")
+}
+
+// model is the expected contents of a store
+type model map[string]string
+
+// apply applies an op to both the store and the model, and compares results
+func (m model) apply(s Store, op Op) error {
+	switch op.Kind {
+	case OpSet:
+		s.Set(op.Key, op.Value)
+		m[op.Key] = op.Value
+		return validate(s)
+	case OpDelete:
+		s.Delete(op.Key)
+		delete(m, op.Key)
+		return validate(s)
+	case OpGet:
+		value, ok := m[op.Key]
+		return comparePair(s.Get(op.Key), op.Key, value, ok)
+	case OpScan:
+		it := s.NewIterator(op.Scan)
+		if op.Key != "" {
+			it.Seek(op.Key)
+		}
+		return m.compareIterator(it, m.scan(op.Scan, op.Key))
+	case OpScanPrefix:
+		return m.compareIterator(s.ScanPrefix(op.Key), m.scan(ScanOptions{Prefix: op.Key}, ""))
+	case OpFirst:
+		key, ok := m.nearest(func(string) bool { return true }, false)
+		return comparePair(s.First(), key, m[key], ok)
+	case OpLast:
+		key, ok := m.nearest(func(string) bool { return true }, true)
+		return comparePair(s.Last(), key, m[key], ok)
+	case OpFloor:
+		key, ok := m.nearest(func(k string) bool { return k <= op.Key }, true)
+		return comparePair(s.Floor(op.Key), key, m[key], ok)
+	case OpCeiling:
+		key, ok := m.nearest(func(k string) bool { return k >= op.Key }, false)
+		return comparePair(s.Ceiling(op.Key), key, m[key], ok)
+	}
+	panic("Unknown operation " + op.Kind.String())
+}
+
+// validate checks the structure of stores which can
+func validate(s Store) error {
+	if v, ok := s.(Validator); ok {
+		if err := v.Validate(); err != nil {
+			return fmt.Errorf("invalid store: %w", err)
+		}
+	}
+	return nil
+}
+
+// sortedKeys returns the keys of the model which match, in order
+func (m model) sortedKeys(match func(string) bool) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		if match(key) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// nearest returns the smallest matching key, or the largest if last is set
+func (m model) nearest(match func(string) bool, last bool) (string, bool) {
+	keys := m.sortedKeys(match)
+	if len(keys) == 0 {
+		return "", false
+	}
+	if last {
+		return keys[len(keys)-1], true
+	}
+	return keys[0], true
+}
+
+// scan returns the keys an iterator created with opts should visit, in order,
+// after seeking to seek if it is set
+func (m model) scan(opts ScanOptions, seek string) []string {
+	keys := m.sortedKeys(func(key string) bool {
+		if key < opts.Start || opts.StartExclusive && key == opts.Start {
+			return false
+		}
+		if opts.End != "" && (key > opts.End || !opts.EndInclusive && key == opts.End) {
+			return false
+		}
+		return strings.HasPrefix(key, opts.Prefix)
+	})
+
+	if opts.Reverse {
+		for i, j := 0, len(keys)-1; i < j; i, j = i+1, j-1 {
+			keys[i], keys[j] = keys[j], keys[i]
+		}
+	}
+	if seek != "" {
+		// Seeking skips the keys before seek, in the direction of the scan
+		skip := 0
+		for skip < len(keys) && (!opts.Reverse && keys[skip] < seek || opts.Reverse && keys[skip] > seek) {
+			skip++
+		}
+		keys = keys[skip:]
+	}
+	if opts.Limit > 0 && len(keys) > opts.Limit {
+		keys = keys[:opts.Limit]
+	}
+	return keys
+}
+
+// compareIterator reads an iterator to the end, comparing the pairs it visits
+// with the expected keys and their values in the model
+func (m model) compareIterator(it Iterator, expected []string) error {
+	defer it.Close()
+
+	found := make([]string, 0, len(expected))
+	for ; it.Valid(); it.Next() {
+		key, value := it.Key(), it.Value()
+		if len(found) < len(expected) && key == expected[len(found)] && value != m[key] {
+			return fmt.Errorf("iterator returned %s for key %q, expected %s", describeValue(value), key, describeValue(m[key]))
+		}
+		if string(it.KeyBytes()) != key || string(it.ValueBytes()) != value {
+			return fmt.Errorf("iterator returned different bytes and strings at key %q", key)
+		}
+		found = append(found, key)
+		if len(found) > len(expected) {
+			break
+		}
+	}
+
+	if !equalKeys(found, expected) {
+		return fmt.Errorf("iterator visited %q, expected %q", found, expected)
+	}
+	return nil
+}
+
+func equalKeys(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// comparePair compares a pair returned by a store with the expected key and
+// value, or nil if ok is false
+func comparePair(pair *KeyValuePair, key string, value string, ok bool) error {
+	if !ok {
+		if pair != nil {
+			return fmt.Errorf("returned key %q, expected none", pair.Key)
+		}
+		return nil
+	}
+	if pair == nil {
+		return fmt.Errorf("returned nothing, expected key %q", key)
+	}
+	if pair.Key != key || pair.Value != value {
+		return fmt.Errorf("returned key %q = %s, expected key %q = %s", pair.Key, describeValue(pair.Value), key, describeValue(value))
+	}
+	return nil
+}
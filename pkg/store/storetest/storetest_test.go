@@ -0,0 +1,63 @@
+package storetest_test
+
+import (
+	"math/rand"
+	"reflect"
+	"testing"
+
+	. "yadb-go/pkg/store"
+	inmemory_btree "yadb-go/pkg/store/inmemory-btree"
+	"yadb-go/pkg/store/storetest"
+)
+
+func TestDecodeOps(t *testing.T) {
+	if ops := storetest.DecodeOps(nil); len(ops) != 0 {
+		t.Fatalf("Expected no operations from no input, found %v", ops)
+	}
+
+	data := make([]byte, 1000)
+	rand.New(rand.NewSource(1)).Read(data)
+	ops := storetest.DecodeOps(data)
+	if len(ops) == 0 || !reflect.DeepEqual(ops, storetest.DecodeOps(data)) {
+		t.Fatalf("Expected the same input to decode to the same operations")
+	}
+
+	kinds := make(map[storetest.OpKind]bool)
+	for _, op := range storetest.RandomOps(rand.New(rand.NewSource(1)), 1000) {
+		kinds[op.Kind] = true
+	}
+	if len(kinds) != int(storetest.OpCeiling)+1 {
+		t.Fatalf("Expected random operations of every kind, found %v", kinds)
+	}
+}
+
+// forgetfulStore ignores every other Delete
+type forgetfulStore struct {
+	Store
+	deletes int
+}
+
+func (s *forgetfulStore) Delete(key string) {
+	s.deletes++
+	if s.deletes%2 == 0 {
+		s.Store.Delete(key)
+	}
+}
+
+func TestRun__detectsDivergence(t *testing.T) {
+	s := &forgetfulStore{Store: inmemory_btree.NewTree(3)}
+	ops := []storetest.Op{
+		{Kind: storetest.OpSet, Key: "a", Value: "1"},
+		{Kind: storetest.OpDelete, Key: "a"},
+		{Kind: storetest.OpSet, Key: "b", Value: "2"},
+	}
+	if err := storetest.Run(s, ops); err == nil {
+		t.Fatalf("Expected the key which wasn't deleted to be found")
+	}
+
+	s = &forgetfulStore{Store: inmemory_btree.NewTree(3)}
+	ops = append(ops[:2], storetest.Op{Kind: storetest.OpGet, Key: "a"})
+	if err := storetest.Run(s, ops); err == nil {
+		t.Fatalf("Expected Get to return the key which wasn't deleted")
+	}
+}
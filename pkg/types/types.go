@@ -1,3 +1,8 @@
 package types
 
 type PageId uint64
+
+// LSN (log sequence number) identifies a position in the write-ahead log. It
+// is the byte offset just past the log record it refers to, so LSNs increase
+// monotonically as the log grows.
+type LSN uint64
@@ -0,0 +1,168 @@
+package wal
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"io"
+
+	"google.golang.org/protobuf/proto"
+	"yadb-go/protoc"
+)
+
+// Record format
+//
+// A log starts with an 8 byte magic number, written with its first record.
+// Each record is then framed as
+//
+//	length uint32 | CRC-32C of length and payload uint32 | payload
+//
+// where the payload is a WalEntry protobuf. The checksum covers the length,
+// so a run of zeros, as a file system may leave after a crash, isn't taken
+// for an empty record.
+//
+// Logs written before records were checksummed hold length-delimited
+// WalEntries with no magic number. They are still read, and are rewritten in
+// the new format before anything is appended to them.
+
+const magic = "yadbwal\x01"
+const recordHeaderSize = 8
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+// errIncompleteRecord is a record cut short by the end of the log, as left
+// by a crash during an append
+var errIncompleteRecord = errors.New("incomplete WAL record")
+
+// errCorruptRecord is a record whose checksum doesn't match
+var errCorruptRecord = errors.New("corrupt WAL record")
+
+// appendRecord appends e, framed, to buf
+func appendRecord(buf []byte, e *protoc.WalEntry) ([]byte, error) {
+	start := len(buf)
+	buf = append(buf, make([]byte, recordHeaderSize)...)
+	buf, err := proto.MarshalOptions{}.MarshalAppend(buf, e)
+	if err != nil {
+		return nil, err
+	}
+	header := buf[start : start+recordHeaderSize]
+	binary.LittleEndian.PutUint32(header, uint32(len(buf)-start-recordHeaderSize))
+	crc := crc32.Update(0, crcTable, header[:4])
+	crc = crc32.Update(crc, crcTable, buf[start+recordHeaderSize:])
+	binary.LittleEndian.PutUint32(header[4:], crc)
+	return buf, nil
+}
+
+// recordReader reads the records of a log in the current format, from just
+// after its magic number
+type recordReader struct {
+	r      *bufio.Reader
+	offset int64 // where the next record starts
+	end    int64 // where the last record read ends, even if it was corrupt
+	size   int64 // of the whole log
+	// followed is set when a record whose length runs past the end of the log
+	// is followed by an intact record, so its length must be corrupt
+	followed bool
+}
+
+func newRecordReader(r io.ReaderAt, size int64) *recordReader {
+	start := int64(len(magic))
+	return &recordReader{r: bufio.NewReader(io.NewSectionReader(r, start, size-start)), offset: start, size: size}
+}
+
+// next reads the next record into e. It returns io.EOF after the last record,
+// errIncompleteRecord if the record runs past the end of the log, as the last
+// append would if it was cut short, and errCorruptRecord if it fails its
+// checksum. A record whose length runs past the end, but which is followed by
+// an intact record, can't have been the last append, so is corrupt. After an
+// error, offset is still the start of the record which couldn't be read.
+func (r *recordReader) next(e *protoc.WalEntry) error {
+	if r.offset == r.size {
+		return io.EOF
+	}
+	if r.size-r.offset < recordHeaderSize {
+		return errIncompleteRecord
+	}
+	var header [recordHeaderSize]byte
+	if _, err := io.ReadFull(r.r, header[:]); err != nil {
+		return err
+	}
+	length := int64(binary.LittleEndian.Uint32(header[:]))
+	if length > r.size-r.offset-recordHeaderSize {
+		rest, err := io.ReadAll(r.r)
+		if err != nil {
+			return err
+		}
+		r.end = r.size
+		if r.followed = intactRecordIn(rest); r.followed {
+			return errCorruptRecord
+		}
+		return errIncompleteRecord
+	}
+
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(r.r, payload); err != nil {
+		return err
+	}
+	r.end = r.offset + recordHeaderSize + length
+	crc := crc32.Update(0, crcTable, header[:4])
+	if crc32.Update(crc, crcTable, payload) != binary.LittleEndian.Uint32(header[4:]) {
+		return errCorruptRecord
+	}
+	if err := proto.Unmarshal(payload, e); err != nil {
+		return errCorruptRecord
+	}
+	r.offset = r.end
+	return nil
+}
+
+// atTail reports whether the corrupt record just read is at the end of the
+// log, so could have been left by a crash: nothing but zeros follow it
+func (r *recordReader) atTail() (bool, error) {
+	if r.followed {
+		return false, nil
+	}
+	if r.end == r.size {
+		return true, nil
+	}
+	return r.restIsZero()
+}
+
+// intactRecordIn reports whether a record passing its checksum starts
+// anywhere in data
+func intactRecordIn(data []byte) bool {
+	for start := 0; start+recordHeaderSize <= len(data); start++ {
+		header := data[start : start+recordHeaderSize]
+		length := int(binary.LittleEndian.Uint32(header))
+		if length > len(data)-start-recordHeaderSize {
+			continue
+		}
+		crc := crc32.Update(0, crcTable, header[:4])
+		payload := data[start+recordHeaderSize : start+recordHeaderSize+length]
+		if crc32.Update(crc, crcTable, payload) == binary.LittleEndian.Uint32(header[4:]) {
+			return true
+		}
+	}
+	return false
+}
+
+// restIsZero reports whether every byte after the last record read is zero,
+// consuming them
+func (r *recordReader) restIsZero() (bool, error) {
+	buf := make([]byte, 4096)
+	for {
+		n, err := r.r.Read(buf)
+		for _, b := range buf[:n] {
+			if b != 0 {
+				return false, nil
+			}
+		}
+		if err == io.EOF {
+			return true, nil
+		}
+		if err != nil {
+			return false, err
+		}
+	}
+}
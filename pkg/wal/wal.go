@@ -1,11 +1,21 @@
 package wal
 
 import (
+	"bufio"
+	"errors"
+	"fmt"
 	"github.com/matttproud/golang_protobuf_extensions/pbutil"
 	"io"
+	"io/fs"
 	"log"
+	"math"
 	"os"
-	"yadb-go/pkg/store"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	. "yadb-go/pkg/store"
+	. "yadb-go/pkg/types"
 	"yadb-go/protoc"
 )
 
@@ -14,60 +24,396 @@ import (
 // 2. Map always needs to be entirely loaded into memory.
 //    So cannot have a Database exceeding memory capacity
 
+// SyncMode says when appended records are made durable
+type SyncMode int
+
+const (
+	// SyncAlways fsyncs each record before Write returns. It is the default.
+	SyncAlways SyncMode = iota
+	// SyncNever leaves flushing records to the OS. They survive the process
+	// crashing, but the most recent may be lost if the machine does.
+	SyncNever
+)
+
+// Options configure a LogFile
+type Options struct {
+	Sync SyncMode
+	// FailOnCorruption makes replaying a log with a corrupt record before its
+	// end an error, rather than dropping everything from that record on
+	FailOnCorruption bool
+}
+
+// LogFile is safe for concurrent use. Appends by concurrent writers are
+// batched together, but records are never interleaved.
 type LogFile struct {
 	filename string
+	opts     Options
+
+	mu      sync.Mutex
+	cond    *sync.Cond // signalled when the writer is released
+	writing bool       // whether the writer is held
+	pending *batch     // records waiting to be appended by the next write
+
+	// Only touched by the holder of the writer
+	checked bool     // whether the log is known to be in the current format
+	file    *os.File // open for appending, once something has been
 }
 
 func NewWalFile(filename string) *LogFile {
-	return &LogFile{filename: filename}
+	return NewWalFileWithOptions(filename, Options{})
 }
 
-func (logFile *LogFile) ReplayIntoStore(store store.Store) {
-	f, err := os.OpenFile(logFile.filename, os.O_RDONLY, 0644)
+// NewWalFileWithOptions creates a log configured by opts
+func NewWalFileWithOptions(filename string, opts Options) *LogFile {
+	logFile := &LogFile{filename: filename, opts: opts}
+	logFile.cond = sync.NewCond(&logFile.mu)
+	return logFile
+}
+
+// ReplayIntoStore applies every record in the log to store. A log which
+// hasn't been created yet holds none.
+//
+// A crash during an append leaves an incomplete or corrupt record at the end
+// of the log. Replay stops before it, and the log is truncated to drop it. A
+// corrupt record anywhere else is an error if the log was opened with
+// FailOnCorruption; otherwise it, and everything after it, is dropped too.
+func (logFile *LogFile) ReplayIntoStore(store Store) error {
+	logFile.acquireWriter()
+	defer logFile.releaseWriter()
+
+	f, err := os.OpenFile(logFile.filename, os.O_RDWR, 0644)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
 	if err != nil {
-		log.Fatalln("Failed to open WAL file.", err)
+		return err
 	}
 	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
 
+	legacy, err := isLegacy(f, info.Size())
+	if err != nil {
+		return err
+	}
+	if legacy {
+		return replayLegacy(f, store)
+	}
+	if info.Size() == 0 {
+		return nil
+	}
+	if info.Size() < int64(len(magic)) {
+		// Even the magic number wasn't written in full
+		return logFile.truncate(f, 0, info.Size())
+	}
+
+	r := newRecordReader(f, info.Size())
 	for {
 		walEntry := &protoc.WalEntry{}
-		_, err := pbutil.ReadDelimited(f, walEntry)
-		if err != nil {
-			if err == io.EOF {
-				break
-			} else {
-				log.Fatalln("Encountered error while reading WAL file lines. Error:", err)
+		err := r.next(walEntry)
+		if err == io.EOF {
+			logFile.checked = true
+			return nil
+		}
+		if err == nil {
+			apply(store, walEntry, LSN(r.offset))
+			continue
+		}
+		if !errors.Is(err, errIncompleteRecord) && !errors.Is(err, errCorruptRecord) {
+			return err
+		}
+		if errors.Is(err, errCorruptRecord) && logFile.opts.FailOnCorruption {
+			tail, err := r.atTail()
+			if err != nil {
+				return err
 			}
+			if !tail {
+				return fmt.Errorf("WAL %s has a corrupt record at offset %d, before its end", logFile.filename, r.offset)
+			}
+		}
+		if err := logFile.truncate(f, r.offset, info.Size()); err != nil {
+			return err
 		}
+		logFile.checked = true
+		return nil
+	}
+}
 
-		if walEntry.Tombstone {
-			store.Delete(walEntry.Key)
-		} else {
-			store.Set(walEntry.Key, walEntry.Value)
+// truncate cuts the log short at offset, dropping what a crash left behind
+func (logFile *LogFile) truncate(f *os.File, offset int64, size int64) error {
+	log.Printf("Truncating WAL %s at offset %d, dropping %d bytes of incomplete or corrupt records", logFile.filename, offset, size-offset)
+	if err := f.Truncate(offset); err != nil {
+		return err
+	}
+	return f.Sync()
+}
+
+// isLegacy reports whether f, of the given size, predates checksums
+func isLegacy(f *os.File, size int64) (bool, error) {
+	if size == 0 {
+		return false, nil
+	}
+	start := make([]byte, len(magic))
+	n, err := f.ReadAt(start, 0)
+	if err != nil && err != io.EOF {
+		return false, err
+	}
+	// A log holding only part of the magic number is new, and torn
+	return string(start[:n]) != magic[:n], nil
+}
+
+// replayLegacy applies the records of a log which predates checksums. An
+// incomplete record at the end is skipped, but left in the log, until it is
+// rewritten by the next append.
+func replayLegacy(f *os.File, store Store) error {
+	return readLegacy(f, func(walEntry *protoc.WalEntry, end int64) error {
+		apply(store, walEntry, LSN(end))
+		return nil
+	})
+}
+
+// readLegacy calls visit with each record of a log which predates checksums,
+// and the offset just past it
+func readLegacy(f *os.File, visit func(walEntry *protoc.WalEntry, end int64) error) error {
+	r := bufio.NewReader(io.NewSectionReader(f, 0, math.MaxInt64))
+	end := int64(0)
+	for {
+		walEntry := &protoc.WalEntry{}
+		n, err := pbutil.ReadDelimited(r, walEntry)
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		end += int64(n)
+		if err := visit(walEntry, end); err != nil {
+			return err
 		}
 	}
 }
 
-// Write writes information regarding a key-value pair to a log file on disk
-// We use Protocol Buffers to serialise the WalEntry into a sequence of bytes
-// This log file can be used to recover the in-memory map on restart
-//
-// Any DML must be logged to the WAL to ensure durability
-// TODO should we make every WAL entry one block in size? (i.e. add padding where required)?
-// TODO should we Write some kind of checksum (like Luhn's/CRC)? Why?
-func (logFile *LogFile) Write(e *protoc.WalEntry) {
-	f, err := os.OpenFile(logFile.filename, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+// apply applies the record ending at lsn to store
+func apply(store Store, walEntry *protoc.WalEntry, lsn LSN) {
+	// Keys and values were strings before they were bytes. The two share an
+	// encoding, so logs written before the change read the same way.
+	if walEntry.Tombstone && walEntry.Prefix {
+		DeletePrefixLogged(store, string(walEntry.Key), lsn)
+	} else if walEntry.Tombstone {
+		DeleteLogged(store, string(walEntry.Key), lsn)
+	} else {
+		SetLogged(store, string(walEntry.Key), string(walEntry.Value), lsn)
+	}
+}
+
+// prepare readies the log for appending, the first time something is
+// appended to it: it writes the magic number to a new log, and rewrites a
+// log which predates checksums in the current format, moving its checkpoint
+// to match.
+func (logFile *LogFile) prepare() error {
+	if logFile.checked {
+		return nil
+	}
+	f, err := os.Open(logFile.filename)
+	if errors.Is(err, fs.ErrNotExist) {
+		err = writeFileAtomically(logFile.filename, magic)
+	} else if err == nil {
+		err = logFile.convert(f)
+		f.Close()
+	}
+	if err == nil {
+		logFile.checked = true
+	}
+	return err
+}
+
+// convert puts the existing log f in the current format
+func (logFile *LogFile) convert(f *os.File) error {
+	info, err := f.Stat()
 	if err != nil {
-		log.Fatalln("Failed to open WAL file.", err)
+		return err
+	}
+	legacy, err := isLegacy(f, info.Size())
+	if err != nil {
+		return err
+	}
+	if !legacy {
+		if info.Size() < int64(len(magic)) {
+			// Empty, or torn before its magic number was written
+			return writeFileAtomically(logFile.filename, magic)
+		}
+		return nil
+	}
+
+	// The checkpoint moves with the record it follows
+	checkpoint, err := logFile.LastCheckpoint()
+	if err != nil {
+		return err
+	}
+	converted := LSN(0)
+	buf := []byte(magic)
+	err = readLegacy(f, func(walEntry *protoc.WalEntry, end int64) error {
+		buf, err = appendRecord(buf, walEntry)
+		if LSN(end) <= checkpoint {
+			converted = LSN(len(buf))
+		}
+		return err
+	})
+	if err != nil {
+		return err
 	}
-	defer f.Close()
 
-	pbutil.WriteDelimited(f, e)
+	// Until both are rewritten, the old checkpoint would point into the
+	// middle of a record, so it is dropped first
+	if checkpoint > 0 {
+		if err := logFile.RecordCheckpoint(0); err != nil {
+			return err
+		}
+	}
+	if err := writeFileAtomically(logFile.filename, string(buf)); err != nil {
+		return err
+	}
+	if checkpoint > 0 {
+		return logFile.RecordCheckpoint(converted)
+	}
+	return nil
+}
+
+// Position returns the LSN just past the last record in the log, i.e. the
+// size of the log file
+func (logFile *LogFile) Position() (LSN, error) {
+	info, err := os.Stat(logFile.filename)
+	if errors.Is(err, fs.ErrNotExist) {
+		return 0, nil
+	}
 	if err != nil {
-		log.Fatalln("Failed to write WalEntry to disk.", err)
+		return 0, err
 	}
-	err = f.Sync()
+	return LSN(info.Size()), nil
+}
+
+// RecordCheckpoint durably records that every change logged before lsn has
+// been written to the data file. The position is kept in a small file next to
+// the log, replaced atomically so a crash never leaves a partial checkpoint.
+func (logFile *LogFile) RecordCheckpoint(lsn LSN) error {
+	return writeFileAtomically(logFile.checkpointFilename(), strconv.FormatUint(uint64(lsn), 10)+"\n")
+}
+
+// writeFileAtomically writes data to a temporary file, fsyncs it, then
+// renames it over filename
+func writeFileAtomically(filename string, data string) error {
+	tmpFilename := filename + ".tmp"
+	f, err := os.OpenFile(tmpFilename, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+
+	_, err = f.WriteString(data)
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+
+	if err := os.Rename(tmpFilename, filename); err != nil {
+		return err
+	}
+	// The rename is only durable once the directory is synced
+	return syncDir(filepath.Dir(filename))
+}
+
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
 	if err != nil {
-		log.Fatalln("Failed to execute fsync WalEntry to disk.", err)
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+// LastCheckpoint returns the position recorded by the most recent checkpoint,
+// or 0 if no checkpoint has been taken.
+// While the tree lives only in memory, recovery still replays the whole log;
+// once nodes are persisted in pages it can start from this position.
+func (logFile *LogFile) LastCheckpoint() (LSN, error) {
+	data, err := os.ReadFile(logFile.checkpointFilename())
+	if errors.Is(err, fs.ErrNotExist) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	lsn, err := strconv.ParseUint(strings.TrimSpace(string(data)), 10, 64)
+	if err != nil {
+		return 0, err
+	}
+	return LSN(lsn), nil
+}
+
+func (logFile *LogFile) checkpointFilename() string {
+	return logFile.filename + ".checkpoint"
+}
+
+// RecordComparator durably records the name of the comparator ordering the
+// keys in the log, alongside the log, replaced atomically like a checkpoint
+func (logFile *LogFile) RecordComparator(name string) error {
+	return writeFileAtomically(logFile.comparatorFilename(), name+"\n")
+}
+
+// Comparator returns the name recorded by RecordComparator, or "" if none has
+// been recorded
+func (logFile *LogFile) Comparator() (string, error) {
+	data, err := os.ReadFile(logFile.comparatorFilename())
+	if errors.Is(err, fs.ErrNotExist) {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(data)), nil
+}
+
+func (logFile *LogFile) comparatorFilename() string {
+	return logFile.filename + ".comparator"
+}
+
+// WritePairs logs a write for every pair in the iterator, then fsyncs once,
+// unless the log is configured not to.
+// It is meant for loading lots of data at once, where an fsync per pair
+// would dominate.
+func (logFile *LogFile) WritePairs(pairs Iterator) error {
+	defer pairs.Close()
+	logFile.acquireWriter()
+	defer logFile.releaseWriter()
+
+	f, err := logFile.open()
+	if err != nil {
+		return err
+	}
+
+	w := bufio.NewWriter(f)
+	record := make([]byte, 0)
+	for ; pairs.Valid(); pairs.Next() {
+		record, err = appendRecord(record[:0], &protoc.WalEntry{
+			Key:   pairs.KeyBytes(),
+			Value: pairs.ValueBytes(),
+		})
+		if err != nil {
+			return err
+		}
+		if _, err = w.Write(record); err != nil {
+			return err
+		}
+	}
+	if err = w.Flush(); err != nil {
+		return err
 	}
+	return logFile.sync(f)
 }
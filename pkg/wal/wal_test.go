@@ -0,0 +1,259 @@
+package wal
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	. "yadb-go/pkg/store"
+	"yadb-go/pkg/store/skiplist"
+	. "yadb-go/pkg/types"
+	"yadb-go/protoc"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// newLog writes a log holding n sets to a new file
+func newLog(t *testing.T, n int, opts Options) *LogFile {
+	logFile := NewWalFileWithOptions(filepath.Join(t.TempDir(), "wal"), opts)
+	for i := 0; i < n; i++ {
+		logFile.Write(&protoc.WalEntry{Key: []byte(fmt.Sprintf("key%02d", i)), Value: []byte("value")})
+	}
+	return logFile
+}
+
+// replay replays a log into a new store, returning its keys
+func replay(t *testing.T, logFile *LogFile) ([]string, error) {
+	s := skiplist.NewSkipList()
+	err := logFile.ReplayIntoStore(s)
+	keys := make([]string, 0)
+	for it := s.NewIterator(ScanOptions{}); it.Valid(); it.Next() {
+		keys = append(keys, it.Key())
+	}
+	return keys, err
+}
+
+func size(t *testing.T, logFile *LogFile) int64 {
+	position, err := logFile.Position()
+	assert.NoError(t, err)
+	return int64(position)
+}
+
+func TestReplay_TruncatesIncompleteTail(t *testing.T) {
+	// Given a log whose last record was cut short by a crash
+	logFile := newLog(t, 3, Options{})
+	complete := size(t, logFile)
+	logFile.Write(&protoc.WalEntry{Key: []byte("torn"), Value: []byte("value")})
+	assert.NoError(t, os.Truncate(logFile.filename, size(t, logFile)-3))
+
+	// When it is replayed
+	keys, err := replay(t, logFile)
+
+	// Then the complete records are applied, and the torn one dropped
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"key00", "key01", "key02"}, keys)
+	assert.Equal(t, complete, size(t, logFile))
+
+	// And appending carries on from the last complete record
+	logFile.Write(&protoc.WalEntry{Key: []byte("key03")})
+	keys, err = replay(t, logFile)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"key00", "key01", "key02", "key03"}, keys)
+}
+
+func TestReplay_TruncatesCorruptTail(t *testing.T) {
+	for name, corrupt := range map[string]func(data []byte) []byte{
+		"checksum": func(data []byte) []byte {
+			data[len(data)-1] ^= 0xff
+			return data
+		},
+		"zeros": func(data []byte) []byte {
+			return append(data, make([]byte, 4096)...)
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			// Given a log ending in garbage
+			logFile := newLog(t, 3, Options{FailOnCorruption: true})
+			data, _ := os.ReadFile(logFile.filename)
+			assert.NoError(t, os.WriteFile(logFile.filename, corrupt(data), 0644))
+
+			// When it is replayed, even by a log failing on corruption
+			keys, err := replay(t, logFile)
+
+			// Then only the garbage is dropped
+			assert.NoError(t, err)
+			if name == "checksum" {
+				assert.Equal(t, []string{"key00", "key01"}, keys)
+			} else {
+				assert.Equal(t, []string{"key00", "key01", "key02"}, keys)
+				assert.Equal(t, int64(len(data)), size(t, logFile))
+			}
+		})
+	}
+}
+
+func TestReplay_CorruptionBeforeTheEnd(t *testing.T) {
+	// Given a log with a corrupt record followed by good ones
+	logFile := newLog(t, 1, Options{})
+	corruptAt := size(t, logFile) + recordHeaderSize
+	for i := 1; i < 5; i++ {
+		logFile.Write(&protoc.WalEntry{Key: []byte(fmt.Sprintf("key%02d", i))})
+	}
+	data, _ := os.ReadFile(logFile.filename)
+	data[corruptAt] ^= 0xff
+	assert.NoError(t, os.WriteFile(logFile.filename, data, 0644))
+
+	// When it is replayed by a log failing on corruption
+	strict := NewWalFileWithOptions(logFile.filename, Options{FailOnCorruption: true})
+	_, err := replay(t, strict)
+
+	// Then replay fails, and the log is left alone
+	assert.Error(t, err)
+	assert.Equal(t, int64(len(data)), size(t, strict))
+
+	// And otherwise, everything from the corrupt record on is dropped
+	keys, err := replay(t, logFile)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"key00"}, keys)
+	assert.Equal(t, corruptAt-recordHeaderSize, size(t, logFile))
+}
+
+func TestReplay_TornMagicNumber(t *testing.T) {
+	logFile := NewWalFile(filepath.Join(t.TempDir(), "wal"))
+	assert.NoError(t, os.WriteFile(logFile.filename, []byte(magic[:3]), 0644))
+
+	keys, err := replay(t, logFile)
+	assert.NoError(t, err)
+	assert.Empty(t, keys)
+	assert.Zero(t, size(t, logFile))
+}
+
+func TestLegacyLog(t *testing.T) {
+	// Given a log written before records were checksummed
+	data, err := os.ReadFile("../../test_data/wal")
+	assert.NoError(t, err)
+	logFile := NewWalFile(filepath.Join(t.TempDir(), "wal"))
+	assert.NoError(t, os.WriteFile(logFile.filename, data, 0644))
+
+	// When it is replayed, then appended to
+	keys, err := replay(t, logFile)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"key2"}, keys)
+	logFile.Write(&protoc.WalEntry{Key: []byte("key3")})
+
+	// Then it is rewritten in the current format, keeping its records
+	converted, _ := os.ReadFile(logFile.filename)
+	assert.Equal(t, magic, string(converted[:len(magic)]))
+	keys, err = replay(t, logFile)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"key2", "key3"}, keys)
+}
+
+func TestConcurrentWrites(t *testing.T) {
+	// Given many goroutines writing at once
+	logFile := NewWalFile(filepath.Join(t.TempDir(), "wal"))
+	var wg sync.WaitGroup
+	for w := 0; w < 32; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < 50; i++ {
+				logFile.Write(&protoc.WalEntry{Key: []byte(fmt.Sprintf("%02d-%02d", w, i))})
+			}
+		}(w)
+	}
+	wg.Wait()
+	assert.NoError(t, logFile.Close())
+
+	// Then every record is logged whole
+	keys, err := replay(t, logFile)
+	assert.NoError(t, err)
+	assert.Len(t, keys, 32*50)
+
+	// And the log can be written to after it is closed
+	logFile.Write(&protoc.WalEntry{Key: []byte("after")})
+	keys, err = replay(t, logFile)
+	assert.NoError(t, err)
+	assert.Len(t, keys, 32*50+1)
+}
+
+func TestWrite_ReturnsLSNs(t *testing.T) {
+	// Given many goroutines writing at once, so writes join batches
+	logFile := NewWalFile(filepath.Join(t.TempDir(), "wal"))
+	var mu sync.Mutex
+	lsns := make(map[LSN]bool)
+	var wg sync.WaitGroup
+	for w := 0; w < 16; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < 20; i++ {
+				lsn := logFile.Write(&protoc.WalEntry{Key: []byte(fmt.Sprintf("%02d-%02d", w, i))})
+				mu.Lock()
+				lsns[lsn] = true
+				mu.Unlock()
+			}
+		}(w)
+	}
+	wg.Wait()
+
+	// Then each write is given the end of its own record, and the last
+	// record ends the log
+	assert.Len(t, lsns, 16*20)
+	var last LSN
+	for lsn := range lsns {
+		if lsn > last {
+			last = lsn
+		}
+	}
+	assert.Equal(t, size(t, logFile), int64(last))
+	assert.NoError(t, logFile.Close())
+}
+
+func TestReplay_CorruptLengthBeforeTheEnd(t *testing.T) {
+	// Given a log in which a record's length was corrupted to run past the
+	// end of the log, though good records follow it
+	logFile := newLog(t, 1, Options{})
+	corruptAt := size(t, logFile)
+	for i := 1; i < 5; i++ {
+		logFile.Write(&protoc.WalEntry{Key: []byte(fmt.Sprintf("key%02d", i))})
+	}
+	data, _ := os.ReadFile(logFile.filename)
+	data[corruptAt+3] = 0x7f
+	assert.NoError(t, os.WriteFile(logFile.filename, data, 0644))
+
+	// When it is replayed by a log failing on corruption, then it isn't
+	// taken for a torn append, and the log is left alone
+	strict := NewWalFileWithOptions(logFile.filename, Options{FailOnCorruption: true})
+	_, err := replay(t, strict)
+	assert.Error(t, err)
+	assert.Equal(t, int64(len(data)), size(t, strict))
+
+	// And otherwise, everything from the corrupt record on is dropped
+	keys, err := replay(t, logFile)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"key00"}, keys)
+	assert.Equal(t, corruptAt, size(t, logFile))
+}
+
+func TestLegacyLog_MovesCheckpoint(t *testing.T) {
+	// Given a log written before records were checksummed, checkpointed
+	// after its first record
+	data, err := os.ReadFile("../../test_data/wal")
+	assert.NoError(t, err)
+	logFile := NewWalFile(filepath.Join(t.TempDir(), "wal"))
+	assert.NoError(t, os.WriteFile(logFile.filename, data, 0644))
+	firstRecord := 1 + int(data[0])
+	assert.NoError(t, logFile.RecordCheckpoint(LSN(firstRecord)))
+
+	// When it is rewritten in the current format
+	logFile.Write(&protoc.WalEntry{Key: []byte("key3")})
+
+	// Then the checkpoint still follows the first record, which has gained
+	// a header, after the magic number
+	checkpoint, err := logFile.LastCheckpoint()
+	assert.NoError(t, err)
+	assert.Equal(t, LSN(len(magic)+recordHeaderSize+firstRecord-1), checkpoint)
+}
@@ -0,0 +1,146 @@
+package wal
+
+import (
+	"log"
+	"os"
+
+	. "yadb-go/pkg/types"
+	"yadb-go/protoc"
+)
+
+// Group commit
+//
+// A log keeps its file open for appending. Only one goroutine, the holder of
+// the writer, touches the file at a time. Records written while the writer is
+// held join a batch, and the first writer to join it waits for the writer,
+// then appends the whole batch with one write and one fsync before releasing
+// everyone in it. Under load, the cost of an fsync is shared by every record
+// which arrived during the one before.
+
+// batch is records waiting to be appended together
+type batch struct {
+	records []byte
+	start   LSN           // where the records were appended, once they have been
+	done    chan struct{} // closed once the records are durable
+}
+
+// Write writes information regarding key-value pairs to a log file on disk
+// We use Protocol Buffers to serialise each WalEntry into a sequence of bytes,
+// framed with a checksum.
+// This log file can be used to recover the in-memory map on restart. Write
+// returns once the records are durable, sharing an fsync with any records
+// written concurrently. Several entries passed at once are appended together.
+// It returns the LSN of the last of them.
+//
+// Any DML must be logged to the WAL to ensure durability
+// TODO should we make every WAL entry one block in size? (i.e. add padding where required)?
+func (logFile *LogFile) Write(entries ...*protoc.WalEntry) LSN {
+	var record []byte
+	for _, e := range entries {
+		var err error
+		if record, err = appendRecord(record, e); err != nil {
+			log.Fatalln("Failed to encode WalEntry.", err)
+		}
+	}
+
+	logFile.mu.Lock()
+	b := logFile.pending
+	if b != nil {
+		b.records = append(b.records, record...)
+		end := LSN(len(b.records))
+		logFile.mu.Unlock()
+		<-b.done
+		return b.start + end
+	}
+
+	// The first record of a batch waits for the writer, while more join it
+	b = &batch{records: record, done: make(chan struct{})}
+	logFile.pending = b
+	for logFile.writing {
+		logFile.cond.Wait()
+	}
+	logFile.writing = true
+	logFile.pending = nil
+	logFile.mu.Unlock()
+
+	start, err := logFile.append(b.records)
+	if err != nil {
+		log.Fatalln("Failed to write WalEntry to disk.", err)
+	}
+	b.start = start
+	logFile.releaseWriter()
+	close(b.done)
+	return start + LSN(len(record))
+}
+
+// append writes records to the end of the log, and makes them durable. It
+// returns the offset they were written at.
+func (logFile *LogFile) append(records []byte) (LSN, error) {
+	f, err := logFile.open()
+	if err != nil {
+		return 0, err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		return 0, err
+	}
+	if _, err := f.Write(records); err != nil {
+		return 0, err
+	}
+	return LSN(info.Size()), logFile.sync(f)
+}
+
+// open returns the file, opened for appending, preparing the log the first
+// time
+func (logFile *LogFile) open() (*os.File, error) {
+	if logFile.file != nil {
+		return logFile.file, nil
+	}
+	if err := logFile.prepare(); err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(logFile.filename, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, err
+	}
+	logFile.file = f
+	return f, nil
+}
+
+// sync fsyncs f, unless the log is configured not to
+func (logFile *LogFile) sync(f *os.File) error {
+	if logFile.opts.Sync == SyncNever {
+		return nil
+	}
+	return f.Sync()
+}
+
+// acquireWriter waits until nothing else is touching the file, then holds it
+func (logFile *LogFile) acquireWriter() {
+	logFile.mu.Lock()
+	defer logFile.mu.Unlock()
+	for logFile.writing {
+		logFile.cond.Wait()
+	}
+	logFile.writing = true
+}
+
+func (logFile *LogFile) releaseWriter() {
+	logFile.mu.Lock()
+	defer logFile.mu.Unlock()
+	logFile.writing = false
+	logFile.cond.Broadcast()
+}
+
+// Close closes the file, once records being written are durable. The log
+// can still be written to, which opens it again.
+func (logFile *LogFile) Close() error {
+	logFile.acquireWriter()
+	defer logFile.releaseWriter()
+	if logFile.file == nil {
+		return nil
+	}
+	err := logFile.file.Close()
+	logFile.file = nil
+	return err
+}